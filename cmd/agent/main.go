@@ -5,8 +5,8 @@ import (
 	"log"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
 	"os/signal"
-	"sync"
 	"syscall"
 	"time"
 
@@ -28,9 +28,18 @@ var (
 
 func main() {
 
-	config := config.NewAgentConfig()
+	config, err := config.NewAgentConfig()
+	if err != nil {
+		log.Fatal("invalid config: ", err)
+	}
+	if config.PrintConfig {
+		if err = config.Print(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	err := logger.Init(config.LogLevel)
+	err = logger.Init(config.LogLevel)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -49,13 +58,24 @@ func main() {
 			return
 		}
 	}
+	labels, err := config.LabelSet()
+	if err != nil {
+		logger.Log().Error("parse labels", zap.Error(err))
+		return
+	}
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
 	defer cancel()
-	a := agent.Agent{Client: client, Metrics: metrics, Host: config.Host, Key: config.Key, PubKey: pubKey}
+	// config is reloaded on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	a := agent.Agent{Client: client, Metrics: metrics, Host: config.Host, Key: config.Key, PubKey: pubKey, Labels: labels, APIToken: config.APIToken}
 
 	switch config.AgentType {
 	case model.HTTPType:
-		run(ctx, &a, *config)
+		if err := a.PushMetadata(ctx); err != nil {
+			logger.Log().Warn("push metadata", zap.Error(err))
+		}
+		run(ctx, &a, *config, hup)
 	case model.GRPCType:
 
 		g := grpcclient.GrpcAgent{Agent: &a}
@@ -64,42 +84,36 @@ func main() {
 			logger.Log().Error("grpc init", zap.Error(err))
 			return
 		}
-		runGrpc(ctx, &g, *config)
+		if err := g.PushMetadata(ctx); err != nil {
+			logger.Log().Warn("push metadata", zap.Error(err))
+		}
+		runGrpc(ctx, &g, *config, hup)
 	}
 
 }
 
-func run(ctx context.Context, a *agent.Agent, cfg config.AgentConfig) {
-
-	poll := time.NewTicker(time.Duration(cfg.PollInterval) * time.Second)
-	report := time.NewTicker(time.Duration(cfg.ReportInterval) * time.Second)
-
-	defer poll.Stop()
-	defer report.Stop()
-
+func run(ctx context.Context, a *agent.Agent, cfg config.AgentConfig, hup <-chan os.Signal) {
 	jobs := make(chan []model.Metrics, cfg.RateLimit)
 	errs := make(chan error)
-	var wg sync.WaitGroup
-	for i := 0; i < cfg.RateLimit-1; i++ {
-		wg.Add(1)
-		go func(workerID int) {
-			defer wg.Done()
-			a.Worker(ctx, workerID, jobs, errs)
-		}(i + 1)
-	}
+	r := newRunner(ctx, a, cfg, func(ctx context.Context, id int) {
+		a.Worker(ctx, id, jobs, errs)
+	})
+	defer r.stop()
 
 	for {
 		select {
-		case <-poll.C:
+		case <-r.poll.C:
 			a.CollectMemMetrics()
 			a.CollectPSutilMetrics(ctx, errs)
-		case <-report.C:
+		case <-r.report.C:
 			a.ReportAllMetricsAtOnes(ctx, jobs)
+		case <-hup:
+			r.reload()
 		case <-ctx.Done():
 			logger.Log().Info("shutting down agent...")
 			close(errs)
 			close(jobs)
-			wg.Wait()
+			r.pool.wait()
 			return
 		case err := <-errs:
 			logger.Log().Error("encountered error", zap.Error(err))
@@ -107,36 +121,28 @@ func run(ctx context.Context, a *agent.Agent, cfg config.AgentConfig) {
 	}
 }
 
-func runGrpc(ctx context.Context, g *grpcclient.GrpcAgent, cfg config.AgentConfig) {
-	poll := time.NewTicker(time.Duration(cfg.PollInterval) * time.Second)
-	report := time.NewTicker(time.Duration(cfg.ReportInterval) * time.Second)
-
-	defer poll.Stop()
-	defer report.Stop()
-
+func runGrpc(ctx context.Context, g *grpcclient.GrpcAgent, cfg config.AgentConfig, hup <-chan os.Signal) {
 	jobs := make(chan []model.Metrics, cfg.RateLimit)
 	errs := make(chan error)
-	var wg sync.WaitGroup
-	for i := 0; i < cfg.RateLimit-1; i++ {
-		wg.Add(1)
-		go func(workerID int) {
-			defer wg.Done()
-			g.Worker(ctx, workerID, jobs, errs)
-		}(i + 1)
-	}
+	r := newRunner(ctx, g.Agent, cfg, func(ctx context.Context, id int) {
+		g.Worker(ctx, id, jobs, errs)
+	})
+	defer r.stop()
 
 	for {
 		select {
-		case <-poll.C:
+		case <-r.poll.C:
 			g.CollectMemMetrics()
 			g.Agent.CollectPSutilMetrics(ctx, errs)
-		case <-report.C:
+		case <-r.report.C:
 			g.ReportAllMetricsAtOnes(ctx, jobs)
+		case <-hup:
+			r.reload()
 		case <-ctx.Done():
 			logger.Log().Info("shutting down agent...")
 			close(errs)
 			close(jobs)
-			wg.Wait()
+			r.pool.wait()
 			return
 		case err := <-errs:
 			logger.Log().Error("encountered error", zap.Error(err))
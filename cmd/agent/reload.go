@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/SmoothWay/metrics/internal/agent"
+	"github.com/SmoothWay/metrics/internal/config"
+	"github.com/SmoothWay/metrics/internal/crypt"
+	"github.com/SmoothWay/metrics/internal/logger"
+)
+
+// pool workers sending reports, number of workers can be changed while agent runs
+type pool struct {
+	ctx     context.Context
+	work    func(ctx context.Context, id int)
+	cancels []context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+// resize - starts or stops workers, so n of them run. Batch being sent by stopped worker is dropped,
+// next report carries its metrics again
+func (p *pool) resize(n int) {
+	for len(p.cancels) < n {
+		ctx, cancel := context.WithCancel(p.ctx)
+		p.cancels = append(p.cancels, cancel)
+		p.wg.Add(1)
+		go func(id int) {
+			defer p.wg.Done()
+			p.work(ctx, id)
+		}(len(p.cancels))
+	}
+	for len(p.cancels) > n {
+		last := len(p.cancels) - 1
+		p.cancels[last]()
+		p.cancels = p.cancels[:last]
+	}
+}
+
+// wait - waits for all workers to stop
+func (p *pool) wait() {
+	p.wg.Wait()
+}
+
+// runner tickers and workers of running agent, reconfigured by reload
+type runner struct {
+	cfg    *config.AgentConfig
+	agent  *agent.Agent
+	pubKey []byte
+	poll   *time.Ticker
+	report *time.Ticker
+	pool   *pool
+}
+
+// newRunner - starts tickers and workers of agent configured by cfg, work runs single worker until its ctx is done
+func newRunner(ctx context.Context, a *agent.Agent, cfg config.AgentConfig, work func(ctx context.Context, id int)) *runner {
+	r := &runner{
+		cfg:    &cfg,
+		agent:  a,
+		pubKey: a.PubKey,
+		poll:   time.NewTicker(seconds(cfg.PollInterval)),
+		report: time.NewTicker(seconds(cfg.ReportInterval)),
+		pool:   &pool{ctx: ctx, work: work},
+	}
+	r.pool.resize(workers(cfg.RateLimit))
+	return r
+}
+
+// stop - stops tickers, workers stop when ctx of runner is done
+func (r *runner) stop() {
+	r.poll.Stop()
+	r.report.Stop()
+}
+
+// reload - reads config again and applies changes of intervals, number of workers, log level and keys,
+// key files are read again even if their paths are the same. Changes of other settings are logged
+// as needing restart, invalid config is logged and ignored
+func (r *runner) reload() {
+	next, err := config.ReloadAgentConfig()
+	if err != nil {
+		logger.Log().Error("reload config", zap.Error(err))
+		return
+	}
+
+	var applied, restart []string
+	for _, key := range r.cfg.Changes(next) {
+		switch key {
+		case "log_level":
+			if err = logger.SetLevel(next.LogLevel); err != nil {
+				logger.Log().Error("reload log level", zap.Error(err))
+				continue
+			}
+			r.cfg.LogLevel = next.LogLevel
+		case "poll_interval":
+			r.poll.Reset(seconds(next.PollInterval))
+			r.cfg.PollInterval = next.PollInterval
+		case "report_interval":
+			r.report.Reset(seconds(next.ReportInterval))
+			r.cfg.ReportInterval = next.ReportInterval
+		case "rate_limit":
+			r.pool.resize(workers(next.RateLimit))
+			r.cfg.RateLimit = next.RateLimit
+		case "key", "crypto_key":
+			// applied along with content of key file below
+			continue
+		default:
+			restart = append(restart, key)
+			continue
+		}
+		applied = append(applied, key)
+	}
+
+	applied = append(applied, r.reloadKeys(next)...)
+	logger.Log().Info("config reloaded", zap.Strings("applied", applied))
+	if len(restart) > 0 {
+		logger.Log().Warn("config changes need restart", zap.Strings("keys", restart))
+	}
+}
+
+// reloadKeys - replaces keys of agent if they or content of public key file changed, returns applied keys
+func (r *runner) reloadKeys(next *config.AgentConfig) []string {
+	var pubKey []byte
+	if next.CryptKeyPath != "" {
+		var err error
+		pubKey, err = crypt.ReadKeyFile(next.CryptKeyPath)
+		if err != nil {
+			logger.Log().Error("reload public key", zap.Error(err))
+			return nil
+		}
+	}
+
+	var applied []string
+	if next.Key != r.cfg.Key {
+		applied = append(applied, "key")
+	}
+	if next.CryptKeyPath != r.cfg.CryptKeyPath || !bytes.Equal(pubKey, r.pubKey) {
+		applied = append(applied, "crypto_key")
+	}
+	if len(applied) > 0 {
+		r.agent.SetKeys(next.Key, pubKey)
+		r.cfg.Key, r.cfg.CryptKeyPath, r.pubKey = next.Key, next.CryptKeyPath, pubKey
+	}
+	return applied
+}
+
+// seconds - converts interval of config in seconds into duration
+func seconds(interval int) time.Duration {
+	return time.Duration(interval) * time.Second
+}
+
+// workers - returns number of workers sending reports with rate limit, one goroutine of rate limit
+// is taken by collecting metrics. At least one worker runs, so reports are sent with rate limit 1
+func workers(rateLimit int) int {
+	if rateLimit < 2 {
+		return 1
+	}
+	return rateLimit - 1
+}
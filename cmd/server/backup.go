@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/SmoothWay/metrics/internal/backup"
+	"github.com/SmoothWay/metrics/internal/logger"
+	"github.com/SmoothWay/metrics/internal/repository/postgres"
+	"github.com/SmoothWay/metrics/internal/repository/wal"
+	"github.com/SmoothWay/metrics/internal/service"
+)
+
+// storageFlags flags choosing storage of backup and restore subcommands
+type storageFlags struct {
+	dsn     *string
+	engine  *string
+	walPath *string
+	file    *string
+}
+
+func newStorageFlags(fs *flag.FlagSet) storageFlags {
+	return storageFlags{
+		dsn:     fs.String("d", os.Getenv("DATABASE_DSN"), "DB connection string"),
+		engine:  fs.String("engine", envOr("STORAGE_ENGINE", "wal"), "storage engine used without database, only wal keeps metrics between runs"),
+		walPath: fs.String("wal-path", envOr("WAL_PATH", "/tmp/metrics-db"), "path to snapshot of wal storage"),
+		file:    fs.String("f", envOr("STORAGE_PATH", "/tmp/metrics-db.json"), "path to backup snapshot, snapshots of tenants are kept next to it"),
+	}
+}
+
+// sinkFlags flags choosing backup sink of backup and restore subcommands, S3 settings are read from
+// the same environment variables as server reads
+type sinkFlags struct {
+	url *string
+}
+
+func newSinkFlags(fs *flag.FlagSet) sinkFlags {
+	return sinkFlags{
+		url: fs.String("sink", os.Getenv("BACKUP_SINK"), "backup sink snapshots are uploaded to or restored from: file:///dir or s3://bucket/prefix"),
+	}
+}
+
+// uploader - returns uploader to sink or nil if sink is not set
+func (f sinkFlags) uploader(opts backup.SinkOptions) (*backup.Uploader, error) {
+	sink, err := backup.NewSink(*f.url, backup.S3Options{
+		Endpoint:  os.Getenv("BACKUP_S3_ENDPOINT"),
+		Region:    os.Getenv("BACKUP_S3_REGION"),
+		AccessKey: os.Getenv("BACKUP_S3_ACCESS_KEY"),
+		SecretKey: os.Getenv("BACKUP_S3_SECRET_KEY"),
+	})
+	if err != nil || sink == nil {
+		return nil, err
+	}
+	return backup.NewUploader(sink, opts), nil
+}
+
+// open - opens storage and returns service over it with tenants enabled and without timeouts,
+// closeStorage must be called when service is not needed
+func (f storageFlags) open() (serv *service.Service, closeStorage func(), err error) {
+	var repo service.Repository
+	switch {
+	case *f.dsn != "":
+		repo, err = postgres.New(*f.dsn, postgres.PoolOptions{})
+	case *f.engine == "wal":
+		repo, err = wal.Open(wal.Options{Path: *f.walPath})
+	default:
+		err = fmt.Errorf("%s storage keeps nothing between runs, use -d or -engine wal", *f.engine)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	closeStorage = func() {}
+	if closer, ok := repo.(io.Closer); ok {
+		closeStorage = func() { closer.Close() }
+	}
+	serv = service.New(repo)
+	enableTenants(serv, repo)
+	serv.SetTimeouts(service.Timeouts{})
+	return serv, closeStorage, nil
+}
+
+// runBackup runs backup subcommand: backup [-d dsn | -engine wal -wal-path path] [-f file] [-compression c] [-keep n]
+// [-sink url -sink-keep n]. Metrics of every tenant are written to snapshot format read by server with -r
+// and by restore subcommand, snapshots are uploaded to sink if it is set
+func runBackup(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	storage := newStorageFlags(fs)
+	compression := fs.String("compression", envOr("BACKUP_COMPRESSION", backup.CompressionNone), "compression of snapshots: none, gzip or zstd")
+	keep := fs.Int("keep", backup.DefaultKeep, "number of previous snapshots kept besides the latest one")
+	sink := newSinkFlags(fs)
+	sinkKeep := fs.Int("sink-keep", 10, "number of the newest uploaded snapshots of every file kept, 0 keeps all")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: server backup [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := logger.Init("error"); err != nil {
+		return err
+	}
+
+	uploader, err := sink.uploader(backup.SinkOptions{Keep: *sinkKeep})
+	if err != nil {
+		return err
+	}
+	serv, closeStorage, err := storage.open()
+	if err != nil {
+		return err
+	}
+	defer closeStorage()
+
+	b, err := backup.New(0, *storage.file, serv, backup.Options{Compression: *compression, Keep: *keep})
+	if err != nil {
+		return err
+	}
+	if uploader != nil {
+		b.SetUploader(uploader)
+	}
+	n, err := b.Save(context.Background())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("wrote %d metrics to %s\n", n, *storage.file)
+	return nil
+}
+
+// runRestore runs restore subcommand: restore [-d dsn | -engine wal -wal-path path] [-f file] [-sink url | -at time]
+// [-tenants a,b] [-merge]. Snapshots of tenants found next to file, or the newest snapshots uploaded to sink if it is set,
+// are loaded. With -at metrics are restored as of that time from snapshots and journal kept next to file.
+// Storage of tenant must be empty unless -merge is passed
+func runRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	storage := newStorageFlags(fs)
+	tenants := fs.String("tenants", "", "comma separated tenants to restore, all tenants having snapshots by default")
+	merge := fs.Bool("merge", false, "restore into storage which already has metrics, counters of snapshot are added to stored ones")
+	sink := newSinkFlags(fs)
+	atFlag := fs.String("at", "", "restore metrics as of time in RFC 3339 format, e.g. 2026-10-19T12:00:00Z, using backup journal")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: server restore [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if err := logger.Init("error"); err != nil {
+		return err
+	}
+
+	var at time.Time
+	if *atFlag != "" {
+		var err error
+		if at, err = time.Parse(time.RFC3339Nano, *atFlag); err != nil {
+			return fmt.Errorf("invalid -at: %w", err)
+		}
+	}
+	ctx := context.Background()
+	uploader, err := sink.uploader(backup.SinkOptions{})
+	if err != nil {
+		return err
+	}
+	if uploader != nil && !at.IsZero() {
+		return errors.New("-at restores from journal kept next to local snapshots and can't be used with -sink")
+	}
+	path := *storage.file
+	if uploader != nil {
+		// snapshots of sink are downloaded into temporary dir and loaded as local ones
+		dir, err := os.MkdirTemp("", "metrics-restore")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		path = filepath.Join(dir, filepath.Base(*storage.file))
+	}
+
+	var ids []string
+	if *tenants != "" {
+		ids = strings.Split(*tenants, ",")
+	} else if uploader != nil {
+		if ids, err = uploader.Tenants(ctx, path); err != nil {
+			return err
+		}
+	} else if ids, err = backup.SnapshotTenants(path); err != nil {
+		return err
+	}
+	if uploader != nil {
+		for _, t := range ids {
+			if err = download(ctx, uploader, backup.TenantPath(path, t)); err != nil {
+				return fmt.Errorf("tenant %q: %w", t, err)
+			}
+		}
+	}
+	if len(ids) == 0 {
+		if uploader != nil {
+			return fmt.Errorf("no snapshots found at %s", *sink.url)
+		}
+		return fmt.Errorf("no snapshots found at %s", *storage.file)
+	}
+
+	serv, closeStorage, err := storage.open()
+	if err != nil {
+		return err
+	}
+	defer closeStorage()
+
+	if !*merge {
+		// storages of all tenants are checked first, so restore is not stopped half way
+		for _, t := range ids {
+			stored, err := serv.ForTenant(t).GetAll(ctx)
+			if err != nil {
+				return err
+			}
+			if len(stored) > 0 {
+				return fmt.Errorf("storage of tenant %q has %d metrics, use -merge to restore into it", t, len(stored))
+			}
+		}
+	}
+	for _, t := range ids {
+		var n int
+		if at.IsZero() {
+			n, err = backup.LoadTenant(ctx, serv.ForTenant(t), backup.TenantPath(path, t))
+		} else {
+			n, err = backup.LoadTenantAt(ctx, serv.ForTenant(t), path, t, at)
+		}
+		if err != nil {
+			return fmt.Errorf("tenant %q: %w", t, err)
+		}
+		fmt.Printf("restored %d metrics of tenant %q\n", n, t)
+	}
+	return nil
+}
+
+// download - writes the newest snapshot uploaded to sink of file at path into path
+func download(ctx context.Context, uploader *backup.Uploader, path string) error {
+	data, err := uploader.Fetch(ctx, filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o600)
+}
+
+// envOr - returns value of environment variable or def if it is not set
+func envOr(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return def
+}
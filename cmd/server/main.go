@@ -3,15 +3,19 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
 	"go.uber.org/zap"
 
+	"github.com/SmoothWay/metrics/internal/alerting"
 	"github.com/SmoothWay/metrics/internal/backup"
 	"github.com/SmoothWay/metrics/internal/config"
 	"github.com/SmoothWay/metrics/internal/crypt"
@@ -19,11 +23,23 @@ import (
 	"github.com/SmoothWay/metrics/internal/handler"
 	"github.com/SmoothWay/metrics/internal/logger"
 	"github.com/SmoothWay/metrics/internal/model"
+	"github.com/SmoothWay/metrics/internal/query"
+	"github.com/SmoothWay/metrics/internal/ratelimit"
 	"github.com/SmoothWay/metrics/internal/repository/memstorage"
 	"github.com/SmoothWay/metrics/internal/repository/postgres"
+	"github.com/SmoothWay/metrics/internal/repository/sharded"
+	"github.com/SmoothWay/metrics/internal/repository/wal"
 	"github.com/SmoothWay/metrics/internal/service"
+	"github.com/SmoothWay/metrics/internal/tenant"
 )
 
+// commands subcommands of server, server is started if none is passed
+var commands = map[string]func(args []string) error{
+	"migrate": runMigrate,
+	"backup":  runBackup,
+	"restore": runRestore,
+}
+
 var (
 	buildVersion = "N/A"
 	buildDate    = "N/A"
@@ -31,19 +47,37 @@ var (
 )
 
 func main() {
-	cfg := config.NewServerConfig()
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				log.Fatal(os.Args[1], ": ", err)
+			}
+			return
+		}
+	}
+
+	cfg, err := config.NewServerConfig()
+	if err != nil {
+		log.Fatal("invalid config: ", err)
+	}
+	if cfg.PrintConfig {
+		if err = cfg.Print(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	var repo service.Repository
 	var metrics *[]model.Metrics
 
-	err := logger.Init(cfg.LogLevel)
+	err = logger.Init(cfg.LogLevel)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	if cfg.Restore {
-		metrics, err = backup.Restore(cfg.StoragePath)
+		metrics, err = restoreLatest(cfg, "")
 		if err != nil {
-			if errors.Is(backup.ErrRestoreFromFile, err) {
+			if errors.Is(err, backup.ErrRestoreFromFile) {
 				log.Println("cant restore from json")
 			} else {
 				log.Println("unexpected err restoring from json", zap.Error(err))
@@ -51,19 +85,78 @@ func main() {
 		}
 	}
 	if cfg.DSN != "" {
-		repo, err = postgres.New(cfg.DSN)
+		repo, err = postgres.New(cfg.DSN, postgres.PoolOptions{
+			MaxConns:     int32(cfg.DBMaxConns),
+			MinConns:     int32(cfg.DBMinConns),
+			QueryTimeout: cfg.DBQueryTimeout,
+		})
 		if err != nil {
 			log.Fatal("error init postgres:", err)
 		}
 	} else {
-		repo = memstorage.New(metrics)
+		repo, err = newLocalRepository(cfg, metrics)
+		if err != nil {
+			log.Fatal("error init storage:", err)
+		}
+	}
+	if closer, ok := repo.(io.Closer); ok {
+		defer closer.Close()
 	}
 	serv := service.New(repo)
+	enableTenants(serv, repo)
+	limits, err := cfg.Limits()
+	if err != nil {
+		log.Fatal("invalid series limits:", err)
+	}
+	serv.SetLimits(limits)
+	serv.SetTimeouts(service.Timeouts{Read: cfg.ReadTimeout, Write: cfg.WriteTimeout})
 
-	cfg.B, err = backup.New(cfg.StoreInvterval, cfg.StoragePath, serv)
+	var tokens *tenant.Registry
+	if cfg.AdminToken != "" {
+		tokens, err = tenant.NewRegistry(cfg.TokensPath)
+		if err != nil {
+			log.Fatal("error loading tenant tokens:", err)
+		}
+		// database and wal storage keep metrics of tenants themselves
+		if cfg.Restore && cfg.DSN == "" && cfg.StorageEngine != "wal" {
+			restoreTenants(serv, cfg, tokens.Tenants())
+		}
+	}
+
+	serv.SetRetention(service.Retention{
+		Raw:    cfg.RetentionRaw,
+		Minute: cfg.RetentionMinute,
+		Hour:   cfg.RetentionHour,
+	})
+	serv.SetIdempotencyWindow(cfg.IdempotencyWindow)
+
+	cfg.B, err = backup.New(cfg.StoreInvterval, cfg.StoragePath, serv, backup.Options{
+		Compression: cfg.BackupCompression,
+		Keep:        cfg.BackupKeep,
+	})
 	if err != nil {
 		log.Fatal("err creating backupper", zap.Error(err))
 	}
+	if cfg.BackupJournal {
+		journal, err := backup.OpenJournal(cfg.StoragePath)
+		if err != nil {
+			log.Fatal("error opening backup journal:", err)
+		}
+		defer journal.Close()
+		serv.SetChangeRecorder(journal)
+		cfg.B.SetJournal(journal)
+	}
+	sink, err := backup.NewSink(cfg.BackupSink, cfg.S3Options())
+	if err != nil {
+		log.Fatal("error init backup sink:", err)
+	}
+	if sink != nil {
+		cfg.B.SetUploader(backup.NewUploader(sink, backup.SinkOptions{
+			Retries: cfg.BackupSinkRetries,
+			Keep:    cfg.BackupSinkKeep,
+			MaxAge:  cfg.BackupSinkMaxAge,
+		}))
+	}
 
 	// config.H = handler.NewHandler(serv)
 
@@ -71,8 +164,13 @@ func main() {
 
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
 	defer cancel()
+	// config is reloaded on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	reload := newReloader(cfg)
 
 	if cfg.StoreInvterval > 0 {
+		reload.backup = cfg.B
 		ticker := time.NewTicker(time.Duration(cfg.StoreInvterval))
 		defer ticker.Stop()
 
@@ -92,6 +190,66 @@ func main() {
 		}()
 	}
 
+	if cfg.CompactInterval > 0 {
+		ticker := time.NewTicker(cfg.CompactInterval)
+		defer ticker.Stop()
+		compactIntervals := make(chan time.Duration, 1)
+		reload.compact = compactIntervals
+
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					logger.Log().Info("Context cancelled. Stopping compaction routine.")
+					return
+				case interval := <-compactIntervals:
+					if interval > 0 {
+						ticker.Reset(interval)
+					} else {
+						ticker.Stop()
+					}
+				case <-ticker.C:
+					if err := serv.CompactAll(ctx); err != nil {
+						logger.Log().Error("Compaction encountered error", zap.Error(err))
+					}
+				}
+			}
+		}()
+	}
+
+	if cfg.RulesPath != "" {
+		rules, err := alerting.LoadRules(cfg.RulesPath)
+		if err != nil {
+			log.Fatal("error loading alerting rules:", err)
+		}
+		if len(rules.RecordingRules) > 0 {
+			recorder := alerting.NewRecorder(rules.RecordingRules, query.New(serv), serv)
+			go recorder.Run(ctx, cfg.RulesInterval)
+		}
+		if len(rules.Rules) > 0 {
+			manager := alerting.NewManager(rules.Rules, query.New(serv), alerting.NewNotifier(rules.Webhooks, rules.Retries))
+			go manager.Run(ctx, cfg.RulesInterval)
+		}
+	}
+
+	var limiter *ratelimit.Limiter
+	if cfg.RateLimitRPS > 0 {
+		limiter, err = ratelimit.NewLimiter(cfg.RateLimitRPS, cfg.RateLimitBurst)
+		if err != nil {
+			logger.Log().Error("rate limiter", zap.Error(err))
+			return
+		}
+	}
+	var quota *ratelimit.Quota
+	if cfg.SeriesQuota > 0 {
+		quota = ratelimit.NewQuota(cfg.SeriesQuota)
+	}
+	proxies, err := ratelimit.ParseProxies(cfg.TrustedProxies)
+	if err != nil {
+		logger.Log().Error("trusted proxies", zap.Error(err))
+		return
+	}
+
 	var privateKey []byte
 	if cfg.CryptKeyPath != "" {
 		privateKey, err = crypt.ReadKeyFile(cfg.CryptKeyPath)
@@ -100,10 +258,17 @@ func main() {
 			return
 		}
 	}
+	reload.privateKey = privateKey
 
 	switch cfg.ServerType {
 	case model.HTTPType:
-		s := handler.NewServer(cfg.Host, handler.NewHandler(serv), cfg.Key, cfg.TrustedSubnet, privateKey)
+		h := handler.NewHandler(serv).WithRateLimit(limiter, quota).WithTrustedProxies(proxies)
+		if tokens != nil {
+			h.WithTenants(tokens, cfg.AdminToken)
+		}
+		s := handler.NewServer(cfg.Host, h, cfg.Key, cfg.TrustedSubnet, privateKey)
+		reload.httpServer = s
+		go reload.run(ctx, hup)
 		go func() {
 			logger.Log().Info("Starting server on", zap.String("host", cfg.Host))
 			if err := s.Run(); err != nil && err != http.ErrServerClosed {
@@ -120,15 +285,18 @@ func main() {
 			logger.Log().Info("Server gracefully stopped")
 		}
 	case model.GRPCType:
-		repo = memstorage.New(metrics)
-
-		serv := service.New(repo)
 		grpcServer := gserver.NewServer(gserver.Config{
-			ServerAddr:    cfg.Host,
-			Service:       serv,
-			TrustedSubnet: handler.TrustedSubnetFromString(cfg.TrustedSubnet),
+			ServerAddr:     cfg.Host,
+			Service:        serv,
+			TrustedSubnet:  handler.TrustedSubnetFromString(cfg.TrustedSubnet),
+			Tokens:         tokens,
+			Limiter:        limiter,
+			Quota:          quota,
+			TrustedProxies: proxies,
 		})
 
+		reload.grpcServer = grpcServer
+		go reload.run(ctx, hup)
 		go grpcServer.Run(ctx)
 
 		<-ctx.Done()
@@ -144,3 +312,63 @@ func main() {
 	}
 
 }
+
+// newLocalRepository - creates storage of engine used without database. Memory engines are filled
+// with restored metrics, wal storage restores its state from own files
+func newLocalRepository(cfg *config.ServerConfig, metrics *[]model.Metrics) (service.Repository, error) {
+	switch cfg.StorageEngine {
+	case "", "memory":
+		return memstorage.New(metrics), nil
+	case "sharded":
+		return sharded.New(metrics), nil
+	case "wal":
+		return wal.Open(wal.Options{
+			Path:         cfg.WALPath,
+			Sync:         cfg.WALSync,
+			SyncInterval: cfg.WALSyncInterval,
+			CompactSize:  cfg.WALCompactSize,
+		})
+	default:
+		return nil, fmt.Errorf("unknown storage engine %q", cfg.StorageEngine)
+	}
+}
+
+// enableTenants - partitions storage of service by tenants
+func enableTenants(serv *service.Service, repo service.Repository) {
+	switch r := repo.(type) {
+	case *memstorage.MemStorage:
+		serv.SetTenants(func(id string) service.Repository { return r.Tenant(id) }, r.Tenants)
+	case *sharded.Storage:
+		serv.SetTenants(func(id string) service.Repository { return r.Tenant(id) }, r.Tenants)
+	case *wal.Storage:
+		serv.SetTenants(func(id string) service.Repository { return r.Tenant(id) }, r.Tenants)
+	case *postgres.PostgreDB:
+		serv.SetTenants(func(id string) service.Repository { return r.Tenant(id) }, r.Tenants)
+	}
+}
+
+// restoreTenants - restores metrics of tenants from their backup files
+func restoreTenants(serv *service.Service, cfg *config.ServerConfig, tenants []string) {
+	for _, t := range tenants {
+		metrics, err := restoreLatest(cfg, t)
+		if err == nil {
+			_, err = backup.Load(context.Background(), serv.ForTenant(t), *metrics)
+		}
+		if err != nil {
+			log.Println("cant restore metrics of tenant", t, err)
+		}
+	}
+}
+
+// restoreLatest - restores the latest metrics of tenant from backup files: the latest snapshot with journal
+// replayed if journal is kept, the latest valid snapshot otherwise
+func restoreLatest(cfg *config.ServerConfig, tenant string) (*[]model.Metrics, error) {
+	if cfg.BackupJournal {
+		metrics, err := backup.RestoreAt(cfg.StoragePath, tenant, time.Now())
+		if err == nil {
+			return &metrics, nil
+		}
+		log.Println("cant replay backup journal of tenant", tenant, err)
+	}
+	return backup.Restore(backup.TenantPath(cfg.StoragePath, tenant))
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/SmoothWay/metrics/internal/repository/postgres"
+)
+
+// runMigrate runs migrate subcommand: migrate [-d dsn] [-steps n] up|down|status
+func runMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dsn := fs.String("d", os.Getenv("DATABASE_DSN"), "DB connection string")
+	steps := fs.Int("steps", 1, "number of migrations reverted by down")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: server migrate [flags] up|down|status")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *dsn == "" {
+		return fmt.Errorf("database dsn is not set, use -d or DATABASE_DSN")
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected one command, got %d", fs.NArg())
+	}
+	command := fs.Arg(0)
+	if command != "up" && command != "down" && command != "status" {
+		fs.Usage()
+		return fmt.Errorf("unknown command %q", command)
+	}
+
+	db, err := postgres.Connect(*dsn, postgres.PoolOptions{})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	m, err := db.Migrator()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	switch command {
+	case "up":
+		n, err := m.Up(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("applied %d migrations\n", n)
+	case "down":
+		if *steps <= 0 {
+			return fmt.Errorf("steps must be positive")
+		}
+		n, err := m.Down(ctx, *steps)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("reverted %d migrations\n", n)
+	case "status":
+		states, err := m.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, s := range states {
+			applied := "pending"
+			if !s.AppliedAt.IsZero() {
+				applied = s.AppliedAt.Format("2006-01-02 15:04:05 MST")
+			}
+			fmt.Printf("%04d %-28s %s\n", s.Version, s.Name, applied)
+		}
+	}
+	return nil
+}
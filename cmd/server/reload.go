@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/SmoothWay/metrics/internal/backup"
+	"github.com/SmoothWay/metrics/internal/config"
+	"github.com/SmoothWay/metrics/internal/crypt"
+	gserver "github.com/SmoothWay/metrics/internal/grpc/server"
+	"github.com/SmoothWay/metrics/internal/handler"
+	"github.com/SmoothWay/metrics/internal/logger"
+)
+
+// reloader applies config read again on SIGHUP to running server. Log level, intervals of running backups
+// and compaction, trusted subnet and, for HTTP server, key and private key are applied live, other settings
+// need restart
+type reloader struct {
+	// cfg settings in effect
+	cfg *config.ServerConfig
+	// backup runs periodic backups, nil if they are disabled
+	backup *backup.BackupConfig
+	// compact receives interval of running compaction, nil if compaction is disabled
+	compact    chan<- time.Duration
+	httpServer interface {
+		Reload(key, trustedSubnet string, privateKey []byte)
+	}
+	grpcServer *gserver.MetricsServer
+	privateKey []byte
+}
+
+func newReloader(cfg *config.ServerConfig) *reloader {
+	current := *cfg
+	return &reloader{cfg: &current}
+}
+
+// run - reloads config on every signal from hup until ctx is done
+func (r *reloader) run(ctx context.Context, hup <-chan os.Signal) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			r.reload(ctx)
+		}
+	}
+}
+
+// reload - reads config again and applies changes of live settings, key file is read again even if its
+// path is the same. Changes of other settings are logged as needing restart, invalid config is logged
+// and ignored
+func (r *reloader) reload(ctx context.Context) {
+	next, err := config.ReloadServerConfig()
+	if err != nil {
+		logger.Log().Error("reload config", zap.Error(err))
+		return
+	}
+
+	var applied, restart []string
+	for _, key := range r.cfg.Changes(next) {
+		switch key {
+		case "log_level":
+			if err = logger.SetLevel(next.LogLevel); err != nil {
+				logger.Log().Error("reload log level", zap.Error(err))
+				continue
+			}
+			r.cfg.LogLevel = next.LogLevel
+		case "store_interval":
+			if r.backup == nil {
+				restart = append(restart, key)
+				continue
+			}
+			r.backup.SetInterval(next.StoreInvterval)
+			r.cfg.StoreInvterval = next.StoreInvterval
+		case "compact_interval":
+			if r.compact == nil {
+				restart = append(restart, key)
+				continue
+			}
+			select {
+			case r.compact <- next.CompactInterval:
+			case <-ctx.Done():
+				return
+			}
+			r.cfg.CompactInterval = next.CompactInterval
+		case "key", "trusted_subnet", "crypto_key":
+			// applied along with content of key file below
+			continue
+		default:
+			restart = append(restart, key)
+			continue
+		}
+		applied = append(applied, key)
+	}
+
+	accessApplied, accessRestart := r.reloadAccess(next)
+	applied, restart = append(applied, accessApplied...), append(restart, accessRestart...)
+	logger.Log().Info("config reloaded", zap.Strings("applied", applied))
+	if len(restart) > 0 {
+		logger.Log().Warn("config changes need restart", zap.Strings("keys", restart))
+	}
+}
+
+// reloadAccess - replaces key, trusted subnet and private key checking requests if they or content
+// of private key file changed, returns applied keys and keys needing restart
+func (r *reloader) reloadAccess(next *config.ServerConfig) (applied, restart []string) {
+	var privateKey []byte
+	if next.CryptKeyPath != "" {
+		var err error
+		privateKey, err = crypt.ReadKeyFile(next.CryptKeyPath)
+		if err != nil {
+			logger.Log().Error("reload private key", zap.Error(err))
+			return nil, nil
+		}
+	}
+
+	var changed []string
+	if next.Key != r.cfg.Key {
+		changed = append(changed, "key")
+	}
+	if next.TrustedSubnet != r.cfg.TrustedSubnet {
+		changed = append(changed, "trusted_subnet")
+	}
+	if next.CryptKeyPath != r.cfg.CryptKeyPath || !bytes.Equal(privateKey, r.privateKey) {
+		changed = append(changed, "crypto_key")
+	}
+	if len(changed) == 0 {
+		return nil, nil
+	}
+
+	if r.httpServer != nil {
+		r.httpServer.Reload(next.Key, next.TrustedSubnet, privateKey)
+		r.cfg.Key, r.cfg.TrustedSubnet, r.cfg.CryptKeyPath, r.privateKey = next.Key, next.TrustedSubnet, next.CryptKeyPath, privateKey
+		return changed, nil
+	}
+
+	// gRPC server checks only trusted subnet live, key and private key are used by it since start
+	for _, key := range changed {
+		if key != "trusted_subnet" {
+			restart = append(restart, key)
+			continue
+		}
+		applied = append(applied, key)
+		if r.grpcServer != nil {
+			r.grpcServer.SetTrustedSubnet(handler.TrustedSubnetFromString(next.TrustedSubnet))
+		}
+		r.cfg.TrustedSubnet = next.TrustedSubnet
+	}
+	return applied, restart
+}
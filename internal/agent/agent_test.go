@@ -3,11 +3,16 @@ package agent
 import (
 	"context"
 	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
+	"github.com/SmoothWay/metrics/internal/logger"
 	"github.com/SmoothWay/metrics/internal/model"
 )
 
@@ -76,3 +81,48 @@ func Test_ReportMetrics(t *testing.T) {
 		})
 	}
 }
+
+func Test_WorkerHonorsRetryAfter(t *testing.T) {
+	logger.Init("fatal")
+
+	var calls atomic.Int32
+	keys := make(chan string, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/updates/" {
+			keys <- r.Header.Get(model.IdempotencyKeyHeader)
+		}
+		if calls.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	a := Agent{Host: strings.TrimPrefix(ts.URL, "http://"), Client: ts.Client()}
+	value := 1.0
+	m := model.Metrics{ID: "Alloc", Mtype: model.MetricTypeGauge, Value: &value}
+
+	var throttled *ThrottledError
+	require.ErrorAs(t, a.sendRequest(context.Background(), m), &throttled)
+	assert.Equal(t, time.Second, throttled.RetryAfter)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	jobs := make(chan []model.Metrics, 1)
+	errs := make(chan error, 1)
+	calls.Store(0)
+	jobs <- []model.Metrics{m}
+	close(jobs)
+
+	start := time.Now()
+	a.Worker(ctx, 1, jobs, errs)
+	assert.GreaterOrEqual(t, time.Since(start), time.Second, "worker must pause for retry after")
+	assert.Equal(t, int32(2), calls.Load(), "throttled metric must be sent again")
+	assert.Empty(t, errs)
+
+	first, second := <-keys, <-keys
+	assert.NotEmpty(t, first)
+	assert.Equal(t, first, second, "retry must reuse idempotency key of batch")
+}
@@ -0,0 +1,80 @@
+package agent
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/SmoothWay/metrics/internal/logger"
+	"github.com/SmoothWay/metrics/internal/model"
+)
+
+// batchRetries number of times batch is sent again after temporary error
+const batchRetries = 2
+
+// ErrTemporary is returned when batch may succeed if sent again: network error or server error
+var ErrTemporary = errors.New("temporary error sending metrics")
+
+// NewIdempotencyKey - returns random key identifying batch of metrics
+func NewIdempotencyKey() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// SendWithRetry - calls send until it succeeds, fails with permanent error or retries are exhausted.
+// Pause between attempts is retry after hint of server if batch is throttled
+func SendWithRetry(ctx context.Context, send func() error) error {
+	err := send()
+	for attempt := 1; err != nil && attempt <= batchRetries; attempt++ {
+		pause := time.Duration(attempt) * time.Second
+		var throttled *ThrottledError
+		if errors.As(err, &throttled) {
+			pause = throttled.RetryAfter
+		} else if !errors.Is(err, ErrTemporary) {
+			return err
+		}
+		logger.Log().Warn("sending metrics failed, retrying", zap.Error(err), zap.Duration("pause", pause))
+		if !Pause(ctx, pause) {
+			return ctx.Err()
+		}
+		err = send()
+	}
+	return err
+}
+
+// sendBatch - sends metrics in one request with idempotency key, so server skips batch if previous attempt
+// with the same key was applied
+func (a *Agent) sendBatch(ctx context.Context, metrics []model.Metrics, key string) error {
+	endpoint := fmt.Sprintf("http://%s/updates/", a.Host)
+	req, err := a.newRequest(ctx, http.MethodPost, endpoint, metrics)
+	if err != nil {
+		return err
+	}
+	defer req.Body.Close()
+	req.Header.Set(model.IdempotencyKeyHeader, key)
+
+	res, err := a.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrTemporary, err.Error())
+	}
+	res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusTooManyRequests:
+		return &ThrottledError{RetryAfter: ParseRetryAfter(res.Header.Get("Retry-After"))}
+	case res.StatusCode >= http.StatusInternalServerError:
+		return fmt.Errorf("%w: status %d", ErrTemporary, res.StatusCode)
+	case res.StatusCode != http.StatusOK:
+		return fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+	return nil
+}
@@ -76,7 +76,7 @@ func (a *Agent) UpdateGaugeMetric(metricName string, metricValue *float64) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
-	a.Metrics = append(a.Metrics, model.Metrics{ID: metricName, Mtype: model.MetricTypeGauge, Value: metricValue})
+	a.Metrics = append(a.Metrics, model.Metrics{ID: metricName, Mtype: model.MetricTypeGauge, Value: metricValue, Labels: a.Labels})
 }
 
 // UpdateCounterMetric - update counter type metric and append to metrics slice
@@ -84,5 +84,5 @@ func (a *Agent) UpdateCounterMetric(metricName string, metricDelta *int64) {
 	a.mu.Lock()
 	defer a.mu.Unlock()
 
-	a.Metrics = append(a.Metrics, model.Metrics{ID: metricName, Mtype: model.MetricTypeCounter, Delta: metricDelta})
+	a.Metrics = append(a.Metrics, model.Metrics{ID: metricName, Mtype: model.MetricTypeCounter, Delta: metricDelta, Labels: a.Labels})
 }
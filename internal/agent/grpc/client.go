@@ -3,7 +3,6 @@ package grpcclient
 import (
 	"context"
 	"fmt"
-	"log"
 	"math/rand"
 	"reflect"
 	"runtime"
@@ -12,15 +11,19 @@ import (
 	"github.com/SmoothWay/metrics/internal/agent"
 	"github.com/SmoothWay/metrics/internal/logger"
 	"github.com/SmoothWay/metrics/internal/model"
+	"github.com/SmoothWay/metrics/internal/tenant"
 	pb "github.com/SmoothWay/metrics/proto"
 	"github.com/grpc-ecosystem/go-grpc-middleware/v2/interceptors/realip"
 
 	sg "github.com/SmoothWay/metrics/internal/grpc"
+	ic "github.com/SmoothWay/metrics/internal/grpc/interceptors"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/encoding/gzip"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 var counter int64
@@ -62,7 +65,7 @@ func (g *GrpcAgent) ReportAllMetricsAtOnes(ctx context.Context, jobs chan<- []mo
 	jobs <- g.Agent.Metrics
 }
 
-// Worker - worker which sends request of single instance of metric to server
+// Worker - worker which sends batch of metrics to server in single request
 func (g *GrpcAgent) Worker(ctx context.Context, id int, jobs <-chan []model.Metrics, errs chan<- error) {
 	for {
 		select {
@@ -75,33 +78,86 @@ func (g *GrpcAgent) Worker(ctx context.Context, id int, jobs <-chan []model.Metr
 				return
 			}
 			logger.Log().Info("worker", zap.Int("started id", id))
+			if len(metrics) == 0 {
+				continue
+			}
+			req := &pb.UpdateMetricsRequest{}
 			for _, metric := range metrics {
 				m, err := sg.MetricToProto(metric)
 				if err != nil {
 					logger.Log().Warn(err.Error())
-				}
-				req := &pb.UpdateMetricRequest{
-					Metric: &m,
-				}
-				logger.Log().Info("send update request", zap.String("data", req.String()))
-
-				gz := grpc.UseCompressor(gzip.Name)
-
-				md := metadata.New(map[string]string{realip.XRealIp: g.ip})
-				ctx = metadata.NewOutgoingContext(ctx, md)
-				log.Println(req)
-				resp, err := g.client.UpdateMetric(ctx, req, gz)
-				if err != nil {
-					logger.Log().Error(err.Error())
 					continue
 				}
-				logger.Log().Info("received response", zap.String("data", resp.String()))
+				req.Metric = append(req.Metric, &m)
 			}
 
+			// every attempt carries the same key, so batch applied before timeout is not counted twice
+			key := agent.NewIdempotencyKey()
+			err := agent.SendWithRetry(ctx, func() error {
+				return g.sendBatch(ctx, req, key)
+			})
+			if err != nil {
+				logger.Log().Error(err.Error())
+			}
 		}
 	}
 }
 
+// sendBatch - sends metrics with idempotency key in metadata, errors are converted to ones
+// agent.SendWithRetry can retry
+func (g *GrpcAgent) sendBatch(ctx context.Context, req *pb.UpdateMetricsRequest, key string) error {
+	md := metadata.New(map[string]string{realip.XRealIp: g.ip})
+	if g.Agent.APIToken != "" {
+		md.Set(tenant.Header, g.Agent.APIToken)
+	}
+	md.Set(model.IdempotencyKeyHeader, key)
+	ctx = metadata.NewOutgoingContext(ctx, md)
+
+	var trailer metadata.MD
+	resp, err := g.client.UpdateMetrics(ctx, req, grpc.UseCompressor(gzip.Name), grpc.Trailer(&trailer))
+	switch status.Code(err) {
+	case codes.OK:
+		logger.Log().Info("received response", zap.Int("metrics", len(resp.Metric)))
+		return nil
+	case codes.ResourceExhausted:
+		var hint string
+		if values := trailer.Get(ic.RetryAfterKey); len(values) > 0 {
+			hint = values[0]
+		}
+		return &agent.ThrottledError{RetryAfter: agent.ParseRetryAfter(hint)}
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Internal:
+		return fmt.Errorf("%w: %s", agent.ErrTemporary, err.Error())
+	default:
+		return err
+	}
+}
+
+// PushMetadata - sends unit and description of default gauge metrics to server
+func (g *GrpcAgent) PushMetadata(ctx context.Context) error {
+	md := metadata.New(map[string]string{realip.XRealIp: g.ip})
+	if g.Agent.APIToken != "" {
+		md.Set(tenant.Header, g.Agent.APIToken)
+	}
+	ctx = metadata.NewOutgoingContext(ctx, md)
+
+	for _, name := range model.GaugeMetrics {
+		meta, ok := model.GaugeMetricsMetadata[name]
+		if !ok {
+			continue
+		}
+		req := &pb.SetMetadataRequest{Metadata: &pb.Metadata{
+			Name:        name,
+			Unit:        meta.Unit,
+			Description: meta.Description,
+			Owner:       meta.Owner,
+		}}
+		if _, err := g.client.SetMetadata(ctx, req); err != nil {
+			return fmt.Errorf("push metadata of %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
 func (g *GrpcAgent) CollectMemMetrics() {
 	var MemStats runtime.MemStats
 
@@ -145,7 +201,7 @@ func (g *GrpcAgent) UpdateGaugeMetric(metricName string, metricValue *float64) {
 	g.mu.Lock()
 	defer g.mu.Unlock()
 
-	g.Agent.Metrics = append(g.Agent.Metrics, model.Metrics{ID: metricName, Mtype: model.MetricTypeGauge, Value: metricValue})
+	g.Agent.Metrics = append(g.Agent.Metrics, model.Metrics{ID: metricName, Mtype: model.MetricTypeGauge, Value: metricValue, Labels: g.Agent.Labels})
 }
 
 // UpdateCounterMetric - update counter type metric and append to metrics slice
@@ -153,5 +209,5 @@ func (g *GrpcAgent) UpdateCounterMetric(metricName string, metricDelta *int64) {
 	g.mu.Lock()
 	defer g.mu.Unlock()
 
-	g.Agent.Metrics = append(g.Agent.Metrics, model.Metrics{ID: metricName, Mtype: model.MetricTypeCounter, Delta: metricDelta})
+	g.Agent.Metrics = append(g.Agent.Metrics, model.Metrics{ID: metricName, Mtype: model.MetricTypeCounter, Delta: metricDelta, Labels: g.Agent.Labels})
 }
@@ -0,0 +1,43 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/SmoothWay/metrics/internal/model"
+)
+
+// PushMetadata - sends unit and description of default gauge metrics to server
+func (a *Agent) PushMetadata(ctx context.Context) error {
+	for _, name := range model.GaugeMetrics {
+		meta, ok := model.GaugeMetricsMetadata[name]
+		if !ok {
+			continue
+		}
+		meta.Name = name
+		if err := a.sendMetadata(ctx, meta); err != nil {
+			return fmt.Errorf("push metadata of %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (a *Agent) sendMetadata(ctx context.Context, meta model.Metadata) error {
+	endpoint := fmt.Sprintf("http://%s/api/v1/metadata/%s", a.Host, meta.Name)
+	req, err := a.newRequest(ctx, http.MethodPut, endpoint, meta)
+	if err != nil {
+		return err
+	}
+	defer req.Body.Close()
+
+	res, err := a.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+	return nil
+}
@@ -21,17 +21,37 @@ import (
 	"github.com/SmoothWay/metrics/internal/crypt"
 	"github.com/SmoothWay/metrics/internal/logger"
 	"github.com/SmoothWay/metrics/internal/model"
+	"github.com/SmoothWay/metrics/internal/tenant"
 )
 
 var counter int64
 
 type Agent struct {
-	PubKey  []byte
-	Host    string
-	Key     string
-	Client  *http.Client
-	Metrics []model.Metrics
-	mu      sync.Mutex
+	PubKey   []byte
+	Host     string
+	Key      string
+	Client   *http.Client
+	Labels   map[string]string
+	APIToken string
+	Metrics  []model.Metrics
+	mu       sync.Mutex
+	// keysMu guards Key and PubKey replaced by SetKeys while workers send reports
+	keysMu sync.RWMutex
+}
+
+// SetKeys - replaces key signing reports and public key encrypting them, requests created afterwards use them
+func (a *Agent) SetKeys(key string, pubKey []byte) {
+	a.keysMu.Lock()
+	defer a.keysMu.Unlock()
+	a.Key = key
+	a.PubKey = pubKey
+}
+
+// keys - returns key signing reports and public key encrypting them
+func (a *Agent) keys() (string, []byte) {
+	a.keysMu.RLock()
+	defer a.keysMu.RUnlock()
+	return a.Key, a.PubKey
 }
 
 // ReportAllMetricsAtOnes - sends all collected metrics in one single slice to jobs channel
@@ -44,7 +64,7 @@ func (a *Agent) ReportAllMetricsAtOnes(ctx context.Context, jobs chan<- []model.
 	jobs <- a.Metrics
 }
 
-// Worker - worker which sends request of single instance of metric to server
+// Worker - worker which sends batch of metrics to server in single request
 func (a *Agent) Worker(ctx context.Context, id int, jobs <-chan []model.Metrics, errs chan<- error) {
 	for {
 		select {
@@ -57,11 +77,16 @@ func (a *Agent) Worker(ctx context.Context, id int, jobs <-chan []model.Metrics,
 				return
 			}
 			logger.Log().Info("worker", zap.Int("started id", id))
-			for _, metric := range metrics {
-				err := a.sendRequest(ctx, metric)
-				if err != nil {
-					errs <- err
-				}
+			if len(metrics) == 0 {
+				continue
+			}
+			// every attempt carries the same key, so batch applied before timeout is not counted twice
+			key := NewIdempotencyKey()
+			err := SendWithRetry(ctx, func() error {
+				return a.sendBatch(ctx, metrics, key)
+			})
+			if err != nil && ctx.Err() == nil {
+				errs <- err
 			}
 		}
 	}
@@ -113,33 +138,56 @@ func (a *Agent) sendRequest(ctx context.Context, m model.Metrics) error {
 		return nil
 	default:
 	}
-	jsonMetric, err := json.Marshal(m)
+
+	endpoint := fmt.Sprintf("http://%s/update/", a.Host)
+	req, err := a.newRequest(ctx, http.MethodPost, endpoint, m)
+	if err != nil {
+		return err
+	}
+	defer req.Body.Close()
+	logger.Log().Info("sent request")
+
+	res, err := a.Client.Do(req)
 	if err != nil {
 		return err
 	}
-	if len(a.PubKey) > 0 {
-		jsonMetric, err = crypt.Encrypt(jsonMetric, a.PubKey)
+
+	res.Body.Close()
+	if res.StatusCode == http.StatusTooManyRequests {
+		return &ThrottledError{RetryAfter: ParseRetryAfter(res.Header.Get("Retry-After"))}
+	}
+	return nil
+}
+
+// newRequest - creates request with payload in JSON, encrypted if public key is set, signed if key is set
+// and compressed
+func (a *Agent) newRequest(ctx context.Context, method, endpoint string, payload any) (*http.Request, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	key, pubKey := a.keys()
+	if len(pubKey) > 0 {
+		data, err = crypt.Encrypt(data, pubKey)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	cJSONMetric, err := compressData(jsonMetric)
+	body, err := compressData(data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	endpoint := fmt.Sprintf("http://%s/update/", a.Host)
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, cJSONMetric)
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, body)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	logger.Log().Info("sent request")
-	if a.Key != "" {
+	if key != "" {
 
-		h := hmac.New(sha256.New, []byte(a.Key))
+		h := hmac.New(sha256.New, []byte(key))
 
-		h.Write(jsonMetric)
+		h.Write(data)
 		metricsHash := h.Sum(nil)
 
 		hashString := hex.EncodeToString(metricsHash)
@@ -147,7 +195,6 @@ func (a *Agent) sendRequest(ctx context.Context, m model.Metrics) error {
 		req.Header.Add("HashSHA256", string(hashString))
 	}
 
-	defer req.Body.Close()
 	ip, err := GetIP()
 	if err != nil {
 		logger.Log().Warn("cant get ip", zap.String("error", err.Error()))
@@ -155,14 +202,10 @@ func (a *Agent) sendRequest(ctx context.Context, m model.Metrics) error {
 	req.Header.Set("X-REAL-IP", ip.String())
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Content-Encoding", "gzip")
-
-	res, err := a.Client.Do(req)
-	if err != nil {
-		return err
+	if a.APIToken != "" {
+		req.Header.Set(tenant.Header, a.APIToken)
 	}
-
-	res.Body.Close()
-	return nil
+	return req, nil
 }
 
 // ReportMetrics - send slice of metrics to server with compression
@@ -204,6 +247,9 @@ func (a *Agent) ReportMetrics(ctx context.Context) error {
 			req.Header.Set("X-REAL-IP", ip.String())
 			req.Header.Set("Content-Type", "application/json")
 			req.Header.Set("Content-Encoding", "gzip")
+			if a.APIToken != "" {
+				req.Header.Set(tenant.Header, a.APIToken)
+			}
 
 			res, err := a.Client.Do(req)
 			if err != nil {
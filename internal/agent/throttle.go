@@ -0,0 +1,41 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// defaultRetryAfter pause used when server throttles without valid retry after hint
+const defaultRetryAfter = time.Second
+
+// ThrottledError is returned when server rejects metrics because of rate limit or series quota
+type ThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("throttled by server, retry after %s", e.RetryAfter)
+}
+
+// ParseRetryAfter - parses retry after hint in seconds, default pause is returned for missing or malformed hint
+func ParseRetryAfter(value string) time.Duration {
+	secs, err := strconv.Atoi(value)
+	if err != nil || secs <= 0 {
+		return defaultRetryAfter
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// Pause - waits for d, returns false if context is done earlier
+func Pause(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
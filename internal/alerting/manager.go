@@ -0,0 +1,186 @@
+package alerting
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/SmoothWay/metrics/internal/logger"
+	"github.com/SmoothWay/metrics/internal/model"
+	"github.com/SmoothWay/metrics/internal/query"
+)
+
+const (
+	StatePending  = "pending"
+	StateFiring   = "firing"
+	StateResolved = "resolved"
+)
+
+// Alert state of rule for single series
+type Alert struct {
+	Rule        string            `json:"rule"`
+	State       string            `json:"state"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Value       float64           `json:"value"`
+	ActiveAt    time.Time         `json:"activeAt"`
+	FiredAt     *time.Time        `json:"firedAt,omitempty"`
+	ResolvedAt  *time.Time        `json:"resolvedAt,omitempty"`
+}
+
+// maxOutbox how many undelivered alerts are kept for single webhook, older ones are dropped
+const maxOutbox = 1000
+
+type Manager struct {
+	rules    []Rule
+	engine   *query.Engine
+	notifier *Notifier
+	active   map[string]*Alert
+	now      func() time.Time
+
+	// outbox alerts not delivered to webhook yet, sent in background and sent again on next evaluation if failed
+	outbox  map[string][]Alert
+	sending map[string]bool
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+}
+
+// NewManager - creates manager evaluating rules with query engine and sending notifications with notifier
+func NewManager(rules []Rule, engine *query.Engine, notifier *Notifier) *Manager {
+	return &Manager{
+		rules:    rules,
+		engine:   engine,
+		notifier: notifier,
+		active:   make(map[string]*Alert),
+		now:      time.Now,
+		outbox:   make(map[string][]Alert),
+		sending:  make(map[string]bool),
+	}
+}
+
+// Run - evaluates rules every interval until context is done, then waits for notifications being sent
+func (m *Manager) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	defer m.wg.Wait()
+
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Log().Info("Context cancelled. Stopping alerting routine.")
+			return
+		case <-ticker.C:
+			m.Evaluate(ctx)
+		}
+	}
+}
+
+// Evaluate - evaluates all rules once and notifies about alerts which started firing or resolved.
+// Notifications are sent in background, so slow webhooks do not delay evaluation
+func (m *Manager) Evaluate(ctx context.Context) {
+	now := m.now()
+	var changed []Alert
+
+	for i := range m.rules {
+		r := &m.rules[i]
+		result, err := m.engine.Query(ctx, r.query)
+		if err != nil {
+			logger.Log().Error("rule evaluation failed", zap.String("rule", r.Name), zap.Error(err))
+			continue
+		}
+
+		seen := make(map[string]bool)
+		for _, s := range result.Series {
+			if !r.matches(s.Value) {
+				continue
+			}
+			labels := mergeLabels(s.Labels, r.Labels)
+			key := model.SeriesKey(r.Name, labels)
+			seen[key] = true
+
+			a, ok := m.active[key]
+			if !ok {
+				a = &Alert{Rule: r.Name, State: StatePending, Labels: labels, Annotations: r.Annotations, ActiveAt: now}
+				m.active[key] = a
+			}
+			a.Value = s.Value
+			if a.State == StatePending && now.Sub(a.ActiveAt) >= r.duration {
+				a.State = StateFiring
+				a.FiredAt = &now
+				changed = append(changed, *a)
+			}
+		}
+
+		for key, a := range m.active {
+			if a.Rule != r.Name || seen[key] {
+				continue
+			}
+			delete(m.active, key)
+			if a.State == StateFiring {
+				a.State = StateResolved
+				a.ResolvedAt = &now
+				changed = append(changed, *a)
+			}
+		}
+	}
+
+	if m.notifier != nil {
+		for _, url := range m.notifier.Webhooks {
+			m.notify(ctx, url, changed)
+		}
+	}
+}
+
+// notify - queues alerts for webhook and starts sending queued alerts unless they are being sent already.
+// Alerts failed to be sent stay queued until next call
+func (m *Manager) notify(ctx context.Context, url string, alerts []Alert) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	queued := append(m.outbox[url], alerts...)
+	if len(queued) > maxOutbox {
+		logger.Log().Warn("dropped undelivered alert notifications", zap.String("url", url), zap.Int("count", len(queued)-maxOutbox))
+		queued = queued[len(queued)-maxOutbox:]
+	}
+	m.outbox[url] = queued
+	if m.sending[url] || len(queued) == 0 {
+		return
+	}
+
+	m.outbox[url] = nil
+	m.sending[url] = true
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		err := m.notifier.NotifyWebhook(ctx, url, queued)
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.sending[url] = false
+		if err != nil {
+			logger.Log().Error("failed to send alert notifications", zap.String("url", url), zap.Error(err))
+			m.outbox[url] = append(queued, m.outbox[url]...)
+		}
+	}()
+}
+
+// wait - waits for notifications being sent
+func (m *Manager) wait() {
+	m.wg.Wait()
+}
+
+func mergeLabels(series, rule map[string]string) map[string]string {
+	if len(series) == 0 && len(rule) == 0 {
+		return nil
+	}
+	labels := make(map[string]string, len(series)+len(rule))
+	for k, v := range series {
+		labels[k] = v
+	}
+	for k, v := range rule {
+		labels[k] = v
+	}
+	return labels
+}
@@ -0,0 +1,172 @@
+package alerting
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/SmoothWay/metrics/internal/logger"
+	"github.com/SmoothWay/metrics/internal/model"
+	"github.com/SmoothWay/metrics/internal/query"
+	"github.com/SmoothWay/metrics/internal/repository/memstorage"
+	"github.com/SmoothWay/metrics/internal/service"
+)
+
+type receiver struct {
+	mu            sync.Mutex
+	failuresLeft  int
+	notifications []Notification
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.failuresLeft > 0 {
+		rc.failuresLeft--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	var n Notification
+	if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	rc.notifications = append(rc.notifications, n)
+}
+
+func TestRule_compile(t *testing.T) {
+	tests := []struct {
+		name      string
+		rule      Rule
+		query     string
+		op        string
+		threshold float64
+		duration  time.Duration
+		wantErr   error
+	}{
+		{name: "for inside expression", rule: Rule{Name: "r", Expr: "FreeMemory < 1e9 for 5m"}, query: "FreeMemory", op: "<", threshold: 1e9, duration: 5 * time.Minute},
+		{name: "matcher with not equal", rule: Rule{Name: "r", Expr: `sum(Alloc{host!="a"}) >= 10`, For: "1m"}, query: `sum(Alloc{host!="a"})`, op: ">=", threshold: 10, duration: time.Minute},
+		{name: "no comparison", rule: Rule{Name: "r", Expr: "FreeMemory"}, wantErr: ErrInvalidRule},
+		{name: "bad threshold", rule: Rule{Name: "r", Expr: "FreeMemory < lots"}, wantErr: ErrInvalidRule},
+		{name: "no name", rule: Rule{Expr: "FreeMemory < 1"}, wantErr: ErrInvalidRule},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.rule.compile()
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Rule.compile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			assert.Equal(t, tt.query, tt.rule.query)
+			assert.Equal(t, tt.op, tt.rule.op)
+			assert.Equal(t, tt.threshold, tt.rule.threshold)
+			assert.Equal(t, tt.duration, tt.rule.duration)
+		})
+	}
+}
+
+func TestManager_Evaluate(t *testing.T) {
+	logger.Init("fatal")
+
+	rc := &receiver{failuresLeft: 1}
+	ts := httptest.NewServer(rc)
+	defer ts.Close()
+
+	s := service.New(memstorage.New(nil))
+	setFree := func(v float64) {
+		require.NoError(t, s.Save(context.Background(), model.Metrics{ID: "FreeMemory", Mtype: model.MetricTypeGauge, Value: &v}))
+	}
+
+	rule := Rule{Name: "LowMemory", Expr: "FreeMemory < 1e9 for 5m", Labels: map[string]string{"severity": "page"}}
+	require.NoError(t, rule.compile())
+
+	notifier := NewNotifier([]string{ts.URL}, 2)
+	notifier.Backoff = func(int) time.Duration { return time.Millisecond }
+	m := NewManager([]Rule{rule}, query.New(s), notifier)
+	now := time.Now()
+	m.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	setFree(5e8)
+	m.Evaluate(ctx)
+	m.wait()
+	assert.Empty(t, rc.notifications, "alert must stay pending during for duration")
+
+	now = now.Add(5 * time.Minute)
+	m.Evaluate(ctx)
+	m.wait()
+	require.Len(t, rc.notifications, 1, "firing alert must be delivered after failed attempt")
+	firing := rc.notifications[0].Alerts[0]
+	assert.Equal(t, StateFiring, firing.State)
+	assert.Equal(t, "page", firing.Labels["severity"])
+
+	now = now.Add(time.Minute)
+	m.Evaluate(ctx)
+	m.wait()
+	assert.Len(t, rc.notifications, 1, "firing alert is notified once")
+
+	setFree(2e9)
+	now = now.Add(time.Minute)
+	m.Evaluate(ctx)
+	m.wait()
+	require.Len(t, rc.notifications, 2)
+	assert.Equal(t, StateResolved, rc.notifications[1].Alerts[0].State)
+}
+
+func TestManager_EvaluateResendsFailed(t *testing.T) {
+	logger.Init("fatal")
+
+	rc := &receiver{failuresLeft: 1}
+	ts := httptest.NewServer(rc)
+	defer ts.Close()
+	blocked := make(chan struct{})
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-blocked
+	}))
+	defer hanging.Close()
+	defer close(blocked)
+
+	s := service.New(memstorage.New(nil))
+	v := 5e8
+	require.NoError(t, s.Save(context.Background(), model.Metrics{ID: "FreeMemory", Mtype: model.MetricTypeGauge, Value: &v}))
+
+	rule := Rule{Name: "LowMemory", Expr: "FreeMemory < 1e9"}
+	require.NoError(t, rule.compile())
+
+	notifier := NewNotifier([]string{hanging.URL, ts.URL}, 1)
+	notifier.Retries = 0
+	m := NewManager([]Rule{rule}, query.New(s), notifier)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	start := time.Now()
+	m.Evaluate(ctx)
+	assert.Less(t, time.Since(start), time.Second, "evaluation must not wait for webhooks")
+
+	require.Eventually(t, func() bool {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return !m.sending[ts.URL]
+	}, time.Second, time.Millisecond)
+	assert.Empty(t, rc.notifications, "first attempt fails")
+
+	m.Evaluate(ctx)
+	require.Eventually(t, func() bool {
+		rc.mu.Lock()
+		defer rc.mu.Unlock()
+		return len(rc.notifications) == 1
+	}, time.Second, time.Millisecond, "failed notification is sent again on next evaluation")
+	assert.Equal(t, StateFiring, rc.notifications[0].Alerts[0].State)
+
+	cancel()
+	m.wait()
+}
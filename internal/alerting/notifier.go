@@ -0,0 +1,109 @@
+package alerting
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/SmoothWay/metrics/internal/logger"
+)
+
+const defaultRetries = 3
+
+// Notification body posted to webhooks
+type Notification struct {
+	Alerts []Alert `json:"alerts"`
+}
+
+type Notifier struct {
+	Client   *http.Client
+	Webhooks []string
+	Retries  int
+	// Backoff returns delay before retry attempt, attempts are counted from 1
+	Backoff func(attempt int) time.Duration
+}
+
+// NewNotifier - creates notifier posting to webhooks, failed requests are retried with growing delay
+func NewNotifier(webhooks []string, retries int) *Notifier {
+	if retries <= 0 {
+		retries = defaultRetries
+	}
+	return &Notifier{
+		Client:   &http.Client{Timeout: 10 * time.Second},
+		Webhooks: webhooks,
+		Retries:  retries,
+		Backoff: func(attempt int) time.Duration {
+			return time.Duration(attempt*2-1) * time.Second
+		},
+	}
+}
+
+// Notify - posts alerts to every webhook, returns last error if any webhook failed after all retries
+func (n *Notifier) Notify(ctx context.Context, alerts []Alert) error {
+	body, err := json.Marshal(Notification{Alerts: alerts})
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	for _, url := range n.Webhooks {
+		if err = n.post(ctx, url, body); err != nil {
+			logger.Log().Error("webhook failed", zap.String("url", url), zap.Error(err))
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// NotifyWebhook - posts alerts to single webhook, returns error if it failed after all retries
+func (n *Notifier) NotifyWebhook(ctx context.Context, url string, alerts []Alert) error {
+	body, err := json.Marshal(Notification{Alerts: alerts})
+	if err != nil {
+		return err
+	}
+	return n.post(ctx, url, body)
+}
+
+func (n *Notifier) post(ctx context.Context, url string, body []byte) error {
+	var err error
+	for attempt := 0; attempt <= n.Retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(n.Backoff(attempt)):
+			}
+		}
+
+		err = n.send(ctx, url, body)
+		if err == nil {
+			return nil
+		}
+		logger.Log().Warn("webhook attempt failed", zap.String("url", url), zap.Int("attempt", attempt+1), zap.Error(err))
+	}
+	return err
+}
+
+func (n *Notifier) send(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package alerting
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/SmoothWay/metrics/internal/logger"
+	"github.com/SmoothWay/metrics/internal/model"
+	"github.com/SmoothWay/metrics/internal/query"
+)
+
+// Saver storage of recorded metrics
+type Saver interface {
+	SaveAll(ctx context.Context, metrics []model.Metrics) error
+}
+
+type Recorder struct {
+	rules  []RecordingRule
+	engine *query.Engine
+	saver  Saver
+}
+
+// NewRecorder - creates recorder evaluating recording rules with query engine and storing results with saver
+func NewRecorder(rules []RecordingRule, engine *query.Engine, saver Saver) *Recorder {
+	return &Recorder{
+		rules:  rules,
+		engine: engine,
+		saver:  saver,
+	}
+}
+
+// Run - evaluates recording rules every interval until context is done
+func (r *Recorder) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Log().Info("Context cancelled. Stopping recording rules routine.")
+			return
+		case <-ticker.C:
+			r.Evaluate(ctx)
+		}
+	}
+}
+
+// Evaluate - evaluates all recording rules once and saves results as gauges
+func (r *Recorder) Evaluate(ctx context.Context) {
+	var metrics []model.Metrics
+	for _, rule := range r.rules {
+		result, err := r.engine.Query(ctx, rule.Expr)
+		if err != nil {
+			logger.Log().Error("recording rule evaluation failed", zap.String("record", rule.Record), zap.Error(err))
+			continue
+		}
+		for _, s := range result.Series {
+			value := s.Value
+			metrics = append(metrics, model.Metrics{
+				ID:     rule.Record,
+				Mtype:  model.MetricTypeGauge,
+				Value:  &value,
+				Labels: mergeLabels(s.Labels, rule.Labels),
+			})
+		}
+	}
+	if len(metrics) == 0 {
+		return
+	}
+	if err := r.saver.SaveAll(ctx, metrics); err != nil {
+		logger.Log().Error("failed to save recorded metrics", zap.Error(err))
+	}
+}
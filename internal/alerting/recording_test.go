@@ -0,0 +1,53 @@
+package alerting
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/SmoothWay/metrics/internal/logger"
+	"github.com/SmoothWay/metrics/internal/model"
+	"github.com/SmoothWay/metrics/internal/query"
+	"github.com/SmoothWay/metrics/internal/repository/memstorage"
+	"github.com/SmoothWay/metrics/internal/service"
+)
+
+func TestRecorder_Evaluate(t *testing.T) {
+	logger.Init("fatal")
+
+	s := service.New(memstorage.New(nil))
+	gauge := func(name string, v float64, host string) model.Metrics {
+		return model.Metrics{ID: name, Mtype: model.MetricTypeGauge, Value: &v, Labels: map[string]string{"host": host}}
+	}
+	require.NoError(t, s.SaveAll(context.Background(), []model.Metrics{
+		gauge("HeapAlloc", 25, "a"),
+		gauge("HeapSys", 100, "a"),
+		gauge("HeapAlloc", 10, "b"),
+		gauge("HeapSys", 20, "b"),
+	}))
+
+	r := NewRecorder([]RecordingRule{
+		{Record: "HeapAllocRatio", Expr: "HeapAlloc / HeapSys"},
+		{Record: "HeapAllocTotal", Expr: "sum(HeapAlloc)", Labels: map[string]string{"scope": "all"}},
+	}, query.New(s), s)
+	r.Evaluate(context.Background())
+
+	tests := []struct {
+		metric model.Metrics
+		want   float64
+	}{
+		{metric: model.Metrics{ID: "HeapAllocRatio", Labels: map[string]string{"host": "a"}}, want: 0.25},
+		{metric: model.Metrics{ID: "HeapAllocRatio", Labels: map[string]string{"host": "b"}}, want: 0.5},
+		{metric: model.Metrics{ID: "HeapAllocTotal", Labels: map[string]string{"scope": "all"}}, want: 35},
+	}
+	for _, tt := range tests {
+		t.Run(tt.metric.Key(), func(t *testing.T) {
+			m := tt.metric
+			m.Mtype = model.MetricTypeGauge
+			require.NoError(t, s.Retrieve(context.Background(), &m))
+			assert.Equal(t, tt.want, *m.Value)
+		})
+	}
+}
@@ -0,0 +1,153 @@
+// Package alerting evaluates threshold rules against stored metrics and notifies webhooks about alerts
+package alerting
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidRule = errors.New("invalid alerting rule")
+
+// comparison operators ordered so two-character ones are matched first
+var comparisons = []string{"<=", ">=", "==", "!=", "<", ">"}
+
+// RulesFile schema of rules file
+type RulesFile struct {
+	Rules          []Rule          `json:"rules"`
+	RecordingRules []RecordingRule `json:"recording_rules"`
+	Webhooks       []string        `json:"webhooks"`
+	Retries        int             `json:"webhook_retries"`
+}
+
+// RecordingRule stores result of expression as gauge named Record, e.g. HeapAllocRatio = HeapAlloc / HeapSys
+type RecordingRule struct {
+	Record string            `json:"record"`
+	Expr   string            `json:"expr"`
+	Labels map[string]string `json:"labels"`
+}
+
+// Rule threshold rule, e.g. expr "FreeMemory < 1e9" with for "5m"
+type Rule struct {
+	Name        string            `json:"name"`
+	Expr        string            `json:"expr"`
+	For         string            `json:"for"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+
+	query     string
+	op        string
+	threshold float64
+	duration  time.Duration
+}
+
+// LoadRules - reads and validates rules file
+func LoadRules(path string) (*RulesFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f RulesFile
+	if err = json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	for i := range f.Rules {
+		if err = f.Rules[i].compile(); err != nil {
+			return nil, err
+		}
+	}
+	for _, r := range f.RecordingRules {
+		if r.Record == "" || r.Expr == "" {
+			return nil, fmt.Errorf("%w: recording rule requires record and expr", ErrInvalidRule)
+		}
+	}
+	return &f, nil
+}
+
+// compile - splits expression into query, comparison and threshold
+func (r *Rule) compile() error {
+	if r.Name == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidRule)
+	}
+	expr := r.Expr
+	// "for" may be written inside expression: FreeMemory < 1e9 for 5m
+	if i := strings.LastIndex(expr, " for "); i >= 0 && r.For == "" {
+		expr, r.For = expr[:i], strings.TrimSpace(expr[i+5:])
+	}
+
+	pos, op := findComparison(expr)
+	if pos < 0 {
+		return fmt.Errorf("%w: %s: comparison operator not found in %q", ErrInvalidRule, r.Name, r.Expr)
+	}
+	threshold, err := strconv.ParseFloat(strings.TrimSpace(expr[pos+len(op):]), 64)
+	if err != nil {
+		return fmt.Errorf("%w: %s: invalid threshold: %s", ErrInvalidRule, r.Name, err.Error())
+	}
+	r.query = strings.TrimSpace(expr[:pos])
+	r.op = op
+	r.threshold = threshold
+
+	if r.For != "" {
+		if r.duration, err = time.ParseDuration(r.For); err != nil {
+			return fmt.Errorf("%w: %s: invalid for: %s", ErrInvalidRule, r.Name, err.Error())
+		}
+	}
+	return nil
+}
+
+// findComparison - finds comparison operator outside of label matchers and strings
+func findComparison(expr string) (int, string) {
+	depth := 0
+	inString := false
+	for i := 0; i < len(expr); i++ {
+		c := expr[i]
+		switch {
+		case inString:
+			if c == '\\' {
+				i++
+			} else if c == '"' {
+				inString = false
+			}
+			continue
+		case c == '"':
+			inString = true
+			continue
+		case c == '{':
+			depth++
+			continue
+		case c == '}':
+			depth--
+			continue
+		}
+		if depth > 0 {
+			continue
+		}
+		for _, op := range comparisons {
+			if strings.HasPrefix(expr[i:], op) {
+				return i, op
+			}
+		}
+	}
+	return -1, ""
+}
+
+func (r *Rule) matches(v float64) bool {
+	switch r.op {
+	case "<":
+		return v < r.threshold
+	case "<=":
+		return v <= r.threshold
+	case ">":
+		return v > r.threshold
+	case ">=":
+		return v >= r.threshold
+	case "==":
+		return v == r.threshold
+	default:
+		return v != r.threshold
+	}
+}
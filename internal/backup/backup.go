@@ -3,10 +3,13 @@ package backup
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"go.uber.org/zap"
@@ -20,73 +23,260 @@ type BackupConfig struct {
 	s        *service.Service
 	FilePath string
 	Interval int64
+	opts     Options
+	uploader *Uploader
+	journal  *Journal
+
+	mu sync.Mutex
+	// intervalChanged notifies running Backup about interval set by SetInterval
+	intervalChanged chan struct{}
 }
 
-// New - creates new BackupConfig instance with interval, path and service parameters
-func New(interval int64, path string, serv *service.Service) (*BackupConfig, error) {
+// New - creates new BackupConfig instance with interval, path, service and snapshot options
+func New(interval int64, path string, serv *service.Service, opts Options) (*BackupConfig, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
 	return &BackupConfig{
-		Interval: interval,
-		FilePath: path,
-		s:        serv,
+		Interval:        interval,
+		FilePath:        path,
+		s:               serv,
+		opts:            opts,
+		intervalChanged: make(chan struct{}, 1),
 	}, nil
+}
+
+// SetInterval - changes interval of backups in seconds, running Backup starts to use it at once,
+// zero interval pauses periodic backups
+func (b *BackupConfig) SetInterval(interval int64) {
+	b.mu.Lock()
+	b.Interval = interval
+	b.mu.Unlock()
+	select {
+	case b.intervalChanged <- struct{}{}:
+	default:
+	}
+}
 
+// resetTicker - makes ticker tick by the current interval or stops it if interval is not positive
+func (b *BackupConfig) resetTicker(ticker *time.Ticker) {
+	b.mu.Lock()
+	interval := b.Interval
+	b.mu.Unlock()
+	if interval > 0 {
+		ticker.Reset(time.Duration(interval) * time.Second)
+	} else {
+		ticker.Stop()
+	}
+}
+
+// SetUploader - makes every backup upload written snapshots with u, failed upload doesn't fail backup
+// since snapshots are kept locally anyway
+func (b *BackupConfig) SetUploader(u *Uploader) {
+	b.uploader = u
 }
 
-var ErrRestoreFromFile = errors.New("error restoring from file")
+// SetJournal - makes every backup start new segment of journal and delete segments older than kept snapshots
+func (b *BackupConfig) SetJournal(j *Journal) {
+	b.journal = j
+}
+
+var (
+	ErrRestoreFromFile = errors.New("error restoring from file")
+	ErrNoRestorePoint  = errors.New("no snapshot taken before requested time")
+)
 
 // Backup - save metrics into file depending on backupInterval.C
 func (b *BackupConfig) Backup(ctx context.Context) error {
-	backupInterval := time.NewTicker(time.Duration(b.Interval) * time.Second)
+	backupInterval := time.NewTicker(time.Hour)
+	b.resetTicker(backupInterval)
 	defer backupInterval.Stop()
 
 	for {
 		select {
+		case <-b.intervalChanged:
+			b.resetTicker(backupInterval)
 		case <-backupInterval.C:
-			if err := b.backupToFile(); err != nil {
+			if err := b.backupToFile(ctx); err != nil {
 				return err
 			}
 		case <-ctx.Done():
-			return b.backupToFile()
+			// last backup is made on shutdown, when ctx is already done
+			return b.backupToFile(context.Background())
 		}
 	}
 }
 
-func (b *BackupConfig) backupToFile() error {
-	metrics := b.s.GetAll()
-
-	if len(metrics) == 0 {
-		return nil
+// TenantPath - returns path of backup file of tenant, default tenant is stored by path itself
+// and other tenants next to it, e.g. /tmp/metrics-db.acme.json
+func TenantPath(path, tenant string) string {
+	if tenant == "" {
+		return path
 	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + tenant + ext
+}
+
+func (b *BackupConfig) backupToFile(ctx context.Context) error {
+	_, err := b.Save(ctx)
+	return err
+}
 
-	logger.Log().Info("writing to file", zap.Int("num of metrics", len(metrics)))
-	file, err := os.Create(b.FilePath)
+// Save - writes snapshot of every tenant of service, whatever storage service uses. Snapshot of tenant is written
+// to TenantPath(FilePath, tenant) and uploaded if uploader is set, tenants without metrics are skipped.
+// Returns number of written metrics
+func (b *BackupConfig) Save(ctx context.Context) (int, error) {
+	tenants, err := b.s.Tenants()
 	if err != nil {
-		return err
+		return 0, err
+	}
+	total := 0
+	for _, t := range tenants {
+		path := TenantPath(b.FilePath, t)
+		n, err := DumpTenant(ctx, b.s.ForTenant(t), path, b.opts)
+		if err != nil {
+			return total, err
+		}
+		total += n
+		if n > 0 && b.uploader != nil {
+			if err = b.uploader.Upload(ctx, path); err != nil {
+				logger.Log().Error("error uploading snapshot", zap.String("path", path), zap.Error(err))
+			}
+		}
+	}
+	if b.journal != nil {
+		if err = b.rotateJournal(tenants); err != nil {
+			return total, err
+		}
 	}
-	defer file.Close()
+	return total, nil
+}
 
-	if err := json.NewEncoder(file).Encode(metrics); err != nil {
-		logger.Log().Error("Error by encode metrics to json", zap.Error(err))
+// rotateJournal - starts new segment of journal and deletes segments which are older than the oldest
+// kept snapshot of every tenant, so every kept snapshot can be replayed to any later time
+func (b *BackupConfig) rotateJournal(tenants []string) error {
+	if err := b.journal.Rotate(); err != nil {
 		return err
 	}
-	return nil
+	var oldest time.Time
+	for _, t := range tenants {
+		path := TenantPath(b.FilePath, t)
+		for n := b.opts.Keep; n >= 0; n-- {
+			at, err := snapshotTime(RotatedPath(path, n))
+			if err != nil || at.IsZero() {
+				continue
+			}
+			if oldest.IsZero() || at.Before(oldest) {
+				oldest = at
+			}
+			break
+		}
+	}
+	if oldest.IsZero() {
+		return nil
+	}
+	return b.journal.Prune(oldest)
 }
 
-// Restore - restore metrics from file and return slice of metrics of type []model.Metrics
+// Restore - restore metrics from the latest valid snapshot: snapshot at FilePath or, if it is missing or corrupt,
+// the newest valid of rotated ones. Error wrapping ErrRestoreFromFile is returned if no snapshot is valid
 func Restore(FilePath string) (*[]model.Metrics, error) {
-	file, err := os.OpenFile(FilePath, os.O_RDONLY, 0666)
-	if err != nil {
-		log.Println("error opening file", err)
-		return nil, err
+	var lastErr error
+	for n := 0; ; n++ {
+		path := RotatedPath(FilePath, n)
+		metrics, err := ReadSnapshot(path)
+		if errors.Is(err, os.ErrNotExist) && n > 0 {
+			break
+		}
+		if err != nil {
+			log.Println("error reading snapshot", path, err)
+			lastErr = err
+			continue
+		}
+		log.Println("restored metrics from file", path)
+		return &metrics, nil
+	}
+	if errors.Is(lastErr, os.ErrNotExist) {
+		return nil, lastErr
+	}
+	return nil, fmt.Errorf("%w: %w", ErrRestoreFromFile, lastErr)
+}
+
+// RestoreAt - restores metrics of tenant as they were at time at from snapshots at path and their journal:
+// the newest valid snapshot of tenant taken not later than at is read, then changes journaled since
+// the snapshot was taken are replayed up to at. Snapshots of older versions have no time and are skipped
+func RestoreAt(path, tenant string, at time.Time) ([]model.Metrics, error) {
+	snapPath := TenantPath(path, tenant)
+	for n := 0; ; n++ {
+		rotated := RotatedPath(snapPath, n)
+		metrics, taken, err := readSnapshot(rotated)
+		if errors.Is(err, os.ErrNotExist) {
+			if n == 0 {
+				continue
+			}
+			return nil, fmt.Errorf("%w: %s", ErrNoRestorePoint, at.Format(time.RFC3339Nano))
+		}
+		if err != nil {
+			log.Println("error reading snapshot", rotated, err)
+			continue
+		}
+		if taken.IsZero() || taken.After(at) {
+			continue
+		}
+
+		changes, err := ReadChanges(path, tenant, taken, at)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrNoRestorePoint, err)
+		}
+		log.Printf("restored metrics from file %s taken at %s, replayed %d changes\n", rotated, taken.Format(time.RFC3339Nano), len(changes))
+		return replay(metrics, changes), nil
 	}
-	defer file.Close()
+}
 
-	var metrics []model.Metrics
-	if err := json.NewDecoder(file).Decode(&metrics); err != nil {
-		log.Println("error by decode metrics from json", err)
-		return &metrics, ErrRestoreFromFile
+// replay - applies changes in order to metrics, metadata of metrics is replaced by the latest journaled one
+func replay(metrics []model.Metrics, changes []service.Change) []model.Metrics {
+	var order []string
+	state := make(map[string]model.Metrics, len(metrics))
+	meta := make(map[string]model.Metadata)
+	set := func(m model.Metrics) {
+		key := m.Mtype + "/" + m.Key()
+		if _, ok := state[key]; !ok {
+			order = append(order, key)
+		}
+		if m.Meta != nil {
+			meta[m.ID] = *m.Meta
+			m.Meta = nil
+		}
+		state[key] = m
+	}
+	for _, m := range metrics {
+		set(m)
+	}
+	for _, c := range changes {
+		switch c.Op {
+		case service.ChangeSet:
+			set(c.Metric)
+		case service.ChangeDelete:
+			delete(state, c.Metric.Mtype+"/"+c.Metric.Key())
+		case service.ChangeMetadata:
+			if c.Metric.Meta != nil {
+				meta[c.Metric.ID] = *c.Metric.Meta
+			}
+		}
 	}
 
-	log.Println("restored metrics from file")
-	return &metrics, nil
+	restored := make([]model.Metrics, 0, len(state))
+	for _, key := range order {
+		m, ok := state[key]
+		if !ok {
+			continue
+		}
+		// key of deleted and set again metric is listed twice
+		delete(state, key)
+		if md, ok := meta[m.ID]; ok {
+			m.Meta = &md
+		}
+		restored = append(restored, m)
+	}
+	return restored
 }
@@ -0,0 +1,119 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/SmoothWay/metrics/internal/logger"
+	"github.com/SmoothWay/metrics/internal/model"
+	"github.com/SmoothWay/metrics/internal/service"
+	"github.com/SmoothWay/metrics/internal/tenant"
+)
+
+// DumpTenant - writes snapshot of metrics of service scoped to tenant into path, nothing is written
+// if there are no metrics. Returns number of written metrics
+func DumpTenant(ctx context.Context, serv *service.Service, path string, opts Options) (int, error) {
+	// time is taken before metrics are read, so changes journaled since then cover whatever snapshot missed
+	at := time.Now()
+	metrics, err := serv.GetAll(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(metrics) == 0 {
+		return 0, nil
+	}
+
+	logger.Log().Info("writing to file", zap.String("path", path), zap.Int("num of metrics", len(metrics)))
+	if err = WriteSnapshot(path, metrics, at, opts); err != nil {
+		logger.Log().Error("Error by writing snapshot", zap.Error(err))
+		return 0, err
+	}
+	return len(metrics), nil
+}
+
+// LoadTenant - saves metrics of the latest valid snapshot at path into service scoped to tenant, along
+// with their metadata. Counters of snapshot are added to stored ones. Returns number of loaded metrics
+func LoadTenant(ctx context.Context, serv *service.Service, path string) (int, error) {
+	metrics, err := Restore(path)
+	if err != nil {
+		return 0, err
+	}
+	return Load(ctx, serv, *metrics)
+}
+
+// LoadTenantAt - saves metrics tenant had at time at, restored by RestoreAt from snapshots at path
+// and their journal, into service scoped to tenant as LoadTenant does. Returns number of loaded metrics
+func LoadTenantAt(ctx context.Context, serv *service.Service, path, tenant string, at time.Time) (int, error) {
+	metrics, err := RestoreAt(path, tenant, at)
+	if err != nil {
+		return 0, err
+	}
+	return Load(ctx, serv, metrics)
+}
+
+// Load - saves restored metrics along with their metadata into service, returns number of saved metrics
+func Load(ctx context.Context, serv *service.Service, metrics []model.Metrics) (int, error) {
+	if err := serv.SaveAll(ctx, metrics); err != nil {
+		return 0, err
+	}
+	for _, m := range metrics {
+		if m.Meta != nil {
+			if err := serv.SetMetadata(ctx, *m.Meta); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(metrics), nil
+}
+
+// SnapshotTenants - returns tenants which have snapshots written next to path by Save, tenant is listed
+// if its latest or previous snapshot exists. Default tenant is listed first
+func SnapshotTenants(path string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	found := make(map[string]bool)
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		if id, ok := snapshotTenant(path, strings.TrimSuffix(e.Name(), RotatedPath("", 1))); ok {
+			found[id] = true
+		}
+	}
+	return sortedTenants(found), nil
+}
+
+// snapshotTenant - returns tenant whose snapshot written next to path by Save has base name file
+func snapshotTenant(path, file string) (string, bool) {
+	base := filepath.Base(path)
+	if file == base {
+		return "", true
+	}
+	ext := filepath.Ext(base)
+	prefix := strings.TrimSuffix(base, ext) + "."
+	if !strings.HasPrefix(file, prefix) || !strings.HasSuffix(file, ext) {
+		return "", false
+	}
+	id := strings.TrimSuffix(strings.TrimPrefix(file, prefix), ext)
+	return id, tenant.ValidID(id)
+}
+
+// sortedTenants - returns found tenants sorted, default tenant is the first
+func sortedTenants(found map[string]bool) []string {
+	tenants := make([]string, 0, len(found))
+	for id := range found {
+		tenants = append(tenants, id)
+	}
+	sort.Strings(tenants)
+	return tenants
+}
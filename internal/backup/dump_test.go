@@ -0,0 +1,120 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/SmoothWay/metrics/internal/logger"
+	"github.com/SmoothWay/metrics/internal/model"
+	"github.com/SmoothWay/metrics/internal/repository/memstorage"
+	"github.com/SmoothWay/metrics/internal/service"
+)
+
+func newTenantService() *service.Service {
+	repo := memstorage.New(&[]model.Metrics{})
+	serv := service.New(repo)
+	serv.SetTenants(func(id string) service.Repository { return repo.Tenant(id) }, repo.Tenants)
+	return serv
+}
+
+func TestSave_LoadTenant(t *testing.T) {
+	logger.Init("error")
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics-db.json")
+
+	delta := int64(5)
+	value := 1.5
+	src := newTenantService()
+	require.NoError(t, src.SaveAll(ctx, []model.Metrics{{ID: "PollCount", Mtype: model.MetricTypeCounter, Delta: &delta}}))
+	require.NoError(t, src.ForTenant("acme").SaveAll(ctx, []model.Metrics{{ID: "Alloc", Mtype: model.MetricTypeGauge, Value: &value}}))
+	require.NoError(t, src.ForTenant("acme").SetMetadata(ctx, model.Metadata{Name: "Alloc", Unit: "bytes"}))
+
+	b, err := New(0, path, src, Options{Compression: CompressionZstd})
+	require.NoError(t, err)
+	n, err := b.Save(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	tenants, err := SnapshotTenants(path)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"", "acme"}, tenants)
+
+	dst := newTenantService()
+	for _, id := range tenants {
+		n, err = LoadTenant(ctx, dst.ForTenant(id), TenantPath(path, id))
+		require.NoError(t, err)
+		assert.Equal(t, 1, n)
+	}
+
+	counter := model.Metrics{ID: "PollCount", Mtype: model.MetricTypeCounter}
+	require.NoError(t, dst.Retrieve(ctx, &counter))
+	assert.Equal(t, delta, *counter.Delta)
+	gauge := model.Metrics{ID: "Alloc", Mtype: model.MetricTypeGauge}
+	assert.ErrorIs(t, dst.Retrieve(ctx, &gauge), model.ErrNotFound, "metrics of tenant must not leak into default tenant")
+
+	require.NoError(t, dst.ForTenant("acme").Retrieve(ctx, &gauge))
+	assert.Equal(t, value, *gauge.Value)
+	meta, err := dst.ForTenant("acme").GetMetadata(ctx, "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, "bytes", meta.Unit)
+}
+
+func TestBackup_SetInterval(t *testing.T) {
+	logger.Init("error")
+	ctx, cancel := context.WithCancel(context.Background())
+	path := filepath.Join(t.TempDir(), "metrics-db.json")
+
+	delta := int64(1)
+	serv := newTenantService()
+	require.NoError(t, serv.SaveAll(ctx, []model.Metrics{{ID: "PollCount", Mtype: model.MetricTypeCounter, Delta: &delta}}))
+	b, err := New(3600, path, serv, Options{})
+	require.NoError(t, err)
+	done := make(chan error)
+	go func() { done <- b.Backup(ctx) }()
+
+	b.SetInterval(1)
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}, 3*time.Second, 50*time.Millisecond, "backup must be made by new interval")
+	cancel()
+	require.NoError(t, <-done)
+}
+
+func TestSnapshotTenants(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+		want  []string
+	}{
+		{name: "no snapshots", want: []string{}},
+		{name: "default tenant only", files: []string{"metrics-db.json"}, want: []string{""}},
+		{
+			name:  "tenants with previous snapshots",
+			files: []string{"metrics-db.json.1", "metrics-db.b.json", "metrics-db.a.json.1"},
+			want:  []string{"", "a", "b"},
+		},
+		{
+			name:  "foreign files are skipped",
+			files: []string{"metrics-db.a.json", "metrics-db.json.tmp123", "metrics-db.bad id.json", "other.json"},
+			want:  []string{"a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, f := range tt.files {
+				require.NoError(t, os.WriteFile(filepath.Join(dir, f), nil, 0o644))
+			}
+			got, err := SnapshotTenants(filepath.Join(dir, "metrics-db.json"))
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SmoothWay/metrics/internal/service"
+)
+
+// segmentLayout layout of start time in name of journal segment, names of segments sort by time
+const segmentLayout = "20060102T150405.000000000Z"
+
+var (
+	ErrJournalClosed = errors.New("journal is closed")
+	ErrJournalGap    = errors.New("journal starts after requested time")
+)
+
+// Journal change log of incremental backups. Changes recorded by service between full snapshots are appended
+// as JSON lines to segments path.changes.<start time> next to snapshots at path, new segment is started by
+// every backup, so segments older than kept snapshots can be deleted. Changes are written without fsync,
+// crash of process loses nothing, crash of machine may lose changes of the last moments
+type Journal struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+	now  func() time.Time
+}
+
+// OpenJournal - opens journal of snapshots at path, new segment is started
+func OpenJournal(path string) (*Journal, error) {
+	j := &Journal{path: path, now: time.Now}
+	if err := j.startSegment(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// RecordChange - appends change to current segment
+func (j *Journal) RecordChange(change service.Change) error {
+	line, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file == nil {
+		return ErrJournalClosed
+	}
+	_, err = j.file.Write(append(line, '\n'))
+	return err
+}
+
+// Rotate - syncs and closes current segment and starts a new one
+func (j *Journal) Rotate() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file == nil {
+		return ErrJournalClosed
+	}
+	prev := j.file
+	if err := j.startSegment(); err != nil {
+		return err
+	}
+	return syncClose(prev)
+}
+
+// Prune - deletes segments which have only changes recorded before time before, current segment is kept
+func (j *Journal) Prune(before time.Time) error {
+	segments, err := journalSegments(j.path)
+	if err != nil {
+		return err
+	}
+	// segment ends where the next one starts
+	for i := 0; i+1 < len(segments); i++ {
+		if !segments[i+1].start.Before(before) {
+			break
+		}
+		if err = os.Remove(segments[i].path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("prune journal: %w", err)
+		}
+	}
+	return nil
+}
+
+// Close - syncs and closes current segment, changes recorded after Close are rejected
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file == nil {
+		return nil
+	}
+	f := j.file
+	j.file = nil
+	return syncClose(f)
+}
+
+// startSegment - creates segment starting now, lock must be held
+func (j *Journal) startSegment() error {
+	name := journalPrefix(j.path) + j.now().UTC().Format(segmentLayout)
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("open journal: %w", err)
+	}
+	j.file = f
+	return nil
+}
+
+// syncClose - syncs and closes segment
+func syncClose(f *os.File) error {
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("sync journal: %w", err)
+	}
+	return f.Close()
+}
+
+// journalPrefix - returns prefix of names of journal segments of snapshots at path
+func journalPrefix(path string) string {
+	return path + ".changes."
+}
+
+// segment journal segment file
+type segment struct {
+	path  string
+	start time.Time
+}
+
+// journalSegments - returns segments of journal of snapshots at path, the oldest first
+func journalSegments(path string) ([]segment, error) {
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	prefix := filepath.Base(journalPrefix(path))
+	var segments []segment
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasPrefix(e.Name(), prefix) {
+			continue
+		}
+		start, err := time.Parse(segmentLayout, strings.TrimPrefix(e.Name(), prefix))
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment{path: filepath.Join(filepath.Dir(path), e.Name()), start: start})
+	}
+	sort.Slice(segments, func(i, k int) bool { return segments[i].start.Before(segments[k].start) })
+	return segments, nil
+}
+
+// ReadChanges - returns changes of tenant journaled next to snapshots at path and recorded in [from, to],
+// in order they were recorded. Torn last line of segment is skipped. ErrJournalGap is returned if journal
+// was started or pruned after from, so changes since then may be missing
+func ReadChanges(path, tenant string, from, to time.Time) ([]service.Change, error) {
+	segments, err := journalSegments(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) == 0 || segments[0].start.After(from) {
+		return nil, fmt.Errorf("%w: %s", ErrJournalGap, from.Format(time.RFC3339Nano))
+	}
+	var changes []service.Change
+	for i, seg := range segments {
+		// changes of segment are recorded before the next segment starts
+		if i+1 < len(segments) && !segments[i+1].start.After(from) {
+			continue
+		}
+		err = readSegment(seg.path, func(c service.Change) {
+			if c.Tenant == tenant && !c.Time.Before(from) && !c.Time.After(to) {
+				changes = append(changes, c)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return changes, nil
+}
+
+// readSegment - calls fn with every change of segment
+func readSegment(path string, fn func(service.Change)) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	lines := bytes.Split(data, []byte{'\n'})
+	// the last line is empty unless it is torn by crash in the middle of write
+	for _, line := range lines[:len(lines)-1] {
+		var c service.Change
+		if err = json.Unmarshal(line, &c); err != nil {
+			return fmt.Errorf("%w: journal %s: %w", ErrCorruptSnapshot, path, err)
+		}
+		fn(c)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/SmoothWay/metrics/internal/logger"
+	"github.com/SmoothWay/metrics/internal/model"
+	"github.com/SmoothWay/metrics/internal/service"
+)
+
+func TestRestoreAt(t *testing.T) {
+	logger.Init("error")
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics-db.json")
+
+	serv := newTenantService()
+	journal, err := OpenJournal(path)
+	require.NoError(t, err)
+	defer journal.Close()
+	serv.SetChangeRecorder(journal)
+	b, err := New(0, path, serv, Options{Keep: 1})
+	require.NoError(t, err)
+	b.SetJournal(journal)
+
+	// mark returns time between writes, so every write is recorded strictly before or after it
+	mark := func() time.Time {
+		time.Sleep(time.Millisecond)
+		defer time.Sleep(time.Millisecond)
+		return time.Now()
+	}
+	save := func(m model.Metrics) {
+		require.NoError(t, serv.Save(ctx, m))
+	}
+	counter := func(v int64) model.Metrics {
+		return model.Metrics{ID: "PollCount", Mtype: model.MetricTypeCounter, Delta: &v}
+	}
+	gauge := func(v float64) model.Metrics {
+		return model.Metrics{ID: "Alloc", Mtype: model.MetricTypeGauge, Value: &v}
+	}
+
+	beforeSnapshots := mark()
+	save(counter(1))
+	save(gauge(1))
+	_, err = b.Save(ctx)
+	require.NoError(t, err)
+	afterFirst := mark()
+	save(counter(2))
+	require.NoError(t, serv.SetMetadata(ctx, model.Metadata{Name: "Alloc", Unit: "bytes"}))
+	beforeGauge := mark()
+	save(gauge(5))
+	require.NoError(t, serv.ForTenant("acme").Save(ctx, counter(7)))
+	_, err = b.Save(ctx)
+	require.NoError(t, err)
+	afterSecond := mark()
+	save(counter(10))
+	require.NoError(t, serv.Retype(ctx, "Alloc", model.MetricTypeHistogram))
+	latest := mark()
+
+	type state struct {
+		counter int64
+		gauge   float64
+		unit    string
+	}
+	tests := []struct {
+		name    string
+		at      time.Time
+		want    state
+		wantErr error
+	}{
+		{name: "before any snapshot", at: beforeSnapshots, wantErr: ErrNoRestorePoint},
+		{name: "first snapshot", at: afterFirst, want: state{counter: 1, gauge: 1}},
+		{name: "first snapshot with changes", at: beforeGauge, want: state{counter: 3, gauge: 1, unit: "bytes"}},
+		{name: "second snapshot", at: afterSecond, want: state{counter: 3, gauge: 5, unit: "bytes"}},
+		{name: "second snapshot with changes", at: latest, want: state{counter: 13}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metrics, err := RestoreAt(path, "", tt.at)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+
+			var got state
+			for _, m := range metrics {
+				switch m.Mtype {
+				case model.MetricTypeCounter:
+					got.counter = *m.Delta
+				case model.MetricTypeGauge:
+					got.gauge = *m.Value
+					if m.Meta != nil {
+						got.unit = m.Meta.Unit
+					}
+				}
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	metrics, err := RestoreAt(path, "acme", latest)
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, int64(7), *metrics[0].Delta, "changes of other tenants must not be replayed")
+
+	// the third backup rotates out the first snapshot, so segment started before it is not needed anymore,
+	// segment which was current when the second snapshot was taken is kept
+	_, err = b.Save(ctx)
+	require.NoError(t, err)
+	segments, err := journalSegments(path)
+	require.NoError(t, err)
+	assert.Len(t, segments, 3)
+	_, err = RestoreAt(path, "", beforeGauge)
+	assert.ErrorIs(t, err, ErrNoRestorePoint)
+}
+
+func TestReadChanges_TornWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics-db.json")
+	journal, err := OpenJournal(path)
+	require.NoError(t, err)
+	from := time.Now()
+	delta := int64(1)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, journal.RecordChange(service.Change{
+			Time:   time.Now(),
+			Op:     service.ChangeSet,
+			Metric: model.Metrics{ID: "PollCount", Mtype: model.MetricTypeCounter, Delta: &delta},
+		}))
+	}
+	require.NoError(t, journal.Close())
+	assert.ErrorIs(t, journal.RecordChange(service.Change{}), ErrJournalClosed)
+
+	segments, err := journalSegments(path)
+	require.NoError(t, err)
+	require.Len(t, segments, 1)
+	f, err := os.OpenFile(segments[0].path, os.O_APPEND|os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"time":"2026-10`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	changes, err := ReadChanges(path, "", from, time.Now())
+	require.NoError(t, err)
+	assert.Len(t, changes, 3)
+
+	_, err = ReadChanges(path, "", from.Add(-time.Hour), time.Now())
+	assert.ErrorIs(t, err, ErrJournalGap)
+}
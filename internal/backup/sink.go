@@ -0,0 +1,295 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/SmoothWay/metrics/internal/logger"
+)
+
+const defaultSinkRetries = 3
+
+// remoteLayout layout of time suffix of remote snapshot name, names of snapshots of one file sort by time
+const remoteLayout = "20060102T150405.000Z"
+
+// BackupSink destination snapshots are uploaded to besides local path. Names are flat, sink may store
+// them under its own prefix
+type BackupSink interface {
+	// Put stores data under name, object with same name is replaced
+	Put(ctx context.Context, name string, data []byte) error
+	// Get returns data stored under name, error wraps os.ErrNotExist if there is no such object
+	Get(ctx context.Context, name string) ([]byte, error)
+	// List returns names of stored objects starting with prefix
+	List(ctx context.Context, prefix string) ([]string, error)
+	// Delete removes object stored under name, missing object is not an error
+	Delete(ctx context.Context, name string) error
+}
+
+// NewSink - creates sink by its URL: file:///dir or plain path for local directory, s3://bucket/prefix
+// for S3-compatible storage configured by s3. Empty URL returns nil sink
+func NewSink(rawURL string, s3 S3Options) (BackupSink, error) {
+	if rawURL == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backup sink %q: %w", rawURL, err)
+	}
+	switch u.Scheme {
+	case "":
+		return NewLocalSink(rawURL)
+	case "file":
+		return NewLocalSink(u.Path)
+	case "s3":
+		s3.Bucket = u.Host
+		s3.Prefix = strings.TrimPrefix(u.Path, "/")
+		return NewS3Sink(s3)
+	default:
+		return nil, fmt.Errorf("unknown backup sink scheme %q", u.Scheme)
+	}
+}
+
+// LocalSink keeps uploaded snapshots in local directory, e.g. mounted network volume
+type LocalSink struct {
+	Dir string
+}
+
+// NewLocalSink - creates sink storing snapshots in dir, dir is created if it doesn't exist
+func NewLocalSink(dir string) (*LocalSink, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create backup sink dir: %w", err)
+	}
+	return &LocalSink{Dir: dir}, nil
+}
+
+// Put - writes data into file named name atomically
+func (s *LocalSink) Put(_ context.Context, name string, data []byte) error {
+	path := filepath.Join(s.Dir, name)
+	tmp, err := writeTemp(path, data)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	if err = os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("rename snapshot: %w", err)
+	}
+	return syncDir(s.Dir)
+}
+
+// Get - reads file named name
+func (s *LocalSink) Get(_ context.Context, name string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(s.Dir, name))
+}
+
+// List - returns names of regular files in directory starting with prefix
+func (s *LocalSink) List(_ context.Context, prefix string) ([]string, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if e.Type().IsRegular() && strings.HasPrefix(e.Name(), prefix) {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+// Delete - removes file named name
+func (s *LocalSink) Delete(_ context.Context, name string) error {
+	err := os.Remove(filepath.Join(s.Dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// SinkOptions retry and retention of uploads. Keep is number of the newest remote snapshots of every file kept,
+// remote snapshots older than MaxAge are deleted. The newest remote snapshot is never deleted, zero Keep
+// or MaxAge disables the policy
+type SinkOptions struct {
+	Retries int
+	Keep    int
+	MaxAge  time.Duration
+}
+
+// Uploader uploads local snapshots to sink, every upload is kept as separate remote snapshot named
+// by base name of local snapshot and upload time
+type Uploader struct {
+	Sink BackupSink
+	opts SinkOptions
+	// Backoff returns delay before retry attempt, attempts are counted from 1
+	Backoff func(attempt int) time.Duration
+	now     func() time.Time
+}
+
+// NewUploader - creates uploader to sink, failed calls of sink are retried with growing delay
+func NewUploader(sink BackupSink, opts SinkOptions) *Uploader {
+	if opts.Retries <= 0 {
+		opts.Retries = defaultSinkRetries
+	}
+	return &Uploader{
+		Sink: sink,
+		opts: opts,
+		Backoff: func(attempt int) time.Duration {
+			return time.Duration(attempt*2-1) * time.Second
+		},
+		now: time.Now,
+	}
+}
+
+// remoteSnapshot snapshot stored in sink
+type remoteSnapshot struct {
+	name string
+	at   time.Time
+}
+
+// Upload - uploads snapshot at path as new remote snapshot, then deletes remote snapshots of path
+// which are out of retention
+func (u *Uploader) Upload(ctx context.Context, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	base := filepath.Base(path)
+	name := base + "." + u.now().UTC().Format(remoteLayout)
+	err = u.retry(ctx, "put "+name, func() error {
+		return u.Sink.Put(ctx, name, data)
+	})
+	if err != nil {
+		return err
+	}
+	logger.Log().Info("uploaded snapshot", zap.String("name", name), zap.Int("bytes", len(data)))
+	return u.applyRetention(ctx, base)
+}
+
+// applyRetention - deletes remote snapshots of base which are out of retention
+func (u *Uploader) applyRetention(ctx context.Context, base string) error {
+	if u.opts.Keep <= 0 && u.opts.MaxAge <= 0 {
+		return nil
+	}
+	snapshots, err := u.snapshots(ctx, base)
+	if err != nil {
+		return err
+	}
+	now := u.now()
+	for i, s := range snapshots {
+		if i == 0 {
+			continue
+		}
+		if (u.opts.Keep > 0 && i >= u.opts.Keep) || (u.opts.MaxAge > 0 && now.Sub(s.at) > u.opts.MaxAge) {
+			err = u.retry(ctx, "delete "+s.name, func() error {
+				return u.Sink.Delete(ctx, s.name)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Fetch - downloads the newest remote snapshot of file with base name base, error wraps os.ErrNotExist
+// if there are no remote snapshots of it
+func (u *Uploader) Fetch(ctx context.Context, base string) ([]byte, error) {
+	snapshots, err := u.snapshots(ctx, base)
+	if err != nil {
+		return nil, err
+	}
+	if len(snapshots) == 0 {
+		return nil, fmt.Errorf("remote snapshot of %s: %w", base, os.ErrNotExist)
+	}
+	var data []byte
+	err = u.retry(ctx, "get "+snapshots[0].name, func() error {
+		data, err = u.Sink.Get(ctx, snapshots[0].name)
+		return err
+	})
+	return data, err
+}
+
+// Tenants - returns tenants which have remote snapshots of files written next to path by Save
+func (u *Uploader) Tenants(ctx context.Context, path string) ([]string, error) {
+	base := filepath.Base(path)
+	prefix := strings.TrimSuffix(base, filepath.Ext(base)) + "."
+	var names []string
+	err := u.retry(ctx, "list "+prefix, func() (err error) {
+		names, err = u.Sink.List(ctx, prefix)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[string]bool)
+	for _, name := range names {
+		if file, _, ok := splitRemoteName(name); ok {
+			if id, ok := snapshotTenant(path, file); ok {
+				found[id] = true
+			}
+		}
+	}
+	return sortedTenants(found), nil
+}
+
+// snapshots - returns remote snapshots of file with base name base, the newest first
+func (u *Uploader) snapshots(ctx context.Context, base string) ([]remoteSnapshot, error) {
+	var names []string
+	err := u.retry(ctx, "list "+base, func() (err error) {
+		names, err = u.Sink.List(ctx, base+".")
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []remoteSnapshot
+	for _, name := range names {
+		if file, at, ok := splitRemoteName(name); ok && file == base {
+			snapshots = append(snapshots, remoteSnapshot{name: name, at: at})
+		}
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].at.After(snapshots[j].at) })
+	return snapshots, nil
+}
+
+// retry - calls fn until it succeeds or retries are exhausted
+func (u *Uploader) retry(ctx context.Context, op string, fn func() error) error {
+	var err error
+	for attempt := 0; attempt <= u.opts.Retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(u.Backoff(attempt)):
+			}
+		}
+
+		err = fn()
+		if err == nil || errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		logger.Log().Warn("backup sink attempt failed", zap.String("op", op), zap.Int("attempt", attempt+1), zap.Error(err))
+	}
+	return fmt.Errorf("%s: %w", op, err)
+}
+
+// splitRemoteName - splits name of remote snapshot into base name of local file and upload time
+func splitRemoteName(name string) (string, time.Time, bool) {
+	i := len(name) - len(remoteLayout) - 1
+	if i <= 0 || name[i] != '.' {
+		return "", time.Time{}, false
+	}
+	at, err := time.Parse(remoteLayout, name[i+1:])
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return name[:i], at, true
+}
@@ -0,0 +1,322 @@
+package backup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/SmoothWay/metrics/internal/model"
+)
+
+// Compressions of snapshot payload
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// FormatVersion version of snapshot format written by WriteSnapshot. Version 1 has no time of snapshot,
+// files without header are read as plain JSON written by older versions
+const FormatVersion = 2
+
+// DefaultKeep number of previous snapshots kept besides the latest one by default
+const DefaultKeep = 3
+
+var (
+	ErrInvalidCompression = errors.New("invalid backup compression")
+	ErrCorruptSnapshot    = errors.New("snapshot is corrupt")
+	ErrUnsupportedVersion = errors.New("unsupported snapshot version")
+)
+
+// magic first bytes of snapshot file
+var magic = [4]byte{'M', 'S', 'N', 'P'}
+
+// header precedes payload of snapshot, checksum is SHA-256 of payload as it is stored.
+// Time is unix nanoseconds of moment metrics were read at
+type header struct {
+	Magic       [4]byte
+	Version     uint16
+	Compression uint8
+	_           uint8
+	Length      uint64
+	Time        int64
+	Checksum    [sha256.Size]byte
+}
+
+// headerV1 header of version 1 snapshots
+type headerV1 struct {
+	Magic       [4]byte
+	Version     uint16
+	Compression uint8
+	_           uint8
+	Length      uint64
+	Checksum    [sha256.Size]byte
+}
+
+var compressionCodes = map[string]uint8{
+	CompressionNone: 0,
+	CompressionGzip: 1,
+	CompressionZstd: 2,
+}
+
+// Options of snapshots. Keep is number of previous snapshots kept besides the latest one,
+// they are rotated into path.1, path.2 and so on, path.1 being the newest
+type Options struct {
+	Compression string
+	Keep        int
+}
+
+// validate - checks options, empty compression means no compression
+func (o *Options) validate() error {
+	if o.Compression == "" {
+		o.Compression = CompressionNone
+	}
+	if _, ok := compressionCodes[o.Compression]; !ok {
+		return fmt.Errorf("%w: %q", ErrInvalidCompression, o.Compression)
+	}
+	if o.Keep < 0 {
+		o.Keep = 0
+	}
+	return nil
+}
+
+// RotatedPath - returns path of n-th previous snapshot, n = 0 is the latest snapshot
+func RotatedPath(path string, n int) string {
+	if n == 0 {
+		return path
+	}
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+// WriteSnapshot - writes metrics read at time at into snapshot at path. Snapshot is written into temporary file
+// which is synced and renamed, so crash leaves either old or new snapshot. Previous snapshots are rotated
+// according to opts.Keep
+func WriteSnapshot(path string, metrics []model.Metrics, at time.Time, opts Options) error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	data, err := encodeSnapshot(metrics, at, opts.Compression)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := writeTemp(path, data)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	for n := opts.Keep; n > 0; n-- {
+		err = os.Rename(RotatedPath(path, n-1), RotatedPath(path, n))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("rotate snapshot: %w", err)
+		}
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("rename snapshot: %w", err)
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// writeTemp - writes data into synced temporary file next to path and returns its name,
+// caller renames temporary file into place or removes it
+func writeTemp(path string, data []byte) (string, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return "", fmt.Errorf("create snapshot: %w", err)
+	}
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("write snapshot: %w", err)
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("sync snapshot: %w", err)
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("close snapshot: %w", err)
+	}
+	return tmp.Name(), nil
+}
+
+// encodeSnapshot - returns header and compressed JSON of metrics
+func encodeSnapshot(metrics []model.Metrics, at time.Time, compression string) ([]byte, error) {
+	var payload bytes.Buffer
+	var w io.WriteCloser
+	switch compression {
+	case CompressionGzip:
+		w = gzip.NewWriter(&payload)
+	case CompressionZstd:
+		zw, err := zstd.NewWriter(&payload)
+		if err != nil {
+			return nil, err
+		}
+		w = zw
+	default:
+		w = nopCloser{&payload}
+	}
+	if err := json.NewEncoder(w).Encode(metrics); err != nil {
+		return nil, fmt.Errorf("encode snapshot: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("compress snapshot: %w", err)
+	}
+
+	h := header{
+		Magic:       magic,
+		Version:     FormatVersion,
+		Compression: compressionCodes[compression],
+		Length:      uint64(payload.Len()),
+		Time:        at.UnixNano(),
+		Checksum:    sha256.Sum256(payload.Bytes()),
+	}
+	var buf bytes.Buffer
+	buf.Grow(binary.Size(h) + payload.Len())
+	if err := binary.Write(&buf, binary.BigEndian, h); err != nil {
+		return nil, err
+	}
+	buf.Write(payload.Bytes())
+	return buf.Bytes(), nil
+}
+
+// ReadSnapshot - reads metrics from snapshot at path, checksum of payload is verified
+func ReadSnapshot(path string) ([]model.Metrics, error) {
+	metrics, _, err := readSnapshot(path)
+	return metrics, err
+}
+
+// readSnapshot - reads metrics and time of snapshot at path, time is zero for snapshots of older versions
+func readSnapshot(path string) ([]model.Metrics, time.Time, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var metrics []model.Metrics
+	if !bytes.HasPrefix(data, magic[:]) {
+		// snapshot of older version is plain JSON
+		if err = json.Unmarshal(data, &metrics); err != nil {
+			return nil, time.Time{}, fmt.Errorf("%w: %w", ErrCorruptSnapshot, err)
+		}
+		return metrics, time.Time{}, nil
+	}
+
+	h, size, err := decodeHeader(data)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	at := time.Time{}
+	if h.Time != 0 {
+		at = time.Unix(0, h.Time)
+	}
+	payload := data[size:]
+	if uint64(len(payload)) != h.Length {
+		return nil, time.Time{}, fmt.Errorf("%w: payload is %d bytes, header says %d", ErrCorruptSnapshot, len(payload), h.Length)
+	}
+	if sha256.Sum256(payload) != h.Checksum {
+		return nil, time.Time{}, fmt.Errorf("%w: checksum mismatch", ErrCorruptSnapshot)
+	}
+
+	var r io.Reader = bytes.NewReader(payload)
+	switch h.Compression {
+	case compressionCodes[CompressionNone]:
+	case compressionCodes[CompressionGzip]:
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("%w: %w", ErrCorruptSnapshot, err)
+		}
+		defer gr.Close()
+		r = gr
+	case compressionCodes[CompressionZstd]:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("%w: %w", ErrCorruptSnapshot, err)
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return nil, time.Time{}, fmt.Errorf("%w: unknown compression %d", ErrCorruptSnapshot, h.Compression)
+	}
+	if err = json.NewDecoder(r).Decode(&metrics); err != nil {
+		return nil, time.Time{}, fmt.Errorf("%w: %w", ErrCorruptSnapshot, err)
+	}
+	return metrics, at, nil
+}
+
+// decodeHeader - decodes header of any supported version from the beginning of data, returns header
+// and its size. Time is zero in header of version 1
+func decodeHeader(data []byte) (header, int, error) {
+	var h header
+	if len(data) < len(magic)+2 {
+		return h, 0, fmt.Errorf("%w: truncated header", ErrCorruptSnapshot)
+	}
+	switch version := binary.BigEndian.Uint16(data[len(magic):]); version {
+	case 1:
+		var v1 headerV1
+		if err := binary.Read(bytes.NewReader(data), binary.BigEndian, &v1); err != nil {
+			return h, 0, fmt.Errorf("%w: %w", ErrCorruptSnapshot, err)
+		}
+		h = header{Magic: v1.Magic, Version: v1.Version, Compression: v1.Compression, Length: v1.Length, Checksum: v1.Checksum}
+		return h, binary.Size(v1), nil
+	case FormatVersion:
+		if err := binary.Read(bytes.NewReader(data), binary.BigEndian, &h); err != nil {
+			return h, 0, fmt.Errorf("%w: %w", ErrCorruptSnapshot, err)
+		}
+		return h, binary.Size(h), nil
+	default:
+		return h, 0, fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+}
+
+// snapshotTime - returns time of snapshot at path reading only its header, checksum is not verified
+func snapshotTime(path string) (time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+	data := make([]byte, binary.Size(header{}))
+	n, err := io.ReadFull(f, data)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return time.Time{}, err
+	}
+	if !bytes.HasPrefix(data[:n], magic[:]) {
+		return time.Time{}, nil
+	}
+	h, _, err := decodeHeader(data[:n])
+	if err != nil || h.Time == 0 {
+		return time.Time{}, err
+	}
+	return time.Unix(0, h.Time), nil
+}
+
+// syncDir - syncs directory, so rename of snapshot survives crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err = d.Sync(); err != nil {
+		return fmt.Errorf("sync snapshot dir: %w", err)
+	}
+	return nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
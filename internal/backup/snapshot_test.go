@@ -0,0 +1,145 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/SmoothWay/metrics/internal/model"
+)
+
+func TestSnapshot_RoundTrip(t *testing.T) {
+	delta := int64(5)
+	value := 1.5
+	h := model.NewHistogram([]float64{1, 2})
+	h.Observe(1.5)
+	metrics := []model.Metrics{
+		{ID: "PollCount", Mtype: model.MetricTypeCounter, Delta: &delta},
+		{ID: "Alloc", Mtype: model.MetricTypeGauge, Value: &value},
+		{ID: "latency", Mtype: model.MetricTypeHistogram, Histogram: &h},
+	}
+
+	tests := []struct {
+		name        string
+		compression string
+		wantErr     error
+	}{
+		{name: "default compression", compression: ""},
+		{name: "no compression", compression: CompressionNone},
+		{name: "gzip", compression: CompressionGzip},
+		{name: "zstd", compression: CompressionZstd},
+		{name: "unknown compression", compression: "lz4", wantErr: ErrInvalidCompression},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "metrics-db.json")
+			err := WriteSnapshot(path, metrics, time.Now(), Options{Compression: tt.compression})
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+
+			got, err := ReadSnapshot(path)
+			require.NoError(t, err)
+			assert.Equal(t, metrics, got)
+		})
+	}
+}
+
+func TestSnapshot_Version1(t *testing.T) {
+	payload := []byte(`[{"id":"PollCount","type":"counter","delta":5}]`)
+	h := headerV1{Magic: magic, Version: 1, Length: uint64(len(payload)), Checksum: sha256.Sum256(payload)}
+	var buf bytes.Buffer
+	require.NoError(t, binary.Write(&buf, binary.BigEndian, h))
+	buf.Write(payload)
+	path := filepath.Join(t.TempDir(), "metrics-db.json")
+	require.NoError(t, os.WriteFile(path, buf.Bytes(), 0o644))
+
+	metrics, at, err := readSnapshot(path)
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, int64(5), *metrics[0].Delta)
+	assert.True(t, at.IsZero(), "snapshot of version 1 has no time")
+
+	taken := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, WriteSnapshot(path, metrics, taken, Options{}))
+	at, err = snapshotTime(path)
+	require.NoError(t, err)
+	assert.True(t, taken.Equal(at))
+}
+
+func TestSnapshot_Corrupt(t *testing.T) {
+	delta := int64(5)
+	metrics := []model.Metrics{{ID: "PollCount", Mtype: model.MetricTypeCounter, Delta: &delta}}
+
+	tests := []struct {
+		name    string
+		corrupt func(data []byte) []byte
+		wantErr error
+	}{
+		{name: "flipped byte", corrupt: func(data []byte) []byte {
+			data[len(data)-2] ^= 0xff
+			return data
+		}, wantErr: ErrCorruptSnapshot},
+		{name: "torn write", corrupt: func(data []byte) []byte {
+			return data[:len(data)-3]
+		}, wantErr: ErrCorruptSnapshot},
+		{name: "newer version", corrupt: func(data []byte) []byte {
+			data[5] = FormatVersion + 1
+			return data
+		}, wantErr: ErrUnsupportedVersion},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "metrics-db.json")
+			require.NoError(t, WriteSnapshot(path, metrics, time.Now(), Options{Compression: CompressionGzip}))
+			data, err := os.ReadFile(path)
+			require.NoError(t, err)
+			require.NoError(t, os.WriteFile(path, tt.corrupt(data), 0o644))
+
+			_, err = ReadSnapshot(path)
+			assert.ErrorIs(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestRestore_Fallback(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics-db.json")
+	for i := int64(1); i <= 4; i++ {
+		delta := i
+		require.NoError(t, WriteSnapshot(path, []model.Metrics{{ID: "PollCount", Mtype: model.MetricTypeCounter, Delta: &delta}}, time.Now(), Options{Keep: 2}))
+	}
+	_, err := os.Stat(RotatedPath(path, 3))
+	assert.ErrorIs(t, err, os.ErrNotExist, "only Keep previous snapshots must be kept")
+
+	restored := func() int64 {
+		metrics, err := Restore(path)
+		require.NoError(t, err)
+		require.Len(t, *metrics, 1)
+		return *(*metrics)[0].Delta
+	}
+	assert.Equal(t, int64(4), restored())
+
+	require.NoError(t, os.WriteFile(path, []byte("garbage"), 0o644))
+	assert.Equal(t, int64(3), restored(), "corrupt latest snapshot must fall back to previous one")
+
+	require.NoError(t, os.Remove(path))
+	require.NoError(t, os.WriteFile(RotatedPath(path, 1), []byte(`[{"id":"PollCount","type":"counter","delta":7}]`), 0o644))
+	assert.Equal(t, int64(7), restored(), "snapshot of older version is plain JSON")
+
+	require.NoError(t, os.WriteFile(RotatedPath(path, 1), nil, 0o644))
+	require.NoError(t, os.WriteFile(RotatedPath(path, 2), nil, 0o644))
+	_, err = Restore(path)
+	assert.ErrorIs(t, err, ErrRestoreFromFile)
+
+	_, err = Restore(filepath.Join(t.TempDir(), "missing.json"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -2,250 +2,351 @@
 package config
 
 import (
-	"encoding/json"
 	"flag"
-	"log"
+	"fmt"
+	"io"
 	"os"
-
-	"github.com/caarlos0/env/v6"
-	_ "github.com/jackc/pgx/v5/stdlib"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/SmoothWay/metrics/internal/backup"
 	"github.com/SmoothWay/metrics/internal/handler"
+	"github.com/SmoothWay/metrics/internal/model"
+	"github.com/SmoothWay/metrics/internal/repository/postgres"
+	"github.com/SmoothWay/metrics/internal/repository/wal"
+	"github.com/SmoothWay/metrics/internal/service"
 )
 
+// AgentConfig config of agent, fields are set by config file keys of json tags, environment variables
+// of env tags and flags, fields tagged secret are masked when config is printed
 type AgentConfig struct {
 	Host           string `env:"ADDRESS" json:"address"`
 	LogLevel       string `env:"LOG_LEVEL" json:"log_level"`
-	Key            string `env:"KEY" json:"key"`
+	Key            string `env:"KEY" json:"key" secret:"true"`
 	CryptKeyPath   string `env:"CRYPTO_KEY" json:"crypto_key"`
-	Config         string `env:"CONFIG"`
+	Config         string `env:"CONFIG" json:"-"`
+	PrintConfig    bool   `json:"-"`
 	AgentType      string `env:"AGENT_TYPE" json:"agent_type"`
+	Labels         string `env:"LABELS" json:"labels"`
+	APIToken       string `env:"API_TOKEN" json:"api_token" secret:"true"`
 	RateLimit      int    `env:"RATE_LIMIT" json:"rate_limit"`
 	PollInterval   int    `env:"POLL_INTERVAL" json:"poll_interval"`
 	ReportInterval int    `env:"REPORT_INTERVAL" json:"report_interval"`
 }
 
+// ServerConfig config of server, fields are set as fields of AgentConfig
 type ServerConfig struct {
-	B              *backup.BackupConfig
-	H              *handler.Handler
-	Host           string `env:"ADDRESS" json:"address"`
-	DSN            string `env:"DATABASE_DSN" json:"database_dsn"`
-	LogLevel       string `env:"LOG_LEVEL" json:"log_level"`
-	StoragePath    string `env:"STORAGE_PATH" json:"store_file"`
-	Key            string `env:"KEY" json:"key"`
-	CryptKeyPath   string `env:"CRYPTO_KEY" json:"crypto_key"`
-	Config         string `env:"CONFIG"`
-	TrustedSubnet  string `env:"TRUSTED_SUBNET" json:"trusted_subnet"`
-	ServerType     string `env:"SERVER_TYPE" json:"server_type"`
-	StoreInvterval int64  `env:"STORE_INTERVAL" json:"store_interval"`
-	Restore        bool   `env:"RESTORE" json:"restore"`
+	B              *backup.BackupConfig `json:"-"`
+	H              *handler.Handler     `json:"-"`
+	Host           string               `env:"ADDRESS" json:"address"`
+	DSN            string               `env:"DATABASE_DSN" json:"database_dsn" secret:"dsn"`
+	LogLevel       string               `env:"LOG_LEVEL" json:"log_level"`
+	StoragePath    string               `env:"STORAGE_PATH" json:"store_file"`
+	Key            string               `env:"KEY" json:"key" secret:"true"`
+	CryptKeyPath   string               `env:"CRYPTO_KEY" json:"crypto_key"`
+	Config         string               `env:"CONFIG" json:"-"`
+	PrintConfig    bool                 `json:"-"`
+	TrustedSubnet  string               `env:"TRUSTED_SUBNET" json:"trusted_subnet"`
+	ServerType     string               `env:"SERVER_TYPE" json:"server_type"`
+	StoreInvterval int64                `env:"STORE_INTERVAL" json:"store_interval"`
+	Restore        bool                 `env:"RESTORE" json:"restore"`
+
+	BackupCompression string `env:"BACKUP_COMPRESSION" json:"backup_compression"`
+	BackupKeep        int    `env:"BACKUP_KEEP" json:"backup_keep"`
+	BackupJournal     bool   `env:"BACKUP_JOURNAL" json:"backup_journal"`
+
+	BackupSink        string        `env:"BACKUP_SINK" json:"backup_sink"`
+	BackupSinkKeep    int           `env:"BACKUP_SINK_KEEP" json:"backup_sink_keep"`
+	BackupSinkMaxAge  time.Duration `env:"BACKUP_SINK_MAX_AGE" json:"backup_sink_max_age"`
+	BackupSinkRetries int           `env:"BACKUP_SINK_RETRIES" json:"backup_sink_retries"`
+	S3Endpoint        string        `env:"BACKUP_S3_ENDPOINT" json:"backup_s3_endpoint"`
+	S3Region          string        `env:"BACKUP_S3_REGION" json:"backup_s3_region"`
+	S3AccessKey       string        `env:"BACKUP_S3_ACCESS_KEY" json:"backup_s3_access_key" secret:"true"`
+	S3SecretKey       string        `env:"BACKUP_S3_SECRET_KEY" json:"backup_s3_secret_key" secret:"true"`
+
+	CompactInterval time.Duration `env:"COMPACT_INTERVAL" json:"compact_interval"`
+	RetentionRaw    time.Duration `env:"RETENTION_RAW" json:"retention_raw"`
+	RetentionMinute time.Duration `env:"RETENTION_1M" json:"retention_1m"`
+	RetentionHour   time.Duration `env:"RETENTION_1H" json:"retention_1h"`
+
+	RulesPath     string        `env:"RULES_FILE" json:"rules_file"`
+	RulesInterval time.Duration `env:"RULES_INTERVAL" json:"rules_interval"`
+
+	AdminToken string `env:"ADMIN_TOKEN" json:"admin_token" secret:"true"`
+	TokensPath string `env:"TOKENS_FILE" json:"tokens_file"`
+
+	RateLimitRPS   float64 `env:"RATE_LIMIT_RPS" json:"rate_limit_rps"`
+	RateLimitBurst int     `env:"RATE_LIMIT_BURST" json:"rate_limit_burst"`
+	SeriesQuota    int     `env:"SERIES_QUOTA" json:"series_quota"`
+	TrustedProxies string  `env:"TRUSTED_PROXIES" json:"trusted_proxies"`
+
+	MaxSeries     int    `env:"MAX_SERIES" json:"max_series"`
+	PrefixLimits  string `env:"SERIES_PREFIX_LIMITS" json:"series_prefix_limits"`
+	MaxNameLength int    `env:"MAX_NAME_LENGTH" json:"max_name_length"`
+	NamePattern   string `env:"METRIC_NAME_PATTERN" json:"metric_name_pattern"`
+
+	IdempotencyWindow time.Duration `env:"IDEMPOTENCY_WINDOW" json:"idempotency_window"`
+
+	StorageEngine string `env:"STORAGE_ENGINE" json:"storage_engine"`
+
+	WALPath         string        `env:"WAL_PATH" json:"wal_path"`
+	WALSync         string        `env:"WAL_SYNC" json:"wal_sync"`
+	WALSyncInterval time.Duration `env:"WAL_SYNC_INTERVAL" json:"wal_sync_interval"`
+	WALCompactSize  int64         `env:"WAL_COMPACT_SIZE" json:"wal_compact_size"`
+
+	DBMaxConns     int           `env:"DB_MAX_CONNS" json:"db_max_conns"`
+	DBMinConns     int           `env:"DB_MIN_CONNS" json:"db_min_conns"`
+	DBQueryTimeout time.Duration `env:"DB_QUERY_TIMEOUT" json:"db_query_timeout"`
+
+	ReadTimeout  time.Duration `env:"READ_TIMEOUT" json:"read_timeout"`
+	WriteTimeout time.Duration `env:"WRITE_TIMEOUT" json:"write_timeout"`
 }
 
-func NewServerConfig() *ServerConfig {
-	flagConfig := parseServerFlags()
-	config := &ServerConfig{}
-	env.Parse(config)
-
-	if config.Config == "" {
-		config.Config = flagConfig.Config
-	}
-
-	if config.Host == "" {
-		config.Host = flagConfig.Host
-	}
-
-	if config.DSN == "" {
-		config.DSN = flagConfig.DSN
-	}
-
-	if config.LogLevel == "" {
-		config.LogLevel = flagConfig.LogLevel
-	}
-
-	if config.StoreInvterval == 0 {
-		config.StoreInvterval = flagConfig.StoreInvterval
-	}
-
-	if config.StoragePath == "" {
-		config.StoragePath = flagConfig.StoragePath
-	}
-
-	if config.Key == "" {
-		config.Key = flagConfig.Key
-	}
-
-	if !config.Restore {
-		config.Restore = flagConfig.Restore
-	}
-
-	if config.CryptKeyPath == "" {
-		config.CryptKeyPath = flagConfig.CryptKeyPath
-	}
-
-	if config.ServerType == "" {
-		config.ServerType = flagConfig.ServerType
-	}
-
-	config = loadServerConfigFile(config.Config, config)
-
-	return config
+// NewServerConfig - builds config of server from command line flags, see LoadServerConfig
+func NewServerConfig() (*ServerConfig, error) {
+	return LoadServerConfig(flag.CommandLine, os.Args[1:])
 }
 
-func NewAgentConfig() *AgentConfig {
-
-	flagAgentConfig := parseAgentFlags()
-	Agentconfig := &AgentConfig{}
-	env.Parse(Agentconfig)
-
-	if Agentconfig.Config == "" {
-		Agentconfig.Config = flagAgentConfig.Config
-	}
-
-	if Agentconfig.RateLimit == 0 {
-		Agentconfig.RateLimit = flagAgentConfig.RateLimit
-	}
-
-	if Agentconfig.PollInterval == 0 {
-		Agentconfig.PollInterval = flagAgentConfig.PollInterval
-	}
-
-	if Agentconfig.ReportInterval == 0 {
-		Agentconfig.ReportInterval = flagAgentConfig.ReportInterval
-	}
-
-	if Agentconfig.Host == "" {
-		Agentconfig.Host = flagAgentConfig.Host
-	}
-
-	if Agentconfig.LogLevel == "" {
-		Agentconfig.LogLevel = flagAgentConfig.LogLevel
-	}
-
-	if Agentconfig.Key == "" {
-		Agentconfig.Key = flagAgentConfig.Key
-	}
-
-	if Agentconfig.CryptKeyPath == "" {
-		Agentconfig.CryptKeyPath = flagAgentConfig.CryptKeyPath
-	}
+// ReloadServerConfig - builds config of server again from the same command line flags, so changes
+// of config file and environment made since start are picked up
+func ReloadServerConfig() (*ServerConfig, error) {
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return LoadServerConfig(fs, os.Args[1:])
+}
 
-	if Agentconfig.AgentType == "" {
-		Agentconfig.AgentType = flagAgentConfig.AgentType
+// LoadServerConfig - builds config of server from layers of growing precedence: defaults, config file,
+// environment and flags explicitly passed in args. Config file is JSON or YAML by its extension, config
+// is validated after all layers are applied
+func LoadServerConfig(fs *flag.FlagSet, args []string) (*ServerConfig, error) {
+	serverFlags(fs, defaultServerConfig())
+	if err := fs.Parse(args); err != nil {
+		return nil, err
 	}
-
-	Config := loadAgentConfigFile(Agentconfig.Config, Agentconfig)
-	return Config
-}
-
-func parseServerFlags() *ServerConfig {
-	config := &ServerConfig{}
-	flag.StringVar(&config.Host, "a", "localhost:8080", "server host")
-	flag.StringVar(&config.DSN, "d", "", "DB connection string")
-	flag.StringVar(&config.LogLevel, "l", "info", "log level")
-	flag.StringVar(&config.StoragePath, "f", "/tmp/metrics-db.json", "path to file to store metrics")
-	flag.StringVar(&config.Key, "k", "", "secret key for signing data")
-	flag.StringVar(&config.CryptKeyPath, "crypto-key", "./internal/crypt/test-private.pem", "path to crypto-key")
-	flag.Int64Var(&config.StoreInvterval, "i", 1, "interval of storing metrics")
-	flag.BoolVar(&config.Restore, "r", false, "store metrics in file")
-	flag.StringVar(&config.Config, "c", "./config-server.json", "config json file path")
-	flag.StringVar(&config.TrustedSubnet, "t", "", "trusted subnet (CIDR)")
-	flag.StringVar(&config.ServerType, "s", "http", "server type: http or grpc")
-	flag.Parse()
-
-	return config
-}
-
-func parseAgentFlags() *AgentConfig {
-	config := &AgentConfig{}
-	flag.IntVar(&config.ReportInterval, "r", 2, "report interval")
-	flag.IntVar(&config.PollInterval, "p", 1, "polling interval")
-	flag.IntVar(&config.RateLimit, "ra", 5, "rate limit num of workers")
-	flag.StringVar(&config.Host, "a", "localhost:8080", "server address")
-	flag.StringVar(&config.LogLevel, "l", "info", "log level")
-	flag.StringVar(&config.Key, "k", "", "secret key for signing data")
-	flag.StringVar(&config.CryptKeyPath, "crypto-key", "./internal/crypt/test-public.pem", "path to crypto-key")
-	flag.StringVar(&config.Config, "c", "./config-agent.json", "config json file path")
-	flag.StringVar(&config.AgentType, "t", "http", "agent type: http/grpc")
-	flag.Parse()
-
-	return config
-}
-
-func loadAgentConfigFile(path string, config *AgentConfig) *AgentConfig {
-	data, err := os.ReadFile(path)
+	config := defaultServerConfig()
+	err := load(config, config.Config, fs, func(bound *flag.FlagSet) { serverFlags(bound, config) })
 	if err != nil {
-		log.Println(err)
-		return config
+		return nil, err
 	}
-	var fileConf AgentConfig
-
-	err = json.Unmarshal(data, &fileConf)
-	if err != nil {
-		log.Println(err)
-		return config
+	if err = config.Validate(); err != nil {
+		return nil, err
 	}
+	return config, nil
+}
 
-	if config.Host == "" {
-		config.Host = fileConf.Host
-	}
+// NewAgentConfig - builds config of agent from command line flags, see LoadAgentConfig
+func NewAgentConfig() (*AgentConfig, error) {
+	return LoadAgentConfig(flag.CommandLine, os.Args[1:])
+}
 
-	if config.PollInterval == 0 {
-		config.PollInterval = fileConf.PollInterval
-	}
+// ReloadAgentConfig - builds config of agent again as ReloadServerConfig does
+func ReloadAgentConfig() (*AgentConfig, error) {
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return LoadAgentConfig(fs, os.Args[1:])
+}
 
-	if config.ReportInterval == 0 {
-		config.ReportInterval = fileConf.ReportInterval
+// LoadAgentConfig - builds config of agent from layers as LoadServerConfig does
+func LoadAgentConfig(fs *flag.FlagSet, args []string) (*AgentConfig, error) {
+	agentFlags(fs, defaultAgentConfig())
+	if err := fs.Parse(args); err != nil {
+		return nil, err
 	}
-
-	if config.RateLimit == 0 {
-		config.RateLimit = fileConf.RateLimit
+	config := defaultAgentConfig()
+	err := load(config, config.Config, fs, func(bound *flag.FlagSet) { agentFlags(bound, config) })
+	if err != nil {
+		return nil, err
 	}
-
-	if config.CryptKeyPath == "" {
-		config.CryptKeyPath = fileConf.CryptKeyPath
+	if err = config.Validate(); err != nil {
+		return nil, err
 	}
-
-	return config
+	return config, nil
 }
 
-func loadServerConfigFile(path string, config *ServerConfig) *ServerConfig {
-	data, err := os.ReadFile(path)
-	if err != nil {
-		log.Println(err)
-		return config
-	}
-	var fileConf ServerConfig
-
-	err = json.Unmarshal(data, &fileConf)
-	if err != nil {
-		log.Println(err)
-		return config
+func defaultServerConfig() *ServerConfig {
+	return &ServerConfig{
+		Host:              "localhost:8080",
+		LogLevel:          "info",
+		StoragePath:       "/tmp/metrics-db.json",
+		CryptKeyPath:      "./internal/crypt/test-private.pem",
+		StoreInvterval:    1,
+		BackupCompression: backup.CompressionNone,
+		BackupKeep:        backup.DefaultKeep,
+		BackupSinkKeep:    10,
+		BackupSinkRetries: 3,
+		S3Region:          "us-east-1",
+		Config:            "./config-server.json",
+		ServerType:        model.HTTPType,
+		CompactInterval:   time.Minute,
+		RetentionRaw:      time.Hour,
+		RetentionMinute:   24 * time.Hour,
+		RetentionHour:     30 * 24 * time.Hour,
+		RulesInterval:     15 * time.Second,
+		TokensPath:        "/tmp/metrics-tokens.json",
+		RateLimitBurst:    100,
+		MaxNameLength:     200,
+		NamePattern:       service.DefaultNamePattern,
+		IdempotencyWindow: service.DefaultIdempotencyWindow,
+		StorageEngine:     "memory",
+		WALPath:           "/tmp/metrics-db",
+		WALSync:           wal.SyncAlways,
+		WALSyncInterval:   time.Second,
+		WALCompactSize:    wal.DefaultCompactSize,
+		DBMaxConns:        10,
+		DBQueryTimeout:    postgres.DefaultQueryTimeout,
+		ReadTimeout:       service.DefaultTimeouts.Read,
+		WriteTimeout:      service.DefaultTimeouts.Write,
 	}
+}
 
-	if config.Host == "" {
-		config.Host = fileConf.Host
+func defaultAgentConfig() *AgentConfig {
+	return &AgentConfig{
+		Host:           "localhost:8080",
+		LogLevel:       "info",
+		CryptKeyPath:   "./internal/crypt/test-public.pem",
+		Config:         "./config-agent.json",
+		AgentType:      model.HTTPType,
+		RateLimit:      5,
+		PollInterval:   1,
+		ReportInterval: 2,
 	}
+}
 
-	if !config.Restore {
-		config.Restore = fileConf.Restore
-	}
+// serverFlags - defines flags of server bound to fields of config, current values of fields are defaults
+func serverFlags(fs *flag.FlagSet, c *ServerConfig) {
+	fs.StringVar(&c.Host, "a", c.Host, "server host")
+	fs.StringVar(&c.DSN, "d", c.DSN, "DB connection string")
+	fs.StringVar(&c.LogLevel, "l", c.LogLevel, "log level")
+	fs.StringVar(&c.StoragePath, "f", c.StoragePath, "path to file to store metrics")
+	fs.StringVar(&c.Key, "k", c.Key, "secret key for signing data")
+	fs.StringVar(&c.CryptKeyPath, "crypto-key", c.CryptKeyPath, "path to crypto-key")
+	fs.Int64Var(&c.StoreInvterval, "i", c.StoreInvterval, "interval of storing metrics")
+	fs.BoolVar(&c.Restore, "r", c.Restore, "store metrics in file")
+	fs.StringVar(&c.BackupCompression, "backup-compression", c.BackupCompression, "compression of backup snapshots: none, gzip or zstd")
+	fs.IntVar(&c.BackupKeep, "backup-keep", c.BackupKeep, "number of previous backup snapshots kept besides the latest one")
+	fs.BoolVar(&c.BackupJournal, "backup-journal", c.BackupJournal, "journal changes between backups, so metrics can be restored as of any moment since the oldest kept snapshot")
+	fs.StringVar(&c.BackupSink, "backup-sink", c.BackupSink, "where snapshots are uploaded besides local file: file:///dir or s3://bucket/prefix")
+	fs.IntVar(&c.BackupSinkKeep, "backup-sink-keep", c.BackupSinkKeep, "number of the newest uploaded snapshots of every file kept, 0 keeps all")
+	fs.DurationVar(&c.BackupSinkMaxAge, "backup-sink-max-age", c.BackupSinkMaxAge, "uploaded snapshots older than max age are deleted, 0 disables")
+	fs.IntVar(&c.BackupSinkRetries, "backup-sink-retries", c.BackupSinkRetries, "number of retries of failed upload")
+	fs.StringVar(&c.S3Endpoint, "s3-endpoint", c.S3Endpoint, "endpoint of S3-compatible storage, AWS endpoint of region by default")
+	fs.StringVar(&c.S3Region, "s3-region", c.S3Region, "region of S3 bucket")
+	fs.StringVar(&c.S3AccessKey, "s3-access-key", c.S3AccessKey, "access key of S3-compatible storage")
+	fs.StringVar(&c.S3SecretKey, "s3-secret-key", c.S3SecretKey, "secret key of S3-compatible storage")
+	fs.StringVar(&c.Config, configFlag, c.Config, "config file path, json or yaml by extension")
+	fs.BoolVar(&c.PrintConfig, "print-config", c.PrintConfig, "print effective config with secrets masked and exit")
+	fs.StringVar(&c.TrustedSubnet, "t", c.TrustedSubnet, "trusted subnet (CIDR)")
+	fs.StringVar(&c.ServerType, "s", c.ServerType, "server type: http or grpc")
+	fs.DurationVar(&c.CompactInterval, "compact-interval", c.CompactInterval, "interval of rolling up metrics history")
+	fs.DurationVar(&c.RetentionRaw, "retention-raw", c.RetentionRaw, "retention of raw metrics history")
+	fs.DurationVar(&c.RetentionMinute, "retention-1m", c.RetentionMinute, "retention of 1m metrics history aggregates")
+	fs.DurationVar(&c.RetentionHour, "retention-1h", c.RetentionHour, "retention of 1h metrics history aggregates")
+	fs.StringVar(&c.RulesPath, "rules", c.RulesPath, "alerting and recording rules json file path")
+	fs.DurationVar(&c.RulesInterval, "rules-interval", c.RulesInterval, "interval of evaluating alerting rules")
+	fs.StringVar(&c.AdminToken, "admin-token", c.AdminToken, "admin token for managing tenant API tokens, enables multi-tenancy")
+	fs.StringVar(&c.TokensPath, "tokens", c.TokensPath, "path to file to store tenant API tokens")
+	fs.Float64Var(&c.RateLimitRPS, "rps", c.RateLimitRPS, "requests per second allowed for every client, 0 disables rate limiting")
+	fs.IntVar(&c.RateLimitBurst, "burst", c.RateLimitBurst, "burst of requests allowed for every client")
+	fs.IntVar(&c.SeriesQuota, "series-quota", c.SeriesQuota, "max number of distinct series written by every client, 0 disables quota")
+	fs.StringVar(&c.TrustedProxies, "trusted-proxies", c.TrustedProxies, "comma separated CIDRs of proxies whose X-Real-IP header identifies client for rate limiting")
+	fs.IntVar(&c.MaxSeries, "max-series", c.MaxSeries, "max number of series stored by every tenant, 0 disables limit")
+	fs.StringVar(&c.PrefixLimits, "prefix-limits", c.PrefixLimits, "max number of series per metric name prefix: go_=100,http_=50")
+	fs.IntVar(&c.MaxNameLength, "max-name-length", c.MaxNameLength, "max length of metric name")
+	fs.StringVar(&c.NamePattern, "name-pattern", c.NamePattern, "regular expression metric names must match")
+	fs.DurationVar(&c.IdempotencyWindow, "idempotency-window", c.IdempotencyWindow, "how long idempotency keys of saved batches are remembered")
+	fs.StringVar(&c.StorageEngine, "engine", c.StorageEngine, "storage engine used without database: memory, sharded or wal")
+	fs.StringVar(&c.WALPath, "wal-path", c.WALPath, "path to snapshot of wal storage, log is kept in path.wal")
+	fs.StringVar(&c.WALSync, "wal-sync", c.WALSync, "when wal is synced to disk: always, interval or never")
+	fs.DurationVar(&c.WALSyncInterval, "wal-sync-interval", c.WALSyncInterval, "interval of syncing wal with interval policy")
+	fs.Int64Var(&c.WALCompactSize, "wal-compact-size", c.WALCompactSize, "size of wal in bytes after which it is compacted into snapshot")
+	fs.IntVar(&c.DBMaxConns, "db-max-conns", c.DBMaxConns, "max number of connections in database pool")
+	fs.IntVar(&c.DBMinConns, "db-min-conns", c.DBMinConns, "min number of idle connections kept in database pool")
+	fs.DurationVar(&c.DBQueryTimeout, "db-query-timeout", c.DBQueryTimeout, "timeout of single database call")
+	fs.DurationVar(&c.ReadTimeout, "read-timeout", c.ReadTimeout, "timeout of reading metrics from storage")
+	fs.DurationVar(&c.WriteTimeout, "write-timeout", c.WriteTimeout, "timeout of saving metrics into storage")
+}
 
-	if config.StoreInvterval == 0 {
-		config.StoreInvterval = fileConf.StoreInvterval
-	}
+// agentFlags - defines flags of agent bound to fields of config, current values of fields are defaults
+func agentFlags(fs *flag.FlagSet, c *AgentConfig) {
+	fs.IntVar(&c.ReportInterval, "r", c.ReportInterval, "report interval")
+	fs.IntVar(&c.PollInterval, "p", c.PollInterval, "polling interval")
+	fs.IntVar(&c.RateLimit, "ra", c.RateLimit, "rate limit num of workers")
+	fs.StringVar(&c.Host, "a", c.Host, "server address")
+	fs.StringVar(&c.LogLevel, "l", c.LogLevel, "log level")
+	fs.StringVar(&c.Key, "k", c.Key, "secret key for signing data")
+	fs.StringVar(&c.CryptKeyPath, "crypto-key", c.CryptKeyPath, "path to crypto-key")
+	fs.StringVar(&c.Config, configFlag, c.Config, "config file path, json or yaml by extension")
+	fs.BoolVar(&c.PrintConfig, "print-config", c.PrintConfig, "print effective config with secrets masked and exit")
+	fs.StringVar(&c.AgentType, "t", c.AgentType, "agent type: http/grpc")
+	fs.StringVar(&c.Labels, "labels", c.Labels, "labels attached to every metric: host=web1,dc=eu")
+	fs.StringVar(&c.APIToken, "api-token", c.APIToken, "tenant API token sent with every report")
+}
 
-	if config.DSN == "" {
-		config.DSN = fileConf.DSN
-	}
+// LabelSet - parses comma separated key=value labels, empty pairs are skipped. Pair without key or "=" is error,
+// so agent doesn't report series without labels asked for
+func (c *AgentConfig) LabelSet() (map[string]string, error) {
+	if c.Labels == "" {
+		return nil, nil
+	}
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(c.Labels, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		k = strings.TrimSpace(k)
+		if !ok || k == "" {
+			return nil, fmt.Errorf("malformed label %q, want key=value", pair)
+		}
+		labels[k] = strings.TrimSpace(v)
+	}
+	return labels, nil
+}
 
-	if config.CryptKeyPath == "" {
-		config.CryptKeyPath = fileConf.CryptKeyPath
+// S3Options - builds options of S3-compatible backup sink
+func (c *ServerConfig) S3Options() backup.S3Options {
+	return backup.S3Options{
+		Endpoint:  c.S3Endpoint,
+		Region:    c.S3Region,
+		AccessKey: c.S3AccessKey,
+		SecretKey: c.S3SecretKey,
 	}
+}
 
-	if config.TrustedSubnet == "" {
-		config.TrustedSubnet = fileConf.TrustedSubnet
-	}
+// Limits - builds cardinality limits of service from series limits and metric name policy
+func (c *ServerConfig) Limits() (service.Limits, error) {
+	limits := service.Limits{
+		MaxSeries:     c.MaxSeries,
+		MaxNameLength: c.MaxNameLength,
+	}
+	if c.NamePattern != "" {
+		pattern, err := regexp.Compile(c.NamePattern)
+		if err != nil {
+			return limits, err
+		}
+		limits.NamePattern = pattern
+	}
+	prefixLimits, err := parsePrefixLimits(c.PrefixLimits)
+	limits.PrefixLimits = prefixLimits
+	return limits, err
+}
 
-	return config
+// parsePrefixLimits - parses comma separated prefix=limit pairs
+func parsePrefixLimits(s string) (map[string]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+	limits := make(map[string]int)
+	for _, pair := range strings.Split(s, ",") {
+		prefix, value, ok := strings.Cut(pair, "=")
+		prefix = strings.TrimSpace(prefix)
+		limit, err := strconv.Atoi(strings.TrimSpace(value))
+		if !ok || prefix == "" || err != nil {
+			return nil, fmt.Errorf("invalid prefix limit %q", pair)
+		}
+		limits[prefix] = limit
+	}
+	return limits, nil
 }
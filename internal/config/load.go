@@ -0,0 +1,267 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caarlos0/env/v6"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// configFlag flag setting path of config file
+	configFlag = "c"
+	// configEnv environment variable setting path of config file
+	configEnv = "CONFIG"
+	// masked value printed instead of secrets
+	masked = "xxxxx"
+)
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	dsnPassword  = regexp.MustCompile(`password=\S+`)
+)
+
+// load - fills config c, which holds defaults, from config file, environment and flags explicitly set
+// in parsed fs, each layer overrides the previous one. bind defines flags of config bound to fields of c.
+// Config file at defaultPath may be missing, file set by flag or environment must exist
+func load(c any, defaultPath string, fs *flag.FlagSet, bind func(bound *flag.FlagSet)) error {
+	path, explicit := defaultPath, false
+	if v := os.Getenv(configEnv); v != "" {
+		path, explicit = v, true
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == configFlag {
+			path, explicit = f.Value.String(), true
+		}
+	})
+
+	if err := loadFile(c, path, explicit); err != nil {
+		return err
+	}
+	if err := env.Parse(c); err != nil {
+		return fmt.Errorf("config environment: %w", err)
+	}
+
+	bound := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	bind(bound)
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if err == nil {
+			err = bound.Set(f.Name, f.Value.String())
+		}
+	})
+	return err
+}
+
+// loadFile - sets fields of config c from keys of config file at path, file is JSON unless its extension
+// is .yaml or .yml. Missing file is skipped unless it is required
+func loadFile(c any, path string, required bool) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !required {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("config file: %w", err)
+	}
+
+	var values map[string]any
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &values)
+	default:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		err = dec.Decode(&values)
+	}
+	if err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	if err = setValues(c, values); err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// fieldKeys - returns indexes of fields of struct type t by their config file keys
+func fieldKeys(t reflect.Type) map[string]int {
+	keys := make(map[string]int)
+	for i := 0; i < t.NumField(); i++ {
+		key, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if key != "" && key != "-" {
+			keys[key] = i
+		}
+	}
+	return keys
+}
+
+// setValues - sets fields of config c by keys of values, null values are skipped. Unknown keys and
+// values not matching types of fields are errors
+func setValues(c any, values map[string]any) error {
+	v := reflect.ValueOf(c).Elem()
+	fields := fieldKeys(v.Type())
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var errs []error
+	for _, key := range keys {
+		i, ok := fields[key]
+		if !ok {
+			errs = append(errs, fmt.Errorf("unknown key %q", key))
+			continue
+		}
+		if values[key] == nil {
+			continue
+		}
+		if err := setField(v.Field(i), values[key]); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// setField - sets field to scalar value decoded from config file. Durations are strings like 1m30s
+// or numbers of nanoseconds as encoding/json decodes them
+func setField(field reflect.Value, value any) error {
+	var s string
+	switch value := value.(type) {
+	case string:
+		s = value
+	case bool, int, int64, uint64, float64, json.Number:
+		s = fmt.Sprint(value)
+	default:
+		return fmt.Errorf("expected scalar value, got %T", value)
+	}
+
+	if field.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			n, nerr := strconv.ParseInt(s, 10, 64)
+			if nerr != nil {
+				return err
+			}
+			d = time.Duration(n)
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
+
+// Changes - returns config file keys of fields which have other values in next config
+func (c *ServerConfig) Changes(next *ServerConfig) []string {
+	return changedKeys(c, next)
+}
+
+// Changes - returns config file keys of fields which have other values in next config
+func (c *AgentConfig) Changes(next *AgentConfig) []string {
+	return changedKeys(c, next)
+}
+
+// changedKeys - returns sorted config file keys of fields which differ in configs of the same type
+func changedKeys(prev, next any) []string {
+	p, n := reflect.ValueOf(prev).Elem(), reflect.ValueOf(next).Elem()
+	var keys []string
+	for key, i := range fieldKeys(p.Type()) {
+		if p.Field(i).Interface() != n.Field(i).Interface() {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Print - writes config as JSON accepted as config file, secrets are masked
+func (c *ServerConfig) Print(w io.Writer) error {
+	return printValues(w, c)
+}
+
+// Print - writes config as JSON accepted as config file, secrets are masked
+func (c *AgentConfig) Print(w io.Writer) error {
+	return printValues(w, c)
+}
+
+// printValues - writes fields of config c by their config file keys, durations are written as strings
+func printValues(w io.Writer, c any) error {
+	v := reflect.ValueOf(c).Elem()
+	values := make(map[string]any)
+	for key, i := range fieldKeys(v.Type()) {
+		field := v.Field(i)
+		switch {
+		case field.Type() == durationType:
+			values[key] = time.Duration(field.Int()).String()
+		case field.Kind() == reflect.String:
+			values[key] = redact(field.String(), v.Type().Field(i).Tag.Get("secret"))
+		default:
+			values[key] = field.Interface()
+		}
+	}
+	data, err := json.MarshalIndent(values, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// redact - masks value of field by its secret tag, password is masked in database DSN
+func redact(value, secret string) string {
+	if value == "" {
+		return value
+	}
+	switch secret {
+	case "true":
+		return masked
+	case "dsn":
+		if u, err := url.Parse(value); err == nil && u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				u.User = url.UserPassword(u.User.Username(), masked)
+			}
+			return u.String()
+		}
+		return dsnPassword.ReplaceAllString(value, "password="+masked)
+	default:
+		return value
+	}
+}
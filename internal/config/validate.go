@@ -0,0 +1,178 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap/zapcore"
+
+	"github.com/SmoothWay/metrics/internal/backup"
+	"github.com/SmoothWay/metrics/internal/model"
+	"github.com/SmoothWay/metrics/internal/ratelimit"
+	"github.com/SmoothWay/metrics/internal/repository/wal"
+)
+
+// validator collects problems of config by config file keys of fields
+type validator struct {
+	errs []error
+}
+
+// check - records err of field with config file key
+func (v *validator) check(key string, err error) {
+	if err != nil {
+		v.errs = append(v.errs, fmt.Errorf("%s: %w", key, err))
+	}
+}
+
+func (v *validator) err() error {
+	return errors.Join(v.errs...)
+}
+
+// Validate - checks values of config, all found problems are returned joined
+func (c *ServerConfig) Validate() error {
+	var v validator
+	v.check("address", validateAddress(c.Host))
+	v.check("log_level", validateLogLevel(c.LogLevel))
+	v.check("server_type", oneOf(c.ServerType, model.HTTPType, model.GRPCType))
+	v.check("crypto_key", validateKeyPath(c.CryptKeyPath))
+	v.check("trusted_subnet", validateCIDR(c.TrustedSubnet))
+	v.check("store_interval", nonNegative(c.StoreInvterval))
+
+	v.check("backup_compression", oneOf(c.BackupCompression, "", backup.CompressionNone, backup.CompressionGzip, backup.CompressionZstd))
+	v.check("backup_keep", nonNegative(c.BackupKeep))
+	v.check("backup_sink_keep", nonNegative(c.BackupSinkKeep))
+	v.check("backup_sink_max_age", nonNegative(c.BackupSinkMaxAge))
+	v.check("backup_sink_retries", nonNegative(c.BackupSinkRetries))
+
+	v.check("compact_interval", nonNegative(c.CompactInterval))
+	v.check("retention_raw", nonNegative(c.RetentionRaw))
+	v.check("retention_1m", nonNegative(c.RetentionMinute))
+	v.check("retention_1h", nonNegative(c.RetentionHour))
+	v.check("rules_interval", positive(c.RulesInterval))
+
+	v.check("rate_limit_rps", nonNegative(c.RateLimitRPS))
+	if c.RateLimitRPS > 0 {
+		v.check("rate_limit_burst", positive(c.RateLimitBurst))
+	}
+	v.check("series_quota", nonNegative(c.SeriesQuota))
+	_, err := ratelimit.ParseProxies(c.TrustedProxies)
+	v.check("trusted_proxies", err)
+	v.check("max_series", nonNegative(c.MaxSeries))
+	_, err = parsePrefixLimits(c.PrefixLimits)
+	v.check("series_prefix_limits", err)
+	v.check("max_name_length", nonNegative(c.MaxNameLength))
+	_, err = regexp.Compile(c.NamePattern)
+	v.check("metric_name_pattern", err)
+	v.check("idempotency_window", nonNegative(c.IdempotencyWindow))
+
+	v.check("storage_engine", oneOf(c.StorageEngine, "", "memory", "sharded", "wal"))
+	v.check("wal_sync", oneOf(c.WALSync, wal.SyncAlways, wal.SyncInterval, wal.SyncNever))
+	if c.WALSync == wal.SyncInterval {
+		v.check("wal_sync_interval", positive(c.WALSyncInterval))
+	}
+	v.check("wal_compact_size", nonNegative(c.WALCompactSize))
+
+	v.check("db_max_conns", positive(c.DBMaxConns))
+	v.check("db_min_conns", nonNegative(c.DBMinConns))
+	if c.DBMinConns > c.DBMaxConns {
+		v.check("db_min_conns", fmt.Errorf("%d is greater than db_max_conns %d", c.DBMinConns, c.DBMaxConns))
+	}
+	v.check("db_query_timeout", nonNegative(c.DBQueryTimeout))
+	v.check("read_timeout", nonNegative(c.ReadTimeout))
+	v.check("write_timeout", nonNegative(c.WriteTimeout))
+	return v.err()
+}
+
+// Validate - checks values of config, all found problems are returned joined
+func (c *AgentConfig) Validate() error {
+	var v validator
+	v.check("address", validateAddress(c.Host))
+	v.check("log_level", validateLogLevel(c.LogLevel))
+	v.check("agent_type", oneOf(c.AgentType, model.HTTPType, model.GRPCType))
+	v.check("crypto_key", validateKeyPath(c.CryptKeyPath))
+	v.check("rate_limit", positive(c.RateLimit))
+	v.check("poll_interval", positive(c.PollInterval))
+	v.check("report_interval", positive(c.ReportInterval))
+	_, err := c.LabelSet()
+	v.check("labels", err)
+	return v.err()
+}
+
+// validateAddress - checks that addr is host:port with numeric port, host may be empty
+func validateAddress(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if _, err = strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
+
+func validateLogLevel(level string) error {
+	_, err := zapcore.ParseLevel(level)
+	return err
+}
+
+// validateKeyPath - checks that key file exists if path is set
+func validateKeyPath(path string) error {
+	if path == "" {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", path)
+	}
+	return nil
+}
+
+// validateCIDR - checks that subnet is CIDR if it is set
+func validateCIDR(subnet string) error {
+	if subnet == "" {
+		return nil
+	}
+	_, _, err := net.ParseCIDR(subnet)
+	return err
+}
+
+func oneOf(value string, allowed ...string) error {
+	for _, a := range allowed {
+		if value == a {
+			return nil
+		}
+	}
+	var names []string
+	for _, a := range allowed {
+		if a != "" {
+			names = append(names, a)
+		}
+	}
+	return fmt.Errorf("%q is not one of %s", value, strings.Join(names, ", "))
+}
+
+type number interface {
+	~int | ~int64 | ~float64
+}
+
+func nonNegative[T number](value T) error {
+	if value < 0 {
+		return fmt.Errorf("must not be negative, got %v", value)
+	}
+	return nil
+}
+
+func positive[T number](value T) error {
+	if value <= 0 {
+		return fmt.Errorf("must be positive, got %v", value)
+	}
+	return nil
+}
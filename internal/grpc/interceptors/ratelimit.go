@@ -0,0 +1,99 @@
+package interceptors
+
+import (
+	"context"
+	"time"
+
+	"github.com/grpc-ecosystem/go-grpc-middleware/v2/interceptors/realip"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	sg "github.com/SmoothWay/metrics/internal/grpc"
+	"github.com/SmoothWay/metrics/internal/ratelimit"
+	"github.com/SmoothWay/metrics/internal/tenant"
+	pb "github.com/SmoothWay/metrics/proto"
+)
+
+// RetryAfterKey trailer metadata key carrying seconds to wait after ResourceExhausted error
+const RetryAfterKey = "retry-after"
+
+// RateLimitInterceptor rejects requests of clients which exceeded requests rate or series quota.
+// Nil limiter or quota disables corresponding check. Must run after TenantInterceptor, x-real-ip metadata
+// identifies client only if call comes from one of proxies
+func RateLimitInterceptor(limiter *ratelimit.Limiter, quota *ratelimit.Quota, proxies ratelimit.Proxies) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if limiter == nil && quota == nil {
+			return handler(ctx, req)
+		}
+		client := clientKey(ctx, proxies)
+
+		if limiter != nil {
+			if ok, wait := limiter.Allow(client); !ok {
+				return nil, resourceExhausted(ctx, wait, "rate limit exceeded")
+			}
+		}
+
+		var series []string
+		if quota != nil {
+			if series = requestSeries(req); len(series) > 0 && !quota.Allow(client, series) {
+				return nil, resourceExhausted(ctx, ratelimit.QuotaRetryAfter, "series quota exceeded")
+			}
+		}
+
+		resp, err := handler(ctx, req)
+		if err == nil && len(series) > 0 {
+			// only saved series use quota
+			quota.Charge(client, series)
+		}
+		return resp, err
+	}
+}
+
+func resourceExhausted(ctx context.Context, wait time.Duration, msg string) error {
+	grpc.SetTrailer(ctx, metadata.Pairs(RetryAfterKey, ratelimit.RetryAfterSeconds(wait)))
+	return status.Error(codes.ResourceExhausted, msg)
+}
+
+// clientKey - identifies client by tenant resolved from API token, or by IP address of peer if tenants are disabled
+func clientKey(ctx context.Context, proxies ratelimit.Proxies) string {
+	if id := tenant.FromContext(ctx); id != "" {
+		return "tenant:" + id
+	}
+	var peerAddr, realIP string
+	if p, ok := peer.FromContext(ctx); ok {
+		peerAddr = p.Addr.String()
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(realip.XRealIp); len(values) > 0 {
+			realIP = values[0]
+		}
+	}
+	return "ip:" + proxies.ClientIP(peerAddr, realIP)
+}
+
+// requestSeries - returns series written by update requests
+func requestSeries(req any) []string {
+	var metrics []*pb.Metric
+	switch r := req.(type) {
+	case *pb.UpdateMetricRequest:
+		metrics = []*pb.Metric{r.Metric}
+	case *pb.UpdateMetricsRequest:
+		metrics = r.Metric
+	default:
+		return nil
+	}
+
+	series := make([]string, 0, len(metrics))
+	for _, pm := range metrics {
+		m, err := sg.ProtoToMetric(pm)
+		if err != nil {
+			// invalid metrics are rejected by handler
+			continue
+		}
+		series = append(series, m.Mtype+"/"+m.Key())
+	}
+	return series
+}
@@ -0,0 +1,38 @@
+package interceptors
+
+import (
+	"context"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/SmoothWay/metrics/internal/tenant"
+)
+
+// TenantInterceptor resolves tenant of API token passed in metadata and puts it into context.
+// Nil registry means tenancy is disabled
+func TenantInterceptor(tokens *tenant.Registry) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if tokens == nil {
+			return handler(ctx, req)
+		}
+
+		var token string
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			values := md.Get(strings.ToLower(tenant.Header))
+			if len(values) > 0 {
+				token = values[0]
+			}
+		}
+
+		id, ok := tokens.Resolve(token)
+		if !ok {
+			return nil, status.Error(codes.Unauthenticated, "invalid or missing api token")
+		}
+
+		return handler(tenant.WithTenant(ctx, id), req)
+	}
+}
@@ -11,8 +11,11 @@ import (
 	"google.golang.org/grpc/status"
 )
 
-func TrustedSubnetInterceptor(subnet *net.IPNet) grpc.UnaryServerInterceptor {
+// TrustedSubnetInterceptor - rejects calls from addresses outside of subnet returned by trustedSubnet,
+// which is called for every call, so subnet can be changed while server runs. Nil subnet allows all calls
+func TrustedSubnetInterceptor(trustedSubnet func() *net.IPNet) grpc.UnaryServerInterceptor {
 	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		subnet := trustedSubnet()
 		if subnet == nil {
 			return handler(ctx, req)
 		}
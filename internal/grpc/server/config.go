@@ -3,7 +3,9 @@ package server
 import (
 	"net"
 
+	"github.com/SmoothWay/metrics/internal/ratelimit"
 	"github.com/SmoothWay/metrics/internal/service"
+	"github.com/SmoothWay/metrics/internal/tenant"
 )
 
 var config Config
@@ -14,4 +16,9 @@ type Config struct {
 	SecretKey     string
 	Service       *service.Service
 	TrustedSubnet *net.IPNet
+	Tokens        *tenant.Registry
+	Limiter       *ratelimit.Limiter
+	Quota         *ratelimit.Quota
+	// TrustedProxies proxies passing address of client in x-real-ip metadata
+	TrustedProxies ratelimit.Proxies
 }
@@ -0,0 +1,29 @@
+package server
+
+import (
+	"context"
+
+	"github.com/SmoothWay/metrics/internal/logger"
+	"github.com/SmoothWay/metrics/internal/model"
+	pb "github.com/SmoothWay/metrics/proto"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (s *MetricsServer) SetMetadata(ctx context.Context, in *pb.SetMetadataRequest) (*pb.SetMetadataResponse, error) {
+	if in.Metadata == nil {
+		return nil, status.Error(codes.InvalidArgument, "metadata is required")
+	}
+	meta := model.Metadata{
+		Name:        in.Metadata.Name,
+		Unit:        in.Metadata.Unit,
+		Description: in.Metadata.Description,
+		Owner:       in.Metadata.Owner,
+	}
+	if err := s.service(ctx).SetMetadata(ctx, meta); err != nil {
+		logger.Log().Error("set metadata", zap.Error(err), zap.Any("metadata", meta))
+		return nil, statusError(err)
+	}
+	return &pb.SetMetadataResponse{Metadata: in.Metadata}, nil
+}
@@ -3,10 +3,12 @@ package server
 import (
 	"context"
 	"net"
+	"sync/atomic"
 
 	ic "github.com/SmoothWay/metrics/internal/grpc/interceptors"
 	"github.com/SmoothWay/metrics/internal/logger"
 	"github.com/SmoothWay/metrics/internal/service"
+	"github.com/SmoothWay/metrics/internal/tenant"
 	pb "github.com/SmoothWay/metrics/proto"
 	"github.com/grpc-ecosystem/go-grpc-middleware/v2/interceptors/logging"
 	"go.uber.org/zap"
@@ -18,6 +20,7 @@ type MetricsServer struct {
 	pb.UnimplementedMetricsServer
 	server  *grpc.Server
 	Service *service.Service
+	subnet  atomic.Pointer[net.IPNet]
 }
 
 func NewServer(cfg Config) *MetricsServer {
@@ -27,6 +30,8 @@ func NewServer(cfg Config) *MetricsServer {
 		logger.Log().Fatal("error", zap.Error(err))
 		return nil
 	}
+	srv := &MetricsServer{Service: cfg.Service}
+	srv.subnet.Store(cfg.TrustedSubnet)
 	interceptors := make([]grpc.ServerOption, 0)
 
 	loggerOpts := []logging.Option{
@@ -34,19 +39,30 @@ func NewServer(cfg Config) *MetricsServer {
 	}
 	interceptors = append(interceptors, grpc.ChainUnaryInterceptor(
 		logging.UnaryServerInterceptor(ic.InterceptorLogger(zlogger), loggerOpts...),
-		ic.TrustedSubnetInterceptor(cfg.TrustedSubnet),
+		ic.TrustedSubnetInterceptor(srv.subnet.Load),
+		ic.TenantInterceptor(cfg.Tokens),
+		ic.RateLimitInterceptor(cfg.Limiter, cfg.Quota, cfg.TrustedProxies),
 	))
 
 	interceptors = append(interceptors, grpc.ChainUnaryInterceptor(
 		logging.UnaryServerInterceptor(ic.InterceptorLogger(zlogger), loggerOpts...),
 	))
 
-	srv := &MetricsServer{Service: cfg.Service}
 	srv.server = grpc.NewServer(interceptors...)
 	pb.RegisterMetricsServer(srv.server, srv)
 	return srv
 }
 
+// SetTrustedSubnet - makes server accept calls only from subnet, nil subnet accepts all calls
+func (s *MetricsServer) SetTrustedSubnet(subnet *net.IPNet) {
+	s.subnet.Store(subnet)
+}
+
+// service - returns service scoped to tenant resolved by interceptor
+func (s *MetricsServer) service(ctx context.Context) *service.Service {
+	return s.Service.ForTenant(tenant.FromContext(ctx))
+}
+
 func (s *MetricsServer) Run(ctx context.Context) {
 	listen, err := net.Listen("tcp", config.ServerAddr)
 	if err != nil {
@@ -2,13 +2,19 @@ package server
 
 import (
 	"context"
+	"errors"
+	"fmt"
 
 	sg "github.com/SmoothWay/metrics/internal/grpc"
 	"github.com/SmoothWay/metrics/internal/logger"
+	"github.com/SmoothWay/metrics/internal/model"
+	"github.com/SmoothWay/metrics/internal/service"
 	pb "github.com/SmoothWay/metrics/proto"
 	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/protoadapt"
 )
 
 func (s *MetricsServer) UpdateMetric(ctx context.Context, in *pb.UpdateMetricRequest) (*pb.UpdateMetricResponse, error) {
@@ -18,10 +24,10 @@ func (s *MetricsServer) UpdateMetric(ctx context.Context, in *pb.UpdateMetricReq
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
-	err = s.Service.Save(metric)
+	err = s.service(ctx).Save(ctx, metric)
 	if err != nil {
 		logger.Log().Error("update", zap.Error(err), zap.Any("metric", metric))
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, statusError(err)
 	}
 
 	m, err := sg.MetricToProto(metric)
@@ -33,3 +39,36 @@ func (s *MetricsServer) UpdateMetric(ctx context.Context, in *pb.UpdateMetricReq
 	response.Metric = &m
 	return &response, nil
 }
+
+// statusError - maps errors of service to gRPC status with the same code as HTTP handlers respond with.
+// Rejected metrics of batch are listed as field violations of BadRequest details,
+// reason of other errors is passed in ErrorInfo details
+func statusError(err error) error {
+	var batchErr *model.BatchError
+	if errors.As(err, &batchErr) {
+		st := status.New(codes.InvalidArgument, err.Error())
+		details := &errdetails.BadRequest{}
+		for _, item := range batchErr.Items {
+			details.FieldViolations = append(details.FieldViolations, &errdetails.BadRequest_FieldViolation{
+				Field:       fmt.Sprintf("metric[%d]", item.Index),
+				Description: item.Err.Error(),
+			})
+		}
+		return withDetails(st, details)
+	}
+
+	httpStatus, reason := service.ErrorCode(err)
+	st := status.New(sg.HTTPCodeToGRPC(httpStatus), err.Error())
+	return withDetails(st, &errdetails.ErrorInfo{Reason: reason, Domain: errorDomain})
+}
+
+// errorDomain domain of ErrorInfo details of returned errors
+const errorDomain = "metrics"
+
+// withDetails - attaches details to status, status without details is returned if they can't be attached
+func withDetails(st *status.Status, details protoadapt.MessageV1) error {
+	if detailed, err := st.WithDetails(details); err == nil {
+		st = detailed
+	}
+	return st.Err()
+}
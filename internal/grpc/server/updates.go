@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"strings"
 
 	sg "github.com/SmoothWay/metrics/internal/grpc"
 	"github.com/SmoothWay/metrics/internal/logger"
@@ -10,6 +11,7 @@ import (
 
 	"go.uber.org/zap"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 )
 
@@ -17,18 +19,30 @@ func (s *MetricsServer) UpdateMetrics(ctx context.Context, in *pb.UpdateMetricsR
 	var response pb.UpdateMetricsResponse
 	var metricsBatch []model.Metrics
 
-	for _, metric := range in.Metric {
+	var batchErr model.BatchError
+	for i, metric := range in.Metric {
 		m, err := sg.ProtoToMetric(metric)
 		if err != nil {
-			return nil, status.Error(codes.InvalidArgument, err.Error())
+			batchErr.Items = append(batchErr.Items, model.ItemError{Index: i, ID: metric.GetId(), Err: err})
+			continue
 		}
 		metricsBatch = append(metricsBatch, m)
 	}
+	if len(batchErr.Items) > 0 {
+		return nil, statusError(&batchErr)
+	}
+
+	var key string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(strings.ToLower(model.IdempotencyKeyHeader)); len(values) > 0 {
+			key = values[0]
+		}
+	}
 
-	err := s.Service.SaveAll(metricsBatch)
+	_, err := s.service(ctx).SaveAllOnce(ctx, metricsBatch, key)
 	if err != nil {
 		logger.Log().Error("updates", zap.Error(err), zap.Any("metrics", metricsBatch))
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, statusError(err)
 	}
 
 	var mb []*pb.Metric
@@ -17,15 +17,31 @@ func ProtoToMetric(m *pb.Metric) (model.Metrics, error) {
 		mtype = model.MetricTypeGauge
 	case pb.Mtype_counter:
 		mtype = model.MetricTypeCounter
+	case pb.Mtype_histogram:
+		if m.Histogram == nil {
+			return model.Metrics{}, fmt.Errorf("histogram value is missing for metric: %s", m.Id)
+		}
+		return model.Metrics{
+			Histogram: &model.Histogram{
+				Buckets: m.Histogram.Buckets,
+				Counts:  m.Histogram.Counts,
+				Sum:     m.Histogram.Sum,
+				Count:   m.Histogram.Count,
+			},
+			Labels: m.Labels,
+			ID:     m.Id,
+			Mtype:  model.MetricTypeHistogram,
+		}, nil
 	default:
 		return model.Metrics{}, fmt.Errorf("unknown metric type: %s", m.Mtype)
 	}
 
 	return model.Metrics{
-		Delta: &m.Delta,
-		Value: &m.Gauge,
-		ID:    m.Id,
-		Mtype: mtype,
+		Delta:  &m.Delta,
+		Value:  &m.Gauge,
+		Labels: m.Labels,
+		ID:     m.Id,
+		Mtype:  mtype,
 	}, nil
 }
 
@@ -36,31 +52,50 @@ func MetricToProto(metric model.Metrics) (pb.Metric, error) {
 		mtype = pb.Mtype_gauge
 	case model.MetricTypeCounter:
 		mtype = pb.Mtype_counter
+	case model.MetricTypeHistogram:
+		if metric.Histogram == nil {
+			return pb.Metric{}, fmt.Errorf("histogram value is missing for metric: %s", metric.ID)
+		}
+		return pb.Metric{
+			Id:     metric.ID,
+			Mtype:  pb.Mtype_histogram,
+			Labels: metric.Labels,
+			Histogram: &pb.Histogram{
+				Buckets: metric.Histogram.Buckets,
+				Counts:  metric.Histogram.Counts,
+				Sum:     metric.Histogram.Sum,
+				Count:   metric.Histogram.Count,
+			},
+		}, nil
 	default:
 		mtype = pb.Mtype_TYPE_UNSPECIFIED
 	}
 	if metric.Delta == nil {
 		return pb.Metric{
-			Id:    metric.ID,
-			Mtype: mtype,
-			Gauge: *metric.Value,
+			Id:     metric.ID,
+			Mtype:  mtype,
+			Gauge:  *metric.Value,
+			Labels: metric.Labels,
 		}, nil
 	}
 	if metric.Value == nil {
 		return pb.Metric{
-			Id:    metric.ID,
-			Mtype: mtype,
-			Delta: *metric.Delta,
+			Id:     metric.ID,
+			Mtype:  mtype,
+			Delta:  *metric.Delta,
+			Labels: metric.Labels,
 		}, nil
 	}
 	return pb.Metric{
-		Id:    metric.ID,
-		Mtype: mtype,
-		Delta: *metric.Delta,
-		Gauge: *metric.Value,
+		Id:     metric.ID,
+		Mtype:  mtype,
+		Delta:  *metric.Delta,
+		Gauge:  *metric.Value,
+		Labels: metric.Labels,
 	}, nil
 }
 
+// HTTPCodeToGRPC - translates HTTP status to gRPC code, 499 is status of request canceled by client
 func HTTPCodeToGRPC(code int) codes.Code {
 	switch code {
 	case http.StatusOK:
@@ -71,8 +106,18 @@ func HTTPCodeToGRPC(code int) codes.Code {
 		return codes.Unavailable
 	case http.StatusBadRequest:
 		return codes.InvalidArgument
+	case http.StatusConflict:
+		return codes.FailedPrecondition
+	case http.StatusUnprocessableEntity, http.StatusTooManyRequests:
+		return codes.ResourceExhausted
 	case http.StatusInternalServerError:
 		return codes.Internal
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	case http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	case 499:
+		return codes.Canceled
 	}
 	return codes.Unknown
 }
@@ -2,6 +2,7 @@ package handler
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -26,7 +27,7 @@ func ExampleHandler_JSONUpdateHandler() {
 		Mtype: model.MetricTypeGauge,
 		Value: &value,
 	}
-	err := service.Save(metric)
+	err := service.Save(context.Background(), metric)
 	if err != nil {
 		logger.Log().Fatal("failed to save metric; error:" + err.Error())
 	}
@@ -68,7 +69,7 @@ func ExampleHandler_JSONGetHandler() {
 		Mtype: model.MetricTypeGauge,
 		Value: &value,
 	}
-	err := service.Save(metric)
+	err := service.Save(context.Background(), metric)
 	if err != nil {
 		logger.Log().Fatal("failed to save metric; error:" + err.Error())
 	}
@@ -146,7 +147,7 @@ func ExampleHandler_GetHandler() {
 		Value: &value,
 	}
 
-	err := service.Save(metric)
+	err := service.Save(context.Background(), metric)
 	if err != nil {
 		logger.Log().Fatal("failed to save metric; error:" + err.Error())
 	}
@@ -237,7 +238,7 @@ func ExampleHandler_GetAllHandler() {
 			Value: &value,
 		},
 	}
-	err := service.SaveAll(metrics)
+	err := service.SaveAll(context.Background(), metrics)
 	if err != nil {
 		logger.Log().Fatal("failed to save all metrics; error:" + err.Error())
 	}
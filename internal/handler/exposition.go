@@ -0,0 +1,115 @@
+package handler
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/SmoothWay/metrics/internal/model"
+)
+
+// ExpositionHandler - responds with all metrics in Prometheus text exposition format
+func (h *Handler) ExpositionHandler(w http.ResponseWriter, r *http.Request) {
+	metrics, err := h.service(r).GetAll(r.Context())
+	if err != nil {
+		serviceErrorResponse(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeExposition(w, metrics)
+}
+
+// writeExposition - writes metrics grouped by name, every group is preceded by # HELP and # TYPE lines
+func writeExposition(w io.Writer, metrics []model.Metrics) {
+	sort.SliceStable(metrics, func(i, j int) bool {
+		if metrics[i].ID != metrics[j].ID {
+			return metrics[i].ID < metrics[j].ID
+		}
+		return metrics[i].Key() < metrics[j].Key()
+	})
+
+	var current string
+	for _, m := range metrics {
+		name := promName(m.ID)
+		if m.ID != current {
+			current = m.ID
+			if help := helpText(m.Meta); help != "" {
+				fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+			}
+			fmt.Fprintf(w, "# TYPE %s %s\n", name, m.Mtype)
+		}
+
+		switch m.Mtype {
+		case model.MetricTypeGauge:
+			fmt.Fprintf(w, "%s%s %s\n", name, promLabels(m.Labels, ""), strconv.FormatFloat(*m.Value, 'g', -1, 64))
+		case model.MetricTypeCounter:
+			fmt.Fprintf(w, "%s%s %d\n", name, promLabels(m.Labels, ""), *m.Delta)
+		case model.MetricTypeHistogram:
+			var cumulative uint64
+			for i, bound := range m.Histogram.Buckets {
+				cumulative += m.Histogram.Counts[i]
+				le := strconv.FormatFloat(bound, 'g', -1, 64)
+				fmt.Fprintf(w, "%s_bucket%s %d\n", name, promLabels(m.Labels, le), cumulative)
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, promLabels(m.Labels, "+Inf"), m.Histogram.Count)
+			fmt.Fprintf(w, "%s_sum%s %s\n", name, promLabels(m.Labels, ""), strconv.FormatFloat(m.Histogram.Sum, 'g', -1, 64))
+			fmt.Fprintf(w, "%s_count%s %d\n", name, promLabels(m.Labels, ""), m.Histogram.Count)
+		}
+	}
+}
+
+// helpText - builds help line from description, unit and owner
+func helpText(meta *model.Metadata) string {
+	if meta == nil {
+		return ""
+	}
+	var details []string
+	if meta.Unit != "" {
+		details = append(details, "unit: "+meta.Unit)
+	}
+	if meta.Owner != "" {
+		details = append(details, "owner: "+meta.Owner)
+	}
+	help := meta.Description
+	if len(details) > 0 {
+		help = strings.TrimSpace(help + " (" + strings.Join(details, ", ") + ")")
+	}
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
+
+// promLabels - formats labels sorted by name, le label of histogram bucket is added if not empty
+func promLabels(labels map[string]string, le string) string {
+	if len(labels) == 0 && le == "" {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	pairs := make([]string, 0, len(keys)+1)
+	for _, k := range keys {
+		pairs = append(pairs, promName(k)+`="`+escape.Replace(labels[k])+`"`)
+	}
+	if le != "" {
+		pairs = append(pairs, `le="`+le+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// promName - replaces characters which are not allowed in Prometheus names with underscore
+func promName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		valid := c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 0 && c >= '0' && c <= '9')
+		if !valid {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
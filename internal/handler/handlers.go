@@ -3,7 +3,6 @@ package handler
 
 import (
 	"bytes"
-	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,6 +10,7 @@ import (
 	"io"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -18,11 +18,26 @@ import (
 
 	"github.com/SmoothWay/metrics/internal/logger"
 	"github.com/SmoothWay/metrics/internal/model"
+	"github.com/SmoothWay/metrics/internal/query"
+	"github.com/SmoothWay/metrics/internal/ratelimit"
 	"github.com/SmoothWay/metrics/internal/service"
+	"github.com/SmoothWay/metrics/internal/tenant"
+)
+
+const (
+	defaultRateWindow   = 5 * time.Minute
+	defaultHistoryRange = time.Hour
+
+	defaultCardinalityLimit = 10
 )
 
 type Handler struct {
-	s *service.Service
+	s          *service.Service
+	tokens     *tenant.Registry
+	adminToken string
+	limiter    *ratelimit.Limiter
+	quota      *ratelimit.Quota
+	proxies    ratelimit.Proxies
 }
 
 func NewHandler(s *service.Service) *Handler {
@@ -32,6 +47,19 @@ func NewHandler(s *service.Service) *Handler {
 	}
 }
 
+// WithTenants - enables multi-tenancy: requests must carry API token issued by registry,
+// tokens are managed through admin endpoints authorized by adminToken
+func (h *Handler) WithTenants(tokens *tenant.Registry, adminToken string) *Handler {
+	h.tokens = tokens
+	h.adminToken = adminToken
+	return h
+}
+
+// service - returns service scoped to tenant of request
+func (h *Handler) service(r *http.Request) *service.Service {
+	return h.s.ForTenant(tenant.FromContext(r.Context()))
+}
+
 // Router Registers all routes and middlewares of server
 // hash - string to check hashed incomming data
 func Router(h *Handler, hash, trustedSubnet string, privateKey []byte) chi.Router {
@@ -39,6 +67,7 @@ func Router(h *Handler, hash, trustedSubnet string, privateKey []byte) chi.Route
 	mw := NewMiddleware(hash)
 	trustNet := TrustedSubnetFromString(trustedSubnet)
 	logger.Log().Info("trusSubnet", zap.Any("net", trustNet))
+	r.Use(keepPeer)
 	r.Use(middleware.RealIP)
 	r.Use(mw.requestLogger)
 	r.Use(mw.decompresser)
@@ -54,6 +83,26 @@ func Router(h *Handler, hash, trustedSubnet string, privateKey []byte) chi.Route
 
 	r.Mount("/debug", middleware.Profiler())
 
+	if h.tokens != nil {
+		r.Route("/api/v1/admin/tokens", func(r chi.Router) {
+			r.Use(h.adminOnly)
+			r.Get("/", h.ListTokensHandler)
+			r.Post("/", h.CreateTokenHandler)
+			r.Delete("/{tokenID}", h.RevokeTokenHandler)
+		})
+	}
+
+	r.Group(func(r chi.Router) {
+		r.Use(h.resolveTenant)
+		r.Use(h.rateLimit)
+		h.routes(r)
+	})
+
+	return r
+}
+
+func (h *Handler) routes(r chi.Router) {
+
 	r.Get("/", h.GetAllHandler)
 	r.Get("/ping", h.PingHandler)
 	r.Get("/value/{metricType}/{metricName}", h.GetHandler)
@@ -62,15 +111,24 @@ func Router(h *Handler, hash, trustedSubnet string, privateKey []byte) chi.Route
 	r.Post("/update/", h.JSONUpdateHandler)
 	r.Post("/updates/", h.SetAllMetrics)
 
-	return r
+	r.Get("/api/v1/rate/{metricName}", h.RateHandler)
+	r.Get("/api/v1/history/{metricType}/{metricName}", h.HistoryHandler)
+	r.Get("/api/v1/query", h.QueryHandler)
+	r.Get("/api/v1/cardinality", h.CardinalityHandler)
+	r.Get("/api/v1/metadata", h.ListMetadataHandler)
+	r.Get("/api/v1/metadata/{metricName}", h.GetMetadataHandler)
+	r.Put("/api/v1/metadata/{metricName}", h.SetMetadataHandler)
+	r.With(h.adminOnly).Post("/api/v1/admin/retype/{metricName}", h.RetypeHandler)
+	r.Get("/metrics", h.ExpositionHandler)
 }
 
 // PingHandler - can be used to check if service connected to database
 func (h *Handler) PingHandler(w http.ResponseWriter, r *http.Request) {
-	err := h.s.PingStorage()
+	err := h.service(r).PingStorage(r.Context())
 	if err != nil {
 		logger.Log().Info("error pinging DB", zap.Error(err))
-		w.WriteHeader(http.StatusInternalServerError)
+		status, _ := service.ErrorCode(err)
+		w.WriteHeader(status)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -89,19 +147,19 @@ func (h *Handler) JSONUpdateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	logger.Log().Info("jsonMetric", zap.Any("jsonMetric", jsonMetric))
-	err = h.s.Save(jsonMetric)
+	if !h.checkSeries(w, r, jsonMetric) {
+		return
+	}
+	err = h.service(r).Save(r.Context(), jsonMetric)
 	if err != nil {
-		badRequestResponse(w, r, err)
+		serviceErrorResponse(w, r, err)
 		return
 	}
+	h.chargeSeries(r, jsonMetric)
 
-	err = h.s.Retrieve(&jsonMetric)
+	err = h.service(r).Retrieve(r.Context(), &jsonMetric)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			notFoundResponse(w, r)
-			return
-		}
-		serverErrorResponse(w, r, err)
+		serviceErrorResponse(w, r, err)
 		return
 	}
 	writeJSON(w, http.StatusOK, jsonMetric)
@@ -120,9 +178,9 @@ func (h *Handler) JSONGetHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = h.s.Retrieve(&jsonMetric)
+	err = h.service(r).Retrieve(r.Context(), &jsonMetric)
 	if err != nil {
-		notFoundResponse(w, r)
+		serviceErrorResponse(w, r, err)
 		return
 	}
 
@@ -155,19 +213,39 @@ func (h *Handler) UpdateHandler(w http.ResponseWriter, r *http.Request) {
 
 		metrics.Delta = &counterValue
 
+	} else if metrics.Mtype == model.MetricTypeHistogram {
+		observation, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			badRequestResponse(w, r, err)
+			return
+		}
+
+		if !h.checkSeries(w, r, metrics) {
+			return
+		}
+		if err = h.service(r).Observe(r.Context(), metrics.ID, observation); err != nil {
+			serviceErrorResponse(w, r, err)
+			return
+		}
+		h.chargeSeries(r, metrics)
+
+		w.Header().Add("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		return
+
 	} else {
 		badRequestResponse(w, r, errors.New("invalid metric type"))
 		return
 	}
 
-	if err := h.s.Save(metrics); err != nil {
-		if err == sql.ErrNoRows {
-			notFoundResponse(w, r)
-			return
-		}
-		badRequestResponse(w, r, err)
+	if !h.checkSeries(w, r, metrics) {
+		return
+	}
+	if err := h.service(r).Save(r.Context(), metrics); err != nil {
+		serviceErrorResponse(w, r, err)
 		return
 	}
+	h.chargeSeries(r, metrics)
 
 	w.Header().Add("Content-Type", "text/plain")
 	w.WriteHeader(http.StatusOK)
@@ -181,10 +259,9 @@ func (h *Handler) GetHandler(w http.ResponseWriter, r *http.Request) {
 	metrics.Mtype = chi.URLParam(r, "metricType")
 	metrics.ID = chi.URLParam(r, "metricName")
 
-	err := h.s.Retrieve(&metrics)
+	err := h.service(r).Retrieve(r.Context(), &metrics)
 	if err != nil {
-		logger.Log().Info("error retrieving value", zap.Error(err))
-		notFoundResponse(w, r)
+		serviceErrorResponse(w, r, err)
 		return
 	}
 
@@ -192,6 +269,8 @@ func (h *Handler) GetHandler(w http.ResponseWriter, r *http.Request) {
 		result = fmt.Sprintf("%g", *metrics.Value)
 	} else if metrics.Mtype == model.MetricTypeCounter {
 		result = fmt.Sprintf("%d", *metrics.Delta)
+	} else if metrics.Mtype == model.MetricTypeHistogram {
+		result = formatHistogram(*metrics.Histogram)
 	}
 
 	w.Header().Set("Content-Type", "text/plain")
@@ -215,17 +294,29 @@ func (h *Handler) SetAllMetrics(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = h.s.SaveAll(metrics)
+	if !h.checkSeries(w, r, metrics...) {
+		return
+	}
+	applied, err := h.service(r).SaveAllOnce(r.Context(), metrics, r.Header.Get(model.IdempotencyKeyHeader))
 	if err != nil {
-		serverErrorResponse(w, r, err)
+		serviceErrorResponse(w, r, err)
 		return
 	}
+	h.chargeSeries(r, metrics...)
+	if !applied {
+		// batch was already applied, duplicate is acknowledged without saving it again
+		w.Header().Set("Idempotent-Replayed", "true")
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
 // GetAllHandler - responds with all metrics which are in storage
 func (h *Handler) GetAllHandler(w http.ResponseWriter, r *http.Request) {
-	metrics := h.s.GetAll()
+	metrics, err := h.service(r).GetAll(r.Context())
+	if err != nil {
+		serviceErrorResponse(w, r, err)
+		return
+	}
 
 	tmpl, err := template.New("metrics").Parse(model.HTMLTemplate)
 	if err != nil {
@@ -241,3 +332,129 @@ func (h *Handler) GetAllHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html")
 	w.Write(buf.Bytes())
 }
+
+// RateHandler - computes rate, irate or increase of counter over time window.
+// Function and window are passed in "func" and "window" query params, defaults are rate and 5m
+func (h *Handler) RateHandler(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "metricName")
+
+	fn := r.URL.Query().Get("func")
+	if fn == "" {
+		fn = model.RateFuncRate
+	}
+
+	window := defaultRateWindow
+	if param := r.URL.Query().Get("window"); param != "" {
+		var err error
+		window, err = time.ParseDuration(param)
+		if err != nil {
+			badRequestResponse(w, r, err)
+			return
+		}
+	}
+
+	result, err := h.service(r).CounterRate(r.Context(), name, fn, window)
+	if err != nil {
+		serviceErrorResponse(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// HistoryHandler - responds with history of metric between "from" and "to" query params in RFC3339.
+// Defaults are last hour. Resolution of history depends on how old requested range is
+func (h *Handler) HistoryHandler(w http.ResponseWriter, r *http.Request) {
+	mtype := chi.URLParam(r, "metricType")
+	name := chi.URLParam(r, "metricName")
+
+	to := time.Now()
+	if param := r.URL.Query().Get("to"); param != "" {
+		var err error
+		to, err = time.Parse(time.RFC3339, param)
+		if err != nil {
+			badRequestResponse(w, r, err)
+			return
+		}
+	}
+
+	from := to.Add(-defaultHistoryRange)
+	if param := r.URL.Query().Get("from"); param != "" {
+		var err error
+		from, err = time.Parse(time.RFC3339, param)
+		if err != nil {
+			badRequestResponse(w, r, err)
+			return
+		}
+	}
+
+	result, err := h.service(r).History(r.Context(), mtype, name, from, to)
+	if err != nil {
+		serviceErrorResponse(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// QueryHandler - evaluates expression passed in "query" param, e.g. sum by (host) (HeapAlloc)
+func (h *Handler) QueryHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query().Get("query")
+	if q == "" {
+		badRequestResponse(w, r, errors.New("query param is required"))
+		return
+	}
+
+	result, err := query.New(h.service(r)).Query(r.Context(), q)
+	if err != nil {
+		if errors.Is(err, query.ErrSyntax) || errors.Is(err, query.ErrEvaluate) {
+			errorResponse(w, r, http.StatusBadRequest, err, err.Error())
+			return
+		}
+		serviceErrorResponse(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// CardinalityHandler - responds with metric name prefixes having the most series, number of prefixes is passed
+// in "limit" query param, default is 10
+func (h *Handler) CardinalityHandler(w http.ResponseWriter, r *http.Request) {
+	limit := defaultCardinalityLimit
+	if param := r.URL.Query().Get("limit"); param != "" {
+		var err error
+		limit, err = strconv.Atoi(param)
+		if err != nil || limit <= 0 {
+			badRequestResponse(w, r, errors.New("limit must be positive integer"))
+			return
+		}
+	}
+
+	prefixes, err := h.service(r).TopPrefixes(r.Context(), limit)
+	if err != nil {
+		serviceErrorResponse(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, prefixes)
+}
+
+// RetypeHandler - admin override moving metric name passed in URL to type passed in JSON body,
+// value stored under previous type is converted or dropped
+func (h *Handler) RetypeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Type string `json:"type"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		badRequestResponse(w, r, err)
+		return
+	}
+	defer r.Body.Close()
+
+	name := chi.URLParam(r, "metricName")
+	if err := h.service(r).Retype(r.Context(), name, input.Type); err != nil {
+		serviceErrorResponse(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, envelope{"id": name, "type": input.Type})
+}
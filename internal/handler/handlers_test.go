@@ -2,18 +2,23 @@ package handler
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/SmoothWay/metrics/internal/logger"
 	"github.com/SmoothWay/metrics/internal/model"
+	"github.com/SmoothWay/metrics/internal/ratelimit"
 	"github.com/SmoothWay/metrics/internal/repository/memstorage"
 	"github.com/SmoothWay/metrics/internal/service"
+	"github.com/SmoothWay/metrics/internal/tenant"
 )
 
 func TestHandler_UpdateHandler(t *testing.T) {
@@ -34,6 +39,8 @@ func TestHandler_UpdateHandler(t *testing.T) {
 
 		{name: "simple gauge request", method: http.MethodPost, endpoint: "/update/gauge/Alloc/123", expectedCode: 200},
 		{name: "simple counter request", method: http.MethodPost, endpoint: "/update/counter/PollCounter/2", expectedCode: 200},
+		{name: "histogram observation", method: http.MethodPost, endpoint: "/update/histogram/Latency/0.25", expectedCode: 200},
+		{name: "bad histogram observation", method: http.MethodPost, endpoint: "/update/histogram/Latency/fast", expectedCode: 400},
 		{name: "bad request #1", method: http.MethodPost, endpoint: "/update/gauge/444/Cpu", expectedCode: 400},
 		{name: "bad request #2", method: http.MethodPost, endpoint: "/update/bad/url/send/to", expectedCode: 404},
 		{name: "not allowed method", method: http.MethodPut, endpoint: "/update/gauge/memory/555", expectedCode: 405},
@@ -71,7 +78,7 @@ func TestHandler_GetHandler(t *testing.T) {
 			Value: &value,
 		},
 	}
-	err := service.SaveAll(metrics)
+	err := service.SaveAll(context.Background(), metrics)
 	if err != nil {
 		logger.Log().Fatal("failed to save all metrics; error:" + err.Error())
 	}
@@ -85,6 +92,8 @@ func TestHandler_GetHandler(t *testing.T) {
 		{name: "simple gauge request", method: http.MethodGet, endpoint: "/value/gauge/Alloc", expectedCode: 200},
 		{name: "simple counter request", method: http.MethodGet, endpoint: "/value/counter/PollCounter", expectedCode: 200},
 		{name: "not found", method: http.MethodGet, endpoint: "/value/gauge/Free", expectedCode: 404},
+		{name: "not found counter", method: http.MethodGet, endpoint: "/value/counter/Free", expectedCode: 404},
+		{name: "invalid type", method: http.MethodGet, endpoint: "/value/bad/Alloc", expectedCode: 400},
 		{name: "not allowed method", method: http.MethodPut, endpoint: "/value/gauge/memory", expectedCode: 405},
 	}
 
@@ -148,6 +157,264 @@ func TestHandler_SetAllMetrics(t *testing.T) {
 	}
 }
 
+func TestHandler_SetAllMetricsIdempotent(t *testing.T) {
+	logger.Init("error")
+	serv := service.New(memstorage.New(nil))
+	ts := httptest.NewServer(Router(NewHandler(serv), "", "", []byte("")))
+	defer ts.Close()
+
+	body := []byte(`[{"id":"PollCount","type":"counter","delta":3}]`)
+	send := func(key string) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/updates/", bytes.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set(model.IdempotencyKeyHeader, key)
+		resp, err := ts.Client().Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := send("batch-1")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("Idempotent-Replayed"))
+
+	resp = send("batch-1")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "true", resp.Header.Get("Idempotent-Replayed"))
+
+	m := model.Metrics{ID: "PollCount", Mtype: model.MetricTypeCounter}
+	require.NoError(t, serv.Retrieve(context.Background(), &m))
+	assert.Equal(t, int64(3), *m.Delta, "retried batch must not be counted twice")
+}
+
+func TestHandler_SetAllMetricsRejected(t *testing.T) {
+	logger.Init("error")
+	serv := service.New(memstorage.New(nil))
+	ts := httptest.NewServer(Router(NewHandler(serv), "", "", []byte("")))
+	defer ts.Close()
+
+	body := []byte(`[{"id":"PollCount","type":"counter","delta":3},{"id":"Alloc","type":"gauge"},{"id":"Frees","type":"summary"}]`)
+	resp := testRequest(t, ts, http.MethodPost, "/updates/", &body)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	var got struct {
+		Items []struct {
+			Index int    `json:"index"`
+			ID    string `json:"id"`
+			Error string `json:"error"`
+		} `json:"items"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&got))
+	require.Len(t, got.Items, 2)
+	assert.Equal(t, 1, got.Items[0].Index)
+	assert.Equal(t, "Alloc", got.Items[0].ID)
+	assert.Equal(t, 2, got.Items[1].Index)
+	assert.NotEmpty(t, got.Items[1].Error)
+
+	m := model.Metrics{ID: "PollCount", Mtype: model.MetricTypeCounter}
+	assert.Error(t, serv.Retrieve(context.Background(), &m), "valid metric of rejected batch must not be saved")
+}
+
+func TestHandler_RateHandler(t *testing.T) {
+	logger.Init("error")
+	repo := memstorage.New(nil)
+	service := service.New(repo)
+	h := NewHandler(service)
+	ts := httptest.NewServer(Router(h, "", "", []byte("")))
+	defer ts.Close()
+
+	for _, endpoint := range []string{"/update/counter/Requests/1", "/update/counter/Requests/2"} {
+		resp := testRequest(t, ts, http.MethodPost, endpoint, nil)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	tests := []struct {
+		name         string
+		endpoint     string
+		expectedCode int
+	}{
+		{name: "increase", endpoint: "/api/v1/rate/Requests?func=increase&window=1m", expectedCode: 200},
+		{name: "unknown function", endpoint: "/api/v1/rate/Requests?func=deriv", expectedCode: 400},
+		{name: "bad window", endpoint: "/api/v1/rate/Requests?window=five", expectedCode: 400},
+		{name: "no samples", endpoint: "/api/v1/rate/Unknown", expectedCode: 404},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := testRequest(t, ts, http.MethodGet, tt.endpoint, nil)
+			defer resp.Body.Close()
+			assert.Equal(t, tt.expectedCode, resp.StatusCode)
+			if tt.expectedCode != http.StatusOK {
+				return
+			}
+			var result model.RateResult
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+			assert.Equal(t, float64(2), result.Value)
+		})
+	}
+}
+
+func TestHandler_Tenants(t *testing.T) {
+	logger.Init("error")
+	repo := memstorage.New(nil)
+	serv := service.New(repo)
+	serv.SetTenants(func(id string) service.Repository { return repo.Tenant(id) }, repo.Tenants)
+
+	tokens, err := tenant.NewRegistry("")
+	require.NoError(t, err)
+	h := NewHandler(serv).WithTenants(tokens, "admin-secret")
+	ts := httptest.NewServer(Router(h, "", "", []byte("")))
+	defer ts.Close()
+
+	do := func(method, path string, header map[string]string, body string) *http.Response {
+		req, err := http.NewRequest(method, ts.URL+path, bytes.NewBufferString(body))
+		require.NoError(t, err)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := ts.Client().Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+	createToken := func(tenantID string) string {
+		resp := do(http.MethodPost, "/api/v1/admin/tokens/", map[string]string{tenant.AdminHeader: "admin-secret"}, `{"tenant":"`+tenantID+`"}`)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		var created struct {
+			Token string `json:"token"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+		return created.Token
+	}
+
+	resp := do(http.MethodPost, "/api/v1/admin/tokens/", map[string]string{tenant.AdminHeader: "wrong"}, `{"tenant":"acme"}`)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	acme := createToken("acme")
+	globex := createToken("globex")
+
+	resp = do(http.MethodPost, "/update/gauge/Alloc/1", nil, "")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "request without token must be rejected")
+
+	resp = do(http.MethodPost, "/update/gauge/Alloc/42", map[string]string{tenant.Header: acme}, "")
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = do(http.MethodGet, "/value/gauge/Alloc", map[string]string{tenant.Header: acme}, "")
+	value, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "42", string(value))
+
+	resp = do(http.MethodGet, "/value/gauge/Alloc", map[string]string{tenant.Header: globex}, "")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "tenant must not see metrics of other tenant")
+
+	tenants, err := serv.Tenants()
+	require.NoError(t, err)
+	assert.Contains(t, tenants, "acme")
+}
+
+func TestHandler_RateLimit(t *testing.T) {
+	logger.Init("error")
+	limiter, err := ratelimit.NewLimiter(1, 3)
+	require.NoError(t, err)
+	h := NewHandler(service.New(memstorage.New(nil))).WithRateLimit(limiter, ratelimit.NewQuota(1))
+	ts := httptest.NewServer(Router(h, "", "", []byte("")))
+	defer ts.Close()
+
+	resp := testRequest(t, ts, http.MethodPost, "/update/gauge/1Alloc/1", nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "rejected series must not use quota")
+
+	resp = testRequest(t, ts, http.MethodPost, "/update/gauge/Alloc/1", nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = testRequest(t, ts, http.MethodPost, "/update/gauge/HeapSys/1", nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode, "second series must exceed quota")
+	assert.Equal(t, "60", resp.Header.Get("Retry-After"))
+
+	resp = testRequest(t, ts, http.MethodPost, "/update/gauge/Alloc/2", nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode, "burst must be exhausted")
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+}
+
+func TestHandler_RateLimitClientKey(t *testing.T) {
+	logger.Init("error")
+	do := func(ts *httptest.Server, realIP string) int {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/ping", nil)
+		require.NoError(t, err)
+		req.Header.Set("X-Real-IP", realIP)
+		resp, err := ts.Client().Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	limiter, err := ratelimit.NewLimiter(1, 1)
+	require.NoError(t, err)
+	h := NewHandler(service.New(memstorage.New(nil))).WithRateLimit(limiter, nil)
+	ts := httptest.NewServer(Router(h, "", "", []byte("")))
+	defer ts.Close()
+	assert.Equal(t, http.StatusOK, do(ts, "198.51.100.1"))
+	assert.Equal(t, http.StatusTooManyRequests, do(ts, "198.51.100.2"), "header of client must not give fresh bucket")
+
+	proxies, err := ratelimit.ParseProxies("127.0.0.0/8,::1/128")
+	require.NoError(t, err)
+	limiter, err = ratelimit.NewLimiter(1, 1)
+	require.NoError(t, err)
+	h = NewHandler(service.New(memstorage.New(nil))).WithRateLimit(limiter, nil).WithTrustedProxies(proxies)
+	proxied := httptest.NewServer(Router(h, "", "", []byte("")))
+	defer proxied.Close()
+	assert.Equal(t, http.StatusOK, do(proxied, "198.51.100.1"))
+	assert.Equal(t, http.StatusOK, do(proxied, "198.51.100.2"), "header of trusted proxy identifies client")
+	assert.Equal(t, http.StatusTooManyRequests, do(proxied, "198.51.100.1"))
+}
+
+func TestHandler_Metadata(t *testing.T) {
+	logger.Init("error")
+	h := NewHandler(service.New(memstorage.New(nil)))
+	ts := httptest.NewServer(Router(h, "", "", []byte("")))
+	defer ts.Close()
+
+	body := []byte(`{"unit":"bytes","description":"Bytes of allocated heap objects","owner":"runtime"}`)
+	resp := testRequest(t, ts, http.MethodPut, "/api/v1/metadata/Alloc", &body)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = testRequest(t, ts, http.MethodPut, "/api/v1/metadata/bad%20name", &body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	for _, endpoint := range []string{"/update/gauge/Alloc/1024", "/update/counter/PollCount/3", "/update/histogram/Latency/0.2"} {
+		resp = testRequest(t, ts, http.MethodPost, endpoint, nil)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	value := []byte(`{"id":"Alloc","type":"gauge"}`)
+	resp = testRequest(t, ts, http.MethodPost, "/value/", &value)
+	var metric model.Metrics
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&metric))
+	resp.Body.Close()
+	require.NotNil(t, metric.Meta)
+	assert.Equal(t, "bytes", metric.Meta.Unit)
+
+	resp = testRequest(t, ts, http.MethodGet, "/metrics", nil)
+	exposition, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Contains(t, string(exposition), "# HELP Alloc Bytes of allocated heap objects (unit: bytes, owner: runtime)\n# TYPE Alloc gauge\nAlloc 1024\n")
+	assert.Contains(t, string(exposition), "# TYPE PollCount counter\nPollCount 3\n")
+	assert.Contains(t, string(exposition), "Latency_bucket{le=\"+Inf\"} 1\n")
+}
+
 func testRequest(t *testing.T, ts *httptest.Server, method, path string, body *[]byte) *http.Response {
 	var req *http.Request
 	var err error
@@ -163,3 +430,125 @@ func testRequest(t *testing.T, ts *httptest.Server, method, path string, body *[
 
 	return resp
 }
+
+// slowRepository storage which doesn't answer about counters until context is done
+type slowRepository struct {
+	*memstorage.MemStorage
+}
+
+func (r slowRepository) SetCounterMetric(ctx context.Context, key string, value int64) (int64, error) {
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+func (r slowRepository) GetCounterMetric(ctx context.Context, key string) (int64, error) {
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+func TestHandler_StorageTimeout(t *testing.T) {
+	logger.Init("error")
+	serv := service.New(slowRepository{memstorage.New(nil)})
+	serv.SetTimeouts(service.Timeouts{Read: 10 * time.Millisecond, Write: 10 * time.Millisecond})
+	ts := httptest.NewServer(Router(NewHandler(serv), "", "", []byte("")))
+	defer ts.Close()
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   []byte
+	}{
+		{name: "update", method: http.MethodPost, path: "/update/counter/PollCount/1"},
+		{name: "json update", method: http.MethodPost, path: "/update/", body: []byte(`{"id":"PollCount","type":"counter","delta":1}`)},
+		{name: "get", method: http.MethodGet, path: "/value/counter/PollCount"},
+		{name: "json get", method: http.MethodPost, path: "/value/", body: []byte(`{"id":"PollCount","type":"counter"}`)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body *[]byte
+			if tt.body != nil {
+				body = &tt.body
+			}
+			resp := testRequest(t, ts, tt.method, tt.path, body)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+		})
+	}
+}
+
+func TestHandler_TypeConflict(t *testing.T) {
+	logger.Init("error")
+	repo := memstorage.New(nil)
+	serv := service.New(repo)
+	serv.SetTenants(func(id string) service.Repository { return repo.Tenant(id) }, repo.Tenants)
+	tokens, err := tenant.NewRegistry("")
+	require.NoError(t, err)
+	token, _, err := tokens.Create("acme")
+	require.NoError(t, err)
+	ts := httptest.NewServer(Router(NewHandler(serv).WithTenants(tokens, "admin-secret"), "", "", []byte("")))
+	defer ts.Close()
+
+	do := func(method, path string, header map[string]string, body string) *http.Response {
+		req, err := http.NewRequest(method, ts.URL+path, bytes.NewBufferString(body))
+		require.NoError(t, err)
+		req.Header.Set(tenant.Header, token)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := ts.Client().Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp := do(http.MethodPost, "/update/gauge/Alloc/42", nil, "")
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = do(http.MethodPost, "/update/counter/Alloc/1", nil, "")
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusConflict, resp.StatusCode, "name of gauge must not be reused by counter")
+	assert.Equal(t, service.ReasonTypeConflict, body.Reason)
+
+	resp = do(http.MethodPost, "/updates/", nil, `[{"id":"Free","type":"gauge","value":1},{"id":"Free","type":"counter","delta":1}]`)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "batch reusing name within itself must be rejected")
+
+	resp = do(http.MethodPost, "/api/v1/admin/retype/Alloc", nil, `{"type":"counter"}`)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "retype requires admin token")
+
+	resp = do(http.MethodPost, "/api/v1/admin/retype/Alloc", map[string]string{tenant.AdminHeader: "admin-secret"}, `{"type":"counter"}`)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = do(http.MethodPost, "/update/counter/Alloc/1", nil, "")
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = do(http.MethodGet, "/value/counter/Alloc", nil, "")
+	value, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "43", string(value), "gauge value must be converted into counter")
+}
+
+func TestServer_Reload(t *testing.T) {
+	logger.Init("error")
+	srv := NewServer("", NewHandler(service.New(memstorage.New(nil))), "", "127.0.0.0/8", nil)
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	resp := testRequest(t, ts, http.MethodPost, "/update/gauge/Alloc/1", nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	srv.Reload("", "10.0.0.0/8", nil)
+	resp = testRequest(t, ts, http.MethodPost, "/update/gauge/Alloc/1", nil)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "request from outside of new trusted subnet must be rejected")
+}
@@ -1,14 +1,21 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"strings"
+	"time"
 
 	"go.uber.org/zap"
 
 	"github.com/SmoothWay/metrics/internal/logger"
+	"github.com/SmoothWay/metrics/internal/model"
+	"github.com/SmoothWay/metrics/internal/ratelimit"
+	"github.com/SmoothWay/metrics/internal/service"
 )
 
 type envelope map[string]any
@@ -43,12 +50,76 @@ func badRequestResponse(w http.ResponseWriter, r *http.Request, err error) {
 	errorResponse(w, r, http.StatusBadRequest, err, message)
 }
 
-// serverErrorResponse wrapper for sending 500 internal error response
+// serverErrorResponse wrapper for sending 500 internal error response, storage timeout is 504 response
 func serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		gatewayTimeoutResponse(w, r, err)
+		return
+	}
 	message := "the server encountered a problem and could not process your request"
 	errorResponse(w, r, http.StatusInternalServerError, err, message)
 }
 
+// gatewayTimeoutResponse wrapper for sending 504 response when storage didn't answer in time
+func gatewayTimeoutResponse(w http.ResponseWriter, r *http.Request, err error) {
+	message := "storage did not respond in time"
+	errorResponse(w, r, http.StatusGatewayTimeout, err, message)
+}
+
+// unauthorizedResponse wrapper for sending 401 unauthorized response
+func unauthorizedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "invalid or missing authentication token"
+	env := envelope{"error": message}
+
+	writeJSON(w, http.StatusUnauthorized, env)
+}
+
+// tooManyRequestsResponse wrapper for sending 429 too many requests response with Retry-After hint
+func tooManyRequestsResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	message := "rate limit exceeded, retry later"
+	env := envelope{"error": message}
+
+	w.Header().Set("Retry-After", ratelimit.RetryAfterSeconds(retryAfter))
+	writeJSON(w, http.StatusTooManyRequests, env)
+}
+
+// serviceErrorResponse wrapper for errors returned by service, status is chosen by service.ErrorCode
+// and response carries reason of error
+func serviceErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	var batchErr *model.BatchError
+	if errors.As(err, &batchErr) {
+		batchErrorResponse(w, r, batchErr)
+		return
+	}
+
+	status, reason := service.ErrorCode(err)
+	var message string
+	switch status {
+	case http.StatusNotFound:
+		message = "the required resource could not be found"
+	case http.StatusGatewayTimeout:
+		message = "storage did not respond in time"
+	case http.StatusInternalServerError:
+		message = "the server encountered a problem and could not process your request"
+	default:
+		message = err.Error()
+	}
+	logger.Log().Error("error handling request", zap.Int("status", status), zap.String("url", r.URL.String()), zap.Error(err))
+
+	writeJSON(w, status, envelope{"error": message, "reason": reason})
+}
+
+// batchErrorResponse wrapper for sending 400 response listing every rejected metric of batch
+func batchErrorResponse(w http.ResponseWriter, r *http.Request, err *model.BatchError) {
+	items := make([]envelope, len(err.Items))
+	for i, item := range err.Items {
+		items[i] = envelope{"index": item.Index, "id": item.ID, "type": item.Mtype, "error": item.Err.Error()}
+	}
+	logger.Log().Error("error handling request", zap.Int("status", http.StatusBadRequest), zap.String("url", r.URL.String()), zap.Error(err))
+
+	writeJSON(w, http.StatusBadRequest, envelope{"error": "batch rejected, no metrics were saved", "items": items})
+}
+
 // notFoundResponse wrapper for sending 404 not found response
 func notFoundResponse(w http.ResponseWriter, r *http.Request) {
 	message := "the required resource could not be found"
@@ -65,6 +136,20 @@ func methodNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusMethodNotAllowed, env)
 }
 
+// formatHistogram formats histogram as plain text lines of cumulative bucket counts, sum and count
+func formatHistogram(h model.Histogram) string {
+	var sb strings.Builder
+	var cumulative uint64
+	for i, bound := range h.Buckets {
+		cumulative += h.Counts[i]
+		fmt.Fprintf(&sb, "le=%g %d\n", bound, cumulative)
+	}
+	fmt.Fprintf(&sb, "le=+Inf %d\n", h.Count)
+	fmt.Fprintf(&sb, "sum %g\n", h.Sum)
+	fmt.Fprintf(&sb, "count %d\n", h.Count)
+	return sb.String()
+}
+
 func TrustedSubnetFromString(subnet string) *net.IPNet {
 	if subnet == "" {
 		return nil
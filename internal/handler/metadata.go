@@ -0,0 +1,50 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/SmoothWay/metrics/internal/model"
+)
+
+// SetMetadataHandler - sets unit, description and owner of metric name passed in URL
+func (h *Handler) SetMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	var meta model.Metadata
+	if err := json.NewDecoder(r.Body).Decode(&meta); err != nil {
+		badRequestResponse(w, r, err)
+		return
+	}
+	defer r.Body.Close()
+	meta.Name = chi.URLParam(r, "metricName")
+
+	if err := h.service(r).SetMetadata(r.Context(), meta); err != nil {
+		serviceErrorResponse(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, meta)
+}
+
+// GetMetadataHandler - responds with metadata of metric name passed in URL
+func (h *Handler) GetMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	meta, err := h.service(r).GetMetadata(r.Context(), chi.URLParam(r, "metricName"))
+	if err != nil {
+		serviceErrorResponse(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, meta)
+}
+
+// ListMetadataHandler - responds with metadata of all metric names
+func (h *Handler) ListMetadataHandler(w http.ResponseWriter, r *http.Request) {
+	all, err := h.service(r).AllMetadata(r.Context())
+	if err != nil {
+		serviceErrorResponse(w, r, err)
+		return
+	}
+	if all == nil {
+		all = []model.Metadata{}
+	}
+	writeJSON(w, http.StatusOK, all)
+}
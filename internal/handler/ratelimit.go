@@ -0,0 +1,88 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/SmoothWay/metrics/internal/model"
+	"github.com/SmoothWay/metrics/internal/ratelimit"
+	"github.com/SmoothWay/metrics/internal/tenant"
+)
+
+// WithRateLimit - enables limiting of requests rate and of number of distinct series per client, nil disables limit
+func (h *Handler) WithRateLimit(limiter *ratelimit.Limiter, quota *ratelimit.Quota) *Handler {
+	h.limiter = limiter
+	h.quota = quota
+	return h
+}
+
+// WithTrustedProxies - makes X-Real-IP header identify client for rate limiting if request comes from proxy
+func (h *Handler) WithTrustedProxies(proxies ratelimit.Proxies) *Handler {
+	h.proxies = proxies
+	return h
+}
+
+type peerKey struct{}
+
+// keepPeer - keeps transport address of request, RealIP middleware replaces RemoteAddr by address from headers
+func keepPeer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), peerKey{}, r.RemoteAddr)))
+	})
+}
+
+// clientKey - identifies client by tenant resolved from API token, or by IP address if tenants are disabled.
+// X-Real-IP header identifies client only if request comes from trusted proxy
+func (h *Handler) clientKey(r *http.Request) string {
+	if id := tenant.FromContext(r.Context()); id != "" {
+		return "tenant:" + id
+	}
+	peer, ok := r.Context().Value(peerKey{}).(string)
+	if !ok {
+		peer = r.RemoteAddr
+	}
+	return "ip:" + h.proxies.ClientIP(peer, r.Header.Get("X-Real-IP"))
+}
+
+// rateLimit - rejects requests of clients which exceeded requests rate
+func (h *Handler) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.limiter == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if ok, wait := h.limiter.Allow(h.clientKey(r)); !ok {
+			tooManyRequestsResponse(w, r, wait)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkSeries - checks series quota of client, responds with 429 and returns false if quota is exceeded.
+// Series are charged to quota by chargeSeries after they are saved
+func (h *Handler) checkSeries(w http.ResponseWriter, r *http.Request, metrics ...model.Metrics) bool {
+	if h.quota == nil {
+		return true
+	}
+	if !h.quota.Allow(h.clientKey(r), quotaSeries(metrics)) {
+		tooManyRequestsResponse(w, r, ratelimit.QuotaRetryAfter)
+		return false
+	}
+	return true
+}
+
+// chargeSeries - charges saved series to quota of client
+func (h *Handler) chargeSeries(r *http.Request, metrics ...model.Metrics) {
+	if h.quota != nil {
+		h.quota.Charge(h.clientKey(r), quotaSeries(metrics))
+	}
+}
+
+func quotaSeries(metrics []model.Metrics) []string {
+	series := make([]string, 0, len(metrics))
+	for _, m := range metrics {
+		series = append(series, m.Mtype+"/"+m.Key())
+	}
+	return series
+}
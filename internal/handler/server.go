@@ -3,20 +3,35 @@ package handler
 import (
 	"context"
 	"net/http"
+	"sync/atomic"
 )
 
 type server struct {
 	server *http.Server
+	h      *Handler
+	// router http.Handler built by Router, replaced by Reload
+	router atomic.Value
 }
 
 func NewServer(host string, h *Handler, key, trustedSubnet string, privateKey []byte) *server {
-	s := &http.Server{
+	srv := &server{h: h}
+	srv.router.Store(Router(h, key, trustedSubnet, privateKey))
+	srv.server = &http.Server{
 		Addr:    host,
-		Handler: Router(h, key, trustedSubnet, privateKey),
-	}
-	return &server{
-		server: s,
+		Handler: srv,
 	}
+	return srv
+}
+
+// ServeHTTP - serves request by the current router
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.router.Load().(http.Handler).ServeHTTP(w, r)
+}
+
+// Reload - replaces router with one checking requests by new key, trusted subnet and private key,
+// requests in flight are finished by the previous router
+func (s *server) Reload(key, trustedSubnet string, privateKey []byte) {
+	s.router.Store(Router(s.h, key, trustedSubnet, privateKey))
 }
 
 func (s *server) Run() error {
@@ -0,0 +1,102 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/SmoothWay/metrics/internal/tenant"
+)
+
+// resolveTenant - puts tenant of API token into request context, requests without valid token are rejected
+// when tenancy is enabled
+func (h *Handler) resolveTenant(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.tokens == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		id, ok := h.tokens.Resolve(r.Header.Get(tenant.Header))
+		if !ok {
+			unauthorizedResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(tenant.WithTenant(r.Context(), id)))
+	})
+}
+
+// adminOnly - allows requests carrying admin token
+func (h *Handler) adminOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get(tenant.AdminHeader)
+		if h.adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(h.adminToken)) != 1 {
+			unauthorizedResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// CreateTokenHandler - issues API token for tenant passed in JSON body, token value is shown only once
+func (h *Handler) CreateTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Tenant string `json:"tenant"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		badRequestResponse(w, r, err)
+		return
+	}
+	defer r.Body.Close()
+
+	value, token, err := h.tokens.Create(input.Tenant)
+	if err != nil {
+		if errors.Is(err, tenant.ErrInvalidTenant) {
+			errorResponse(w, r, http.StatusBadRequest, err, err.Error())
+			return
+		}
+		serverErrorResponse(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, envelope{
+		"id":         token.ID,
+		"tenant":     token.Tenant,
+		"token":      value,
+		"created_at": token.CreatedAt,
+	})
+}
+
+// ListTokensHandler - responds with issued tokens without their values
+func (h *Handler) ListTokensHandler(w http.ResponseWriter, r *http.Request) {
+	type tokenInfo struct {
+		ID        string    `json:"id"`
+		Tenant    string    `json:"tenant"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+	tokens := h.tokens.List()
+	result := make([]tokenInfo, 0, len(tokens))
+	for _, t := range tokens {
+		result = append(result, tokenInfo{ID: t.ID, Tenant: t.Tenant, CreatedAt: t.CreatedAt})
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// RevokeTokenHandler - revokes token by id
+func (h *Handler) RevokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	err := h.tokens.Revoke(chi.URLParam(r, "tokenID"))
+	if err != nil {
+		if errors.Is(err, tenant.ErrTokenNotFound) {
+			notFoundResponse(w, r)
+			return
+		}
+		serverErrorResponse(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
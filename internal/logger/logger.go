@@ -8,6 +8,7 @@ import (
 
 type Logger struct {
 	logger *zap.Logger
+	level  zap.AtomicLevel
 }
 
 var log *Logger
@@ -28,11 +29,21 @@ func Init(level string) error {
 		return err
 	}
 
-	log = &Logger{logger: zl}
+	log = &Logger{logger: zl, level: lvl}
 
 	return nil
 }
 
+// SetLevel changes level of initialized logger, messages logged concurrently are filtered by either level
+func SetLevel(level string) error {
+	lvl, err := zapcore.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	log.level.SetLevel(lvl)
+	return nil
+}
+
 // Info wrapper for info level log
 func (l *Logger) Info(title string, msg ...zapcore.Field) {
 
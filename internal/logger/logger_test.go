@@ -63,3 +63,15 @@ func TestLog(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, log)
 }
+
+func TestSetLevel(t *testing.T) {
+	assert.NoError(t, Init("info"))
+	assert.True(t, log.logger.Core().Enabled(zapcore.InfoLevel))
+
+	assert.NoError(t, SetLevel("warn"))
+	assert.False(t, log.logger.Core().Enabled(zapcore.InfoLevel))
+	assert.True(t, log.logger.Core().Enabled(zapcore.WarnLevel))
+
+	assert.Error(t, SetLevel("loud"))
+	assert.NoError(t, Init("info"))
+}
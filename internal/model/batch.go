@@ -0,0 +1,60 @@
+package model
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ItemError error of single metric of batch, Index is position of metric in batch
+type ItemError struct {
+	Index int
+	ID    string
+	Mtype string
+	Err   error
+}
+
+func (e ItemError) Error() string {
+	return fmt.Sprintf("metric %d (%s %s): %s", e.Index, e.Mtype, e.ID, e.Err)
+}
+
+func (e ItemError) Unwrap() error {
+	return e.Err
+}
+
+// BatchError is returned when some metrics of batch are rejected, none of metrics of batch are saved then
+type BatchError struct {
+	Items []ItemError
+}
+
+func (e *BatchError) Error() string {
+	msgs := make([]string, len(e.Items))
+	for i, item := range e.Items {
+		msgs[i] = item.Error()
+	}
+	return fmt.Sprintf("batch rejected, %d invalid metrics: %s", len(e.Items), strings.Join(msgs, "; "))
+}
+
+// Unwrap - returns errors of items, so errors.Is matches cause of any item
+func (e *BatchError) Unwrap() []error {
+	errs := make([]error, len(e.Items))
+	for i, item := range e.Items {
+		errs[i] = item
+	}
+	return errs
+}
+
+// Written - returns distinct series written by batch, by type and series key, in order they first appear in it.
+// Values of returned metrics are not set
+func Written(metrics []Metrics) []Metrics {
+	seen := make(map[[2]string]bool, len(metrics))
+	written := make([]Metrics, 0, len(metrics))
+	for _, m := range metrics {
+		series := [2]string{m.Mtype, m.ID}
+		if seen[series] {
+			continue
+		}
+		seen[series] = true
+		written = append(written, Metrics{ID: m.ID, Mtype: m.Mtype})
+	}
+	return written
+}
@@ -0,0 +1,20 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Domain errors shared by service and storages. Storages wrap them, so callers match them with errors.Is
+// whichever storage is used
+var (
+	ErrNotFound           = errors.New("metric not found")
+	ErrTypeConflict       = errors.New("metric name is already used by another type")
+	ErrInvalidValue       = errors.New("invalid metric value")
+	ErrStorageUnavailable = errors.New("storage unavailable")
+)
+
+// TypeConflict - returns ErrTypeConflict for series key which is stored with another type than written one
+func TypeConflict(key string) error {
+	return fmt.Errorf("%w: %s", ErrTypeConflict, key)
+}
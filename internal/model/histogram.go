@@ -0,0 +1,98 @@
+package model
+
+import (
+	"errors"
+	"sort"
+)
+
+var (
+	ErrInvalidBuckets = errors.New("histogram buckets must be sorted in increasing order")
+	ErrBucketMismatch = errors.New("histogram buckets do not match stored layout")
+)
+
+// DefaultBuckets default upper bounds used for histograms created from a single observation
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Histogram distribution of observed values.
+// Counts has one more element than Buckets, the last one counts observations above the largest bound
+type Histogram struct {
+	Buckets []float64 `json:"buckets"` // upper bounds of buckets
+	Counts  []uint64  `json:"counts"`  // number of observations per bucket
+	Sum     float64   `json:"sum"`     // sum of all observed values
+	Count   uint64    `json:"count"`   // number of observations
+}
+
+// NewHistogram - creates empty histogram with passed bucket bounds, DefaultBuckets are used if none passed
+func NewHistogram(buckets []float64) Histogram {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	b := make([]float64, len(buckets))
+	copy(b, buckets)
+	return Histogram{
+		Buckets: b,
+		Counts:  make([]uint64, len(b)+1),
+	}
+}
+
+// Observe - adds single value into histogram
+func (h *Histogram) Observe(value float64) {
+	i := sort.SearchFloat64s(h.Buckets, value)
+	h.Counts[i]++
+	h.Sum += value
+	h.Count++
+}
+
+// Validate - checks that buckets are sorted and counts are consistent with buckets
+func (h *Histogram) Validate() error {
+	if !sort.Float64sAreSorted(h.Buckets) {
+		return ErrInvalidBuckets
+	}
+	for i := 1; i < len(h.Buckets); i++ {
+		if h.Buckets[i] == h.Buckets[i-1] {
+			return ErrInvalidBuckets
+		}
+	}
+	if len(h.Counts) != len(h.Buckets)+1 {
+		return ErrBucketMismatch
+	}
+	var total uint64
+	for _, c := range h.Counts {
+		total += c
+	}
+	if total != h.Count {
+		return ErrBucketMismatch
+	}
+	return nil
+}
+
+// Merge - adds observations of other histogram, bucket layouts must be equal
+func (h *Histogram) Merge(other Histogram) error {
+	if len(h.Buckets) != len(other.Buckets) {
+		return ErrBucketMismatch
+	}
+	for i := range h.Buckets {
+		if h.Buckets[i] != other.Buckets[i] {
+			return ErrBucketMismatch
+		}
+	}
+	for i := range h.Counts {
+		h.Counts[i] += other.Counts[i]
+	}
+	h.Sum += other.Sum
+	h.Count += other.Count
+	return nil
+}
+
+// Copy - returns deep copy of histogram
+func (h Histogram) Copy() Histogram {
+	c := Histogram{
+		Buckets: make([]float64, len(h.Buckets)),
+		Counts:  make([]uint64, len(h.Counts)),
+		Sum:     h.Sum,
+		Count:   h.Count,
+	}
+	copy(c.Buckets, h.Buckets)
+	copy(c.Counts, h.Counts)
+	return c
+}
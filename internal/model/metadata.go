@@ -0,0 +1,40 @@
+package model
+
+// Metadata describes metric name: unit, help text and owner
+type Metadata struct {
+	Name        string `json:"name"`
+	Unit        string `json:"unit,omitempty"`
+	Description string `json:"description,omitempty"`
+	Owner       string `json:"owner,omitempty"`
+}
+
+// GaugeMetricsMetadata metadata of default metrics collected from runtime.MemStats
+var GaugeMetricsMetadata = map[string]Metadata{
+	"Alloc":         {Unit: "bytes", Description: "Bytes of allocated heap objects"},
+	"BuckHashSys":   {Unit: "bytes", Description: "Bytes of memory in profiling bucket hash tables"},
+	"Frees":         {Unit: "objects", Description: "Cumulative count of heap objects freed"},
+	"GCCPUFraction": {Unit: "ratio", Description: "Fraction of available CPU time used by GC since program started"},
+	"GCSys":         {Unit: "bytes", Description: "Bytes of memory in garbage collection metadata"},
+	"HeapAlloc":     {Unit: "bytes", Description: "Bytes of allocated heap objects"},
+	"HeapIdle":      {Unit: "bytes", Description: "Bytes in idle (unused) heap spans"},
+	"HeapInuse":     {Unit: "bytes", Description: "Bytes in in-use heap spans"},
+	"HeapObjects":   {Unit: "objects", Description: "Number of allocated heap objects"},
+	"HeapReleased":  {Unit: "bytes", Description: "Bytes of physical memory returned to the OS"},
+	"HeapSys":       {Unit: "bytes", Description: "Bytes of heap memory obtained from the OS"},
+	"LastGC":        {Unit: "nanoseconds", Description: "Time the last garbage collection finished, since Unix epoch"},
+	"Lookups":       {Unit: "lookups", Description: "Number of pointer lookups performed by the runtime"},
+	"MCacheInuse":   {Unit: "bytes", Description: "Bytes of allocated mcache structures"},
+	"MCacheSys":     {Unit: "bytes", Description: "Bytes of memory obtained from the OS for mcache structures"},
+	"MSpanInuse":    {Unit: "bytes", Description: "Bytes of allocated mspan structures"},
+	"MSpanSys":      {Unit: "bytes", Description: "Bytes of memory obtained from the OS for mspan structures"},
+	"Mallocs":       {Unit: "objects", Description: "Cumulative count of heap objects allocated"},
+	"NextGC":        {Unit: "bytes", Description: "Target heap size of the next GC cycle"},
+	"NumForcedGC":   {Unit: "cycles", Description: "Number of GC cycles forced by the application calling runtime.GC"},
+	"NumGC":         {Unit: "cycles", Description: "Number of completed GC cycles"},
+	"OtherSys":      {Unit: "bytes", Description: "Bytes of memory in miscellaneous off-heap runtime allocations"},
+	"PauseTotalNs":  {Unit: "nanoseconds", Description: "Cumulative time spent in GC stop-the-world pauses"},
+	"StackInuse":    {Unit: "bytes", Description: "Bytes in stack spans"},
+	"StackSys":      {Unit: "bytes", Description: "Bytes of stack memory obtained from the OS"},
+	"Sys":           {Unit: "bytes", Description: "Total bytes of memory obtained from the OS"},
+	"TotalAlloc":    {Unit: "bytes", Description: "Cumulative bytes allocated for heap objects"},
+}
@@ -2,10 +2,15 @@
 package model
 
 const (
-	HTTPType          = "http"
-	GRPCType          = "grpc"
-	MetricTypeCounter = "counter"
-	MetricTypeGauge   = "gauge"
+	HTTPType            = "http"
+	GRPCType            = "grpc"
+	MetricTypeCounter   = "counter"
+	MetricTypeGauge     = "gauge"
+	MetricTypeHistogram = "histogram"
+
+	// IdempotencyKeyHeader HTTP header and gRPC metadata key identifying batch of metrics,
+	// server skips batch with key it has already applied
+	IdempotencyKeyHeader = "Idempotency-Key"
 )
 
 // GaugeMetrics all available default metrics
@@ -43,10 +48,13 @@ var (
 
 // Metrics metrics schema for accepting request and response
 type Metrics struct {
-	Delta *int64   `json:"delta,omitempty"` // metric value for int type
-	Value *float64 `json:"value,omitempty"` // metric value for floag type
-	ID    string   `json:"id"`              // metric name
-	Mtype string   `json:"type"`            // metric type
+	Delta     *int64            `json:"delta,omitempty"`     // metric value for int type
+	Value     *float64          `json:"value,omitempty"`     // metric value for floag type
+	Histogram *Histogram        `json:"histogram,omitempty"` // metric value for histogram type
+	Labels    map[string]string `json:"labels,omitempty"`    // labels distinguishing series of same metric
+	Meta      *Metadata         `json:"metadata,omitempty"`  // unit, help text and owner of metric name
+	ID        string            `json:"id"`                  // metric name
+	Mtype     string            `json:"type"`                // metric type
 }
 
 // HTMLTemplate For constructing response for slice of metrics
@@ -56,6 +64,11 @@ const HTMLTemplate = `
         {{.ID}}: {{.Value}}
     {{else if eq .Mtype "counter"}}
         {{.ID}}: {{.Delta}}
+    {{else if eq .Mtype "histogram"}}
+        {{.ID}}: count={{.Histogram.Count}} sum={{.Histogram.Sum}}
+    {{end}}
+    {{with .Meta}}
+        {{if .Unit}}{{.Unit}}{{end}} {{if .Description}}<i>{{.Description}}</i>{{end}} {{if .Owner}}(owner: {{.Owner}}){{end}}
     {{end}}
 	<br>
 {{end}}
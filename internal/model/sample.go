@@ -0,0 +1,88 @@
+package model
+
+import "time"
+
+const (
+	RateFuncRate     = "rate"
+	RateFuncIRate    = "irate"
+	RateFuncIncrease = "increase"
+)
+
+// Sample value of metric at the moment of time, kept as history of metric
+type Sample struct {
+	Timestamp time.Time `json:"timestamp"`
+	Value     float64   `json:"value"`
+}
+
+// RateResult response schema for counter rate queries
+type RateResult struct {
+	ID      string  `json:"id"`      // metric name
+	Func    string  `json:"func"`    // one of rate, irate, increase
+	Window  string  `json:"window"`  // time window of samples used for computation
+	Value   float64 `json:"value"`   // computed value
+	Samples int     `json:"samples"` // number of samples used for computation
+}
+
+const (
+	ResolutionRaw    time.Duration = 0
+	ResolutionMinute               = time.Minute
+	ResolutionHour                 = time.Hour
+)
+
+// SeriesRef identifies history of single metric
+type SeriesRef struct {
+	ID    string `json:"id"`
+	Mtype string `json:"type"`
+}
+
+// Aggregate rolled up samples of metric in bucket of resolution size starting at Timestamp
+type Aggregate struct {
+	Timestamp time.Time `json:"timestamp"`
+	Min       float64   `json:"min"`
+	Max       float64   `json:"max"`
+	Sum       float64   `json:"sum"`
+	Last      float64   `json:"last"`
+	Count     int64     `json:"count"`
+}
+
+// Avg average of aggregated samples
+func (a Aggregate) Avg() float64 {
+	if a.Count == 0 {
+		return 0
+	}
+	return a.Sum / float64(a.Count)
+}
+
+// Add - adds sample into aggregate, samples are expected in time order
+func (a *Aggregate) Add(s Sample) {
+	a.merge(Aggregate{Min: s.Value, Max: s.Value, Sum: s.Value, Last: s.Value, Count: 1})
+}
+
+// Merge - merges aggregate of finer resolution, aggregates are expected in time order
+func (a *Aggregate) Merge(other Aggregate) {
+	a.merge(other)
+}
+
+func (a *Aggregate) merge(other Aggregate) {
+	if a.Count == 0 {
+		a.Min, a.Max = other.Min, other.Max
+	}
+	if other.Min < a.Min {
+		a.Min = other.Min
+	}
+	if other.Max > a.Max {
+		a.Max = other.Max
+	}
+	a.Sum += other.Sum
+	a.Count += other.Count
+	a.Last = other.Last
+}
+
+// HistoryResult response schema for history queries
+type HistoryResult struct {
+	ID         string      `json:"id"`
+	Mtype      string      `json:"type"`
+	Resolution string      `json:"resolution"`
+	Samples    []Sample    `json:"samples,omitempty"`
+	Aggregates []Aggregate `json:"aggregates,omitempty"`
+}
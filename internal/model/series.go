@@ -0,0 +1,83 @@
+package model
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Key - storage key of metric series, it is metric name followed by sorted labels
+func (m Metrics) Key() string {
+	return SeriesKey(m.ID, m.Labels)
+}
+
+// SeriesKey - builds storage key of metric series as name{label="value",...}.
+// Name is returned as is for metric without labels
+func SeriesKey(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	sb.WriteString(name)
+	sb.WriteByte('{')
+	for i, k := range names {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(k)
+		sb.WriteByte('=')
+		sb.WriteString(strconv.Quote(labels[k]))
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+// SeriesName - returns metric name of series key without parsing its labels
+func SeriesName(key string) string {
+	if start := strings.IndexByte(key, '{'); start > 0 && strings.HasSuffix(key, "}") {
+		return key[:start]
+	}
+	return key
+}
+
+// ParseSeriesKey - splits storage key of metric series into name and labels.
+// Key which is not in name{label="value",...} form is returned as name without labels
+func ParseSeriesKey(key string) (string, map[string]string) {
+	start := strings.IndexByte(key, '{')
+	if start <= 0 || !strings.HasSuffix(key, "}") {
+		return key, nil
+	}
+	name, rest := key[:start], key[start+1:len(key)-1]
+
+	labels := make(map[string]string)
+	for rest != "" {
+		eq := strings.IndexByte(rest, '=')
+		if eq <= 0 {
+			return key, nil
+		}
+		label := rest[:eq]
+		quoted, err := strconv.QuotedPrefix(rest[eq+1:])
+		if err != nil {
+			return key, nil
+		}
+		value, err := strconv.Unquote(quoted)
+		if err != nil {
+			return key, nil
+		}
+		labels[label] = value
+		rest = strings.TrimPrefix(rest[eq+1+len(quoted):], ",")
+	}
+	return name, labels
+}
+
+// PrefixCount number of series of metric names sharing prefix
+type PrefixCount struct {
+	Prefix string `json:"prefix"`
+	Series int    `json:"series"`
+}
@@ -0,0 +1,334 @@
+// Package query evaluates expressions aggregating metric series across labels
+package query
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/SmoothWay/metrics/internal/model"
+	"github.com/SmoothWay/metrics/internal/service"
+)
+
+var (
+	ErrSyntax    = errors.New("query syntax error")
+	ErrEvaluate  = errors.New("query evaluation error")
+	aggregations = map[string]bool{"sum": true, "avg": true, "max": true, "min": true, "count": true}
+	rangeFuncs   = map[string]bool{
+		model.RateFuncRate:     true,
+		model.RateFuncIRate:    true,
+		model.RateFuncIncrease: true,
+	}
+)
+
+// Source storage of metrics used by engine
+type Source interface {
+	GetAll(ctx context.Context) ([]model.Metrics, error)
+	CounterRate(ctx context.Context, name, fn string, window time.Duration) (model.RateResult, error)
+}
+
+// Series single value of query result
+type Series struct {
+	Name   string            `json:"name,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  float64           `json:"value"`
+}
+
+// Result response schema for query
+type Result struct {
+	Query  string   `json:"query"`
+	Scalar bool     `json:"scalar"`
+	Series []Series `json:"series"`
+}
+
+type Engine struct {
+	src Source
+}
+
+// New - creates query engine reading metrics from passed source
+func New(src Source) *Engine {
+	return &Engine{src: src}
+}
+
+// Query - parses and evaluates expression
+func (e *Engine) Query(ctx context.Context, q string) (Result, error) {
+	n, err := parse(q)
+	if err != nil {
+		return Result{}, err
+	}
+	v, err := n.eval(&evalContext{ctx: ctx, src: e.src})
+	if err != nil {
+		return Result{}, err
+	}
+
+	result := Result{Query: q, Scalar: v.scalar, Series: []Series{}}
+	if v.scalar {
+		result.Series = append(result.Series, Series{Value: v.value})
+		return result, nil
+	}
+	for _, s := range v.series {
+		// NaN and Inf can't be represented in JSON
+		if math.IsNaN(s.Value) || math.IsInf(s.Value, 0) {
+			continue
+		}
+		result.Series = append(result.Series, s)
+	}
+	sort.Slice(result.Series, func(i, j int) bool {
+		return model.SeriesKey(result.Series[i].Name, result.Series[i].Labels) <
+			model.SeriesKey(result.Series[j].Name, result.Series[j].Labels)
+	})
+	return result, nil
+}
+
+type evalContext struct {
+	ctx     context.Context
+	src     Source
+	metrics []model.Metrics
+}
+
+// all - metrics are read from source once per query
+func (c *evalContext) all() ([]model.Metrics, error) {
+	if c.metrics == nil {
+		metrics, err := c.src.GetAll(c.ctx)
+		if err != nil {
+			return nil, err
+		}
+		c.metrics = metrics
+	}
+	return c.metrics, nil
+}
+
+type value struct {
+	scalar bool
+	value  float64
+	series []Series
+}
+
+type node interface {
+	eval(*evalContext) (value, error)
+}
+
+type numberNode struct {
+	value float64
+}
+
+func (n *numberNode) eval(*evalContext) (value, error) {
+	return value{scalar: true, value: n.value}, nil
+}
+
+type matcher struct {
+	label  string
+	value  string
+	negate bool
+}
+
+type selectorNode struct {
+	name     string
+	matchers []matcher
+}
+
+func (n *selectorNode) matches(m model.Metrics) bool {
+	if m.ID != n.name {
+		return false
+	}
+	for _, mt := range n.matchers {
+		if (m.Labels[mt.label] == mt.value) == mt.negate {
+			return false
+		}
+	}
+	return true
+}
+
+func (n *selectorNode) eval(c *evalContext) (value, error) {
+	all, err := c.all()
+	if err != nil {
+		return value{}, err
+	}
+	result := value{series: []Series{}}
+	for _, m := range all {
+		if !n.matches(m) {
+			continue
+		}
+		var v float64
+		switch {
+		case m.Mtype == model.MetricTypeGauge && m.Value != nil:
+			v = *m.Value
+		case m.Mtype == model.MetricTypeCounter && m.Delta != nil:
+			v = float64(*m.Delta)
+		default:
+			continue
+		}
+		result.series = append(result.series, Series{Name: m.ID, Labels: m.Labels, Value: v})
+	}
+	return result, nil
+}
+
+type rangeNode struct {
+	fn       string
+	selector *selectorNode
+	window   time.Duration
+}
+
+func (n *rangeNode) eval(c *evalContext) (value, error) {
+	all, err := c.all()
+	if err != nil {
+		return value{}, err
+	}
+	result := value{series: []Series{}}
+	for _, m := range all {
+		if m.Mtype != model.MetricTypeCounter || !n.selector.matches(m) {
+			continue
+		}
+		r, err := c.src.CounterRate(c.ctx, m.Key(), n.fn, n.window)
+		if err != nil {
+			if errors.Is(err, service.ErrNotEnoughSamples) {
+				continue
+			}
+			return value{}, err
+		}
+		result.series = append(result.series, Series{Labels: m.Labels, Value: r.Value})
+	}
+	return result, nil
+}
+
+type aggregateNode struct {
+	op  string
+	by  []string
+	arg node
+}
+
+func (n *aggregateNode) eval(c *evalContext) (value, error) {
+	arg, err := n.arg.eval(c)
+	if err != nil {
+		return value{}, err
+	}
+	if arg.scalar {
+		return value{}, fmt.Errorf("%w: %s expects series argument", ErrEvaluate, n.op)
+	}
+
+	type group struct {
+		labels map[string]string
+		values []float64
+	}
+	groups := make(map[string]*group)
+	var order []string
+	for _, s := range arg.series {
+		labels := make(map[string]string, len(n.by))
+		for _, l := range n.by {
+			if v, ok := s.Labels[l]; ok {
+				labels[l] = v
+			}
+		}
+		key := model.SeriesKey("", labels)
+		g, ok := groups[key]
+		if !ok {
+			g = &group{labels: labels}
+			groups[key] = g
+			order = append(order, key)
+		}
+		g.values = append(g.values, s.Value)
+	}
+
+	result := value{series: []Series{}}
+	for _, key := range order {
+		g := groups[key]
+		s := Series{Value: aggregate(n.op, g.values)}
+		if len(g.labels) > 0 {
+			s.Labels = g.labels
+		}
+		result.series = append(result.series, s)
+	}
+	return result, nil
+}
+
+func aggregate(op string, values []float64) float64 {
+	switch op {
+	case "count":
+		return float64(len(values))
+	case "max":
+		result := math.Inf(-1)
+		for _, v := range values {
+			result = math.Max(result, v)
+		}
+		return result
+	case "min":
+		result := math.Inf(1)
+		for _, v := range values {
+			result = math.Min(result, v)
+		}
+		return result
+	}
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	if op == "avg" {
+		return sum / float64(len(values))
+	}
+	return sum
+}
+
+type binaryNode struct {
+	op    string
+	left  node
+	right node
+}
+
+func (n *binaryNode) eval(c *evalContext) (value, error) {
+	left, err := n.left.eval(c)
+	if err != nil {
+		return value{}, err
+	}
+	right, err := n.right.eval(c)
+	if err != nil {
+		return value{}, err
+	}
+
+	switch {
+	case left.scalar && right.scalar:
+		return value{scalar: true, value: apply(n.op, left.value, right.value)}, nil
+	case right.scalar:
+		result := value{series: make([]Series, len(left.series))}
+		for i, s := range left.series {
+			result.series[i] = Series{Labels: s.Labels, Value: apply(n.op, s.Value, right.value)}
+		}
+		return result, nil
+	case left.scalar:
+		result := value{series: make([]Series, len(right.series))}
+		for i, s := range right.series {
+			result.series[i] = Series{Labels: s.Labels, Value: apply(n.op, left.value, s.Value)}
+		}
+		return result, nil
+	}
+
+	// series of both sides are matched by equal labels, metric name is ignored
+	rightByLabels := make(map[string]Series, len(right.series))
+	for _, s := range right.series {
+		rightByLabels[model.SeriesKey("", s.Labels)] = s
+	}
+	result := value{series: []Series{}}
+	for _, l := range left.series {
+		r, ok := rightByLabels[model.SeriesKey("", l.Labels)]
+		if !ok {
+			continue
+		}
+		result.series = append(result.series, Series{Labels: l.Labels, Value: apply(n.op, l.Value, r.Value)})
+	}
+	return result, nil
+}
+
+func apply(op string, a, b float64) float64 {
+	switch op {
+	case "+":
+		return a + b
+	case "-":
+		return a - b
+	case "*":
+		return a * b
+	default:
+		return a / b
+	}
+}
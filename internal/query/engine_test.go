@@ -0,0 +1,117 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/SmoothWay/metrics/internal/model"
+	"github.com/SmoothWay/metrics/internal/repository/memstorage"
+	"github.com/SmoothWay/metrics/internal/service"
+)
+
+func newTestEngine(t *testing.T) *Engine {
+	s := service.New(memstorage.New(nil))
+
+	gauge := func(name string, v float64, labels map[string]string) model.Metrics {
+		return model.Metrics{ID: name, Mtype: model.MetricTypeGauge, Value: &v, Labels: labels}
+	}
+	metrics := []model.Metrics{
+		gauge("HeapAlloc", 100, map[string]string{"host": "a", "dc": "eu"}),
+		gauge("HeapAlloc", 200, map[string]string{"host": "b", "dc": "eu"}),
+		gauge("HeapAlloc", 300, map[string]string{"host": "c", "dc": "us"}),
+		gauge("HeapSys", 400, map[string]string{"host": "a", "dc": "eu"}),
+		gauge("HeapSys", 400, map[string]string{"host": "b", "dc": "eu"}),
+	}
+	require.NoError(t, s.SaveAll(context.Background(), metrics))
+	return New(s)
+}
+
+func TestEngine_Query(t *testing.T) {
+	e := newTestEngine(t)
+
+	tests := []struct {
+		name  string
+		query string
+		want  []Series
+	}{
+		{
+			name:  "total across all hosts",
+			query: "sum(HeapAlloc)",
+			want:  []Series{{Value: 600}},
+		},
+		{
+			name:  "sum by label",
+			query: "sum by (dc) (HeapAlloc)",
+			want: []Series{
+				{Labels: map[string]string{"dc": "eu"}, Value: 300},
+				{Labels: map[string]string{"dc": "us"}, Value: 300},
+			},
+		},
+		{
+			name:  "trailing by clause",
+			query: "count(HeapAlloc) by (dc)",
+			want: []Series{
+				{Labels: map[string]string{"dc": "eu"}, Value: 2},
+				{Labels: map[string]string{"dc": "us"}, Value: 1},
+			},
+		},
+		{
+			name:  "selector with matchers",
+			query: `max(HeapAlloc{dc="eu", host!="b"})`,
+			want:  []Series{{Value: 100}},
+		},
+		{
+			name:  "arithmetic between series",
+			query: `HeapAlloc / HeapSys * 100`,
+			want: []Series{
+				{Labels: map[string]string{"host": "a", "dc": "eu"}, Value: 25},
+				{Labels: map[string]string{"host": "b", "dc": "eu"}, Value: 50},
+			},
+		},
+		{
+			name:  "scalar arithmetic",
+			query: "(1 + 2) * -2",
+			want:  []Series{{Value: -6}},
+		},
+		{
+			name:  "no matching series",
+			query: "avg(Unknown)",
+			want:  []Series{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := e.Query(context.Background(), tt.query)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got.Series)
+		})
+	}
+}
+
+func TestEngine_QueryErrors(t *testing.T) {
+	e := newTestEngine(t)
+
+	tests := []struct {
+		name    string
+		query   string
+		wantErr error
+	}{
+		{name: "unclosed paren", query: "sum(HeapAlloc", wantErr: ErrSyntax},
+		{name: "unknown character", query: "HeapAlloc % 2", wantErr: ErrSyntax},
+		{name: "matcher without string", query: "HeapAlloc{host=a}", wantErr: ErrSyntax},
+		{name: "rate without window", query: "rate(PollCount)", wantErr: ErrSyntax},
+		{name: "aggregation of scalar", query: "sum(1)", wantErr: ErrEvaluate},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := e.Query(context.Background(), tt.query)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Engine.Query() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,327 @@
+package query
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokDuration
+	tokPunct
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// lex - splits expression into tokens
+func lex(input string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(input); {
+		c := rune(input[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '_' || unicode.IsLetter(c):
+			start := i
+			for i < len(input) && (input[i] == '_' || input[i] == '.' || unicode.IsLetter(rune(input[i])) || unicode.IsDigit(rune(input[i]))) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokIdent, text: input[start:i], pos: start})
+		case unicode.IsDigit(c):
+			start := i
+			for i < len(input) && (unicode.IsDigit(rune(input[i])) || input[i] == '.' || input[i] == 'e' ||
+				((input[i] == '-' || input[i] == '+') && input[i-1] == 'e')) {
+				i++
+			}
+			kind := tokNumber
+			// duration has unit suffix like 5m or 1h30m
+			if i < len(input) && strings.ContainsRune("smhd", rune(input[i])) {
+				kind = tokDuration
+				for i < len(input) && (unicode.IsDigit(rune(input[i])) || strings.ContainsRune("smhdnuµ", rune(input[i]))) {
+					i++
+				}
+			}
+			tokens = append(tokens, token{kind: kind, text: input[start:i], pos: start})
+		case c == '"':
+			quoted, err := strconv.QuotedPrefix(input[i:])
+			if err != nil {
+				return nil, fmt.Errorf("%w: unterminated string at %d", ErrSyntax, i)
+			}
+			value, _ := strconv.Unquote(quoted)
+			tokens = append(tokens, token{kind: tokString, text: value, pos: i})
+			i += len(quoted)
+		case c == '!' && i+1 < len(input) && input[i+1] == '=':
+			tokens = append(tokens, token{kind: tokPunct, text: "!=", pos: i})
+			i += 2
+		case strings.ContainsRune("(){}[],=+-*/", c):
+			tokens = append(tokens, token{kind: tokPunct, text: string(c), pos: i})
+			i++
+		default:
+			return nil, fmt.Errorf("%w: unexpected character %q at %d", ErrSyntax, c, i)
+		}
+	}
+	return append(tokens, token{kind: tokEOF, pos: len(input)}), nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// parse - builds expression tree from query.
+//
+//	expr     = term { ("+" | "-") term }
+//	term     = factor { ("*" | "/") factor }
+//	factor   = number | "(" expr ")" | "-" factor | aggr | range | selector
+//	aggr     = ("sum" | "avg" | "max" | "min" | "count") [by] "(" expr ")" [by]
+//	by       = "by" "(" label { "," label } ")"
+//	range    = ("rate" | "irate" | "increase") "(" selector "[" duration "]" ")"
+//	selector = name [ "{" label ("=" | "!=") string { "," ... } "}" ]
+func parse(input string) (node, error) {
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	n, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, p.unexpected(t)
+	}
+	return n, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) isPunct(text string) bool {
+	t := p.peek()
+	return t.kind == tokPunct && t.text == text
+}
+
+func (p *parser) expect(text string) error {
+	if t := p.next(); t.kind != tokPunct || t.text != text {
+		return fmt.Errorf("%w: expected %q at %d", ErrSyntax, text, t.pos)
+	}
+	return nil
+}
+
+func (p *parser) unexpected(t token) error {
+	if t.kind == tokEOF {
+		return fmt.Errorf("%w: unexpected end of query", ErrSyntax)
+	}
+	return fmt.Errorf("%w: unexpected %q at %d", ErrSyntax, t.text, t.pos)
+}
+
+func (p *parser) expr() (node, error) {
+	left, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for p.isPunct("+") || p.isPunct("-") {
+		op := p.next().text
+		right, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) term() (node, error) {
+	left, err := p.factor()
+	if err != nil {
+		return nil, err
+	}
+	for p.isPunct("*") || p.isPunct("/") {
+		op := p.next().text
+		right, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) factor() (node, error) {
+	t := p.peek()
+	switch t.kind {
+	case tokNumber:
+		p.next()
+		v, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid number %q at %d", ErrSyntax, t.text, t.pos)
+		}
+		return &numberNode{value: v}, nil
+	case tokPunct:
+		switch t.text {
+		case "(":
+			p.next()
+			n, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			return n, p.expect(")")
+		case "-":
+			p.next()
+			n, err := p.factor()
+			if err != nil {
+				return nil, err
+			}
+			return &binaryNode{op: "*", left: &numberNode{value: -1}, right: n}, nil
+		}
+	case tokIdent:
+		after := p.tokens[p.pos+1]
+		opens := after.kind == tokPunct && after.text == "("
+		if aggregations[t.text] && (opens || after.kind == tokIdent && after.text == "by") {
+			return p.aggregation()
+		}
+		if rangeFuncs[t.text] && opens {
+			return p.rangeFunc()
+		}
+		return p.selector()
+	}
+	return nil, p.unexpected(t)
+}
+
+func (p *parser) aggregation() (node, error) {
+	n := &aggregateNode{op: p.next().text}
+	var err error
+	if p.peek().kind == tokIdent && p.peek().text == "by" {
+		if n.by, err = p.grouping(); err != nil {
+			return nil, err
+		}
+	}
+	if err = p.expect("("); err != nil {
+		return nil, err
+	}
+	if n.arg, err = p.expr(); err != nil {
+		return nil, err
+	}
+	if err = p.expect(")"); err != nil {
+		return nil, err
+	}
+	if n.by == nil && p.peek().kind == tokIdent && p.peek().text == "by" {
+		if n.by, err = p.grouping(); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+func (p *parser) grouping() ([]string, error) {
+	p.next()
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	labels := []string{}
+	for !p.isPunct(")") {
+		t := p.next()
+		if t.kind != tokIdent {
+			return nil, p.unexpected(t)
+		}
+		labels = append(labels, t.text)
+		if !p.isPunct(")") {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return labels, p.expect(")")
+}
+
+func (p *parser) rangeFunc() (node, error) {
+	n := &rangeNode{fn: p.next().text}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	sel, err := p.selector()
+	if err != nil {
+		return nil, err
+	}
+	n.selector = sel.(*selectorNode)
+	if err = p.expect("["); err != nil {
+		return nil, err
+	}
+	t := p.next()
+	if t.kind != tokDuration {
+		return nil, fmt.Errorf("%w: expected duration at %d", ErrSyntax, t.pos)
+	}
+	if n.window, err = parseDuration(t.text); err != nil {
+		return nil, fmt.Errorf("%w: invalid duration %q at %d", ErrSyntax, t.text, t.pos)
+	}
+	if err = p.expect("]"); err != nil {
+		return nil, err
+	}
+	return n, p.expect(")")
+}
+
+func (p *parser) selector() (node, error) {
+	t := p.next()
+	if t.kind != tokIdent {
+		return nil, p.unexpected(t)
+	}
+	n := &selectorNode{name: t.text}
+	if !p.isPunct("{") {
+		return n, nil
+	}
+	p.next()
+	for !p.isPunct("}") {
+		label := p.next()
+		if label.kind != tokIdent {
+			return nil, p.unexpected(label)
+		}
+		op := p.next()
+		if op.kind != tokPunct || (op.text != "=" && op.text != "!=") {
+			return nil, p.unexpected(op)
+		}
+		value := p.next()
+		if value.kind != tokString {
+			return nil, fmt.Errorf("%w: expected string at %d", ErrSyntax, value.pos)
+		}
+		n.matchers = append(n.matchers, matcher{label: label.text, value: value.text, negate: op.text == "!="})
+		if !p.isPunct("}") {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return n, p.expect("}")
+}
+
+// parseDuration - parses duration with additional "d" unit for days
+func parseDuration(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
@@ -0,0 +1,46 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Proxies networks of proxies trusted to pass address of client in X-Real-IP header
+type Proxies []*net.IPNet
+
+// ParseProxies - parses comma separated CIDRs of trusted proxies, empty string trusts no proxy
+func ParseProxies(s string) (Proxies, error) {
+	var proxies Proxies
+	for _, cidr := range strings.Split(s, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy network %q: %w", cidr, err)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+// ClientIP - returns IP address of client connected from peer address. Address passed in realIP header
+// is used only if peer is trusted proxy, clients can not pick their identity by sending the header
+func (p Proxies) ClientIP(peer, realIP string) string {
+	host, _, err := net.SplitHostPort(peer)
+	if err != nil {
+		host = peer
+	}
+	if realIP == "" {
+		return host
+	}
+	ip := net.ParseIP(host)
+	for _, network := range p {
+		if ip != nil && network.Contains(ip) {
+			return realIP
+		}
+	}
+	return host
+}
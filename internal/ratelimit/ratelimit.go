@@ -0,0 +1,187 @@
+// Package ratelimit limits rate of requests and number of distinct series per client.
+// Client is identified by its tenant or by IP address if tenants are disabled
+package ratelimit
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// QuotaRetryAfter hint returned to clients which exceeded series quota
+	QuotaRetryAfter = time.Minute
+	// maxClients number of clients tracked by limiter or quota, least recently seen clients are evicted over it
+	maxClients = 10000
+)
+
+var ErrInvalidRate = errors.New("rate must be positive")
+
+// clients state of clients ordered by last use, least recently used client is evicted over max clients
+type clients[T any] struct {
+	max   int
+	items map[string]*list.Element
+	order *list.List
+}
+
+type client[T any] struct {
+	key   string
+	state T
+}
+
+func newClients[T any](max int) *clients[T] {
+	return &clients[T]{
+		max:   max,
+		items: make(map[string]*list.Element),
+		order: list.New(),
+	}
+}
+
+// get - returns state of client and marks it as the most recently used one, new state is created by create
+func (c *clients[T]) get(key string, create func() T) T {
+	if e, ok := c.items[key]; ok {
+		c.order.MoveToFront(e)
+		return e.Value.(*client[T]).state
+	}
+	if c.order.Len() >= c.max {
+		c.remove(c.order.Back())
+	}
+	state := create()
+	c.items[key] = c.order.PushFront(&client[T]{key: key, state: state})
+	return state
+}
+
+// lookup - returns state of client without marking it as used
+func (c *clients[T]) lookup(key string) (T, bool) {
+	if e, ok := c.items[key]; ok {
+		return e.Value.(*client[T]).state, true
+	}
+	var zero T
+	return zero, false
+}
+
+func (c *clients[T]) remove(e *list.Element) {
+	delete(c.items, e.Value.(*client[T]).key)
+	c.order.Remove(e)
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter token bucket limiter, every client has own bucket of burst size refilled with rate tokens per second
+type Limiter struct {
+	rate    float64
+	burst   float64
+	buckets *clients[*bucket]
+	mu      sync.Mutex
+	now     func() time.Time
+}
+
+// NewLimiter - creates limiter allowing rps requests per second with bursts up to burst requests
+func NewLimiter(rps float64, burst int) (*Limiter, error) {
+	if !(rps > 0) || math.IsInf(rps, 1) {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRate, rps)
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		rate:    rps,
+		burst:   float64(burst),
+		buckets: newClients[*bucket](maxClients),
+		now:     time.Now,
+	}, nil
+}
+
+// Allow - takes token from bucket of client. If bucket is empty returns false and time until next token
+func (l *Limiter) Allow(client string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.expire(now)
+	b := l.buckets.get(client, func() *bucket {
+		return &bucket{tokens: l.burst, last: now}
+	})
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// expire - removes buckets of idle clients which have been refilled, they are equal to new ones.
+// Buckets are ordered by last use, so only the oldest ones are checked
+func (l *Limiter) expire(now time.Time) {
+	for e := l.buckets.order.Back(); e != nil; e = l.buckets.order.Back() {
+		b := e.Value.(*client[*bucket]).state
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate < l.burst {
+			return
+		}
+		l.buckets.remove(e)
+	}
+}
+
+// Quota limits number of distinct series client can write. Series of the least recently seen clients
+// are forgotten when number of clients exceeds limit
+type Quota struct {
+	max    int
+	series *clients[map[string]struct{}]
+	mu     sync.Mutex
+}
+
+// NewQuota - creates quota allowing max distinct series per client
+func NewQuota(max int) *Quota {
+	return &Quota{
+		max:    max,
+		series: newClients[map[string]struct{}](maxClients),
+	}
+}
+
+// Allow - checks that series written by client fit into quota, nothing is registered until Charge
+func (q *Quota) Allow(client string, series []string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	known, _ := q.series.lookup(client)
+	fresh := make(map[string]struct{})
+	for _, s := range series {
+		if _, ok := known[s]; !ok {
+			fresh[s] = struct{}{}
+		}
+	}
+	return len(known)+len(fresh) <= q.max
+}
+
+// Charge - registers series written by client. Called after series are saved, so rejected writes
+// do not use quota. Concurrent writes checked by Allow may exceed quota by series they add
+func (q *Quota) Charge(client string, series []string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	known := q.series.get(client, func() map[string]struct{} {
+		return make(map[string]struct{})
+	})
+	for _, s := range series {
+		known[s] = struct{}{}
+	}
+}
+
+// RetryAfterSeconds - formats retry after hint as whole seconds, at least one
+func RetryAfterSeconds(d time.Duration) string {
+	secs := int64(math.Ceil(d.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	return strconv.FormatInt(secs, 10)
+}
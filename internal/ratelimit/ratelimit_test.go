@@ -0,0 +1,100 @@
+package ratelimit
+
+import (
+	"math"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiter_Allow(t *testing.T) {
+	l, err := NewLimiter(2, 2)
+	require.NoError(t, err)
+	now := time.Now()
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		ok, _ := l.Allow("agent")
+		assert.True(t, ok, "burst must be allowed")
+	}
+	ok, wait := l.Allow("agent")
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	ok, _ = l.Allow("other")
+	assert.True(t, ok, "clients must have separate buckets")
+
+	now = now.Add(wait)
+	ok, _ = l.Allow("agent")
+	assert.True(t, ok, "bucket must be refilled")
+}
+
+func TestNewLimiter(t *testing.T) {
+	for _, rps := range []float64{0, -1, math.NaN(), math.Inf(1)} {
+		_, err := NewLimiter(rps, 1)
+		assert.ErrorIs(t, err, ErrInvalidRate, "rps %v", rps)
+	}
+}
+
+func TestLimiter_Evict(t *testing.T) {
+	l, err := NewLimiter(1, 2)
+	require.NoError(t, err)
+	now := time.Now()
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < maxClients+10; i++ {
+		l.Allow(strconv.Itoa(i))
+	}
+	assert.Equal(t, maxClients, len(l.buckets.items), "number of buckets is capped")
+
+	now = now.Add(time.Second)
+	l.Allow("fresh")
+	assert.Equal(t, 1, len(l.buckets.items), "refilled buckets of idle clients are expired")
+}
+
+func TestQuota(t *testing.T) {
+	q := NewQuota(3)
+
+	assert.True(t, q.Allow("agent", []string{"gauge/Alloc", "gauge/HeapSys"}))
+	q.Charge("agent", []string{"gauge/Alloc", "gauge/HeapSys"})
+	assert.True(t, q.Allow("agent", []string{"gauge/Alloc", "counter/PollCount"}), "known series are not counted again")
+	q.Charge("agent", []string{"gauge/Alloc", "counter/PollCount"})
+	assert.False(t, q.Allow("agent", []string{"gauge/Alloc", "gauge/Frees"}))
+	assert.True(t, q.Allow("other", []string{"gauge/Frees"}))
+
+	assert.True(t, q.Allow("new", []string{"gauge/A", "gauge/B", "gauge/C"}))
+	assert.True(t, q.Allow("new", []string{"gauge/D"}), "series are not charged until they are saved")
+}
+
+func TestRetryAfterSeconds(t *testing.T) {
+	assert.Equal(t, "1", RetryAfterSeconds(10*time.Millisecond))
+	assert.Equal(t, "3", RetryAfterSeconds(2100*time.Millisecond))
+}
+
+func TestProxies_ClientIP(t *testing.T) {
+	proxies, err := ParseProxies("10.0.0.0/8, 192.168.1.1/32")
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		peer   string
+		realIP string
+		want   string
+	}{
+		{name: "no header", peer: "203.0.113.5:4242", want: "203.0.113.5"},
+		{name: "header from client is ignored", peer: "203.0.113.5:4242", realIP: "198.51.100.1", want: "203.0.113.5"},
+		{name: "header from proxy", peer: "10.1.2.3:4242", realIP: "198.51.100.1", want: "198.51.100.1"},
+		{name: "ipv6 peer", peer: "[2001:db8::1]:4242", realIP: "198.51.100.1", want: "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, proxies.ClientIP(tt.peer, tt.realIP))
+		})
+	}
+
+	_, err = ParseProxies("10.0.0.0")
+	assert.Error(t, err)
+}
@@ -0,0 +1,117 @@
+package memstorage
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// IdempotencyKeys idempotency keys of applied batches. Keys expire in order they were recorded, so checking
+// a key does not scan all of them. Batches with the same key are applied one at a time, batches with
+// other keys do not wait for each other
+type IdempotencyKeys struct {
+	mu      sync.Mutex
+	applied map[string]time.Time
+	order   []appliedKey             // applied keys in order they were recorded
+	pending map[string]chan struct{} // keys of batches being applied, channel is closed when batch is done
+}
+
+type appliedKey struct {
+	key string
+	at  time.Time
+}
+
+// NewIdempotencyKeys - creates empty set of idempotency keys
+func NewIdempotencyKeys() *IdempotencyKeys {
+	return &IdempotencyKeys{
+		applied: make(map[string]time.Time),
+		pending: make(map[string]chan struct{}),
+	}
+}
+
+// Apply - applies batch by apply unless batch with the same key was applied within window before appliedAt.
+// Returns false if batch is skipped as duplicate. Batch with key of batch being applied waits for it and is
+// skipped if that batch succeeds, key of failed batch is not recorded
+func (k *IdempotencyKeys) Apply(ctx context.Context, key string, appliedAt time.Time, window time.Duration, apply func() error) (bool, error) {
+	cutoff := appliedAt.Add(-window)
+	for {
+		k.mu.Lock()
+		k.expire(cutoff)
+		if at, ok := k.applied[key]; ok && !at.Before(cutoff) {
+			k.mu.Unlock()
+			return false, nil
+		}
+		wait, busy := k.pending[key]
+		if !busy {
+			done := make(chan struct{})
+			k.pending[key] = done
+			k.mu.Unlock()
+
+			err := apply()
+
+			k.mu.Lock()
+			delete(k.pending, key)
+			close(done)
+			if err == nil {
+				k.record(key, appliedAt)
+			}
+			k.mu.Unlock()
+			return err == nil, err
+		}
+		k.mu.Unlock()
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+}
+
+// record - remembers key of applied batch. Must be called under lock
+func (k *IdempotencyKeys) record(key string, at time.Time) {
+	k.applied[key] = at
+	k.order = append(k.order, appliedKey{key: key, at: at})
+}
+
+// expire - forgets keys recorded before cutoff, checking only the oldest ones. Must be called under lock
+func (k *IdempotencyKeys) expire(cutoff time.Time) {
+	for len(k.order) > 0 && k.order[0].at.Before(cutoff) {
+		oldest := k.order[0]
+		// key may be recorded again after it expired, newer record is kept
+		if at, ok := k.applied[oldest.key]; ok && at.Equal(oldest.at) {
+			delete(k.applied, oldest.key)
+		}
+		k.order[0] = appliedKey{}
+		k.order = k.order[1:]
+	}
+}
+
+// Snapshot - returns applied keys with times they were applied at
+func (k *IdempotencyKeys) Snapshot() map[string]time.Time {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	keys := make(map[string]time.Time, len(k.applied))
+	for key, at := range k.applied {
+		keys[key] = at
+	}
+	return keys
+}
+
+// Restore - replaces applied keys with keys of snapshot
+func (k *IdempotencyKeys) Restore(keys map[string]time.Time) {
+	order := make([]appliedKey, 0, len(keys))
+	applied := make(map[string]time.Time, len(keys))
+	for key, at := range keys {
+		order = append(order, appliedKey{key: key, at: at})
+		applied[key] = at
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return order[i].at.Before(order[j].at)
+	})
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.applied, k.order = applied, order
+}
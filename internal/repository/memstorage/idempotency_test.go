@@ -0,0 +1,60 @@
+package memstorage
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyKeys_Apply(t *testing.T) {
+	k := NewIdempotencyKeys()
+	ctx := context.Background()
+	now := time.Now()
+	var applied atomic.Int32
+	apply := func() error {
+		applied.Add(1)
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := k.Apply(ctx, "batch", now, time.Minute, apply); err != nil {
+				t.Errorf("Apply() error = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := applied.Load(); n != 1 {
+		t.Fatalf("batch applied %d times concurrently, want once", n)
+	}
+
+	failed := errors.New("failed")
+	if ok, err := k.Apply(ctx, "other", now, time.Minute, func() error { return failed }); ok || !errors.Is(err, failed) {
+		t.Fatalf("Apply() = %v, %v, want error of batch", ok, err)
+	}
+	if ok, _ := k.Apply(ctx, "other", now, time.Minute, apply); !ok {
+		t.Error("key of failed batch must not be recorded")
+	}
+
+	if ok, _ := k.Apply(ctx, "batch", now.Add(30*time.Second), time.Minute, apply); ok {
+		t.Error("duplicate within window must be skipped")
+	}
+	if ok, _ := k.Apply(ctx, "batch", now.Add(2*time.Minute), time.Minute, apply); !ok {
+		t.Error("batch must be applied again after window")
+	}
+	if len(k.order) != 1 || len(k.applied) != 1 {
+		t.Errorf("expired keys are kept: order %d, applied %d", len(k.order), len(k.applied))
+	}
+
+	restored := NewIdempotencyKeys()
+	restored.Restore(k.Snapshot())
+	if ok, _ := restored.Apply(ctx, "batch", now.Add(2*time.Minute), time.Minute, apply); ok {
+		t.Error("restored key must be remembered")
+	}
+}
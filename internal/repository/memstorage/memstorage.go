@@ -2,71 +2,177 @@
 package memstorage
 
 import (
-	"errors"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/SmoothWay/metrics/internal/model"
 )
 
 var (
-	ErrNotFound     = errors.New("value not found")
-	ErrCannotAssign = errors.New("cannot assign value, key is already in use by another metric type")
+	ErrNotFound     = model.ErrNotFound
+	ErrCannotAssign = model.ErrTypeConflict
+	ErrInvalidValue = fmt.Errorf("%w: value is missing", model.ErrInvalidValue)
 )
 
 type MemStorage struct {
-	Gauge   map[string]float64
-	Counter map[string]int64
-	mu      *sync.RWMutex
+	Gauge     map[string]float64
+	Counter   map[string]int64
+	Histogram map[string]model.Histogram
+	History   map[string][]model.Sample
+	Rollups   map[string]map[int64]model.Aggregate
+	Metadata  map[string]model.Metadata
+	owners    *Owners          // types owning metric names
+	keys      *IdempotencyKeys // idempotency keys of applied batches
+	mu        *sync.RWMutex
+	tenants   *partitions
+}
+
+// partitions storages of tenants, shared by storage of default tenant and storages of other tenants
+type partitions struct {
+	storages map[string]*MemStorage
+	mu       sync.Mutex
 }
 
 // New - creates new memory storage with gauge and counter are maps. Fill storage with values if non empty metrics passed
 func New(metrics *[]model.Metrics) *MemStorage {
 	gauge := make(map[string]float64)
 	counter := make(map[string]int64)
+	histogram := make(map[string]model.Histogram)
+	metadata := make(map[string]model.Metadata)
 	if metrics != nil {
 		for _, v := range *metrics {
 			if v.Mtype == model.MetricTypeCounter {
-				counterValue := counter[v.ID]
-				counter[v.ID] = *v.Delta + counterValue
+				key := v.Key()
+				counterValue := counter[key]
+				counter[key] = *v.Delta + counterValue
 			} else if v.Mtype == model.MetricTypeGauge {
-				gauge[v.ID] = *v.Value
+				gauge[v.Key()] = *v.Value
+			} else if v.Mtype == model.MetricTypeHistogram && v.Histogram != nil {
+				histogram[v.Key()] = v.Histogram.Copy()
+			}
+			if v.Meta != nil {
+				metadata[v.ID] = *v.Meta
 			}
 		}
 	}
 	return &MemStorage{
-		Gauge:   gauge,
-		Counter: counter,
-		mu:      &sync.RWMutex{},
+		Gauge:     gauge,
+		Counter:   counter,
+		Histogram: histogram,
+		History:   make(map[string][]model.Sample),
+		Rollups:   make(map[string]map[int64]model.Aggregate),
+		Metadata:  metadata,
+		owners:    ownersOf(counter, gauge, histogram),
+		keys:      NewIdempotencyKeys(),
+		mu:        &sync.RWMutex{},
+		tenants:   &partitions{storages: make(map[string]*MemStorage)},
+	}
+}
+
+// ownersOf - returns owners of names of stored series
+func ownersOf(counter map[string]int64, gauge map[string]float64, histogram map[string]model.Histogram) *Owners {
+	owners := NewOwners()
+	for key := range counter {
+		owners.Add(key, model.MetricTypeCounter)
+	}
+	for key := range gauge {
+		owners.Add(key, model.MetricTypeGauge)
+	}
+	for key := range histogram {
+		owners.Add(key, model.MetricTypeHistogram)
+	}
+	return owners
+}
+
+// Tenant - returns storage of tenant, creating it on first use. Storage itself is returned for default tenant
+func (ms *MemStorage) Tenant(id string) *MemStorage {
+	if id == "" {
+		return ms
+	}
+	ms.tenants.mu.Lock()
+	defer ms.tenants.mu.Unlock()
+	storage, ok := ms.tenants.storages[id]
+	if !ok {
+		storage = New(nil)
+		storage.tenants = ms.tenants
+		ms.tenants.storages[id] = storage
+	}
+	return storage
+}
+
+// Tenants - returns ids of tenants which storages were created
+func (ms *MemStorage) Tenants() ([]string, error) {
+	ms.tenants.mu.Lock()
+	defer ms.tenants.mu.Unlock()
+	tenants := make([]string, 0, len(ms.tenants.storages))
+	for id := range ms.tenants.storages {
+		tenants = append(tenants, id)
 	}
+	sort.Strings(tenants)
+	return tenants, nil
 }
 
-// SetCounterMetric - set counter metric value by name to memory storage
-func (ms *MemStorage) SetCounterMetric(key string, value int64) error {
+// SetCounterMetric - add value to counter metric by name in memory storage, returns new value of counter
+func (ms *MemStorage) SetCounterMetric(ctx context.Context, key string, value int64) (int64, error) {
 	ms.mu.Lock()
 	defer ms.mu.Unlock()
+	if !ms.canAssign(key, model.MetricTypeCounter) {
+		return 0, model.TypeConflict(key)
+	}
 	_, exists := ms.Counter[key]
 
 	if exists {
 		ms.Counter[key] += value
-		return nil
+		return ms.Counter[key], nil
 	}
+	ms.owners.Add(key, model.MetricTypeCounter)
 	ms.Counter[key] = value
-	return nil
+	return value, nil
 }
 
 // SetGaugeMetric - set gauge metric value by name to memory storage
-func (ms *MemStorage) SetGaugeMetric(key string, value float64) error {
+func (ms *MemStorage) SetGaugeMetric(ctx context.Context, key string, value float64) error {
 	ms.mu.Lock()
 	defer ms.mu.Unlock()
+	if !ms.canAssign(key, model.MetricTypeGauge) {
+		return model.TypeConflict(key)
+	}
+	if _, exists := ms.Gauge[key]; !exists {
+		ms.owners.Add(key, model.MetricTypeGauge)
+	}
 	ms.Gauge[key] = value
 	return nil
 }
 
-// GetCounterMetric - get counter metric value by name from memory storage
-func (ms *MemStorage) GetCounterMetric(key string) (int64, error) {
+// SetHistogramMetric - merge histogram observations by name into memory storage, returns merged histogram
+func (ms *MemStorage) SetHistogramMetric(ctx context.Context, key string, value model.Histogram) (model.Histogram, error) {
 	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if !ms.canAssign(key, model.MetricTypeHistogram) {
+		return model.Histogram{}, model.TypeConflict(key)
+	}
+	stored, exists := ms.Histogram[key]
+	if !exists {
+		ms.owners.Add(key, model.MetricTypeHistogram)
+		ms.Histogram[key] = value.Copy()
+		return value.Copy(), nil
+	}
+	if err := stored.Merge(value); err != nil {
+		return model.Histogram{}, err
+	}
+	ms.Histogram[key] = stored
+	return stored.Copy(), nil
+}
+
+// GetCounterMetric - get counter metric value by name from memory storage
+func (ms *MemStorage) GetCounterMetric(ctx context.Context, key string) (int64, error) {
+	ms.mu.RLock()
 	v, ok := ms.Counter[key]
-	ms.mu.Unlock()
+	ms.mu.RUnlock()
 	if !ok {
 		return 0, ErrNotFound
 	}
@@ -74,42 +180,260 @@ func (ms *MemStorage) GetCounterMetric(key string) (int64, error) {
 }
 
 // GetGaugeMetric - get gauge metric value by name from memory storage
-func (ms *MemStorage) GetGaugeMetric(key string) (float64, error) {
-	ms.mu.Lock()
+func (ms *MemStorage) GetGaugeMetric(ctx context.Context, key string) (float64, error) {
+	ms.mu.RLock()
 	v, ok := ms.Gauge[key]
-	ms.mu.Unlock()
+	ms.mu.RUnlock()
 	if !ok {
 		return 0, ErrNotFound
 	}
 	return v, nil
 }
 
-// SetAllMetrics - sets slice of metrics passed to memroy storage
-func (ms *MemStorage) SetAllMetrics(metrics []model.Metrics) error {
+// GetHistogramMetric - get histogram metric value by name from memory storage
+func (ms *MemStorage) GetHistogramMetric(ctx context.Context, key string) (model.Histogram, error) {
+	ms.mu.RLock()
+	v, ok := ms.Histogram[key]
+	ms.mu.RUnlock()
+	if !ok {
+		return model.Histogram{}, ErrNotFound
+	}
+	return v.Copy(), nil
+}
 
-	for _, v := range metrics {
-		v := v
-		if v.Mtype == model.MetricTypeCounter {
+// SetAllMetrics - sets slice of metrics passed to memory storage atomically. Whole batch is checked first
+// and applied under single lock, so readers never see part of batch. If some metrics can't be applied,
+// *model.BatchError is returned and storage is not changed. Returns values of written series after batch,
+// see model.Written
+func (ms *MemStorage) SetAllMetrics(ctx context.Context, metrics []model.Metrics) ([]model.Metrics, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	histograms, err := ms.check(ms.owners, nil, metrics)
+	if err != nil {
+		return nil, err
+	}
+	ms.set(metrics, histograms)
+	return ms.values(model.Written(metrics)), nil
+}
 
-			err := ms.SetCounterMetric(v.ID, *v.Delta)
-			if err != nil {
-				return err
+// values - fills stored values of metrics by type and key. Must be called under lock
+func (ms *MemStorage) values(metrics []model.Metrics) []model.Metrics {
+	for i, m := range metrics {
+		switch m.Mtype {
+		case model.MetricTypeCounter:
+			if v, ok := ms.Counter[m.ID]; ok {
+				metrics[i].Delta = &v
+			}
+		case model.MetricTypeGauge:
+			if v, ok := ms.Gauge[m.ID]; ok {
+				metrics[i].Value = &v
 			}
-		} else if v.Mtype == model.MetricTypeGauge {
-			err := ms.SetGaugeMetric(v.ID, *v.Value)
-			if err != nil {
-				return err
+		case model.MetricTypeHistogram:
+			if v, ok := ms.Histogram[m.ID]; ok {
+				v = v.Copy()
+				metrics[i].Histogram = &v
 			}
 		}
 	}
+	return metrics
+}
+
+// set - applies checked batch with its merged histograms. Must be called under lock
+func (ms *MemStorage) set(metrics []model.Metrics, histograms map[string]model.Histogram) {
+	for _, v := range metrics {
+		switch v.Mtype {
+		case model.MetricTypeCounter:
+			if _, ok := ms.Counter[v.ID]; !ok {
+				ms.owners.Add(v.ID, v.Mtype)
+			}
+			ms.Counter[v.ID] += *v.Delta
+		case model.MetricTypeGauge:
+			if _, ok := ms.Gauge[v.ID]; !ok {
+				ms.owners.Add(v.ID, v.Mtype)
+			}
+			ms.Gauge[v.ID] = *v.Value
+		}
+	}
+	for key, h := range histograms {
+		if _, ok := ms.Histogram[key]; !ok {
+			ms.owners.Add(key, model.MetricTypeHistogram)
+		}
+		ms.Histogram[key] = h
+	}
+}
+
+// CheckMetrics - reports whether batch can be set by SetAllMetrics, without changing storage.
+// Returns the same *model.BatchError as SetAllMetrics would
+func (ms *MemStorage) CheckMetrics(ctx context.Context, metrics []model.Metrics) error {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	_, err := ms.check(ms.owners, nil, metrics)
+	return err
+}
+
+// ReplaceMetrics - removes series of remove and sets metrics of set atomically, under single lock.
+// Series to remove are identified by type and series key, missing one is ErrNotFound. Metrics of set
+// are checked as batch of SetAllMetrics written after removal. Nothing is changed if anything can't be applied
+func (ms *MemStorage) ReplaceMetrics(ctx context.Context, remove, set []model.Metrics) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	owners, histograms, err := ms.checkReplace(remove, set)
+	if err != nil {
+		return err
+	}
+	for _, m := range remove {
+		ms.delete(m.Mtype, m.ID)
+	}
+	ms.owners = owners
+	ms.set(set, histograms)
 	return nil
 }
 
-// GetAllMetric - retrieve all metrics from memory storage
-func (ms *MemStorage) GetAllMetric() []model.Metrics {
+// CheckReplace - reports whether ReplaceMetrics would succeed, without changing storage
+func (ms *MemStorage) CheckReplace(ctx context.Context, remove, set []model.Metrics) error {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	_, _, err := ms.checkReplace(remove, set)
+	return err
+}
+
+// checkReplace - checks replacement and returns owners of names after removal and merged histograms of set.
+// Must be called under lock
+func (ms *MemStorage) checkReplace(remove, set []model.Metrics) (*Owners, map[string]model.Histogram, error) {
+	owners := ms.owners.Copy()
+	removed := make(map[string]bool, len(remove))
+	for _, m := range remove {
+		if !ms.stored(m.Mtype, m.ID) || removed[historyKey(m.Mtype, m.ID)] {
+			return nil, nil, ErrNotFound
+		}
+		removed[historyKey(m.Mtype, m.ID)] = true
+		owners.Remove(m.ID)
+	}
+	histograms, err := ms.check(owners, removed, set)
+	if err != nil {
+		return nil, nil, err
+	}
+	return owners, histograms, nil
+}
+
+// check - checks batch against owners of names and returns stored histograms merged with histograms of batch.
+// Histograms are merged into copies, bucket mismatch must not leave part of batch applied. Stored series
+// in removed, by type and key, are treated as missing. Must be called under lock
+func (ms *MemStorage) check(owners *Owners, removed map[string]bool, metrics []model.Metrics) (map[string]model.Histogram, error) {
+	histograms := make(map[string]model.Histogram)
+	types := make(map[string]string) // types of names written by batch
+	var batchErr model.BatchError
+	for i, v := range metrics {
+		var err error
+		name := model.SeriesName(v.ID)
+		if mtype, ok := types[name]; (ok && mtype != v.Mtype) || !owners.CanAssign(v.ID, v.Mtype) {
+			batchErr.Items = append(batchErr.Items, model.ItemError{Index: i, ID: v.ID, Mtype: v.Mtype, Err: model.TypeConflict(v.ID)})
+			continue
+		}
+		types[name] = v.Mtype
+		switch v.Mtype {
+		case model.MetricTypeCounter:
+			if v.Delta == nil {
+				err = ErrInvalidValue
+			}
+		case model.MetricTypeGauge:
+			if v.Value == nil {
+				err = ErrInvalidValue
+			}
+		case model.MetricTypeHistogram:
+			if v.Histogram == nil {
+				err = ErrInvalidValue
+				break
+			}
+			stored, ok := histograms[v.ID]
+			if !ok && !removed[historyKey(v.Mtype, v.ID)] {
+				stored, ok = ms.Histogram[v.ID]
+				stored = stored.Copy()
+			}
+			if !ok {
+				stored = v.Histogram.Copy()
+			} else {
+				err = stored.Merge(*v.Histogram)
+			}
+			histograms[v.ID] = stored
+		}
+		if err != nil {
+			batchErr.Items = append(batchErr.Items, model.ItemError{Index: i, ID: v.ID, Mtype: v.Mtype, Err: err})
+		}
+	}
+	if len(batchErr.Items) > 0 {
+		return nil, &batchErr
+	}
+	return histograms, nil
+}
+
+// canAssign - reports whether name of series key is free or owned by passed type, every name has one type
+// whatever labels of its series are. Must be called under lock
+func (ms *MemStorage) canAssign(key, mtype string) bool {
+	return ms.owners.CanAssign(key, mtype)
+}
+
+// DeleteMetric - removes value of metric stored by series key with passed type
+func (ms *MemStorage) DeleteMetric(ctx context.Context, mtype, key string) error {
 	ms.mu.Lock()
 	defer ms.mu.Unlock()
-	lenMetrics := len(ms.Counter) + len(ms.Gauge)
+	if !ms.stored(mtype, key) {
+		return ErrNotFound
+	}
+	ms.delete(mtype, key)
+	return nil
+}
+
+// stored - reports whether series key is stored with passed type. Must be called under lock
+func (ms *MemStorage) stored(mtype, key string) bool {
+	var exists bool
+	switch mtype {
+	case model.MetricTypeCounter:
+		_, exists = ms.Counter[key]
+	case model.MetricTypeGauge:
+		_, exists = ms.Gauge[key]
+	case model.MetricTypeHistogram:
+		_, exists = ms.Histogram[key]
+	}
+	return exists
+}
+
+// delete - removes stored series and frees its name with the last series. Must be called under lock
+func (ms *MemStorage) delete(mtype, key string) {
+	switch mtype {
+	case model.MetricTypeCounter:
+		delete(ms.Counter, key)
+	case model.MetricTypeGauge:
+		delete(ms.Gauge, key)
+	case model.MetricTypeHistogram:
+		delete(ms.Histogram, key)
+	}
+	ms.owners.Remove(key)
+}
+
+// SetAllMetricsOnce - sets metrics unless batch with same idempotency key was applied within window before appliedAt.
+// Returns false if batch is skipped as duplicate, values of written series are returned only if batch is applied
+func (ms *MemStorage) SetAllMetricsOnce(ctx context.Context, metrics []model.Metrics, key string, appliedAt time.Time, window time.Duration) ([]model.Metrics, bool, error) {
+	var written []model.Metrics
+	applied, err := ms.ApplyOnce(ctx, key, appliedAt, window, func() (err error) {
+		written, err = ms.SetAllMetrics(ctx, metrics)
+		return err
+	})
+	return written, applied, err
+}
+
+// ApplyOnce - runs apply unless batch with same idempotency key was applied within window before appliedAt,
+// key is remembered only if apply succeeds. Returns false if batch is skipped as duplicate
+func (ms *MemStorage) ApplyOnce(ctx context.Context, key string, appliedAt time.Time, window time.Duration, apply func() error) (bool, error) {
+	return ms.keys.Apply(ctx, key, appliedAt, window, apply)
+}
+
+// GetAllMetric - retrieve all metrics from memory storage
+func (ms *MemStorage) GetAllMetric(ctx context.Context) ([]model.Metrics, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	lenMetrics := len(ms.Counter) + len(ms.Gauge) + len(ms.Histogram)
 	metrics := make([]model.Metrics, lenMetrics)
 	i := 0
 	for k, v := range ms.Counter {
@@ -128,9 +452,252 @@ func (ms *MemStorage) GetAllMetric() []model.Metrics {
 		metrics[i].Value = &v
 		i++
 	}
-	return metrics
+	for k, v := range ms.Histogram {
+		k := k
+		v := v.Copy()
+		metrics[i].ID = k
+		metrics[i].Mtype = model.MetricTypeHistogram
+		metrics[i].Histogram = &v
+		i++
+	}
+	return metrics, nil
+}
+
+// AppendSample - append sample to history of metric
+func (ms *MemStorage) AppendSample(ctx context.Context, mtype, name string, sample model.Sample) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	key := historyKey(mtype, name)
+	ms.History[key] = append(ms.History[key], sample)
+	return nil
+}
+
+// GetSamples - get samples of metric which timestamps are in [from, to] range
+func (ms *MemStorage) GetSamples(ctx context.Context, mtype, name string, from, to time.Time) ([]model.Sample, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	var samples []model.Sample
+	for _, s := range ms.History[historyKey(mtype, name)] {
+		if s.Timestamp.Before(from) || s.Timestamp.After(to) {
+			continue
+		}
+		samples = append(samples, s)
+	}
+	return samples, nil
+}
+
+// DeleteSamplesBefore - remove samples older than passed time from history of all metrics
+func (ms *MemStorage) DeleteSamplesBefore(ctx context.Context, before time.Time) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for key, samples := range ms.History {
+		kept := samples[:0]
+		for _, s := range samples {
+			if !s.Timestamp.Before(before) {
+				kept = append(kept, s)
+			}
+		}
+		if len(kept) == 0 {
+			delete(ms.History, key)
+			continue
+		}
+		ms.History[key] = kept
+	}
+	return nil
+}
+
+// HistorySeries - list metrics which have raw samples in history
+func (ms *MemStorage) HistorySeries(ctx context.Context) ([]model.SeriesRef, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	series := make([]model.SeriesRef, 0, len(ms.History))
+	for key := range ms.History {
+		mtype, name, _ := strings.Cut(key, "/")
+		series = append(series, model.SeriesRef{ID: name, Mtype: mtype})
+	}
+	return series, nil
+}
+
+// SaveAggregates - insert or replace aggregates of metric with passed resolution
+func (ms *MemStorage) SaveAggregates(ctx context.Context, mtype, name string, resolution time.Duration, aggs []model.Aggregate) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	key := rollupKey(resolution, mtype, name)
+	rollup, ok := ms.Rollups[key]
+	if !ok {
+		rollup = make(map[int64]model.Aggregate)
+		ms.Rollups[key] = rollup
+	}
+	for _, a := range aggs {
+		rollup[a.Timestamp.UnixNano()] = a
+	}
+	return nil
+}
+
+// GetAggregates - get aggregates of metric with passed resolution which timestamps are in [from, to] range
+func (ms *MemStorage) GetAggregates(ctx context.Context, mtype, name string, resolution time.Duration, from, to time.Time) ([]model.Aggregate, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	var aggs []model.Aggregate
+	for _, a := range ms.Rollups[rollupKey(resolution, mtype, name)] {
+		if a.Timestamp.Before(from) || a.Timestamp.After(to) {
+			continue
+		}
+		aggs = append(aggs, a)
+	}
+	sort.Slice(aggs, func(i, j int) bool {
+		return aggs[i].Timestamp.Before(aggs[j].Timestamp)
+	})
+	return aggs, nil
+}
+
+// DeleteAggregatesBefore - remove aggregates with passed resolution older than passed time
+func (ms *MemStorage) DeleteAggregatesBefore(ctx context.Context, resolution time.Duration, before time.Time) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	prefix := resolution.String() + "|"
+	for key, rollup := range ms.Rollups {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		for ts, a := range rollup {
+			if a.Timestamp.Before(before) {
+				delete(rollup, ts)
+			}
+		}
+		if len(rollup) == 0 {
+			delete(ms.Rollups, key)
+		}
+	}
+	return nil
+}
+
+func historyKey(mtype, name string) string {
+	return mtype + "/" + name
+}
+
+func rollupKey(resolution time.Duration, mtype, name string) string {
+	return resolution.String() + "|" + historyKey(mtype, name)
+}
+
+// SetMetadata - sets metadata of metric name
+func (ms *MemStorage) SetMetadata(ctx context.Context, meta model.Metadata) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.Metadata[meta.Name] = meta
+	return nil
 }
 
-func (ms *MemStorage) PingStorage() error {
+// GetMetadata - returns metadata of metric name
+func (ms *MemStorage) GetMetadata(ctx context.Context, name string) (model.Metadata, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	meta, ok := ms.Metadata[name]
+	if !ok {
+		return model.Metadata{}, ErrNotFound
+	}
+	return meta, nil
+}
+
+// GetAllMetadata - returns metadata of all metric names ordered by name
+func (ms *MemStorage) GetAllMetadata(ctx context.Context) ([]model.Metadata, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	result := make([]model.Metadata, 0, len(ms.Metadata))
+	for _, meta := range ms.Metadata {
+		result = append(result, meta)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
+
+func (ms *MemStorage) PingStorage(ctx context.Context) error {
 	return nil
 }
+
+// Dump all data of storage partition, used to snapshot storage
+type Dump struct {
+	Gauge     map[string]float64                   `json:"gauge,omitempty"`
+	Counter   map[string]int64                     `json:"counter,omitempty"`
+	Histogram map[string]model.Histogram           `json:"histogram,omitempty"`
+	History   map[string][]model.Sample            `json:"history,omitempty"`
+	Rollups   map[string]map[int64]model.Aggregate `json:"rollups,omitempty"`
+	Metadata  map[string]model.Metadata            `json:"metadata,omitempty"`
+	Keys      map[string]time.Time                 `json:"keys,omitempty"`
+}
+
+// Dump - returns copy of all data of storage partition
+func (ms *MemStorage) Dump() Dump {
+	ms.mu.RLock()
+	d := Dump{
+		Gauge:     make(map[string]float64, len(ms.Gauge)),
+		Counter:   make(map[string]int64, len(ms.Counter)),
+		Histogram: make(map[string]model.Histogram, len(ms.Histogram)),
+		History:   make(map[string][]model.Sample, len(ms.History)),
+		Rollups:   make(map[string]map[int64]model.Aggregate, len(ms.Rollups)),
+		Metadata:  make(map[string]model.Metadata, len(ms.Metadata)),
+	}
+	for k, v := range ms.Gauge {
+		d.Gauge[k] = v
+	}
+	for k, v := range ms.Counter {
+		d.Counter[k] = v
+	}
+	for k, v := range ms.Histogram {
+		d.Histogram[k] = v.Copy()
+	}
+	for k, v := range ms.History {
+		d.History[k] = append([]model.Sample(nil), v...)
+	}
+	for k, v := range ms.Rollups {
+		rollup := make(map[int64]model.Aggregate, len(v))
+		for ts, a := range v {
+			rollup[ts] = a
+		}
+		d.Rollups[k] = rollup
+	}
+	for k, v := range ms.Metadata {
+		d.Metadata[k] = v
+	}
+	ms.mu.RUnlock()
+
+	d.Keys = ms.keys.Snapshot()
+	return d
+}
+
+// Load - replaces all data of storage partition with dump
+func (ms *MemStorage) Load(d Dump) {
+	fresh := New(nil)
+	for k, v := range d.Gauge {
+		fresh.Gauge[k] = v
+	}
+	for k, v := range d.Counter {
+		fresh.Counter[k] = v
+	}
+	for k, v := range d.Histogram {
+		fresh.Histogram[k] = v.Copy()
+	}
+	for k, v := range d.History {
+		fresh.History[k] = append([]model.Sample(nil), v...)
+	}
+	for k, v := range d.Rollups {
+		rollup := make(map[int64]model.Aggregate, len(v))
+		for ts, a := range v {
+			rollup[ts] = a
+		}
+		fresh.Rollups[k] = rollup
+	}
+	for k, v := range d.Metadata {
+		fresh.Metadata[k] = v
+	}
+
+	ms.mu.Lock()
+	ms.Gauge, ms.Counter, ms.Histogram = fresh.Gauge, fresh.Counter, fresh.Histogram
+	ms.History, ms.Rollups, ms.Metadata = fresh.History, fresh.Rollups, fresh.Metadata
+	ms.owners = ownersOf(fresh.Counter, fresh.Gauge, fresh.Histogram)
+	ms.mu.Unlock()
+
+	ms.keys.Restore(d.Keys)
+}
@@ -0,0 +1,59 @@
+package memstorage
+
+import "github.com/SmoothWay/metrics/internal/model"
+
+// Owners types owning metric names. All series of a name have one type whatever their labels are,
+// name is owned while some series of it is stored. Owners is not safe for concurrent use,
+// storage guards it by its own lock
+type Owners struct {
+	names map[string]owner
+}
+
+type owner struct {
+	mtype  string
+	series int
+}
+
+// NewOwners - creates owners of no names
+func NewOwners() *Owners {
+	return &Owners{names: make(map[string]owner)}
+}
+
+// CanAssign - reports whether series key can be stored with mtype, name of series is free or owned by mtype
+func (o *Owners) CanAssign(key, mtype string) bool {
+	own, ok := o.names[model.SeriesName(key)]
+	return !ok || own.mtype == mtype
+}
+
+// Add - counts new series key stored with mtype, name of series must be assignable to mtype
+func (o *Owners) Add(key, mtype string) {
+	name := model.SeriesName(key)
+	own := o.names[name]
+	own.mtype = mtype
+	own.series++
+	o.names[name] = own
+}
+
+// Remove - forgets removed series key, name becomes free with its last series
+func (o *Owners) Remove(key string) {
+	name := model.SeriesName(key)
+	own, ok := o.names[name]
+	if !ok {
+		return
+	}
+	own.series--
+	if own.series <= 0 {
+		delete(o.names, name)
+		return
+	}
+	o.names[name] = own
+}
+
+// Copy - returns owners which can be changed without changing o
+func (o *Owners) Copy() *Owners {
+	names := make(map[string]owner, len(o.names))
+	for name, own := range o.names {
+		names[name] = own
+	}
+	return &Owners{names: names}
+}
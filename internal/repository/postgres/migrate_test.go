@@ -0,0 +1,83 @@
+package postgres
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	file := func(s string) *fstest.MapFile { return &fstest.MapFile{Data: []byte(s)} }
+
+	tests := []struct {
+		name     string
+		fsys     fstest.MapFS
+		versions []int
+		wantErr  bool
+	}{
+		{
+			name: "ordered by version",
+			fsys: fstest.MapFS{
+				"0002_b.up.sql":   file("B"),
+				"0002_b.down.sql": file("-B"),
+				"0001_a.up.sql":   file("A"),
+				"0001_a.down.sql": file("-A"),
+				"README.md":       file("not a migration"),
+			},
+			versions: []int{1, 2},
+		},
+		{
+			name:    "missing down file",
+			fsys:    fstest.MapFS{"0001_a.up.sql": file("A")},
+			wantErr: true,
+		},
+		{
+			name: "duplicate version",
+			fsys: fstest.MapFS{
+				"0001_a.up.sql":   file("A"),
+				"0001_a.down.sql": file("-A"),
+				"0001_b.up.sql":   file("B"),
+				"0001_b.down.sql": file("-B"),
+			},
+			wantErr: true,
+		},
+		{
+			name:    "no direction",
+			fsys:    fstest.MapFS{"0001_a.sql": file("A")},
+			wantErr: true,
+		},
+		{
+			name:    "no version",
+			fsys:    fstest.MapFS{"a.up.sql": file("A"), "a.down.sql": file("-A")},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			migrations, err := LoadMigrations(tt.fsys)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidMigration)
+				return
+			}
+			require.NoError(t, err)
+			var versions []int
+			for _, m := range migrations {
+				versions = append(versions, m.Version)
+			}
+			assert.Equal(t, tt.versions, versions)
+			assert.Equal(t, "A", migrations[0].Up)
+			assert.Equal(t, "-A", migrations[0].Down)
+		})
+	}
+}
+
+func TestMigrations_Embedded(t *testing.T) {
+	migrations, err := Migrations()
+	require.NoError(t, err)
+	require.NotEmpty(t, migrations)
+	for i, m := range migrations {
+		assert.Equal(t, i+1, m.Version, "versions must have no gaps")
+	}
+}
@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS metrics (
+	name TEXT PRIMARY KEY,
+	type VARCHAR(50),
+	value DOUBLE PRECISION,
+	delta BIGINT);
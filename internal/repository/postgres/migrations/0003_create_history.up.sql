@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS metric_samples (
+	name TEXT NOT NULL,
+	type VARCHAR(50) NOT NULL,
+	ts TIMESTAMPTZ NOT NULL,
+	value DOUBLE PRECISION NOT NULL);
+CREATE INDEX IF NOT EXISTS metric_samples_name_ts_idx ON metric_samples (type, name, ts);
+
+CREATE TABLE IF NOT EXISTS metric_rollups (
+	name TEXT NOT NULL,
+	type VARCHAR(50) NOT NULL,
+	resolution BIGINT NOT NULL,
+	ts TIMESTAMPTZ NOT NULL,
+	min DOUBLE PRECISION NOT NULL,
+	max DOUBLE PRECISION NOT NULL,
+	sum DOUBLE PRECISION NOT NULL,
+	last DOUBLE PRECISION NOT NULL,
+	count BIGINT NOT NULL,
+	PRIMARY KEY (resolution, type, name, ts));
@@ -0,0 +1,12 @@
+-- rows of other tenants are removed, they can't be kept without tenant column
+DELETE FROM metrics WHERE tenant <> '';
+DELETE FROM metric_samples WHERE tenant <> '';
+DELETE FROM metric_rollups WHERE tenant <> '';
+DROP INDEX IF EXISTS metric_samples_tenant_name_ts_idx;
+ALTER TABLE metrics DROP CONSTRAINT IF EXISTS metrics_pkey;
+ALTER TABLE metric_rollups DROP CONSTRAINT IF EXISTS metric_rollups_pkey;
+ALTER TABLE metrics DROP COLUMN IF EXISTS tenant;
+ALTER TABLE metric_samples DROP COLUMN IF EXISTS tenant;
+ALTER TABLE metric_rollups DROP COLUMN IF EXISTS tenant;
+ALTER TABLE metrics ADD PRIMARY KEY (name);
+ALTER TABLE metric_rollups ADD PRIMARY KEY (resolution, type, name, ts);
@@ -0,0 +1,18 @@
+-- tenant column partitions all tables, default tenant is empty string
+ALTER TABLE metrics ADD COLUMN IF NOT EXISTS tenant TEXT NOT NULL DEFAULT '';
+ALTER TABLE metric_samples ADD COLUMN IF NOT EXISTS tenant TEXT NOT NULL DEFAULT '';
+ALTER TABLE metric_rollups ADD COLUMN IF NOT EXISTS tenant TEXT NOT NULL DEFAULT '';
+DO $$
+BEGIN
+	IF NOT EXISTS (SELECT 1 FROM information_schema.key_column_usage
+		WHERE table_name = 'metrics' AND constraint_name = 'metrics_pkey' AND column_name = 'tenant') THEN
+		ALTER TABLE metrics DROP CONSTRAINT IF EXISTS metrics_pkey;
+		ALTER TABLE metrics ADD PRIMARY KEY (tenant, name);
+	END IF;
+	IF NOT EXISTS (SELECT 1 FROM information_schema.key_column_usage
+		WHERE table_name = 'metric_rollups' AND constraint_name = 'metric_rollups_pkey' AND column_name = 'tenant') THEN
+		ALTER TABLE metric_rollups DROP CONSTRAINT IF EXISTS metric_rollups_pkey;
+		ALTER TABLE metric_rollups ADD PRIMARY KEY (tenant, resolution, type, name, ts);
+	END IF;
+END $$;
+CREATE INDEX IF NOT EXISTS metric_samples_tenant_name_ts_idx ON metric_samples (tenant, type, name, ts);
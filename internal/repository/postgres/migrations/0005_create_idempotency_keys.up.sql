@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+	tenant TEXT NOT NULL DEFAULT '',
+	key TEXT NOT NULL,
+	applied_at TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (tenant, key));
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS metric_metadata (
+	tenant TEXT NOT NULL DEFAULT '',
+	name TEXT NOT NULL,
+	unit TEXT NOT NULL DEFAULT '',
+	description TEXT NOT NULL DEFAULT '',
+	owner TEXT NOT NULL DEFAULT '',
+	PRIMARY KEY (tenant, name));
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS metric_types;
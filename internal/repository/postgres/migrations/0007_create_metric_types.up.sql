@@ -0,0 +1,12 @@
+-- type owning metric name, all series of a name have one type whatever their labels are
+CREATE TABLE IF NOT EXISTS metric_types (
+	tenant TEXT NOT NULL DEFAULT '',
+	name TEXT NOT NULL,
+	type VARCHAR(50) NOT NULL,
+	PRIMARY KEY (tenant, name));
+-- name stored with several types before is owned by one of them, series of others are kept until retyped
+INSERT INTO metric_types(tenant, name, type)
+SELECT DISTINCT ON (tenant, split_part(name, '{', 1)) tenant, split_part(name, '{', 1), type
+FROM metrics WHERE type IS NOT NULL
+ORDER BY tenant, split_part(name, '{', 1), type
+ON CONFLICT (tenant, name) DO NOTHING;
@@ -2,30 +2,89 @@
 package postgres
 
 import (
-	"database/sql"
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
+	"sort"
 	"time"
 
-	"go.uber.org/zap"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
 
-	"github.com/SmoothWay/metrics/internal/logger"
 	"github.com/SmoothWay/metrics/internal/model"
 )
 
-var ErrNotFound = errors.New("value not found")
+var ErrNotFound = model.ErrNotFound
+
+// DefaultQueryTimeout how long single call of repository may take by default
+const DefaultQueryTimeout = 5 * time.Second
+
+// PoolOptions sizes and timeouts of connection pool, zero values keep pgxpool defaults
+type PoolOptions struct {
+	MaxConns        int32
+	MinConns        int32
+	MaxConnLifetime time.Duration
+	MaxConnIdleTime time.Duration
+	QueryTimeout    time.Duration
+}
 
 type PostgreDB struct {
-	db *sql.DB
+	pool         *pgxpool.Pool
+	tenant       string
+	queryTimeout time.Duration
 }
 
-// New connects to database by passed dsn and creates neccesary table returning PostgreDB type
-func New(dsn string) (*PostgreDB, error) {
+// New connects to database by passed dsn and migrates its schema to latest version returning PostgreDB type
+func New(dsn string, opts PoolOptions) (*PostgreDB, error) {
+	p, err := Connect(dsn, opts)
+	if err != nil {
+		return nil, err
+	}
+	m, err := p.Migrator()
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	applied, err := m.Up(context.Background())
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	if applied > 0 {
+		log.Printf("Applied %d migrations\n", applied)
+	}
+	return p, nil
+}
+
+// Connect connects to database by passed dsn, schema is left as is
+func Connect(dsn string, opts PoolOptions) (*PostgreDB, error) {
+	config, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if opts.MaxConns > 0 {
+		config.MaxConns = opts.MaxConns
+	}
+	if opts.MinConns > 0 {
+		config.MinConns = opts.MinConns
+	}
+	if opts.MaxConnLifetime > 0 {
+		config.MaxConnLifetime = opts.MaxConnLifetime
+	}
+	if opts.MaxConnIdleTime > 0 {
+		config.MaxConnIdleTime = opts.MaxConnIdleTime
+	}
+	if opts.QueryTimeout <= 0 {
+		opts.QueryTimeout = DefaultQueryTimeout
+	}
+
 	var counts int
-	var connection *sql.DB
-	var err error
+	var pool *pgxpool.Pool
 	for {
-		connection, err = openDB(dsn)
+		pool, err = openPool(config, opts.QueryTimeout)
 		if err != nil {
 			log.Println("Database not ready...")
 			counts++
@@ -40,236 +99,604 @@ func New(dsn string) (*PostgreDB, error) {
 		time.Sleep(time.Duration(2+counts) * time.Second)
 	}
 
-	stmtCreateTable, err := connection.Prepare(`
-	CREATE TABLE IF NOT EXISTS metrics (
-		name TEXT PRIMARY KEY,
-		type VARCHAR(50),
-		value DOUBLE PRECISION,
-		delta BIGINT);`)
+	return &PostgreDB{pool: pool, queryTimeout: opts.QueryTimeout}, nil
+}
+
+func openPool(config *pgxpool.Config, timeout time.Duration) (*pgxpool.Pool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	pool, err := pgxpool.NewWithConfig(ctx, config)
 	if err != nil {
 		return nil, err
 	}
-
-	_, err = stmtCreateTable.Exec()
-	if err != nil {
+	if err = pool.Ping(ctx); err != nil {
+		pool.Close()
 		return nil, err
 	}
+	return pool, nil
+}
 
-	return &PostgreDB{
-		db: connection,
-	}, nil
+// context returns context of single call of repository, ctx of caller limited by query timeout
+func (p *PostgreDB) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, p.queryTimeout)
 }
 
-func openDB(dsn string) (*sql.DB, error) {
-	db, err := sql.Open("pgx", dsn)
-	if err != nil {
-		return nil, err
-	}
-	err = db.Ping()
-	if err != nil {
-		return nil, err
-	}
-	return db, nil
+// Close closes all connections of pool
+func (p *PostgreDB) Close() error {
+	p.pool.Close()
+	return nil
 }
 
-// SetCounterMetric sets value for counter type metric
-func (p *PostgreDB) SetCounterMetric(key string, value int64) error {
-	var name string
-	var prevDelta sql.NullInt64
-	stmtGetCounter := `SELECT name, delta FROM metrics WHERE name = $1 and type = 'counter'`
-	stmtUpdateCounter := `UPDATE metrics SET delta = $1 WHERE name = $2`
-	stmtInsertCounter := `INSERT INTO metrics(name, type, delta) VALUES($1, $2, $3)`
+// Tenant returns storage working with rows of tenant, default tenant is empty string
+func (p *PostgreDB) Tenant(id string) *PostgreDB {
+	return &PostgreDB{pool: p.pool, tenant: id, queryTimeout: p.queryTimeout}
+}
 
-	tx, err := p.db.Begin()
+// Tenants lists tenants which have metrics in database
+func (p *PostgreDB) Tenants() ([]string, error) {
+	ctx, cancel := p.context(context.Background())
+	defer cancel()
+	rows, err := p.pool.Query(ctx, `SELECT DISTINCT tenant FROM metrics ORDER BY tenant`)
 	if err != nil {
-		tx.Rollback()
-		return err
+		return nil, storageError(err)
 	}
+	result, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	return result, storageError(err)
+}
 
-	getDelta := tx.QueryRow(stmtGetCounter, key)
+// Upserts claim metric name $4 of series $1 for their type in metric_types first. Row of owner is locked
+// by claim until end of transaction, so concurrent writers of a name can't claim it for different types.
+// Series is written only if name is owned by its type and stored row has the same type, so no row
+// is affected when name is used by another type. Counter upsert returns new value of counter
+const (
+	upsertCounterStmt = `WITH owner AS (
+		INSERT INTO metric_types(tenant, name, type) VALUES($3, $4, 'counter')
+		ON CONFLICT (tenant, name) DO UPDATE SET type = metric_types.type RETURNING type)
+	INSERT INTO metrics(name, type, delta, tenant)
+	SELECT $1::text, 'counter', $2::bigint, $3::text FROM owner WHERE owner.type = 'counter'
+	ON CONFLICT (tenant, name) DO UPDATE SET delta = COALESCE(metrics.delta, 0) + EXCLUDED.delta
+	WHERE metrics.type = 'counter' RETURNING metrics.delta`
+
+	upsertGaugeStmt = `WITH owner AS (
+		INSERT INTO metric_types(tenant, name, type) VALUES($3, $4, 'gauge')
+		ON CONFLICT (tenant, name) DO UPDATE SET type = metric_types.type RETURNING type)
+	INSERT INTO metrics(name, type, value, tenant)
+	SELECT $1::text, 'gauge', $2::double precision, $3::text FROM owner WHERE owner.type = 'gauge'
+	ON CONFLICT (tenant, name) DO UPDATE SET value = EXCLUDED.value
+	WHERE metrics.type = 'gauge'`
+
+	upsertHistogramStmt = `WITH owner AS (
+		INSERT INTO metric_types(tenant, name, type) VALUES($3, $4, 'histogram')
+		ON CONFLICT (tenant, name) DO UPDATE SET type = metric_types.type RETURNING type)
+	INSERT INTO metrics(name, type, histogram, tenant)
+	SELECT $1::text, 'histogram', $2::jsonb, $3::text FROM owner WHERE owner.type = 'histogram'
+	ON CONFLICT (tenant, name) DO UPDATE SET histogram = EXCLUDED.histogram
+	WHERE metrics.type = 'histogram'`
+
+	// claimNameStmt claims metric name $2 for type $3 unless it is owned already and returns type owning it.
+	// Row of owner is locked until end of transaction even if it is inserted by the claim
+	claimNameStmt = `INSERT INTO metric_types(tenant, name, type) VALUES($1, $2, $3)
+	ON CONFLICT (tenant, name) DO UPDATE SET type = metric_types.type RETURNING type`
+
+	// releaseNameStmt frees metric name $2 which has no series left
+	releaseNameStmt = `DELETE FROM metric_types WHERE tenant = $1 AND name = $2
+	AND NOT EXISTS (SELECT 1 FROM metrics WHERE metrics.tenant = $1 AND split_part(metrics.name, '{', 1) = $2)`
+)
 
-	err = getDelta.Scan(&name, &prevDelta)
+// SetCounterMetric adds value to counter type metric and returns new value of counter
+func (p *PostgreDB) SetCounterMetric(ctx context.Context, key string, value int64) (int64, error) {
+	ctx, cancel := p.context(ctx)
+	defer cancel()
+	var total int64
+	err := p.pool.QueryRow(ctx, upsertCounterStmt, key, value, p.tenant, model.SeriesName(key)).Scan(&total)
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			_, err = tx.Exec(stmtInsertCounter, key, model.MetricTypeCounter, value)
-			if err != nil {
-				tx.Rollback()
-				return err
-			}
-			tx.Commit()
-			return nil
-		} else {
-			tx.Rollback()
-			return err
-		}
+		return 0, counterConflict(err, key)
 	}
-	updateValue := prevDelta.Int64 + value
-	log.Println(updateValue)
-	_, err = tx.Exec(stmtUpdateCounter, updateValue, name)
+	return total, nil
+}
+
+// SetGaugeMetric sets value for gauge type metric
+func (p *PostgreDB) SetGaugeMetric(ctx context.Context, key string, value float64) error {
+	ctx, cancel := p.context(ctx)
+	defer cancel()
+	tag, err := p.pool.Exec(ctx, upsertGaugeStmt, key, value, p.tenant, model.SeriesName(key))
 	if err != nil {
-		tx.Rollback()
-		return err
+		return storageError(err)
+	}
+	return typeConflict(tag, key)
+}
+
+// typeConflict returns conflict error if upsert didn't affect row because name is used by another type
+func typeConflict(tag pgconn.CommandTag, key string) error {
+	if tag.RowsAffected() == 0 {
+		return model.TypeConflict(key)
 	}
-	tx.Commit()
 	return nil
 }
 
-// SetGaugeMetric sets value for counter type metric
-func (p *PostgreDB) SetGaugeMetric(key string, value float64) error {
-	var name string
-	stmtGetGauge := `SELECT name FROM metrics WHERE name = $1 and type = 'gauge'`
-	stmtUpdateGauge := `UPDATE metrics SET value = $1 WHERE name = $2`
-	stmtInsertGauge := `INSERT INTO metrics(name, type, value) VALUES($1, $2, $3) 
-	ON CONFLICT (name) DO UPDATE SET value = $3 WHERE metrics.name = $1`
+// counterConflict returns conflict error if counter upsert returned no row because name is used by another type,
+// other errors are returned as storage errors
+func counterConflict(err error, key string) error {
+	if errors.Is(err, pgx.ErrNoRows) {
+		return model.TypeConflict(key)
+	}
+	return storageError(err)
+}
 
-	tx, err := p.db.Begin()
-	if err != nil {
-		tx.Rollback()
+// SetHistogramMetric merges histogram observations with stored value and returns merged histogram
+func (p *PostgreDB) SetHistogramMetric(ctx context.Context, key string, value model.Histogram) (model.Histogram, error) {
+	ctx, cancel := p.context(ctx)
+	defer cancel()
+	var merged model.Histogram
+	err := pgx.BeginFunc(ctx, p.pool, func(tx pgx.Tx) (err error) {
+		merged, err = setHistogramTx(ctx, tx, p.tenant, key, value)
 		return err
+	})
+	if err != nil {
+		return model.Histogram{}, storageError(err)
 	}
-	getDelta := p.db.QueryRow(stmtGetGauge, key)
-	err = getDelta.Scan(&name)
-	if errors.Is(err, sql.ErrNoRows) {
-		_, err = p.db.Exec(stmtInsertGauge, key, model.MetricTypeGauge, value)
-		if err != nil {
-			tx.Rollback()
-			return err
-		}
-		tx.Commit()
-		return nil
-	} else if err != nil {
-		tx.Rollback()
-		return err
+	return merged, nil
+}
+
+// setHistogramTx merges histogram with stored one and returns merged histogram. Owner of metric name is
+// claimed and locked first, it exists even before first series of name is stored, so concurrent first writes
+// of series are merged one after another instead of overwriting each other. Lock is held until end of transaction
+func setHistogramTx(ctx context.Context, tx pgx.Tx, tenant, key string, value model.Histogram) (model.Histogram, error) {
+	var owner string
+	err := tx.QueryRow(ctx, claimNameStmt, tenant, model.SeriesName(key), model.MetricTypeHistogram).Scan(&owner)
+	if err != nil {
+		return model.Histogram{}, err
+	}
+	if owner != model.MetricTypeHistogram {
+		return model.Histogram{}, model.TypeConflict(key)
 	}
 
-	_, err = p.db.Exec(stmtUpdateGauge, value, name)
+	stmtGetHistogram := `SELECT histogram FROM metrics WHERE name = $1 AND type = 'histogram' AND tenant = $2`
+	var raw []byte
+	err = tx.QueryRow(ctx, stmtGetHistogram, key, tenant).Scan(&raw)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return model.Histogram{}, err
+	}
+	if len(raw) > 0 {
+		var stored model.Histogram
+		if err = json.Unmarshal(raw, &stored); err != nil {
+			return model.Histogram{}, err
+		}
+		if err = stored.Merge(value); err != nil {
+			return model.Histogram{}, err
+		}
+		value = stored
+	}
+	data, err := json.Marshal(value)
 	if err != nil {
-		tx.Rollback()
-		return err
+		return model.Histogram{}, err
 	}
-	tx.Commit()
-	return nil
+	tag, err := tx.Exec(ctx, upsertHistogramStmt, key, data, tenant, model.SeriesName(key))
+	if err != nil {
+		return model.Histogram{}, err
+	}
+	if err = typeConflict(tag, key); err != nil {
+		return model.Histogram{}, err
+	}
+	return value, nil
 }
 
-// SetAllMetrics inserts slice of metrics into database, if it exists then updates metric
-func (p *PostgreDB) SetAllMetrics(metrics []model.Metrics) error {
-	stmtGetCounter := `SELECT delta FROM metrics WHERE name = $1 and type = 'counter'`
-
-	upsertGaugeStmt := `INSERT INTO metrics(name, type, value) VALUES($1, $2, $3) 
-	ON CONFLICT (name) DO UPDATE SET value = $3 WHERE metrics.name = $1 `
+// SetAllMetrics inserts slice of metrics into database in one transaction, if it exists then updates metric.
+// Returns values of written series after batch, see model.Written
+func (p *PostgreDB) SetAllMetrics(ctx context.Context, metrics []model.Metrics) ([]model.Metrics, error) {
+	ctx, cancel := p.context(ctx)
+	defer cancel()
+	var written []model.Metrics
+	err := pgx.BeginFunc(ctx, p.pool, func(tx pgx.Tx) (err error) {
+		written, err = p.setAllTx(ctx, tx, metrics)
+		return err
+	})
+	if err != nil {
+		return nil, storageError(err)
+	}
+	return written, nil
+}
 
-	upsertCounterStmt := `INSERT INTO metrics(name, type, delta) VALUES($1, $2, $3) 
-	ON CONFLICT (name) DO UPDATE SET delta = $3 WHERE metrics.name = $1`
+// SetAllMetricsOnce sets metrics in one transaction with idempotency key. Batch is skipped and false is returned
+// if key was applied within window before appliedAt, values of written series are returned only if batch is applied
+func (p *PostgreDB) SetAllMetricsOnce(ctx context.Context, metrics []model.Metrics, key string, appliedAt time.Time, window time.Duration) ([]model.Metrics, bool, error) {
+	ctx, cancel := p.context(ctx)
+	defer cancel()
 
-	tx, err := p.db.Begin()
-	if err != nil {
-		tx.Rollback()
+	var applied bool
+	var written []model.Metrics
+	err := pgx.BeginFunc(ctx, p.pool, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, `DELETE FROM idempotency_keys WHERE tenant = $1 AND applied_at < $2`, p.tenant, appliedAt.Add(-window))
+		if err != nil {
+			return err
+		}
+		tag, err := tx.Exec(ctx, `INSERT INTO idempotency_keys(tenant, key, applied_at) VALUES($1, $2, $3)
+		ON CONFLICT (tenant, key) DO NOTHING`, p.tenant, key, appliedAt)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return nil
+		}
+		applied = true
+		written, err = p.setAllTx(ctx, tx, metrics)
 		return err
+	})
+	if err != nil {
+		return nil, false, storageError(err)
 	}
-	for _, v := range metrics {
-		v := v
-		if v.Mtype == model.MetricTypeCounter {
-			row := tx.QueryRow(stmtGetCounter, v.ID)
-			var delta sql.NullInt64
+	return written, applied, nil
+}
 
-			err = row.Scan(&delta)
-			if err != nil && !errors.Is(err, sql.ErrNoRows) {
-				tx.Rollback()
-				return err
+// setAllTx merges histograms one by one, because merge needs stored value, then sends upserts
+// of counters and gauges in one batch. Metrics which name is used by another type reject the batch.
+// Returns values of written series after batch, taken from results of upserts
+func (p *PostgreDB) setAllTx(ctx context.Context, tx pgx.Tx, metrics []model.Metrics) ([]model.Metrics, error) {
+	batch := &pgx.Batch{}
+	var queued []int                            // indexes of metrics queued into batch
+	values := make(map[[2]string]model.Metrics) // last value of every written series by type and key
+	for i, v := range metrics {
+		switch v.Mtype {
+		case model.MetricTypeCounter:
+			batch.Queue(upsertCounterStmt, v.ID, *v.Delta, p.tenant, model.SeriesName(v.ID))
+			queued = append(queued, i)
+		case model.MetricTypeGauge:
+			batch.Queue(upsertGaugeStmt, v.ID, *v.Value, p.tenant, model.SeriesName(v.ID))
+			queued = append(queued, i)
+			values[[2]string{v.Mtype, v.ID}] = v
+		case model.MetricTypeHistogram:
+			merged, err := setHistogramTx(ctx, tx, p.tenant, v.ID, *v.Histogram)
+			if errors.Is(err, model.ErrBucketMismatch) || errors.Is(err, model.ErrTypeConflict) {
+				// transaction is rolled back, so batch is rejected as whole because of this metric
+				return nil, &model.BatchError{Items: []model.ItemError{{Index: i, ID: v.ID, Mtype: v.Mtype, Err: err}}}
 			}
-			_, err = tx.Exec(upsertCounterStmt, v.ID, v.Mtype, *v.Delta+delta.Int64)
 			if err != nil {
-				logger.Log().Info("counter error tx", zap.Error(err))
-				tx.Rollback()
-				return err
+				return nil, fmt.Errorf("set histogram %s: %w", v.ID, err)
 			}
+			values[[2]string{v.Mtype, v.ID}] = model.Metrics{ID: v.ID, Mtype: v.Mtype, Histogram: &merged}
+		}
+	}
 
-		} else if v.Mtype == model.MetricTypeGauge {
-			_, err = tx.Exec(upsertGaugeStmt, v.ID, v.Mtype, v.Value)
+	if batch.Len() > 0 {
+		results := tx.SendBatch(ctx, batch)
+		var batchErr model.BatchError
+		for _, i := range queued {
+			m := metrics[i]
+			var err error
+			if m.Mtype == model.MetricTypeCounter {
+				var total int64
+				if err = results.QueryRow().Scan(&total); err == nil {
+					values[[2]string{m.Mtype, m.ID}] = model.Metrics{ID: m.ID, Mtype: m.Mtype, Delta: &total}
+				} else if errors.Is(err, pgx.ErrNoRows) {
+					err = model.TypeConflict(m.ID)
+				}
+			} else {
+				var tag pgconn.CommandTag
+				if tag, err = results.Exec(); err == nil {
+					err = typeConflict(tag, m.ID)
+				}
+			}
+			if errors.Is(err, model.ErrTypeConflict) {
+				batchErr.Items = append(batchErr.Items, model.ItemError{Index: i, ID: m.ID, Mtype: m.Mtype, Err: err})
+				continue
+			}
 			if err != nil {
-				logger.Log().Info("gauge error tx", zap.Error(err))
-				tx.Rollback()
-				return err
+				results.Close()
+				return nil, err
 			}
 		}
+		if err := results.Close(); err != nil {
+			return nil, err
+		}
+		if len(batchErr.Items) > 0 {
+			return nil, &batchErr
+		}
 	}
-	tx.Commit()
-	return nil
+
+	written := model.Written(metrics)
+	for i, m := range written {
+		written[i] = values[[2]string{m.Mtype, m.ID}]
+	}
+	return written, nil
 }
 
-// GetCounterMetric retrieve counter metric by name from database
-func (p *PostgreDB) GetCounterMetric(key string) (int64, error) {
-	stmtSelect := `SELECT delta FROM metrics WHERE name = $1 AND type = 'counter'`
-	var counter sql.NullInt64
+// DeleteMetric removes value of metric stored by name with passed type, metric name is freed with its last series
+func (p *PostgreDB) DeleteMetric(ctx context.Context, mtype, key string) error {
+	ctx, cancel := p.context(ctx)
+	defer cancel()
+	err := pgx.BeginFunc(ctx, p.pool, func(tx pgx.Tx) error {
+		return p.removeTx(ctx, tx, []model.Metrics{{ID: key, Mtype: mtype}})
+	})
+	return storageError(err)
+}
 
-	row := p.db.QueryRow(stmtSelect, key)
+// ReplaceMetrics removes series of remove and sets metrics of set in one transaction. Series to remove
+// are identified by type and series key, missing one is ErrNotFound. Nothing is changed if anything can't be applied
+func (p *PostgreDB) ReplaceMetrics(ctx context.Context, remove, set []model.Metrics) error {
+	ctx, cancel := p.context(ctx)
+	defer cancel()
+	err := pgx.BeginFunc(ctx, p.pool, func(tx pgx.Tx) error {
+		if err := p.removeTx(ctx, tx, remove); err != nil {
+			return err
+		}
+		_, err := p.setAllTx(ctx, tx, set)
+		return err
+	})
+	return storageError(err)
+}
 
-	err := row.Scan(&counter)
+// removeTx deletes series and frees their metric names which have no series left. Owners of names
+// are locked first, in order of names, so writers can't add series of them until transaction ends
+func (p *PostgreDB) removeTx(ctx context.Context, tx pgx.Tx, remove []model.Metrics) error {
+	names := make([]string, 0, len(remove))
+	seen := make(map[string]bool, len(remove))
+	for _, m := range remove {
+		name := model.SeriesName(m.ID)
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	_, err := tx.Exec(ctx, `SELECT 1 FROM metric_types WHERE tenant = $1 AND name = ANY($2) ORDER BY name FOR UPDATE`,
+		p.tenant, names)
 	if err != nil {
-		return 0, err
+		return err
+	}
+
+	for _, m := range remove {
+		tag, err := tx.Exec(ctx, `DELETE FROM metrics WHERE tenant = $1 AND name = $2 AND type = $3`, p.tenant, m.ID, m.Mtype)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return ErrNotFound
+		}
 	}
-	if !counter.Valid {
-		return 0, sql.ErrNoRows
+	for _, name := range names {
+		if _, err = tx.Exec(ctx, releaseNameStmt, p.tenant, name); err != nil {
+			return err
+		}
 	}
-	return counter.Int64, nil
+	return nil
 }
 
-// GetGaugeMetric retrieve gauge metric by name from database
-func (p *PostgreDB) GetGaugeMetric(key string) (float64, error) {
-	stmtSelect := `SELECT value FROM metrics WHERE name = $1 AND type = 'gauge'`
-	var value sql.NullFloat64
+// GetCounterMetric retrieve counter metric by name from database
+func (p *PostgreDB) GetCounterMetric(ctx context.Context, key string) (int64, error) {
+	ctx, cancel := p.context(ctx)
+	defer cancel()
+	var counter *int64
+	err := p.pool.QueryRow(ctx, `SELECT delta FROM metrics WHERE name = $1 AND type = 'counter' AND tenant = $2`,
+		key, p.tenant).Scan(&counter)
+	if err != nil {
+		return 0, storageError(err)
+	}
+	if counter == nil {
+		return 0, ErrNotFound
+	}
+	return *counter, nil
+}
 
-	row := p.db.QueryRow(stmtSelect, key)
+// GetGaugeMetric retrieve gauge metric by name from database
+func (p *PostgreDB) GetGaugeMetric(ctx context.Context, key string) (float64, error) {
+	ctx, cancel := p.context(ctx)
+	defer cancel()
+	var value *float64
+	err := p.pool.QueryRow(ctx, `SELECT value FROM metrics WHERE name = $1 AND type = 'gauge' AND tenant = $2`,
+		key, p.tenant).Scan(&value)
+	if err != nil {
+		return 0, storageError(err)
+	}
+	if value == nil {
+		return 0, ErrNotFound
+	}
+	return *value, nil
+}
 
-	err := row.Scan(&value)
+// GetHistogramMetric retrieve histogram metric by name from database
+func (p *PostgreDB) GetHistogramMetric(ctx context.Context, key string) (model.Histogram, error) {
+	ctx, cancel := p.context(ctx)
+	defer cancel()
+	var raw []byte
+	err := p.pool.QueryRow(ctx, `SELECT histogram FROM metrics WHERE name = $1 AND type = 'histogram' AND tenant = $2`,
+		key, p.tenant).Scan(&raw)
 	if err != nil {
-		return 0, err
+		return model.Histogram{}, storageError(err)
+	}
+	if len(raw) == 0 {
+		return model.Histogram{}, ErrNotFound
 	}
 
-	if !value.Valid {
-		return 0, sql.ErrNoRows
+	var h model.Histogram
+	if err = json.Unmarshal(raw, &h); err != nil {
+		return model.Histogram{}, err
 	}
-	return value.Float64, nil
+	return h, nil
 }
 
 // GetAllMetric retrieve all metrics from database
-func (p *PostgreDB) GetAllMetric() []model.Metrics {
-	selectStmt := `SELECT name, type, delta, value FROM metrics`
-	tx, err := p.db.Begin()
+func (p *PostgreDB) GetAllMetric(ctx context.Context) ([]model.Metrics, error) {
+	ctx, cancel := p.context(ctx)
+	defer cancel()
+	rows, err := p.pool.Query(ctx, `SELECT name, type, delta, value, histogram FROM metrics WHERE tenant = $1`, p.tenant)
 	if err != nil {
-		tx.Rollback()
-		return nil
+		return nil, storageError(err)
 	}
-	rows, err := p.db.Query(selectStmt)
+
+	result, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (model.Metrics, error) {
+		var m model.Metrics
+		var raw []byte
+		if err := row.Scan(&m.ID, &m.Mtype, &m.Delta, &m.Value, &raw); err != nil {
+			return m, err
+		}
+		if len(raw) > 0 {
+			m.Histogram = &model.Histogram{}
+			if err := json.Unmarshal(raw, m.Histogram); err != nil {
+				return m, err
+			}
+		}
+		return m, nil
+	})
+	return result, storageError(err)
+}
+
+// AppendSample inserts sample into history of metric
+func (p *PostgreDB) AppendSample(ctx context.Context, mtype, name string, sample model.Sample) error {
+	ctx, cancel := p.context(ctx)
+	defer cancel()
+	stmtInsert := `INSERT INTO metric_samples(name, type, ts, value, tenant) VALUES($1, $2, $3, $4, $5)`
+	_, err := p.pool.Exec(ctx, stmtInsert, name, mtype, sample.Timestamp, sample.Value, p.tenant)
+	return storageError(err)
+}
+
+// GetSamples retrieve samples of metric in [from, to] range ordered by time
+func (p *PostgreDB) GetSamples(ctx context.Context, mtype, name string, from, to time.Time) ([]model.Sample, error) {
+	ctx, cancel := p.context(ctx)
+	defer cancel()
+	stmtSelect := `SELECT ts, value FROM metric_samples
+	WHERE type = $1 AND name = $2 AND ts BETWEEN $3 AND $4 AND tenant = $5 ORDER BY ts`
+
+	rows, err := p.pool.Query(ctx, stmtSelect, mtype, name, from, to, p.tenant)
 	if err != nil {
-		tx.Rollback()
-		return nil
+		return nil, storageError(err)
 	}
+	result, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (model.Sample, error) {
+		var s model.Sample
+		err := row.Scan(&s.Timestamp, &s.Value)
+		return s, err
+	})
+	return result, storageError(err)
+}
 
-	var metrics []model.Metrics
+// DeleteSamplesBefore removes samples older than passed time
+func (p *PostgreDB) DeleteSamplesBefore(ctx context.Context, before time.Time) error {
+	ctx, cancel := p.context(ctx)
+	defer cancel()
+	_, err := p.pool.Exec(ctx, `DELETE FROM metric_samples WHERE ts < $1 AND tenant = $2`, before, p.tenant)
+	return storageError(err)
+}
 
-	for rows.Next() {
-		var metric model.Metrics
+// HistorySeries lists metrics which have samples
+func (p *PostgreDB) HistorySeries(ctx context.Context) ([]model.SeriesRef, error) {
+	ctx, cancel := p.context(ctx)
+	defer cancel()
+	rows, err := p.pool.Query(ctx, `SELECT DISTINCT type, name FROM metric_samples WHERE tenant = $1`, p.tenant)
+	if err != nil {
+		return nil, storageError(err)
+	}
+	result, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (model.SeriesRef, error) {
+		var ref model.SeriesRef
+		err := row.Scan(&ref.Mtype, &ref.ID)
+		return ref, err
+	})
+	return result, storageError(err)
+}
 
-		err = rows.Scan(metric.ID, metric.Mtype, metric.Delta, metric.Value)
-		if err != nil {
-			tx.Rollback()
-			return nil
-		}
+// SaveAggregates inserts aggregates, existing aggregates with same timestamp are replaced
+func (p *PostgreDB) SaveAggregates(ctx context.Context, mtype, name string, resolution time.Duration, aggs []model.Aggregate) error {
+	upsertStmt := `INSERT INTO metric_rollups(name, type, resolution, ts, min, max, sum, last, count, tenant)
+	VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	ON CONFLICT (tenant, resolution, type, name, ts) DO UPDATE
+	SET min = $5, max = $6, sum = $7, last = $8, count = $9`
+
+	ctx, cancel := p.context(ctx)
+	defer cancel()
+	batch := &pgx.Batch{}
+	for _, a := range aggs {
+		batch.Queue(upsertStmt, name, mtype, int64(resolution.Seconds()), a.Timestamp, a.Min, a.Max, a.Sum, a.Last, a.Count, p.tenant)
+	}
+	err := pgx.BeginFunc(ctx, p.pool, func(tx pgx.Tx) error {
+		return tx.SendBatch(ctx, batch).Close()
+	})
+	return storageError(err)
+}
+
+// GetAggregates retrieve aggregates of passed resolution in [from, to] range ordered by time
+func (p *PostgreDB) GetAggregates(ctx context.Context, mtype, name string, resolution time.Duration, from, to time.Time) ([]model.Aggregate, error) {
+	ctx, cancel := p.context(ctx)
+	defer cancel()
+	stmtSelect := `SELECT ts, min, max, sum, last, count FROM metric_rollups
+	WHERE resolution = $1 AND type = $2 AND name = $3 AND ts BETWEEN $4 AND $5 AND tenant = $6 ORDER BY ts`
 
-		metrics = append(metrics, metric)
+	rows, err := p.pool.Query(ctx, stmtSelect, int64(resolution.Seconds()), mtype, name, from, to, p.tenant)
+	if err != nil {
+		return nil, storageError(err)
 	}
+	result, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (model.Aggregate, error) {
+		var a model.Aggregate
+		err := row.Scan(&a.Timestamp, &a.Min, &a.Max, &a.Sum, &a.Last, &a.Count)
+		return a, err
+	})
+	return result, storageError(err)
+}
+
+// DeleteAggregatesBefore removes aggregates of passed resolution older than passed time
+func (p *PostgreDB) DeleteAggregatesBefore(ctx context.Context, resolution time.Duration, before time.Time) error {
+	ctx, cancel := p.context(ctx)
+	defer cancel()
+	_, err := p.pool.Exec(ctx, `DELETE FROM metric_rollups WHERE resolution = $1 AND ts < $2 AND tenant = $3`,
+		int64(resolution.Seconds()), before, p.tenant)
+	return storageError(err)
+}
+
+// SetMetadata upserts metadata of metric name
+func (p *PostgreDB) SetMetadata(ctx context.Context, meta model.Metadata) error {
+	ctx, cancel := p.context(ctx)
+	defer cancel()
+	upsertStmt := `INSERT INTO metric_metadata(tenant, name, unit, description, owner) VALUES($1, $2, $3, $4, $5)
+	ON CONFLICT (tenant, name) DO UPDATE SET unit = $3, description = $4, owner = $5`
+	_, err := p.pool.Exec(ctx, upsertStmt, p.tenant, meta.Name, meta.Unit, meta.Description, meta.Owner)
+	return storageError(err)
+}
+
+// GetMetadata returns metadata of metric name
+func (p *PostgreDB) GetMetadata(ctx context.Context, name string) (model.Metadata, error) {
+	ctx, cancel := p.context(ctx)
+	defer cancel()
+	stmtSelect := `SELECT name, unit, description, owner FROM metric_metadata WHERE tenant = $1 AND name = $2`
+	var meta model.Metadata
+	err := p.pool.QueryRow(ctx, stmtSelect, p.tenant, name).Scan(&meta.Name, &meta.Unit, &meta.Description, &meta.Owner)
+	return meta, storageError(err)
+}
 
-	if rows.Err() != nil {
-		tx.Rollback()
-		return nil
+// GetAllMetadata returns metadata of all metric names ordered by name
+func (p *PostgreDB) GetAllMetadata(ctx context.Context) ([]model.Metadata, error) {
+	ctx, cancel := p.context(ctx)
+	defer cancel()
+	stmtSelect := `SELECT name, unit, description, owner FROM metric_metadata WHERE tenant = $1 ORDER BY name`
+	rows, err := p.pool.Query(ctx, stmtSelect, p.tenant)
+	if err != nil {
+		return nil, storageError(err)
 	}
-	tx.Commit()
-	return metrics
+	result, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (model.Metadata, error) {
+		var meta model.Metadata
+		err := row.Scan(&meta.Name, &meta.Unit, &meta.Description, &meta.Owner)
+		return meta, err
+	})
+	return result, storageError(err)
 }
 
 // PingStorage check connection with database
-func (p *PostgreDB) PingStorage() error {
-	err := p.db.Ping()
-	return err
+func (p *PostgreDB) PingStorage(ctx context.Context) error {
+	ctx, cancel := p.context(ctx)
+	defer cancel()
+	return storageError(p.pool.Ping(ctx))
+}
+
+// storageError converts errors of pgx into domain errors: missing row is ErrNotFound,
+// failed connection is model.ErrStorageUnavailable. Expired context is returned as is
+func storageError(err error) error {
+	var connectErr *pgconn.ConnectError
+	switch {
+	case err == nil, errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return err
+	case errors.Is(err, pgx.ErrNoRows):
+		return ErrNotFound
+	case errors.Is(err, model.ErrStorageUnavailable):
+		return err
+	case errors.As(err, &connectErr), pgconn.SafeToRetry(err):
+		return fmt.Errorf("%w: %w", model.ErrStorageUnavailable, err)
+	default:
+		return err
+	}
 }
@@ -0,0 +1,52 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/SmoothWay/metrics/internal/model"
+)
+
+// testDB - connects to database of TEST_DATABASE_DSN and migrates it, test is skipped if it is not set.
+// Returned storage works with rows of tenant unique to the test
+func testDB(t *testing.T) *PostgreDB {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN is not set")
+	}
+	p, err := New(dsn, PoolOptions{})
+	require.NoError(t, err)
+	t.Cleanup(func() { p.Close() })
+	return p.Tenant(fmt.Sprintf("%s-%d", t.Name(), time.Now().UnixNano()))
+}
+
+func TestPostgreDB_SetHistogramMetricConcurrentFirstWrites(t *testing.T) {
+	p := testDB(t)
+	ctx := context.Background()
+
+	const writers = 16
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h := model.NewHistogram(nil)
+			h.Observe(0.1)
+			if _, err := p.SetHistogramMetric(ctx, `latency{host="a"}`, h); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	stored, err := p.GetHistogramMetric(ctx, `latency{host="a"}`)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(writers), stored.Count, "first writes of series must be merged, not overwrite each other")
+}
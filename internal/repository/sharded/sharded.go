@@ -0,0 +1,601 @@
+// Package sharded is storage layer which keeps metrics in memory split into shards by series key,
+// every shard has its own lock, so writers of different series do not contend
+package sharded
+
+import (
+	"context"
+	"hash/fnv"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/SmoothWay/metrics/internal/model"
+	"github.com/SmoothWay/metrics/internal/repository/memstorage"
+)
+
+// DefaultShards number of shards used by New
+const DefaultShards = 64
+
+var (
+	ErrNotFound     = memstorage.ErrNotFound
+	ErrInvalidValue = memstorage.ErrInvalidValue
+)
+
+// shard part of series. Counters and gauges are updated atomically under read lock,
+// write lock is taken to add new series, to update histograms and to apply batches.
+// Every counter or gauge write appends sample to history, so history and rollups of series
+// are kept by memory storage of its shard, not behind one lock for all series
+type shard struct {
+	mu         sync.RWMutex
+	counters   map[string]*atomic.Int64
+	gauges     map[string]*atomic.Uint64 // bits of float64 value
+	histograms map[string]model.Histogram
+	history    *memstorage.MemStorage
+}
+
+type Storage struct {
+	shards []*shard
+	// owners types owning metric names, series of one name are spread over shards. Lock of owners
+	// is taken after locks of shards, only to add or remove series
+	owners   *memstorage.Owners
+	ownersMu sync.Mutex
+	// metadata is kept by metric name and is not on hot path of writes
+	metadata *memstorage.MemStorage
+	keys     *memstorage.IdempotencyKeys // idempotency keys of applied batches
+	tenants  *partitions
+}
+
+// partitions storages of tenants, shared by storage of default tenant and storages of other tenants
+type partitions struct {
+	storages map[string]*Storage
+	mu       sync.Mutex
+}
+
+// New - creates sharded storage with DefaultShards shards. Fill storage with values if non empty metrics passed
+func New(metrics *[]model.Metrics) *Storage {
+	return NewWithShards(DefaultShards, metrics)
+}
+
+// NewWithShards - creates sharded storage with n shards, at least one shard is created
+func NewWithShards(n int, metrics *[]model.Metrics) *Storage {
+	if n < 1 {
+		n = 1
+	}
+	s := &Storage{
+		shards:   make([]*shard, n),
+		owners:   memstorage.NewOwners(),
+		metadata: memstorage.New(nil),
+		keys:     memstorage.NewIdempotencyKeys(),
+		tenants:  &partitions{storages: make(map[string]*Storage)},
+	}
+	for i := range s.shards {
+		s.shards[i] = &shard{
+			counters:   make(map[string]*atomic.Int64),
+			gauges:     make(map[string]*atomic.Uint64),
+			histograms: make(map[string]model.Histogram),
+			history:    memstorage.New(nil),
+		}
+	}
+	if metrics != nil {
+		ctx := context.Background()
+		for _, v := range *metrics {
+			key := v.Key()
+			switch {
+			case v.Mtype == model.MetricTypeCounter && v.Delta != nil:
+				s.SetCounterMetric(ctx, key, *v.Delta)
+			case v.Mtype == model.MetricTypeGauge && v.Value != nil:
+				s.SetGaugeMetric(ctx, key, *v.Value)
+			case v.Mtype == model.MetricTypeHistogram && v.Histogram != nil:
+				s.SetHistogramMetric(ctx, key, *v.Histogram)
+			}
+			if v.Meta != nil {
+				s.metadata.SetMetadata(ctx, *v.Meta)
+			}
+		}
+	}
+	return s
+}
+
+// Tenant - returns storage of tenant, creating it on first use. Storage itself is returned for default tenant
+func (s *Storage) Tenant(id string) *Storage {
+	if id == "" {
+		return s
+	}
+	s.tenants.mu.Lock()
+	defer s.tenants.mu.Unlock()
+	storage, ok := s.tenants.storages[id]
+	if !ok {
+		storage = NewWithShards(len(s.shards), nil)
+		storage.tenants = s.tenants
+		s.tenants.storages[id] = storage
+	}
+	return storage
+}
+
+// Tenants - returns ids of tenants which storages were created
+func (s *Storage) Tenants() ([]string, error) {
+	s.tenants.mu.Lock()
+	defer s.tenants.mu.Unlock()
+	tenants := make([]string, 0, len(s.tenants.storages))
+	for id := range s.tenants.storages {
+		tenants = append(tenants, id)
+	}
+	sort.Strings(tenants)
+	return tenants, nil
+}
+
+// shardIndex - returns index of shard keeping series
+func (s *Storage) shardIndex(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(s.shards)))
+}
+
+func (s *Storage) shardOf(key string) *shard {
+	return s.shards[s.shardIndex(key)]
+}
+
+// SetCounterMetric - adds value to counter by series key, returns new value of counter
+func (s *Storage) SetCounterMetric(ctx context.Context, key string, value int64) (int64, error) {
+	sh := s.shardOf(key)
+	sh.mu.RLock()
+	c, ok := sh.counters[key]
+	var total int64
+	if ok {
+		total = c.Add(value)
+	}
+	sh.mu.RUnlock()
+	if ok {
+		return total, nil
+	}
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if _, ok = sh.counters[key]; !ok && !s.claim(key, model.MetricTypeCounter) {
+		return 0, model.TypeConflict(key)
+	}
+	return sh.counter(key).Add(value), nil
+}
+
+// SetGaugeMetric - sets gauge value by series key
+func (s *Storage) SetGaugeMetric(ctx context.Context, key string, value float64) error {
+	sh := s.shardOf(key)
+	sh.mu.RLock()
+	g, ok := sh.gauges[key]
+	if ok {
+		g.Store(math.Float64bits(value))
+	}
+	sh.mu.RUnlock()
+	if ok {
+		return nil
+	}
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if _, ok = sh.gauges[key]; !ok && !s.claim(key, model.MetricTypeGauge) {
+		return model.TypeConflict(key)
+	}
+	sh.gauge(key).Store(math.Float64bits(value))
+	return nil
+}
+
+// SetHistogramMetric - merges histogram observations by series key, returns merged histogram
+func (s *Storage) SetHistogramMetric(ctx context.Context, key string, value model.Histogram) (model.Histogram, error) {
+	sh := s.shardOf(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	stored, ok := sh.histograms[key]
+	if !ok {
+		if !s.claim(key, model.MetricTypeHistogram) {
+			return model.Histogram{}, model.TypeConflict(key)
+		}
+		sh.histograms[key] = value.Copy()
+		return value.Copy(), nil
+	}
+	if err := stored.Merge(value); err != nil {
+		return model.Histogram{}, err
+	}
+	sh.histograms[key] = stored
+	return stored.Copy(), nil
+}
+
+// GetCounterMetric - get counter value by series key
+func (s *Storage) GetCounterMetric(ctx context.Context, key string) (int64, error) {
+	sh := s.shardOf(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	c, ok := sh.counters[key]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	return c.Load(), nil
+}
+
+// GetGaugeMetric - get gauge value by series key
+func (s *Storage) GetGaugeMetric(ctx context.Context, key string) (float64, error) {
+	sh := s.shardOf(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	g, ok := sh.gauges[key]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	return math.Float64frombits(g.Load()), nil
+}
+
+// GetHistogramMetric - get histogram value by series key
+func (s *Storage) GetHistogramMetric(ctx context.Context, key string) (model.Histogram, error) {
+	sh := s.shardOf(key)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	h, ok := sh.histograms[key]
+	if !ok {
+		return model.Histogram{}, ErrNotFound
+	}
+	return h.Copy(), nil
+}
+
+// GetAllMetric - retrieve all metrics. Read locks of all shards are held together,
+// so result contains either whole batch or nothing of it
+func (s *Storage) GetAllMetric(ctx context.Context) ([]model.Metrics, error) {
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+	}
+	defer func() {
+		for _, sh := range s.shards {
+			sh.mu.RUnlock()
+		}
+	}()
+
+	var metrics []model.Metrics
+	for _, sh := range s.shards {
+		for k, c := range sh.counters {
+			v := c.Load()
+			metrics = append(metrics, model.Metrics{ID: k, Mtype: model.MetricTypeCounter, Delta: &v})
+		}
+		for k, g := range sh.gauges {
+			v := math.Float64frombits(g.Load())
+			metrics = append(metrics, model.Metrics{ID: k, Mtype: model.MetricTypeGauge, Value: &v})
+		}
+		for k, h := range sh.histograms {
+			v := h.Copy()
+			metrics = append(metrics, model.Metrics{ID: k, Mtype: model.MetricTypeHistogram, Histogram: &v})
+		}
+	}
+	return metrics, nil
+}
+
+// SetAllMetrics - sets slice of metrics atomically. Write locks of shards touched by batch are taken
+// in order of shards, whole batch is checked and then applied. If some metrics can't be applied,
+// *model.BatchError is returned and storage is not changed. Returns values of written series after batch,
+// see model.Written
+func (s *Storage) SetAllMetrics(ctx context.Context, metrics []model.Metrics) ([]model.Metrics, error) {
+	locked := s.lockShards(metrics)
+	defer func() {
+		for _, i := range locked {
+			s.shards[i].mu.Unlock()
+		}
+	}()
+
+	s.ownersMu.Lock()
+	defer s.ownersMu.Unlock()
+	histograms, err := s.check(s.owners, nil, metrics)
+	if err != nil {
+		return nil, err
+	}
+	s.set(metrics, histograms)
+	written := model.Written(metrics)
+	for i, m := range written {
+		s.shardOf(m.ID).value(&written[i])
+	}
+	return written, nil
+}
+
+// ReplaceMetrics - removes series of remove and sets metrics of set atomically, under locks of all shards
+// keeping them. Series to remove are identified by type and series key, missing one is ErrNotFound. Metrics
+// of set are checked as batch of SetAllMetrics written after removal. Nothing is changed if anything can't be applied
+func (s *Storage) ReplaceMetrics(ctx context.Context, remove, set []model.Metrics) error {
+	locked := s.lockShards(append(append([]model.Metrics(nil), remove...), set...))
+	defer func() {
+		for _, i := range locked {
+			s.shards[i].mu.Unlock()
+		}
+	}()
+	s.ownersMu.Lock()
+	defer s.ownersMu.Unlock()
+
+	owners := s.owners.Copy()
+	removed := make(map[string]bool, len(remove))
+	for _, m := range remove {
+		if !s.shardOf(m.ID).stored(m.Mtype, m.ID) || removed[m.Mtype+"/"+m.ID] {
+			return ErrNotFound
+		}
+		removed[m.Mtype+"/"+m.ID] = true
+		owners.Remove(m.ID)
+	}
+	histograms, err := s.check(owners, removed, set)
+	if err != nil {
+		return err
+	}
+	for _, m := range remove {
+		s.shardOf(m.ID).delete(m.Mtype, m.ID)
+	}
+	s.owners = owners
+	s.set(set, histograms)
+	return nil
+}
+
+// check - checks batch against owners of names and returns stored histograms merged with histograms of batch.
+// Histograms are merged into copies, bucket mismatch must not leave part of batch applied. Stored series
+// in removed, by type and key, are treated as missing. Must be called under locks of shards and owners
+func (s *Storage) check(owners *memstorage.Owners, removed map[string]bool, metrics []model.Metrics) (map[string]model.Histogram, error) {
+	histograms := make(map[string]model.Histogram)
+	types := make(map[string]string) // types of names written by batch
+	var batchErr model.BatchError
+	for i, v := range metrics {
+		var err error
+		name := model.SeriesName(v.ID)
+		if mtype, ok := types[name]; (ok && mtype != v.Mtype) || !owners.CanAssign(v.ID, v.Mtype) {
+			batchErr.Items = append(batchErr.Items, model.ItemError{Index: i, ID: v.ID, Mtype: v.Mtype, Err: model.TypeConflict(v.ID)})
+			continue
+		}
+		types[name] = v.Mtype
+		switch v.Mtype {
+		case model.MetricTypeCounter:
+			if v.Delta == nil {
+				err = ErrInvalidValue
+			}
+		case model.MetricTypeGauge:
+			if v.Value == nil {
+				err = ErrInvalidValue
+			}
+		case model.MetricTypeHistogram:
+			if v.Histogram == nil {
+				err = ErrInvalidValue
+				break
+			}
+			stored, ok := histograms[v.ID]
+			if !ok && !removed[v.Mtype+"/"+v.ID] {
+				stored, ok = s.shardOf(v.ID).histograms[v.ID]
+				stored = stored.Copy()
+			}
+			if !ok {
+				stored = v.Histogram.Copy()
+			} else {
+				err = stored.Merge(*v.Histogram)
+			}
+			histograms[v.ID] = stored
+		}
+		if err != nil {
+			batchErr.Items = append(batchErr.Items, model.ItemError{Index: i, ID: v.ID, Mtype: v.Mtype, Err: err})
+		}
+	}
+	if len(batchErr.Items) > 0 {
+		return nil, &batchErr
+	}
+	return histograms, nil
+}
+
+// set - applies checked batch with its merged histograms. Must be called under locks of shards and owners
+func (s *Storage) set(metrics []model.Metrics, histograms map[string]model.Histogram) {
+	for _, v := range metrics {
+		sh := s.shardOf(v.ID)
+		switch v.Mtype {
+		case model.MetricTypeCounter:
+			if !sh.stored(v.Mtype, v.ID) {
+				s.owners.Add(v.ID, v.Mtype)
+			}
+			sh.counter(v.ID).Add(*v.Delta)
+		case model.MetricTypeGauge:
+			if !sh.stored(v.Mtype, v.ID) {
+				s.owners.Add(v.ID, v.Mtype)
+			}
+			sh.gauge(v.ID).Store(math.Float64bits(*v.Value))
+		}
+	}
+	for key, h := range histograms {
+		sh := s.shardOf(key)
+		if !sh.stored(model.MetricTypeHistogram, key) {
+			s.owners.Add(key, model.MetricTypeHistogram)
+		}
+		sh.histograms[key] = h
+	}
+}
+
+// SetAllMetricsOnce - sets metrics unless batch with same idempotency key was applied within window before appliedAt.
+// Returns false if batch is skipped as duplicate, values of written series are returned only if batch is applied
+func (s *Storage) SetAllMetricsOnce(ctx context.Context, metrics []model.Metrics, key string, appliedAt time.Time, window time.Duration) ([]model.Metrics, bool, error) {
+	var written []model.Metrics
+	applied, err := s.keys.Apply(ctx, key, appliedAt, window, func() (err error) {
+		written, err = s.SetAllMetrics(ctx, metrics)
+		return err
+	})
+	return written, applied, err
+}
+
+// lockShards - takes write locks of shards keeping metrics in increasing order of shards,
+// so concurrent batches can't deadlock. Returns indexes of locked shards
+func (s *Storage) lockShards(metrics []model.Metrics) []int {
+	seen := make(map[int]bool)
+	indexes := make([]int, 0, len(metrics))
+	for _, m := range metrics {
+		i := s.shardIndex(m.ID)
+		if !seen[i] {
+			seen[i] = true
+			indexes = append(indexes, i)
+		}
+	}
+	sort.Ints(indexes)
+	for _, i := range indexes {
+		s.shards[i].mu.Lock()
+	}
+	return indexes
+}
+
+// DeleteMetric - removes value of metric stored by series key with passed type
+func (s *Storage) DeleteMetric(ctx context.Context, mtype, key string) error {
+	sh := s.shardOf(key)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if !sh.stored(mtype, key) {
+		return ErrNotFound
+	}
+	sh.delete(mtype, key)
+	s.ownersMu.Lock()
+	s.owners.Remove(key)
+	s.ownersMu.Unlock()
+	return nil
+}
+
+// claim - counts new series key with passed type if its name is free or owned by that type, every name
+// has one type whatever labels of its series are. Must be called under lock of shard keeping series
+func (s *Storage) claim(key, mtype string) bool {
+	s.ownersMu.Lock()
+	defer s.ownersMu.Unlock()
+	if !s.owners.CanAssign(key, mtype) {
+		return false
+	}
+	s.owners.Add(key, mtype)
+	return true
+}
+
+// stored - reports whether series key is stored with passed type. Must be called under lock
+func (sh *shard) stored(mtype, key string) bool {
+	var exists bool
+	switch mtype {
+	case model.MetricTypeCounter:
+		_, exists = sh.counters[key]
+	case model.MetricTypeGauge:
+		_, exists = sh.gauges[key]
+	case model.MetricTypeHistogram:
+		_, exists = sh.histograms[key]
+	}
+	return exists
+}
+
+// delete - removes stored series, owner of its name is left to caller. Must be called under write lock
+func (sh *shard) delete(mtype, key string) {
+	switch mtype {
+	case model.MetricTypeCounter:
+		delete(sh.counters, key)
+	case model.MetricTypeGauge:
+		delete(sh.gauges, key)
+	case model.MetricTypeHistogram:
+		delete(sh.histograms, key)
+	}
+}
+
+// value - fills stored value of metric by its type and series key. Must be called under lock
+func (sh *shard) value(m *model.Metrics) {
+	switch m.Mtype {
+	case model.MetricTypeCounter:
+		if c, ok := sh.counters[m.ID]; ok {
+			v := c.Load()
+			m.Delta = &v
+		}
+	case model.MetricTypeGauge:
+		if g, ok := sh.gauges[m.ID]; ok {
+			v := math.Float64frombits(g.Load())
+			m.Value = &v
+		}
+	case model.MetricTypeHistogram:
+		if h, ok := sh.histograms[m.ID]; ok {
+			v := h.Copy()
+			m.Histogram = &v
+		}
+	}
+}
+
+// counter - returns counter of series, creating it. Must be called under write lock
+func (sh *shard) counter(key string) *atomic.Int64 {
+	c, ok := sh.counters[key]
+	if !ok {
+		c = &atomic.Int64{}
+		sh.counters[key] = c
+	}
+	return c
+}
+
+// gauge - returns gauge of series, creating it. Must be called under write lock
+func (sh *shard) gauge(key string) *atomic.Uint64 {
+	g, ok := sh.gauges[key]
+	if !ok {
+		g = &atomic.Uint64{}
+		sh.gauges[key] = g
+	}
+	return g
+}
+
+// AppendSample - append sample to history of metric
+func (s *Storage) AppendSample(ctx context.Context, mtype, name string, sample model.Sample) error {
+	return s.shardOf(name).history.AppendSample(ctx, mtype, name, sample)
+}
+
+// GetSamples - get samples of metric which timestamps are in [from, to] range
+func (s *Storage) GetSamples(ctx context.Context, mtype, name string, from, to time.Time) ([]model.Sample, error) {
+	return s.shardOf(name).history.GetSamples(ctx, mtype, name, from, to)
+}
+
+// DeleteSamplesBefore - remove samples older than passed time from history of all metrics
+func (s *Storage) DeleteSamplesBefore(ctx context.Context, before time.Time) error {
+	for _, sh := range s.shards {
+		if err := sh.history.DeleteSamplesBefore(ctx, before); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HistorySeries - list metrics which have raw samples in history
+func (s *Storage) HistorySeries(ctx context.Context) ([]model.SeriesRef, error) {
+	var series []model.SeriesRef
+	for _, sh := range s.shards {
+		refs, err := sh.history.HistorySeries(ctx)
+		if err != nil {
+			return nil, err
+		}
+		series = append(series, refs...)
+	}
+	return series, nil
+}
+
+// SaveAggregates - insert or replace aggregates of metric with passed resolution
+func (s *Storage) SaveAggregates(ctx context.Context, mtype, name string, resolution time.Duration, aggs []model.Aggregate) error {
+	return s.shardOf(name).history.SaveAggregates(ctx, mtype, name, resolution, aggs)
+}
+
+// GetAggregates - get aggregates of metric with passed resolution which timestamps are in [from, to] range
+func (s *Storage) GetAggregates(ctx context.Context, mtype, name string, resolution time.Duration, from, to time.Time) ([]model.Aggregate, error) {
+	return s.shardOf(name).history.GetAggregates(ctx, mtype, name, resolution, from, to)
+}
+
+// DeleteAggregatesBefore - remove aggregates with passed resolution older than passed time
+func (s *Storage) DeleteAggregatesBefore(ctx context.Context, resolution time.Duration, before time.Time) error {
+	for _, sh := range s.shards {
+		if err := sh.history.DeleteAggregatesBefore(ctx, resolution, before); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetMetadata - sets metadata of metric name
+func (s *Storage) SetMetadata(ctx context.Context, meta model.Metadata) error {
+	return s.metadata.SetMetadata(ctx, meta)
+}
+
+// GetMetadata - returns metadata of metric name
+func (s *Storage) GetMetadata(ctx context.Context, name string) (model.Metadata, error) {
+	return s.metadata.GetMetadata(ctx, name)
+}
+
+// GetAllMetadata - returns metadata of all metric names ordered by name
+func (s *Storage) GetAllMetadata(ctx context.Context) ([]model.Metadata, error) {
+	return s.metadata.GetAllMetadata(ctx)
+}
+
+func (s *Storage) PingStorage(ctx context.Context) error {
+	return nil
+}
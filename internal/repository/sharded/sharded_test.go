@@ -0,0 +1,281 @@
+package sharded
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SmoothWay/metrics/internal/logger"
+	"github.com/SmoothWay/metrics/internal/model"
+	"github.com/SmoothWay/metrics/internal/repository/memstorage"
+	"github.com/SmoothWay/metrics/internal/service"
+)
+
+func TestStorage_ConcurrentCounters(t *testing.T) {
+	s := NewWithShards(8, nil)
+
+	const writers, writes = 16, 1000
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				s.SetCounterMetric(context.Background(), "shared", 1)
+				s.SetGaugeMetric(context.Background(), "gauge_"+strconv.Itoa(w), float64(i))
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	got, err := s.GetCounterMetric(context.Background(), "shared")
+	if err != nil || got != writers*writes {
+		t.Errorf("GetCounterMetric() = %d, %v, want %d", got, err, writers*writes)
+	}
+	all, err := s.GetAllMetric(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(all); n != writers+1 {
+		t.Errorf("GetAllMetric() returned %d metrics, want %d", n, writers+1)
+	}
+}
+
+func TestStorage_SetAllMetrics(t *testing.T) {
+	delta := int64(2)
+	value := 1.5
+	h := model.NewHistogram([]float64{1, 2})
+	other := model.NewHistogram([]float64{5})
+
+	tests := []struct {
+		name        string
+		metrics     []model.Metrics
+		wantErr     bool
+		wantCounter int64
+	}{
+		{
+			name: "batch is applied",
+			metrics: []model.Metrics{
+				{ID: "PollCount", Mtype: model.MetricTypeCounter, Delta: &delta},
+				{ID: "Alloc", Mtype: model.MetricTypeGauge, Value: &value},
+				{ID: "latency", Mtype: model.MetricTypeHistogram, Histogram: &h},
+			},
+			wantCounter: 2,
+		},
+		{
+			name: "batch with invalid item is not applied",
+			metrics: []model.Metrics{
+				{ID: "PollCount", Mtype: model.MetricTypeCounter, Delta: &delta},
+				{ID: "latency", Mtype: model.MetricTypeHistogram, Histogram: &other},
+			},
+			wantErr:     true,
+			wantCounter: 2,
+		},
+		{
+			name: "name of gauge reused by counter",
+			metrics: []model.Metrics{
+				{ID: "PollCount", Mtype: model.MetricTypeCounter, Delta: &delta},
+				{ID: "Alloc", Mtype: model.MetricTypeCounter, Delta: &delta},
+			},
+			wantErr:     true,
+			wantCounter: 2,
+		},
+		{
+			name: "labeled series of counter name written as gauge",
+			metrics: []model.Metrics{
+				{ID: "PollCount", Mtype: model.MetricTypeCounter, Delta: &delta},
+				{ID: `PollCount{host="a"}`, Mtype: model.MetricTypeGauge, Value: &value},
+			},
+			wantErr:     true,
+			wantCounter: 2,
+		},
+		{
+			name: "same series twice in batch",
+			metrics: []model.Metrics{
+				{ID: "PollCount", Mtype: model.MetricTypeCounter, Delta: &delta},
+				{ID: "PollCount", Mtype: model.MetricTypeCounter, Delta: &delta},
+			},
+			wantCounter: 6,
+		},
+	}
+
+	s := New(nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			written, err := s.SetAllMetrics(context.Background(), tt.metrics)
+			var batchErr *model.BatchError
+			if tt.wantErr != errors.As(err, &batchErr) {
+				t.Fatalf("SetAllMetrics() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (written[0].ID != "PollCount" || *written[0].Delta != tt.wantCounter) {
+				t.Errorf("SetAllMetrics() written %v, want PollCount = %d first", written[0], tt.wantCounter)
+			}
+			if !tt.wantErr && len(written) != len(model.Written(tt.metrics)) {
+				t.Errorf("SetAllMetrics() written %d series, want %d", len(written), len(model.Written(tt.metrics)))
+			}
+			if got, _ := s.GetCounterMetric(context.Background(), "PollCount"); got != tt.wantCounter {
+				t.Errorf("counter = %d, want %d", got, tt.wantCounter)
+			}
+		})
+	}
+}
+
+func TestStorage_OwnersByName(t *testing.T) {
+	ctx := context.Background()
+	// series of one name land in different shards
+	s := NewWithShards(16, nil)
+	for i := 0; i < 16; i++ {
+		if _, err := s.SetCounterMetric(ctx, model.SeriesKey("requests", map[string]string{"host": strconv.Itoa(i)}), 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.SetGaugeMetric(ctx, `requests{host="new"}`, 1); !errors.Is(err, model.ErrTypeConflict) {
+		t.Errorf("SetGaugeMetric() error = %v, want %v", err, model.ErrTypeConflict)
+	}
+
+	remove := []model.Metrics{{ID: `requests{host="0"}`, Mtype: model.MetricTypeCounter}}
+	value := 1.0
+	set := []model.Metrics{{ID: `requests{host="0"}`, Mtype: model.MetricTypeGauge, Value: &value}}
+	if err := s.ReplaceMetrics(ctx, remove, set); !errors.Is(err, model.ErrTypeConflict) {
+		t.Fatalf("ReplaceMetrics() error = %v, want %v while other series own the name", err, model.ErrTypeConflict)
+	}
+	if _, err := s.GetCounterMetric(ctx, `requests{host="0"}`); err != nil {
+		t.Errorf("failed replacement removed series: %v", err)
+	}
+
+	for i := 1; i < 16; i++ {
+		key := model.SeriesKey("requests", map[string]string{"host": strconv.Itoa(i)})
+		remove = append(remove, model.Metrics{ID: key, Mtype: model.MetricTypeCounter})
+	}
+	if err := s.ReplaceMetrics(ctx, remove, set); err != nil {
+		t.Fatalf("ReplaceMetrics() error = %v", err)
+	}
+	if err := s.SetGaugeMetric(ctx, `requests{host="new"}`, 1); err != nil {
+		t.Errorf("SetGaugeMetric() error = %v, name must be owned by gauge after replacement", err)
+	}
+}
+
+func TestStorage_History(t *testing.T) {
+	s := NewWithShards(8, nil)
+	ctx := context.Background()
+	now := time.Now()
+
+	for i := 0; i < 32; i++ {
+		key := "series_" + strconv.Itoa(i)
+		for _, at := range []time.Time{now.Add(-time.Hour), now} {
+			if err := s.AppendSample(ctx, model.MetricTypeGauge, key, model.Sample{Timestamp: at, Value: float64(i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		agg := model.Aggregate{Timestamp: now.Add(-time.Hour), Count: 1}
+		if err := s.SaveAggregates(ctx, model.MetricTypeGauge, key, time.Minute, []model.Aggregate{agg}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	series, err := s.HistorySeries(ctx)
+	if err != nil || len(series) != 32 {
+		t.Fatalf("HistorySeries() = %d series, %v, want 32", len(series), err)
+	}
+	if err = s.DeleteSamplesBefore(ctx, now.Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.DeleteAggregatesBefore(ctx, time.Minute, now); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 32; i++ {
+		key := "series_" + strconv.Itoa(i)
+		samples, _ := s.GetSamples(ctx, model.MetricTypeGauge, key, now.Add(-2*time.Hour), now)
+		if len(samples) != 1 || samples[0].Value != float64(i) {
+			t.Errorf("GetSamples(%s) = %v, want one sample of the series", key, samples)
+		}
+		aggs, _ := s.GetAggregates(ctx, model.MetricTypeGauge, key, time.Minute, now.Add(-2*time.Hour), now)
+		if len(aggs) != 0 {
+			t.Errorf("GetAggregates(%s) = %v, want expired", key, aggs)
+		}
+	}
+}
+
+// repository current values part of service.Repository, implemented by both memory storages
+type repository interface {
+	SetCounterMetric(ctx context.Context, key string, value int64) (int64, error)
+	SetGaugeMetric(ctx context.Context, key string, value float64) error
+	GetGaugeMetric(ctx context.Context, key string) (float64, error)
+}
+
+// benchmarkWrites - every goroutine updates its own series, as agents reporting different metrics do
+func benchmarkWrites(b *testing.B, repo repository) {
+	for _, parallelism := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("writers=%dxGOMAXPROCS", parallelism), func(b *testing.B) {
+			var id int64
+			var mu sync.Mutex
+			b.SetParallelism(parallelism)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				mu.Lock()
+				id++
+				prefix := "series_" + strconv.FormatInt(id, 10) + "_"
+				mu.Unlock()
+				i := 0
+				for pb.Next() {
+					key := prefix + strconv.Itoa(i%64)
+					repo.SetCounterMetric(context.Background(), key, 1)
+					repo.SetGaugeMetric(context.Background(), key, float64(i))
+					repo.GetGaugeMetric(context.Background(), key)
+					i++
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkMemStorage_Writes(b *testing.B) {
+	benchmarkWrites(b, memstorage.New(nil))
+}
+
+func BenchmarkSharded_Writes(b *testing.B) {
+	benchmarkWrites(b, New(nil))
+}
+
+// benchmarkSaveAll - every goroutine saves batches of its own series through service, so samples
+// are appended to history on every write as they are when agents report
+func benchmarkSaveAll(b *testing.B, repo service.Repository) {
+	logger.Init("error")
+	for _, parallelism := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("writers=%dxGOMAXPROCS", parallelism), func(b *testing.B) {
+			s := service.New(repo)
+			var id int64
+			var mu sync.Mutex
+			b.SetParallelism(parallelism)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				mu.Lock()
+				id++
+				prefix := "series_" + strconv.FormatInt(id, 10) + "_"
+				mu.Unlock()
+				i := 0
+				for pb.Next() {
+					delta, value := int64(1), float64(i)
+					key := prefix + strconv.Itoa(i%64)
+					s.SaveAll(context.Background(), []model.Metrics{
+						{ID: key + "_count", Mtype: model.MetricTypeCounter, Delta: &delta},
+						{ID: key, Mtype: model.MetricTypeGauge, Value: &value},
+					})
+					i++
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkMemStorage_SaveAll(b *testing.B) {
+	benchmarkSaveAll(b, memstorage.New(nil))
+}
+
+func BenchmarkSharded_SaveAll(b *testing.B) {
+	benchmarkSaveAll(b, New(nil))
+}
@@ -0,0 +1,270 @@
+package wal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/SmoothWay/metrics/internal/logger"
+	"github.com/SmoothWay/metrics/internal/model"
+	"github.com/SmoothWay/metrics/internal/repository/memstorage"
+)
+
+// operations of log records
+const (
+	opCounter          = "counter"
+	opGauge            = "gauge"
+	opHistogram        = "histogram"
+	opBatch            = "batch"
+	opBatchOnce        = "batch_once"
+	opSample           = "sample"
+	opDeleteSamples    = "delete_samples"
+	opAggregates       = "aggregates"
+	opDeleteAggregates = "delete_aggregates"
+	opMetadata         = "metadata"
+	opDeleteMetric     = "delete_metric"
+	opReplace          = "replace"
+)
+
+// record mutation of storage, log is file of records in JSON, one per line
+type record struct {
+	Seq            uint64            `json:"seq"`
+	Op             string            `json:"op"`
+	Tenant         string            `json:"tenant,omitempty"`
+	Key            string            `json:"key,omitempty"`
+	Mtype          string            `json:"type,omitempty"`
+	Delta          int64             `json:"delta,omitempty"`
+	Value          float64           `json:"value,omitempty"`
+	Histogram      *model.Histogram  `json:"histogram,omitempty"`
+	Metrics        []model.Metrics   `json:"metrics,omitempty"`
+	Remove         []model.Metrics   `json:"remove,omitempty"`
+	Sample         *model.Sample     `json:"sample,omitempty"`
+	Aggregates     []model.Aggregate `json:"aggregates,omitempty"`
+	Resolution     time.Duration     `json:"resolution,omitempty"`
+	Time           time.Time         `json:"time,omitempty"`
+	Window         time.Duration     `json:"window,omitempty"`
+	IdempotencyKey string            `json:"idempotency_key,omitempty"`
+	Metadata       *model.Metadata   `json:"metadata,omitempty"`
+	// SampledAt time of samples of counters and gauges written by record, set if record appends their new
+	// values to history, so value and its sample take one write
+	SampledAt *time.Time `json:"sampled_at,omitempty"`
+}
+
+func (d *db) logPath() string {
+	return d.opts.Path + ".wal"
+}
+
+// append - writes record to log with next sequence number and syncs it according to policy.
+// Record which is not written or synced completely is cut off, so it is never replayed. Must be called under lock
+func (d *db) append(rec record) error {
+	rec.Seq = d.seq + 1
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("encode wal record: %w", err)
+	}
+	data = append(data, '\n')
+	if _, err = d.log.Write(data); err != nil {
+		d.rollback()
+		return fmt.Errorf("%w: write wal record: %w", model.ErrStorageUnavailable, err)
+	}
+	if d.opts.Sync == SyncAlways {
+		if err = d.log.Sync(); err != nil {
+			d.rollback()
+			return fmt.Errorf("%w: sync wal: %w", model.ErrStorageUnavailable, err)
+		}
+	}
+	d.size += int64(len(data))
+	d.seq = rec.Seq
+	return nil
+}
+
+// rollback - cuts off log after last appended record. Must be called under lock
+func (d *db) rollback() {
+	d.log.Truncate(d.size)
+	d.log.Seek(d.size, io.SeekStart)
+}
+
+// compactIfLarge - compacts log if it is too large. Must be called under lock after record is applied
+// to memory, otherwise snapshot misses it while log holding it is truncated
+func (d *db) compactIfLarge() {
+	if d.opts.CompactSize <= 0 || d.size < d.opts.CompactSize {
+		return
+	}
+	if err := d.compact(); err != nil && logger.Log() != nil {
+		// records are durable in log, compaction is retried with next record
+		logger.Log().Error("compact wal", zap.Error(err))
+	}
+}
+
+// replay - applies records of log newer than snapshot and opens log for appending.
+// Record without trailing newline at the end of log is left by crash in the middle of writing it,
+// it was never acknowledged and is cut off. Record which can't be decoded anywhere else means log
+// is corrupted, then storage is not opened rather than losing records after it
+func (d *db) replay() error {
+	f, err := os.OpenFile(d.logPath(), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("open wal: %w", err)
+	}
+
+	var valid int64
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 && logger.Log() != nil {
+				logger.Log().Warn("cut off torn wal record", zap.Int64("offset", valid), zap.Int("size", len(line)))
+			}
+			break
+		}
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("read wal: %w", err)
+		}
+		var rec record
+		if err = json.Unmarshal(bytes.TrimSpace(line), &rec); err != nil {
+			f.Close()
+			return fmt.Errorf("%w: record at offset %d: %w", ErrCorrupted, valid, err)
+		}
+		valid += int64(len(line))
+		if rec.Seq <= d.seq {
+			// record is already part of snapshot
+			continue
+		}
+		if err = d.apply(rec); err != nil && logger.Log() != nil {
+			logger.Log().Warn("skip wal record", zap.Uint64("seq", rec.Seq), zap.Error(err))
+		}
+		d.seq = rec.Seq
+	}
+
+	if err = f.Truncate(valid); err != nil {
+		f.Close()
+		return fmt.Errorf("truncate wal: %w", err)
+	}
+	if _, err = f.Seek(valid, io.SeekStart); err != nil {
+		f.Close()
+		return fmt.Errorf("seek wal: %w", err)
+	}
+	d.log = f
+	d.size = valid
+	return nil
+}
+
+// apply - applies replayed record to memory of its tenant. Records are logged only after mutation is checked,
+// so failure can't happen unless log is corrupted
+func (d *db) apply(rec record) error {
+	mem := d.root.Tenant(rec.Tenant)
+	if rec.Op == opBatchOnce {
+		_, err := mem.ApplyOnce(context.Background(), rec.IdempotencyKey, rec.Time, rec.Window, func() error {
+			_, err := applyRecord(mem, rec)
+			return err
+		})
+		return err
+	}
+	_, err := applyRecord(mem, rec)
+	return err
+}
+
+// applyRecord - applies mutation of record to memory, idempotency key of batch is not checked.
+// Returns values of series written by record after it is applied, see model.Written
+func applyRecord(mem *memstorage.MemStorage, rec record) ([]model.Metrics, error) {
+	ctx := context.Background()
+	var written []model.Metrics
+	var err error
+	switch rec.Op {
+	case opCounter:
+		var total int64
+		if total, err = mem.SetCounterMetric(ctx, rec.Key, rec.Delta); err == nil {
+			written = []model.Metrics{{ID: rec.Key, Mtype: model.MetricTypeCounter, Delta: &total}}
+		}
+	case opGauge:
+		if err = mem.SetGaugeMetric(ctx, rec.Key, rec.Value); err == nil {
+			value := rec.Value
+			written = []model.Metrics{{ID: rec.Key, Mtype: model.MetricTypeGauge, Value: &value}}
+		}
+	case opHistogram:
+		if rec.Histogram != nil {
+			var merged model.Histogram
+			if merged, err = mem.SetHistogramMetric(ctx, rec.Key, *rec.Histogram); err == nil {
+				written = []model.Metrics{{ID: rec.Key, Mtype: model.MetricTypeHistogram, Histogram: &merged}}
+			}
+		}
+	case opBatch, opBatchOnce:
+		written, err = mem.SetAllMetrics(ctx, rec.Metrics)
+	case opSample:
+		if rec.Sample != nil {
+			err = mem.AppendSample(ctx, rec.Mtype, rec.Key, *rec.Sample)
+		}
+	case opDeleteSamples:
+		err = mem.DeleteSamplesBefore(ctx, rec.Time)
+	case opAggregates:
+		err = mem.SaveAggregates(ctx, rec.Mtype, rec.Key, rec.Resolution, rec.Aggregates)
+	case opDeleteAggregates:
+		err = mem.DeleteAggregatesBefore(ctx, rec.Resolution, rec.Time)
+	case opMetadata:
+		if rec.Metadata != nil {
+			err = mem.SetMetadata(ctx, *rec.Metadata)
+		}
+	case opDeleteMetric:
+		err = mem.DeleteMetric(ctx, rec.Mtype, rec.Key)
+	case opReplace:
+		err = mem.ReplaceMetrics(ctx, rec.Remove, rec.Metrics)
+	default:
+		err = fmt.Errorf("unknown operation %q", rec.Op)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if rec.SampledAt != nil {
+		err = appendSamples(ctx, mem, *rec.SampledAt, written)
+	}
+	return written, err
+}
+
+// appendSamples - appends values of counters and gauges written by record to their history at time of record.
+// Values are taken after record is applied, so replay appends the same samples as write did
+func appendSamples(ctx context.Context, mem *memstorage.MemStorage, at time.Time, written []model.Metrics) error {
+	for _, m := range written {
+		var value float64
+		switch {
+		case m.Mtype == model.MetricTypeCounter && m.Delta != nil:
+			value = float64(*m.Delta)
+		case m.Mtype == model.MetricTypeGauge && m.Value != nil:
+			value = *m.Value
+		default:
+			continue
+		}
+		if err := mem.AppendSample(ctx, m.Mtype, m.ID, model.Sample{Timestamp: at, Value: value}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncLoop - syncs log to disk every sync interval until storage is closed
+func (d *db) syncLoop() {
+	defer d.wg.Done()
+	ticker := time.NewTicker(d.opts.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+			d.mu.Lock()
+			if d.log != nil {
+				if err := d.log.Sync(); err != nil && logger.Log() != nil {
+					logger.Log().Error("sync wal", zap.Error(err))
+				}
+			}
+			d.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package wal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/SmoothWay/metrics/internal/repository/memstorage"
+)
+
+// snapshot state of all tenants after record Seq of log
+type snapshot struct {
+	Seq     uint64                     `json:"seq"`
+	Tenants map[string]memstorage.Dump `json:"tenants"`
+}
+
+// loadSnapshot - restores memory from snapshot file, missing file means empty storage
+func (d *db) loadSnapshot() error {
+	data, err := os.ReadFile(d.opts.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read snapshot: %w", err)
+	}
+	var snap snapshot
+	if err = json.Unmarshal(data, &snap); err != nil {
+		return fmt.Errorf("decode snapshot: %w", err)
+	}
+	for tenant, dump := range snap.Tenants {
+		d.root.Tenant(tenant).Load(dump)
+	}
+	d.seq = snap.Seq
+	return nil
+}
+
+// compact - writes state of memory into snapshot and starts empty log. Snapshot is written into temporary
+// file and renamed, so crash leaves either old or new snapshot. Records of log which are part of snapshot
+// are skipped by replay if crash happens before log is truncated. Must be called under lock
+func (d *db) compact() error {
+	tenants, err := d.root.Tenants()
+	if err != nil {
+		return err
+	}
+	snap := snapshot{Seq: d.seq, Tenants: map[string]memstorage.Dump{"": d.root.Dump()}}
+	for _, t := range tenants {
+		snap.Tenants[t] = d.root.Tenant(t).Dump()
+	}
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return fmt.Errorf("encode snapshot: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(d.opts.Path), filepath.Base(d.opts.Path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("create snapshot: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write snapshot: %w", err)
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("sync snapshot: %w", err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("close snapshot: %w", err)
+	}
+	if err = os.Rename(tmp.Name(), d.opts.Path); err != nil {
+		return fmt.Errorf("rename snapshot: %w", err)
+	}
+
+	if err = d.log.Truncate(0); err != nil {
+		return fmt.Errorf("truncate wal: %w", err)
+	}
+	if _, err = d.log.Seek(0, 0); err != nil {
+		return fmt.Errorf("seek wal: %w", err)
+	}
+	d.size = 0
+	return d.log.Sync()
+}
+
+// Compact - writes snapshot of storage and truncates log
+func (s *Storage) Compact() error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	if s.db.log == nil {
+		return ErrClosed
+	}
+	return s.db.compact()
+}
@@ -0,0 +1,368 @@
+// Package wal is durable local storage layer. Metrics are kept in memory, every mutation is written
+// to append-only write-ahead log before it is applied to memory and acknowledged. Log is replayed on startup
+// and compacted into snapshot when it grows
+package wal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/SmoothWay/metrics/internal/model"
+	"github.com/SmoothWay/metrics/internal/repository/memstorage"
+)
+
+// Sync policies of log
+const (
+	SyncAlways   = "always"   // fsync after every mutation
+	SyncInterval = "interval" // fsync every Options.SyncInterval
+	SyncNever    = "never"    // leave flushing to operating system
+)
+
+// DefaultCompactSize size of log after which it is compacted into snapshot
+const DefaultCompactSize = 64 << 20
+
+var (
+	ErrInvalidSyncPolicy = errors.New("invalid wal sync policy")
+	ErrClosed            = fmt.Errorf("%w: wal is closed", model.ErrStorageUnavailable)
+	ErrCorrupted         = errors.New("wal is corrupted")
+)
+
+// Options of storage. Path is snapshot file, log is kept next to it in Path + ".wal"
+type Options struct {
+	Path         string
+	Sync         string
+	SyncInterval time.Duration
+	CompactSize  int64
+}
+
+// db state shared by storages of all tenants
+type db struct {
+	mu   sync.Mutex
+	opts Options
+	log  *os.File
+	seq  uint64 // sequence number of last record
+	size int64  // size of log
+	root *memstorage.MemStorage
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+type Storage struct {
+	db     *db
+	mem    *memstorage.MemStorage // partition of tenant
+	tenant string
+}
+
+// Open - opens storage at path of options, state is restored from snapshot and log
+func Open(opts Options) (*Storage, error) {
+	switch opts.Sync {
+	case "":
+		opts.Sync = SyncAlways
+	case SyncAlways, SyncNever:
+	case SyncInterval:
+		if opts.SyncInterval <= 0 {
+			return nil, fmt.Errorf("%w: interval must be positive", ErrInvalidSyncPolicy)
+		}
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrInvalidSyncPolicy, opts.Sync)
+	}
+	if opts.CompactSize == 0 {
+		opts.CompactSize = DefaultCompactSize
+	}
+
+	d := &db{opts: opts, root: memstorage.New(nil), done: make(chan struct{})}
+	if err := d.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	if err := d.replay(); err != nil {
+		return nil, err
+	}
+
+	if opts.Sync == SyncInterval {
+		d.wg.Add(1)
+		go d.syncLoop()
+	}
+	return &Storage{db: d, mem: d.root}, nil
+}
+
+// Close - flushes log to disk and closes it
+func (s *Storage) Close() error {
+	d := s.db
+	d.mu.Lock()
+	if d.log == nil {
+		d.mu.Unlock()
+		return nil
+	}
+	close(d.done)
+	err := d.log.Sync()
+	if closeErr := d.log.Close(); err == nil {
+		err = closeErr
+	}
+	d.log = nil
+	d.mu.Unlock()
+
+	d.wg.Wait()
+	return err
+}
+
+// Tenant - returns storage of tenant, creating it on first use. Storage itself is returned for default tenant
+func (s *Storage) Tenant(id string) *Storage {
+	if id == "" {
+		return s
+	}
+	return &Storage{db: s.db, mem: s.db.root.Tenant(id), tenant: id}
+}
+
+// Tenants - returns ids of tenants which storages were created
+func (s *Storage) Tenants() ([]string, error) {
+	return s.db.root.Tenants()
+}
+
+// mutate - writes record of mutation to log and then applies it to memory, under lock, so order of log
+// is order of mutations. Mutation is checked first, rejected mutation is neither logged nor applied.
+// Memory is changed only after record is durable according to sync policy, nothing is done if ctx is already done.
+// Returns values of series written by record, see applyRecord
+func (s *Storage) mutate(ctx context.Context, rec record, check func() error) ([]model.Metrics, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	d := s.db
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.log == nil {
+		return nil, ErrClosed
+	}
+	if err := check(); err != nil {
+		return nil, err
+	}
+	rec.Tenant = s.tenant
+	if err := d.append(rec); err != nil {
+		return nil, err
+	}
+	written, err := applyRecord(s.mem, rec)
+	d.compactIfLarge()
+	return written, err
+}
+
+// exec - mutates storage by record whose written values are not needed
+func (s *Storage) exec(ctx context.Context, rec record, check func() error) error {
+	_, err := s.mutate(ctx, rec, check)
+	return err
+}
+
+// SetCounterMetric - adds value to counter by series key. New value of counter is appended to its history
+// by the same record. Returns new value of counter
+func (s *Storage) SetCounterMetric(ctx context.Context, key string, value int64) (int64, error) {
+	m := model.Metrics{ID: key, Mtype: model.MetricTypeCounter, Delta: &value}
+	written, err := s.mutate(ctx, record{Op: opCounter, Key: key, Delta: value, SampledAt: sampleTime()}, func() error {
+		return s.checkMetric(ctx, m)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return *written[0].Delta, nil
+}
+
+// SetGaugeMetric - sets gauge value by series key. Value is appended to history of gauge by the same record
+func (s *Storage) SetGaugeMetric(ctx context.Context, key string, value float64) error {
+	m := model.Metrics{ID: key, Mtype: model.MetricTypeGauge, Value: &value}
+	return s.exec(ctx, record{Op: opGauge, Key: key, Value: value, SampledAt: sampleTime()}, func() error {
+		return s.checkMetric(ctx, m)
+	})
+}
+
+// SetHistogramMetric - merges histogram observations by series key, returns merged histogram
+func (s *Storage) SetHistogramMetric(ctx context.Context, key string, value model.Histogram) (model.Histogram, error) {
+	m := model.Metrics{ID: key, Mtype: model.MetricTypeHistogram, Histogram: &value}
+	written, err := s.mutate(ctx, record{Op: opHistogram, Key: key, Histogram: &value}, func() error {
+		return s.checkMetric(ctx, m)
+	})
+	if err != nil {
+		return model.Histogram{}, err
+	}
+	return *written[0].Histogram, nil
+}
+
+// SetAllMetrics - sets slice of metrics atomically, batch is one record of log. New values of counters
+// and gauges of batch are appended to their history by the same record. Returns values of written series after batch
+func (s *Storage) SetAllMetrics(ctx context.Context, metrics []model.Metrics) ([]model.Metrics, error) {
+	return s.mutate(ctx, record{Op: opBatch, Metrics: metrics, SampledAt: sampleTime()}, func() error {
+		return s.mem.CheckMetrics(ctx, metrics)
+	})
+}
+
+// SetAllMetricsOnce - sets metrics unless batch with same idempotency key was applied within window before appliedAt.
+// Returns false if batch is skipped as duplicate, skipped batch is not logged. Values of written series
+// are returned only if batch is applied
+func (s *Storage) SetAllMetricsOnce(ctx context.Context, metrics []model.Metrics, key string, appliedAt time.Time, window time.Duration) ([]model.Metrics, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	d := s.db
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.log == nil {
+		return nil, false, ErrClosed
+	}
+	rec := record{
+		Op:             opBatchOnce,
+		Tenant:         s.tenant,
+		Metrics:        metrics,
+		IdempotencyKey: key,
+		Time:           appliedAt,
+		Window:         window,
+		SampledAt:      &appliedAt,
+	}
+	// batches are serialized by lock of db, so key can't be pending and ApplyOnce doesn't wait
+	var written []model.Metrics
+	applied, err := s.mem.ApplyOnce(ctx, key, appliedAt, window, func() (err error) {
+		if err = s.mem.CheckMetrics(ctx, metrics); err != nil {
+			return err
+		}
+		if err = d.append(rec); err != nil {
+			return err
+		}
+		written, err = applyRecord(s.mem, rec)
+		return err
+	})
+	if applied {
+		d.compactIfLarge()
+	}
+	return written, applied, err
+}
+
+// ReplaceMetrics - removes series of remove and sets metrics of set atomically, replacement is one record of log
+func (s *Storage) ReplaceMetrics(ctx context.Context, remove, set []model.Metrics) error {
+	return s.exec(ctx, record{Op: opReplace, Remove: remove, Metrics: set}, func() error {
+		return s.mem.CheckReplace(ctx, remove, set)
+	})
+}
+
+// AppendSample - append sample to history of metric
+func (s *Storage) AppendSample(ctx context.Context, mtype, name string, sample model.Sample) error {
+	return s.exec(ctx, record{Op: opSample, Mtype: mtype, Key: name, Sample: &sample}, noCheck)
+}
+
+// DeleteSamplesBefore - remove samples older than passed time from history of all metrics
+func (s *Storage) DeleteSamplesBefore(ctx context.Context, before time.Time) error {
+	return s.exec(ctx, record{Op: opDeleteSamples, Time: before}, noCheck)
+}
+
+// SaveAggregates - insert or replace aggregates of metric with passed resolution
+func (s *Storage) SaveAggregates(ctx context.Context, mtype, name string, resolution time.Duration, aggs []model.Aggregate) error {
+	rec := record{Op: opAggregates, Mtype: mtype, Key: name, Resolution: resolution, Aggregates: aggs}
+	return s.exec(ctx, rec, noCheck)
+}
+
+// DeleteAggregatesBefore - remove aggregates with passed resolution older than passed time
+func (s *Storage) DeleteAggregatesBefore(ctx context.Context, resolution time.Duration, before time.Time) error {
+	return s.exec(ctx, record{Op: opDeleteAggregates, Resolution: resolution, Time: before}, noCheck)
+}
+
+// SetMetadata - sets metadata of metric name
+func (s *Storage) SetMetadata(ctx context.Context, meta model.Metadata) error {
+	return s.exec(ctx, record{Op: opMetadata, Metadata: &meta}, noCheck)
+}
+
+// DeleteMetric - removes value of metric stored by series key with passed type
+func (s *Storage) DeleteMetric(ctx context.Context, mtype, key string) error {
+	return s.exec(ctx, record{Op: opDeleteMetric, Mtype: mtype, Key: key}, func() error {
+		var err error
+		switch mtype {
+		case model.MetricTypeCounter:
+			_, err = s.mem.GetCounterMetric(ctx, key)
+		case model.MetricTypeGauge:
+			_, err = s.mem.GetGaugeMetric(ctx, key)
+		case model.MetricTypeHistogram:
+			_, err = s.mem.GetHistogramMetric(ctx, key)
+		default:
+			err = memstorage.ErrNotFound
+		}
+		return err
+	})
+}
+
+// checkMetric - reports whether single metric can be written, with error of metric itself rather than of batch
+func (s *Storage) checkMetric(ctx context.Context, m model.Metrics) error {
+	err := s.mem.CheckMetrics(ctx, []model.Metrics{m})
+	var batchErr *model.BatchError
+	if errors.As(err, &batchErr) && len(batchErr.Items) == 1 {
+		return batchErr.Items[0].Err
+	}
+	return err
+}
+
+// noCheck - check of mutations which memory always accepts
+func noCheck() error {
+	return nil
+}
+
+// sampleTime - returns time samples of written values are taken at
+func sampleTime() *time.Time {
+	t := time.Now()
+	return &t
+}
+
+// WritesHistory - reports that writes of counters and gauges append their new values to history themselves
+func (s *Storage) WritesHistory() bool {
+	return true
+}
+
+// GetCounterMetric - get counter value by series key
+func (s *Storage) GetCounterMetric(ctx context.Context, key string) (int64, error) {
+	return s.mem.GetCounterMetric(ctx, key)
+}
+
+// GetGaugeMetric - get gauge value by series key
+func (s *Storage) GetGaugeMetric(ctx context.Context, key string) (float64, error) {
+	return s.mem.GetGaugeMetric(ctx, key)
+}
+
+// GetHistogramMetric - get histogram value by series key
+func (s *Storage) GetHistogramMetric(ctx context.Context, key string) (model.Histogram, error) {
+	return s.mem.GetHistogramMetric(ctx, key)
+}
+
+// GetAllMetric - retrieve all metrics
+func (s *Storage) GetAllMetric(ctx context.Context) ([]model.Metrics, error) {
+	return s.mem.GetAllMetric(ctx)
+}
+
+// GetSamples - get samples of metric which timestamps are in [from, to] range
+func (s *Storage) GetSamples(ctx context.Context, mtype, name string, from, to time.Time) ([]model.Sample, error) {
+	return s.mem.GetSamples(ctx, mtype, name, from, to)
+}
+
+// HistorySeries - list metrics which have raw samples in history
+func (s *Storage) HistorySeries(ctx context.Context) ([]model.SeriesRef, error) {
+	return s.mem.HistorySeries(ctx)
+}
+
+// GetAggregates - get aggregates of metric with passed resolution which timestamps are in [from, to] range
+func (s *Storage) GetAggregates(ctx context.Context, mtype, name string, resolution time.Duration, from, to time.Time) ([]model.Aggregate, error) {
+	return s.mem.GetAggregates(ctx, mtype, name, resolution, from, to)
+}
+
+// GetMetadata - returns metadata of metric name
+func (s *Storage) GetMetadata(ctx context.Context, name string) (model.Metadata, error) {
+	return s.mem.GetMetadata(ctx, name)
+}
+
+// GetAllMetadata - returns metadata of all metric names ordered by name
+func (s *Storage) GetAllMetadata(ctx context.Context) ([]model.Metadata, error) {
+	return s.mem.GetAllMetadata(ctx)
+}
+
+// PingStorage - checks that log is open
+func (s *Storage) PingStorage(ctx context.Context) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	if s.db.log == nil {
+		return ErrClosed
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package wal
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/SmoothWay/metrics/internal/model"
+)
+
+func TestStorage_Reopen(t *testing.T) {
+	delta := int64(2)
+	value := 1.5
+
+	tests := []struct {
+		name string
+		opts Options
+		// crash simulates process killed in the middle of writing record
+		crash bool
+	}{
+		{name: "log replay", opts: Options{Sync: SyncAlways}},
+		{name: "snapshot and log", opts: Options{Sync: SyncNever, CompactSize: 300}},
+		{name: "interval sync", opts: Options{Sync: SyncInterval, SyncInterval: time.Millisecond}},
+		{name: "torn record at the end", opts: Options{Sync: SyncAlways}, crash: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.Path = filepath.Join(t.TempDir(), "metrics.db")
+			s, err := Open(tt.opts)
+			require.NoError(t, err)
+
+			for i := 0; i < 5; i++ {
+				_, err = s.SetCounterMetric(context.Background(), "PollCount", 1)
+				require.NoError(t, err)
+			}
+			written, err := s.SetAllMetrics(context.Background(), []model.Metrics{
+				{ID: "PollCount", Mtype: model.MetricTypeCounter, Delta: &delta},
+				{ID: "Alloc", Mtype: model.MetricTypeGauge, Value: &value},
+			})
+			require.NoError(t, err)
+			require.Len(t, written, 2)
+			assert.Equal(t, int64(7), *written[0].Delta, "batch must return new value of counter")
+			_, applied, err := s.SetAllMetricsOnce(context.Background(), []model.Metrics{{ID: "PollCount", Mtype: model.MetricTypeCounter, Delta: &delta}}, "k", time.Now(), time.Hour)
+			require.NoError(t, err)
+			assert.True(t, applied)
+			require.NoError(t, s.Tenant("team-a").SetGaugeMetric(context.Background(), "Alloc", 7))
+			require.NoError(t, s.SetMetadata(context.Background(), model.Metadata{Name: "Alloc", Unit: "bytes"}))
+			_, err = s.SetCounterMetric(context.Background(), "Free", 1)
+			require.NoError(t, err)
+			require.NoError(t, s.DeleteMetric(context.Background(), model.MetricTypeCounter, "Free"))
+			require.NoError(t, s.SetGaugeMetric(context.Background(), "Temp", 3.7))
+			require.NoError(t, s.ReplaceMetrics(context.Background(),
+				[]model.Metrics{{ID: "Temp", Mtype: model.MetricTypeGauge}},
+				[]model.Metrics{{ID: "Temp", Mtype: model.MetricTypeCounter, Delta: &delta}}))
+			require.NoError(t, s.Close())
+
+			if tt.crash {
+				f, err := os.OpenFile(tt.opts.Path+".wal", os.O_APPEND|os.O_WRONLY, 0o644)
+				require.NoError(t, err)
+				f.WriteString(`{"seq":100,"op":"counter","key":"PollCou`)
+				f.Close()
+			}
+
+			s, err = Open(tt.opts)
+			require.NoError(t, err)
+			defer s.Close()
+
+			counter, err := s.GetCounterMetric(context.Background(), "PollCount")
+			require.NoError(t, err)
+			assert.Equal(t, int64(9), counter)
+			gauge, err := s.Tenant("team-a").GetGaugeMetric(context.Background(), "Alloc")
+			require.NoError(t, err)
+			assert.Equal(t, 7.0, gauge)
+			meta, err := s.GetMetadata(context.Background(), "Alloc")
+			require.NoError(t, err)
+			assert.Equal(t, "bytes", meta.Unit)
+			_, err = s.GetCounterMetric(context.Background(), "Free")
+			assert.ErrorIs(t, err, model.ErrNotFound, "deleted metric must stay deleted")
+			temp, err := s.GetCounterMetric(context.Background(), "Temp")
+			require.NoError(t, err)
+			assert.Equal(t, delta, temp, "replaced metric must keep its new type")
+
+			_, applied, err = s.SetAllMetricsOnce(context.Background(), []model.Metrics{{ID: "PollCount", Mtype: model.MetricTypeCounter, Delta: &delta}}, "k", time.Now(), time.Hour)
+			require.NoError(t, err)
+			assert.False(t, applied, "idempotency key must survive restart")
+
+			_, err = s.SetCounterMetric(context.Background(), "PollCount", 1)
+			require.NoError(t, err, "log must accept records after reopen")
+		})
+	}
+}
+
+func TestStorage_CompactCrash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.db")
+	s, err := Open(Options{Path: path})
+	require.NoError(t, err)
+	_, err = s.SetCounterMetric(context.Background(), "PollCount", 3)
+	require.NoError(t, err)
+
+	// snapshot is written, but process dies before log is truncated
+	log, err := os.ReadFile(path + ".wal")
+	require.NoError(t, err)
+	require.NoError(t, s.Compact())
+	require.NoError(t, s.Close())
+	require.NoError(t, os.WriteFile(path+".wal", log, 0o644))
+
+	s, err = Open(Options{Path: path})
+	require.NoError(t, err)
+	defer s.Close()
+	counter, err := s.GetCounterMetric(context.Background(), "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), counter, "records of snapshot must not be replayed twice")
+}
+
+func TestOpen_InvalidSync(t *testing.T) {
+	_, err := Open(Options{Path: filepath.Join(t.TempDir(), "metrics.db"), Sync: "sometimes"})
+	assert.ErrorIs(t, err, ErrInvalidSyncPolicy)
+}
+
+func TestOpen_CorruptedLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.db")
+	s, err := Open(Options{Path: path})
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = s.SetCounterMetric(context.Background(), "PollCount", 1)
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.Close())
+
+	log, err := os.ReadFile(path + ".wal")
+	require.NoError(t, err)
+	first := bytes.IndexByte(log, '\n') + 1
+	corrupted := append(append(append([]byte{}, log[:first]...), "{\"seq\":2,\"op\n"...), log[first:]...)
+	require.NoError(t, os.WriteFile(path+".wal", corrupted, 0o644))
+
+	_, err = Open(Options{Path: path})
+	assert.ErrorIs(t, err, ErrCorrupted)
+	kept, err := os.ReadFile(path + ".wal")
+	require.NoError(t, err)
+	assert.Equal(t, corrupted, kept, "records after corrupted one must not be cut off")
+}
+
+func TestStorage_LogBeforeMemory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.db")
+	s, err := Open(Options{Path: path})
+	require.NoError(t, err)
+	ctx := context.Background()
+	total, err := s.SetCounterMetric(ctx, "PollCount", 2)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), total)
+
+	info, err := os.Stat(path + ".wal")
+	require.NoError(t, err)
+	assert.Equal(t, 1, lines(t, path+".wal"), "value and its sample must take one record")
+	samples, err := s.GetSamples(ctx, model.MetricTypeCounter, "PollCount", time.Time{}, time.Now())
+	require.NoError(t, err)
+	require.Len(t, samples, 1)
+	assert.Equal(t, 2.0, samples[0].Value)
+
+	err = s.SetGaugeMetric(ctx, "PollCount", 1)
+	assert.ErrorIs(t, err, model.ErrTypeConflict)
+	after, err := os.Stat(path + ".wal")
+	require.NoError(t, err)
+	assert.Equal(t, info.Size(), after.Size(), "rejected write must not be logged")
+
+	// write of log fails, memory must keep state matching log
+	require.NoError(t, s.db.log.Close())
+	_, err = s.SetCounterMetric(ctx, "PollCount", 1)
+	assert.ErrorIs(t, err, model.ErrStorageUnavailable)
+	counter, err := s.GetCounterMetric(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), counter)
+	s.db.log = nil
+
+	s, err = Open(Options{Path: path})
+	require.NoError(t, err)
+	defer s.Close()
+	counter, err = s.GetCounterMetric(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), counter)
+	restored, err := s.GetSamples(ctx, model.MetricTypeCounter, "PollCount", time.Time{}, time.Now())
+	require.NoError(t, err)
+	require.Len(t, restored, 1)
+	assert.Equal(t, samples[0].Value, restored[0].Value)
+	assert.True(t, samples[0].Timestamp.Equal(restored[0].Timestamp), "replay must append the same samples")
+}
+
+// lines - returns number of records in log
+func lines(t *testing.T, path string) int {
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return bytes.Count(data, []byte{'\n'})
+}
@@ -0,0 +1,184 @@
+package service
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/SmoothWay/metrics/internal/logger"
+	"github.com/SmoothWay/metrics/internal/model"
+)
+
+// Operations of recorded changes
+const (
+	ChangeSet      = "set"
+	ChangeDelete   = "delete"
+	ChangeMetadata = "metadata"
+)
+
+// Change state of metric after write of service. Set change carries whole value of metric, not written delta,
+// so replaying changes in order over any earlier state gives state after the last of them. Metadata change
+// carries metadata in Metric.Meta
+type Change struct {
+	Time   time.Time     `json:"time"`
+	Tenant string        `json:"tenant,omitempty"`
+	Op     string        `json:"op"`
+	Metric model.Metrics `json:"metric"`
+}
+
+// ChangeRecorder receives changes made by writes of service, e.g. journal of incremental backups
+type ChangeRecorder interface {
+	RecordChange(change Change) error
+}
+
+// changeLog recorder shared by services of all tenants. Writes of series hold lock of that series from write
+// to storage until their change is queued, so changes of series are queued in order their values were stored.
+// Queue is passed to recorder after locks of series are released, by one writer at a time, so neither storage
+// nor recorder is called under lock shared by all series
+type changeLog struct {
+	mu       sync.Mutex
+	recorder ChangeRecorder
+	queue    []Change
+	flushing bool                      // some writer passes queue to recorder
+	series   map[[2]string]*seriesLock // locks of series by tenant and series key
+}
+
+// seriesLock lock of series, kept while some writer holds or waits for it
+type seriesLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// SetChangeRecorder - makes service record changes of metrics of every tenant into recorder, nil stops recording
+func (s *Service) SetChangeRecorder(recorder ChangeRecorder) {
+	s.changes.mu.Lock()
+	defer s.changes.mu.Unlock()
+	s.changes.recorder = recorder
+}
+
+// recordWrite - applies write of series keys of tenant and records values it returns: removed series
+// as deleted and set series with their whole stored values. Nothing is recorded if write fails
+func (s *Service) recordWrite(keys []string, write func() (removed, set []model.Metrics, err error)) error {
+	unlock := s.changes.lock(s.tenant, keys)
+	removed, set, err := write()
+	if err != nil || unlock == nil {
+		if unlock != nil {
+			unlock()
+		}
+		return err
+	}
+	now := s.now()
+	changes := make([]Change, 0, len(removed)+len(set))
+	for _, m := range removed {
+		changes = append(changes, s.change(now, ChangeDelete, model.Metrics{ID: m.ID, Mtype: m.Mtype}))
+	}
+	for _, m := range set {
+		changes = append(changes, s.change(now, ChangeSet, m))
+	}
+	s.changes.enqueue(changes...)
+	unlock()
+	s.changes.flush()
+	return nil
+}
+
+// change - returns change of stored metric, which is known to storage by series key
+func (s *Service) change(at time.Time, op string, m model.Metrics) Change {
+	m.ID, m.Labels = model.ParseSeriesKey(m.ID)
+	return Change{Time: at, Tenant: s.tenant, Op: op, Metric: m}
+}
+
+// recordMetadataChange - records metadata set for metric name
+func (s *Service) recordMetadataChange(meta model.Metadata) {
+	s.changes.enqueue(Change{Time: s.now(), Tenant: s.tenant, Op: ChangeMetadata, Metric: model.Metrics{ID: meta.Name, Meta: &meta}})
+	s.changes.flush()
+}
+
+// lock - locks series keys of tenant in order of keys, so concurrent writes of batches can't deadlock.
+// Returns nil without locking if changes are not recorded
+func (l *changeLog) lock(tenant string, keys []string) (unlock func()) {
+	sorted, locks, ok := l.acquire(tenant, keys)
+	if !ok {
+		return nil
+	}
+	for _, lock := range locks {
+		lock.mu.Lock()
+	}
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for i, lock := range locks {
+			lock.mu.Unlock()
+			if lock.refs--; lock.refs == 0 {
+				delete(l.series, [2]string{tenant, sorted[i]})
+			}
+		}
+	}
+}
+
+// acquire - returns distinct series keys sorted and locks of them in tenant, creating missing locks.
+// Returns false if changes are not recorded
+func (l *changeLog) acquire(tenant string, keys []string) ([]string, []*seriesLock, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.recorder == nil {
+		return nil, nil, false
+	}
+	if l.series == nil {
+		l.series = make(map[[2]string]*seriesLock)
+	}
+	sorted := make([]string, 0, len(keys))
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if !seen[key] {
+			seen[key] = true
+			sorted = append(sorted, key)
+		}
+	}
+	sort.Strings(sorted)
+	locks := make([]*seriesLock, len(sorted))
+	for i, key := range sorted {
+		lock, ok := l.series[[2]string{tenant, key}]
+		if !ok {
+			lock = &seriesLock{}
+			l.series[[2]string{tenant, key}] = lock
+		}
+		lock.refs++
+		locks[i] = lock
+	}
+	return sorted, locks, true
+}
+
+// enqueue - queues changes to be passed to recorder, changes are dropped if no recorder is set
+func (l *changeLog) enqueue(changes ...Change) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.recorder != nil {
+		l.queue = append(l.queue, changes...)
+	}
+}
+
+// flush - passes queued changes to recorder in order they were queued, unless another writer does it already.
+// That writer takes changes queued while it records, so no change is left in queue
+func (l *changeLog) flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.flushing {
+		return
+	}
+	l.flushing = true
+	for len(l.queue) > 0 && l.recorder != nil {
+		queue, recorder := l.queue, l.recorder
+		l.queue = nil
+		l.mu.Unlock()
+		for _, change := range queue {
+			if err := recorder.RecordChange(change); err != nil && logger.Log() != nil {
+				logger.Log().Error("failed to record change", zap.String("name", change.Metric.ID), zap.Error(err))
+			}
+		}
+		l.mu.Lock()
+	}
+	l.queue = nil
+	l.flushing = false
+}
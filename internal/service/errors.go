@@ -0,0 +1,56 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/SmoothWay/metrics/internal/model"
+)
+
+// Domain errors returned by every storage, see model package
+var (
+	ErrNotFound           = model.ErrNotFound
+	ErrTypeConflict       = model.ErrTypeConflict
+	ErrStorageUnavailable = model.ErrStorageUnavailable
+)
+
+// Reasons of errors, passed to clients along with status so they don't have to parse messages
+const (
+	ReasonNotFound           = "NOT_FOUND"
+	ReasonTypeConflict       = "TYPE_CONFLICT"
+	ReasonInvalidValue       = "INVALID_VALUE"
+	ReasonSeriesLimit        = "SERIES_LIMIT"
+	ReasonStorageUnavailable = "STORAGE_UNAVAILABLE"
+	ReasonDeadlineExceeded   = "DEADLINE_EXCEEDED"
+	ReasonCanceled           = "CANCELED"
+	ReasonInternal           = "INTERNAL"
+)
+
+// StatusClientClosedRequest non standard status of request canceled by client
+const StatusClientClosedRequest = 499
+
+// ErrorCode - maps error returned by service to HTTP status and reason, transports translate status further
+// so that the same error means the same thing over HTTP and gRPC
+func ErrorCode(err error) (int, string) {
+	switch {
+	case errors.Is(err, ErrNotFound), errors.Is(err, ErrNotEnoughSamples):
+		return http.StatusNotFound, ReasonNotFound
+	case errors.Is(err, ErrTypeConflict):
+		return http.StatusConflict, ReasonTypeConflict
+	case errors.Is(err, ErrInvalidMetricValue), errors.Is(err, ErrInavlidMetricType),
+		errors.Is(err, ErrInvalidMetricName), errors.Is(err, ErrInvalidLabel), errors.Is(err, ErrInvalidRateFunc),
+		errors.Is(err, model.ErrInvalidBuckets), errors.Is(err, model.ErrBucketMismatch):
+		return http.StatusBadRequest, ReasonInvalidValue
+	case errors.Is(err, ErrSeriesLimit):
+		return http.StatusUnprocessableEntity, ReasonSeriesLimit
+	case errors.Is(err, ErrStorageUnavailable):
+		return http.StatusServiceUnavailable, ReasonStorageUnavailable
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout, ReasonDeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		return StatusClientClosedRequest, ReasonCanceled
+	default:
+		return http.StatusInternalServerError, ReasonInternal
+	}
+}
@@ -0,0 +1,204 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/SmoothWay/metrics/internal/model"
+)
+
+// DefaultNamePattern allowed metric names: letter or underscore followed by letters, digits and _ . : -
+const DefaultNamePattern = `^[A-Za-z_][A-Za-z0-9_.:-]*$`
+
+var (
+	ErrInvalidMetricName = errors.New("invalid metric name")
+	ErrInvalidLabel      = errors.New("invalid label")
+	ErrSeriesLimit       = errors.New("series limit exceeded")
+)
+
+// Limits cardinality protection of storage partition.
+// Zero MaxSeries and MaxNameLength disable corresponding check, nil NamePattern allows any name
+type Limits struct {
+	MaxSeries     int
+	PrefixLimits  map[string]int
+	MaxNameLength int
+	NamePattern   *regexp.Regexp
+}
+
+// DefaultLimits - name policy is enforced, series are not limited
+func DefaultLimits() Limits {
+	return Limits{
+		MaxNameLength: 200,
+		NamePattern:   regexp.MustCompile(DefaultNamePattern),
+	}
+}
+
+// series known series of every tenant, loaded from storage on first write of tenant
+type series struct {
+	tenants map[string]map[string]string // tenant -> series -> metric name
+	mu      sync.Mutex
+}
+
+// SetLimits - sets limits applied to every tenant by Save, SaveAll and Observe
+func (s *Service) SetLimits(l Limits) {
+	s.limits = l
+}
+
+// validateName - checks metric name against name policy
+func (s *Service) validateName(name string) error {
+	if name == "" {
+		return fmt.Errorf("%w: name is empty", ErrInvalidMetricName)
+	}
+	if s.limits.MaxNameLength > 0 && len(name) > s.limits.MaxNameLength {
+		return fmt.Errorf("%w: %q is longer than %d characters", ErrInvalidMetricName, name, s.limits.MaxNameLength)
+	}
+	if s.limits.NamePattern != nil && !s.limits.NamePattern.MatchString(name) {
+		return fmt.Errorf("%w: %q does not match %s", ErrInvalidMetricName, name, s.limits.NamePattern)
+	}
+	return nil
+}
+
+// validateLabels - checks label names against name policy, names can not contain characters separating
+// labels in series key. Values are quoted in series key, so they may be any UTF-8 text
+func (s *Service) validateLabels(labels map[string]string) error {
+	for name, value := range labels {
+		switch {
+		case name == "" || strings.ContainsAny(name, `={},"`):
+			return fmt.Errorf("%w: name %q", ErrInvalidLabel, name)
+		case s.limits.MaxNameLength > 0 && len(name) > s.limits.MaxNameLength:
+			return fmt.Errorf("%w: name %q is longer than %d characters", ErrInvalidLabel, name, s.limits.MaxNameLength)
+		case s.limits.NamePattern != nil && !s.limits.NamePattern.MatchString(name):
+			return fmt.Errorf("%w: name %q does not match %s", ErrInvalidLabel, name, s.limits.NamePattern)
+		case !utf8.ValidString(value):
+			return fmt.Errorf("%w: value of %q is not valid UTF-8", ErrInvalidLabel, name)
+		}
+	}
+	return nil
+}
+
+// admit - validates names of metrics and reserves their new series. Nothing is reserved if new series
+// would exceed global or prefix limits. Returned release frees reserved series and must be called if metrics
+// are not saved, so rejected writes do not use up limits
+func (s *Service) admit(ctx context.Context, metrics ...model.Metrics) (release func(), err error) {
+	release = func() {}
+	for _, m := range metrics {
+		if err = s.validateName(m.ID); err != nil {
+			return release, err
+		}
+	}
+	if s.limits.MaxSeries == 0 && len(s.limits.PrefixLimits) == 0 {
+		return release, nil
+	}
+
+	s.series.mu.Lock()
+	defer s.series.mu.Unlock()
+
+	known, err := s.knownSeries(ctx)
+	if err != nil {
+		return release, err
+	}
+	fresh := make(map[string]string)
+	for _, m := range metrics {
+		key := m.Mtype + "/" + m.Key()
+		if _, ok := known[key]; !ok {
+			fresh[key] = m.ID
+		}
+	}
+	if len(fresh) == 0 {
+		return release, nil
+	}
+
+	if s.limits.MaxSeries > 0 && len(known)+len(fresh) > s.limits.MaxSeries {
+		return release, fmt.Errorf("%w: storage is limited to %d series", ErrSeriesLimit, s.limits.MaxSeries)
+	}
+	for prefix, limit := range s.limits.PrefixLimits {
+		added := countPrefix(fresh, prefix)
+		if added > 0 && countPrefix(known, prefix)+added > limit {
+			return release, fmt.Errorf("%w: prefix %q is limited to %d series", ErrSeriesLimit, prefix, limit)
+		}
+	}
+
+	for key, name := range fresh {
+		known[key] = name
+	}
+	return func() {
+		s.series.mu.Lock()
+		defer s.series.mu.Unlock()
+		for key := range fresh {
+			delete(known, key)
+		}
+	}, nil
+}
+
+// knownSeries - returns series of tenant, loading them from storage on first call. Must be called under lock
+func (s *Service) knownSeries(ctx context.Context) (map[string]string, error) {
+	known, ok := s.series.tenants[s.tenant]
+	if ok {
+		return known, nil
+	}
+	stored, err := s.repo.GetAllMetric(ctx)
+	if err != nil {
+		return nil, err
+	}
+	known = make(map[string]string)
+	for _, m := range stored {
+		name, _ := model.ParseSeriesKey(m.ID)
+		known[m.Mtype+"/"+m.ID] = name
+	}
+	s.series.tenants[s.tenant] = known
+	return known, nil
+}
+
+func countPrefix(series map[string]string, prefix string) int {
+	n := 0
+	for _, name := range series {
+		if strings.HasPrefix(name, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+// TopPrefixes - returns up to n metric name prefixes with the largest number of series.
+// Prefix is part of name before first '_', '.', ':' or '-', whole name if there is no separator
+func (s *Service) TopPrefixes(ctx context.Context, n int) ([]model.PrefixCount, error) {
+	ctx, cancel := s.readContext(ctx)
+	defer cancel()
+	stored, err := s.repo.GetAllMetric(ctx)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int)
+	for _, m := range stored {
+		name, _ := model.ParseSeriesKey(m.ID)
+		counts[namePrefix(name)]++
+	}
+
+	result := make([]model.PrefixCount, 0, len(counts))
+	for prefix, c := range counts {
+		result = append(result, model.PrefixCount{Prefix: prefix, Series: c})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Series != result[j].Series {
+			return result[i].Series > result[j].Series
+		}
+		return result[i].Prefix < result[j].Prefix
+	})
+	if n > 0 && len(result) > n {
+		result = result[:n]
+	}
+	return result, nil
+}
+
+func namePrefix(name string) string {
+	if i := strings.IndexAny(name, "_.:-"); i > 0 {
+		return name[:i]
+	}
+	return name
+}
@@ -0,0 +1,52 @@
+package service
+
+import (
+	"context"
+
+	"github.com/SmoothWay/metrics/internal/model"
+)
+
+// SetMetadata - sets unit, description and owner of metric name
+func (s *Service) SetMetadata(ctx context.Context, meta model.Metadata) error {
+	ctx, cancel := s.writeContext(ctx)
+	defer cancel()
+	if err := s.validateName(meta.Name); err != nil {
+		return err
+	}
+	if err := s.repo.SetMetadata(ctx, meta); err != nil {
+		return err
+	}
+	s.recordMetadataChange(meta)
+	return nil
+}
+
+// GetMetadata - returns metadata of metric name
+func (s *Service) GetMetadata(ctx context.Context, name string) (model.Metadata, error) {
+	ctx, cancel := s.readContext(ctx)
+	defer cancel()
+	return s.repo.GetMetadata(ctx, name)
+}
+
+// AllMetadata - returns metadata of all metric names
+func (s *Service) AllMetadata(ctx context.Context) ([]model.Metadata, error) {
+	ctx, cancel := s.readContext(ctx)
+	defer cancel()
+	return s.repo.GetAllMetadata(ctx)
+}
+
+// attachMetadata - sets metadata of metrics which have it, metrics must have names without labels
+func (s *Service) attachMetadata(ctx context.Context, metrics []model.Metrics) {
+	all, err := s.repo.GetAllMetadata(ctx)
+	if err != nil || len(all) == 0 {
+		return
+	}
+	byName := make(map[string]model.Metadata, len(all))
+	for _, meta := range all {
+		byName[meta.Name] = meta
+	}
+	for i := range metrics {
+		if meta, ok := byName[metrics[i].ID]; ok {
+			metrics[i].Meta = &meta
+		}
+	}
+}
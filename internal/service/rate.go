@@ -0,0 +1,95 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/SmoothWay/metrics/internal/model"
+)
+
+var (
+	ErrNotEnoughSamples = errors.New("not enough samples in window")
+	ErrInvalidRateFunc  = errors.New("invalid rate function")
+)
+
+// CounterRate - computes rate, irate or increase of counter by name over samples from last window
+func (s *Service) CounterRate(ctx context.Context, name, fn string, window time.Duration) (model.RateResult, error) {
+	if window <= 0 {
+		return model.RateResult{}, ErrInvalidMetricValue
+	}
+	to := s.now()
+	samples, err := s.samples(ctx, model.MetricTypeCounter, name, to.Add(-window), to)
+	if err != nil {
+		return model.RateResult{}, err
+	}
+
+	var value float64
+	switch fn {
+	case model.RateFuncRate:
+		value, err = rate(samples)
+	case model.RateFuncIRate:
+		value, err = irate(samples)
+	case model.RateFuncIncrease:
+		value, err = increase(samples)
+	default:
+		return model.RateResult{}, ErrInvalidRateFunc
+	}
+	if err != nil {
+		return model.RateResult{}, err
+	}
+
+	return model.RateResult{
+		ID:      name,
+		Func:    fn,
+		Window:  window.String(),
+		Value:   value,
+		Samples: len(samples),
+	}, nil
+}
+
+// increase - sum of growth between consecutive samples.
+// Decrease of value is treated as counter reset, so value after reset is counted from zero
+func increase(samples []model.Sample) (float64, error) {
+	if len(samples) < 2 {
+		return 0, ErrNotEnoughSamples
+	}
+	var result float64
+	for i := 1; i < len(samples); i++ {
+		result += delta(samples[i-1].Value, samples[i].Value)
+	}
+	return result, nil
+}
+
+// rate - per-second average growth over time covered by samples
+func rate(samples []model.Sample) (float64, error) {
+	inc, err := increase(samples)
+	if err != nil {
+		return 0, err
+	}
+	seconds := samples[len(samples)-1].Timestamp.Sub(samples[0].Timestamp).Seconds()
+	if seconds <= 0 {
+		return 0, ErrNotEnoughSamples
+	}
+	return inc / seconds, nil
+}
+
+// irate - per-second growth between two last samples
+func irate(samples []model.Sample) (float64, error) {
+	if len(samples) < 2 {
+		return 0, ErrNotEnoughSamples
+	}
+	last, prev := samples[len(samples)-1], samples[len(samples)-2]
+	seconds := last.Timestamp.Sub(prev.Timestamp).Seconds()
+	if seconds <= 0 {
+		return 0, ErrNotEnoughSamples
+	}
+	return delta(prev.Value, last.Value) / seconds, nil
+}
+
+func delta(prev, cur float64) float64 {
+	if cur < prev {
+		return cur
+	}
+	return cur - prev
+}
@@ -0,0 +1,68 @@
+package service
+
+import (
+	"context"
+
+	"github.com/SmoothWay/metrics/internal/model"
+)
+
+// Retype - admin override of type owning metric name. Every series of name stored under another type is removed,
+// so name can be written with mtype whatever labels are. Counter becomes gauge with the same value and gauge becomes
+// counter with value truncated to integer, histogram is neither converted nor produced by conversion.
+// Series are removed and converted atomically by storage, so failure leaves the name as it was
+func (s *Service) Retype(ctx context.Context, name, mtype string) error {
+	ctx, cancel := s.writeContext(ctx)
+	defer cancel()
+	switch mtype {
+	case model.MetricTypeCounter, model.MetricTypeGauge, model.MetricTypeHistogram:
+	default:
+		return ErrInavlidMetricType
+	}
+
+	stored, err := s.repo.GetAllMetric(ctx)
+	if err != nil {
+		return err
+	}
+	var found bool
+	var remove, set []model.Metrics
+	for _, m := range stored {
+		if model.SeriesName(m.ID) != name {
+			continue
+		}
+		found = true
+		if m.Mtype == mtype {
+			continue
+		}
+		remove = append(remove, model.Metrics{ID: m.ID, Mtype: m.Mtype})
+		switch {
+		case mtype == model.MetricTypeGauge && m.Delta != nil:
+			value := float64(*m.Delta)
+			set = append(set, model.Metrics{ID: m.ID, Mtype: mtype, Value: &value})
+		case mtype == model.MetricTypeCounter && m.Value != nil:
+			delta := int64(*m.Value)
+			set = append(set, model.Metrics{ID: m.ID, Mtype: mtype, Delta: &delta})
+		}
+	}
+	if !found {
+		return ErrNotFound
+	}
+	if len(remove) == 0 {
+		return nil
+	}
+	keys := make([]string, len(remove))
+	for i, m := range remove {
+		keys[i] = m.ID
+	}
+	// converted series of set carry their whole values, so they are recorded as they are
+	err = s.recordWrite(keys, func() (_, _ []model.Metrics, err error) {
+		return remove, set, s.repo.ReplaceMetrics(ctx, remove, set)
+	})
+	if err != nil {
+		return err
+	}
+	// series of tenant are reloaded from storage on next write
+	s.series.mu.Lock()
+	delete(s.series.tenants, s.tenant)
+	s.series.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,181 @@
+package service
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/SmoothWay/metrics/internal/model"
+)
+
+// Retention how long history is kept for every resolution
+type Retention struct {
+	Raw    time.Duration
+	Minute time.Duration
+	Hour   time.Duration
+}
+
+// DefaultRetention retention used if none is set
+var DefaultRetention = Retention{
+	Raw:    time.Hour,
+	Minute: 24 * time.Hour,
+	Hour:   30 * 24 * time.Hour,
+}
+
+// SetRetention - sets retention of history for every resolution
+func (s *Service) SetRetention(r Retention) {
+	s.retention = r
+}
+
+// CompactAll - compacts history of every tenant
+func (s *Service) CompactAll(ctx context.Context) error {
+	tenants, err := s.Tenants()
+	if err != nil {
+		return err
+	}
+	for _, t := range tenants {
+		if err = s.ForTenant(t).Compact(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Compact - rolls raw samples into minute aggregates and minute aggregates into hour ones,
+// then removes history older than retention of its resolution.
+// Only finished buckets are rolled up, buckets are recomputed on every run so it is safe to repeat
+func (s *Service) Compact(ctx context.Context) error {
+	now := s.now()
+
+	series, err := s.repo.HistorySeries(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, ref := range series {
+		if err = s.rollupMinutes(ctx, ref, now); err != nil {
+			return err
+		}
+		if err = s.rollupHours(ctx, ref, now); err != nil {
+			return err
+		}
+	}
+
+	if err = s.repo.DeleteSamplesBefore(ctx, now.Add(-s.retention.Raw)); err != nil {
+		return err
+	}
+	if err = s.repo.DeleteAggregatesBefore(ctx, model.ResolutionMinute, now.Add(-s.retention.Minute)); err != nil {
+		return err
+	}
+	return s.repo.DeleteAggregatesBefore(ctx, model.ResolutionHour, now.Add(-s.retention.Hour))
+}
+
+func (s *Service) rollupMinutes(ctx context.Context, ref model.SeriesRef, now time.Time) error {
+	to := now.Truncate(model.ResolutionMinute)
+	// bucket crossing retention boundary may be partially deleted already, so it is not recomputed
+	from := now.Add(-s.retention.Raw).Truncate(model.ResolutionMinute).Add(model.ResolutionMinute)
+	samples, err := s.repo.GetSamples(ctx, ref.Mtype, ref.ID, from, to.Add(-time.Nanosecond))
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].Timestamp.Before(samples[j].Timestamp)
+	})
+
+	var aggs []model.Aggregate
+	for _, sample := range samples {
+		ts := sample.Timestamp.Truncate(model.ResolutionMinute)
+		if len(aggs) == 0 || !aggs[len(aggs)-1].Timestamp.Equal(ts) {
+			aggs = append(aggs, model.Aggregate{Timestamp: ts})
+		}
+		aggs[len(aggs)-1].Add(sample)
+	}
+	if len(aggs) == 0 {
+		return nil
+	}
+	return s.repo.SaveAggregates(ctx, ref.Mtype, ref.ID, model.ResolutionMinute, aggs)
+}
+
+func (s *Service) rollupHours(ctx context.Context, ref model.SeriesRef, now time.Time) error {
+	to := now.Truncate(model.ResolutionHour)
+	from := now.Add(-s.retention.Minute).Truncate(model.ResolutionHour).Add(model.ResolutionHour)
+	minutes, err := s.repo.GetAggregates(ctx, ref.Mtype, ref.ID, model.ResolutionMinute, from, to.Add(-time.Nanosecond))
+	if err != nil {
+		return err
+	}
+
+	var aggs []model.Aggregate
+	for _, m := range minutes {
+		ts := m.Timestamp.Truncate(model.ResolutionHour)
+		if len(aggs) == 0 || !aggs[len(aggs)-1].Timestamp.Equal(ts) {
+			aggs = append(aggs, model.Aggregate{Timestamp: ts})
+		}
+		aggs[len(aggs)-1].Merge(m)
+	}
+	if len(aggs) == 0 {
+		return nil
+	}
+	return s.repo.SaveAggregates(ctx, ref.Mtype, ref.ID, model.ResolutionHour, aggs)
+}
+
+// resolutionFor - picks the finest resolution which retention still covers from
+func (s *Service) resolutionFor(from time.Time) time.Duration {
+	age := s.now().Sub(from)
+	switch {
+	case age <= s.retention.Raw:
+		return model.ResolutionRaw
+	case age <= s.retention.Minute:
+		return model.ResolutionMinute
+	default:
+		return model.ResolutionHour
+	}
+}
+
+// History - retrieve history of metric by type and name in passed time range.
+// Resolution is picked automatically: raw samples while they are retained, then minute and hour aggregates
+func (s *Service) History(ctx context.Context, mtype, name string, from, to time.Time) (model.HistoryResult, error) {
+	ctx, cancel := s.readContext(ctx)
+	defer cancel()
+	if mtype != model.MetricTypeCounter && mtype != model.MetricTypeGauge {
+		return model.HistoryResult{}, ErrInavlidMetricType
+	}
+	result := model.HistoryResult{ID: name, Mtype: mtype, Resolution: "raw"}
+
+	res := s.resolutionFor(from)
+	if res == model.ResolutionRaw {
+		samples, err := s.repo.GetSamples(ctx, mtype, name, from, to)
+		if err != nil {
+			return model.HistoryResult{}, err
+		}
+		sort.SliceStable(samples, func(i, j int) bool {
+			return samples[i].Timestamp.Before(samples[j].Timestamp)
+		})
+		result.Samples = samples
+		return result, nil
+	}
+
+	aggs, err := s.repo.GetAggregates(ctx, mtype, name, res, from.Truncate(res), to)
+	if err != nil {
+		return model.HistoryResult{}, err
+	}
+	result.Resolution = res.String()
+	result.Aggregates = aggs
+	return result, nil
+}
+
+// samples - history of metric as samples in the resolution picked for from.
+// Last value of aggregate is used as sample for rolled up history
+func (s *Service) samples(ctx context.Context, mtype, name string, from, to time.Time) ([]model.Sample, error) {
+	h, err := s.History(ctx, mtype, name, from, to)
+	if err != nil {
+		return nil, err
+	}
+	if h.Aggregates == nil {
+		return h.Samples, nil
+	}
+	samples := make([]model.Sample, len(h.Aggregates))
+	for i, a := range h.Aggregates {
+		samples[i] = model.Sample{Timestamp: a.Timestamp, Value: a.Last}
+	}
+	return samples, nil
+}
@@ -2,88 +2,423 @@
 package service
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"time"
 
+	"go.uber.org/zap"
+
+	"github.com/SmoothWay/metrics/internal/logger"
 	"github.com/SmoothWay/metrics/internal/model"
 )
 
 const (
-	TypeCounter = "counter"
-	TypeGauge   = "gauge"
+	TypeCounter   = "counter"
+	TypeGauge     = "gauge"
+	TypeHistogram = "histogram"
 )
 
+// DefaultIdempotencyWindow how long idempotency keys of saved batches are remembered by default
+const DefaultIdempotencyWindow = 10 * time.Minute
+
 var (
-	ErrInvalidMetricValue = errors.New("invalid metric value")
+	ErrInvalidMetricValue = model.ErrInvalidValue
 	ErrInavlidMetricType  = errors.New("invalid metric type")
 )
 
 type Service struct {
-	repo Repository
+	repo        Repository
+	now         func() time.Time
+	retention   Retention
+	tenantRepo  TenantRepository
+	listTenants func() ([]string, error)
+	tenant      string
+	limits      Limits
+	series      *series
+	changes     *changeLog
+	timeouts    Timeouts
+
+	idempotencyWindow time.Duration
 }
 
-// Repository Interface for working with storage
+// TenantRepository returns storage partition of tenant
+type TenantRepository func(tenant string) Repository
+
+// Repository Interface for working with storage. Writes return values stored by them, so service doesn't
+// read values back: new value of counter, merged histogram, for batches values of distinct written series
+// in order they first appear in batch, see model.Written
 type Repository interface {
-	GetAllMetric() []model.Metrics
-	GetCounterMetric(string) (int64, error)
-	GetGaugeMetric(string) (float64, error)
-	SetAllMetrics([]model.Metrics) error
-	SetCounterMetric(string, int64) error
-	SetGaugeMetric(string, float64) error
-	PingStorage() error
+	GetAllMetric(ctx context.Context) ([]model.Metrics, error)
+	GetCounterMetric(ctx context.Context, key string) (int64, error)
+	GetGaugeMetric(ctx context.Context, key string) (float64, error)
+	GetHistogramMetric(ctx context.Context, key string) (model.Histogram, error)
+	SetAllMetrics(ctx context.Context, metrics []model.Metrics) ([]model.Metrics, error)
+	SetAllMetricsOnce(ctx context.Context, metrics []model.Metrics, key string, appliedAt time.Time, window time.Duration) ([]model.Metrics, bool, error)
+	SetCounterMetric(ctx context.Context, key string, value int64) (int64, error)
+	SetGaugeMetric(ctx context.Context, key string, value float64) error
+	SetHistogramMetric(ctx context.Context, key string, value model.Histogram) (model.Histogram, error)
+	DeleteMetric(ctx context.Context, mtype, key string) error
+	ReplaceMetrics(ctx context.Context, remove, set []model.Metrics) error
+	AppendSample(ctx context.Context, mtype, name string, sample model.Sample) error
+	GetSamples(ctx context.Context, mtype, name string, from, to time.Time) ([]model.Sample, error)
+	DeleteSamplesBefore(ctx context.Context, before time.Time) error
+	HistorySeries(ctx context.Context) ([]model.SeriesRef, error)
+	SaveAggregates(ctx context.Context, mtype, name string, resolution time.Duration, aggs []model.Aggregate) error
+	GetAggregates(ctx context.Context, mtype, name string, resolution time.Duration, from, to time.Time) ([]model.Aggregate, error)
+	DeleteAggregatesBefore(ctx context.Context, resolution time.Duration, before time.Time) error
+	SetMetadata(ctx context.Context, meta model.Metadata) error
+	GetMetadata(ctx context.Context, name string) (model.Metadata, error)
+	GetAllMetadata(ctx context.Context) ([]model.Metadata, error)
+	PingStorage(ctx context.Context) error
+}
+
+// HistoryWriter storage which appends new values of counters and gauges to their history by the same write
+// as values themselves. Service does not append samples to such storage
+type HistoryWriter interface {
+	WritesHistory() bool
 }
 
 func New(repo Repository) *Service {
-	return &Service{repo: repo}
+	return &Service{
+		repo:      repo,
+		now:       time.Now,
+		retention: DefaultRetention,
+		limits:    DefaultLimits(),
+		series:    &series{tenants: make(map[string]map[string]string)},
+		changes:   &changeLog{},
+		timeouts:  DefaultTimeouts,
+
+		idempotencyWindow: DefaultIdempotencyWindow,
+	}
+}
+
+// SetIdempotencyWindow - sets how long idempotency keys of saved batches are remembered
+func (s *Service) SetIdempotencyWindow(window time.Duration) {
+	s.idempotencyWindow = window
+}
+
+// SetTenants - enables partitioning of storage by tenants.
+// repo returns partition of tenant, list returns tenants which have data in storage
+func (s *Service) SetTenants(repo TenantRepository, list func() ([]string, error)) {
+	s.tenantRepo = repo
+	s.listTenants = list
+}
+
+// ForTenant - returns service working with storage partition of tenant.
+// Service itself is returned for default tenant or if tenants are not enabled
+func (s *Service) ForTenant(tenant string) *Service {
+	if tenant == "" || s.tenantRepo == nil {
+		return s
+	}
+	return &Service{
+		repo:        s.tenantRepo(tenant),
+		now:         s.now,
+		retention:   s.retention,
+		tenantRepo:  s.tenantRepo,
+		listTenants: s.listTenants,
+		tenant:      tenant,
+		limits:      s.limits,
+		series:      s.series,
+		changes:     s.changes,
+		timeouts:    s.timeouts,
+
+		idempotencyWindow: s.idempotencyWindow,
+	}
+}
+
+// Tenants - returns tenants which have data in storage, default tenant is always included
+func (s *Service) Tenants() ([]string, error) {
+	if s.listTenants == nil {
+		return []string{""}, nil
+	}
+	tenants, err := s.listTenants()
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tenants {
+		if t == "" {
+			return tenants, nil
+		}
+	}
+	return append([]string{""}, tenants...), nil
 }
 
 // SaveAll - save slice of metrics into storage
-func (s *Service) SaveAll(metrics []model.Metrics) error {
-	err := s.repo.SetAllMetrics(metrics)
+func (s *Service) SaveAll(ctx context.Context, metrics []model.Metrics) error {
+	ctx, cancel := s.writeContext(ctx)
+	defer cancel()
+	_, err := s.saveAll(ctx, metrics, func(stored []model.Metrics) ([]model.Metrics, bool, error) {
+		written, err := s.repo.SetAllMetrics(ctx, stored)
+		return written, true, err
+	})
+	return err
+}
+
+// SaveAllOnce - save slice of metrics into storage unless batch with same idempotency key was saved
+// within idempotency window. Returns false if batch is skipped as duplicate. Empty key saves batch as SaveAll
+func (s *Service) SaveAllOnce(ctx context.Context, metrics []model.Metrics, key string) (bool, error) {
+	if key == "" {
+		return true, s.SaveAll(ctx, metrics)
+	}
+	ctx, cancel := s.writeContext(ctx)
+	defer cancel()
+	return s.saveAll(ctx, metrics, func(stored []model.Metrics) ([]model.Metrics, bool, error) {
+		return s.repo.SetAllMetricsOnce(ctx, stored, key, s.now(), s.idempotencyWindow)
+	})
+}
+
+// saveAll - validates whole batch before anything is saved, then saves it with apply, which returns values
+// of written series. Invalid metrics and metrics reusing name of another type within batch, whatever their labels,
+// are reported together as *model.BatchError
+func (s *Service) saveAll(ctx context.Context, metrics []model.Metrics, apply func([]model.Metrics) ([]model.Metrics, bool, error)) (bool, error) {
+	var batchErr model.BatchError
+	types := make(map[string]string, len(metrics))
+	for i, m := range metrics {
+		err := s.validateMetric(m)
+		if mtype, ok := types[m.ID]; err == nil && ok && mtype != m.Mtype {
+			err = model.TypeConflict(m.Key())
+		}
+		if err != nil {
+			batchErr.Items = append(batchErr.Items, model.ItemError{Index: i, ID: m.ID, Mtype: m.Mtype, Err: err})
+			continue
+		}
+		types[m.ID] = m.Mtype
+	}
+	if len(batchErr.Items) > 0 {
+		return false, &batchErr
+	}
+	release, err := s.admit(ctx, metrics...)
 	if err != nil {
-		return err
+		return false, err
 	}
-	return nil
+	stored := make([]model.Metrics, len(metrics))
+	keys := make([]string, len(metrics))
+	for i, m := range metrics {
+		stored[i] = toStored(m)
+		keys[i] = stored[i].ID
+	}
+	var written []model.Metrics
+	var applied bool
+	err = s.recordWrite(keys, func() (_, set []model.Metrics, err error) {
+		written, applied, err = apply(stored)
+		return nil, written, err
+	})
+	if err != nil {
+		release()
+		// storage reports series keys, callers know metrics by names
+		var storageErr *model.BatchError
+		if errors.As(err, &storageErr) {
+			for i, item := range storageErr.Items {
+				if item.Index >= 0 && item.Index < len(metrics) {
+					storageErr.Items[i].ID = metrics[item.Index].ID
+				}
+			}
+		}
+		return false, err
+	}
+	if !applied {
+		return false, nil
+	}
+
+	for _, m := range written {
+		s.recordSample(ctx, m)
+	}
+	return true, nil
 }
 
-// Save - save metric into storage
-func (s *Service) Save(jsonMetric model.Metrics) error {
-	switch jsonMetric.Mtype {
+// validateMetric - checks type, name, labels and value of single metric
+func (s *Service) validateMetric(m model.Metrics) error {
+	if err := s.validateName(m.ID); err != nil {
+		return err
+	}
+	if err := s.validateLabels(m.Labels); err != nil {
+		return err
+	}
+	switch m.Mtype {
 	case model.MetricTypeCounter:
-		return s.repo.SetCounterMetric(jsonMetric.ID, *jsonMetric.Delta)
+		if m.Delta == nil {
+			return ErrInvalidMetricValue
+		}
 	case model.MetricTypeGauge:
-		return s.repo.SetGaugeMetric(jsonMetric.ID, *jsonMetric.Value)
+		if m.Value == nil {
+			return ErrInvalidMetricValue
+		}
+	case model.MetricTypeHistogram:
+		return validateHistogram(m.Histogram)
 	default:
 		return ErrInavlidMetricType
 	}
+	return nil
+}
+
+// Save - save metric into storage
+func (s *Service) Save(ctx context.Context, jsonMetric model.Metrics) error {
+	ctx, cancel := s.writeContext(ctx)
+	defer cancel()
+	if err := s.validateMetric(jsonMetric); err != nil {
+		return err
+	}
+	release, err := s.admit(ctx, jsonMetric)
+	if err != nil {
+		return err
+	}
+
+	key := jsonMetric.Key()
+	written := model.Metrics{ID: key, Mtype: jsonMetric.Mtype}
+	err = s.recordWrite([]string{key}, func() (_, set []model.Metrics, err error) {
+		switch jsonMetric.Mtype {
+		case model.MetricTypeCounter:
+			var total int64
+			total, err = s.repo.SetCounterMetric(ctx, key, *jsonMetric.Delta)
+			written.Delta = &total
+		case model.MetricTypeGauge:
+			value := *jsonMetric.Value
+			err = s.repo.SetGaugeMetric(ctx, key, value)
+			written.Value = &value
+		default:
+			var merged model.Histogram
+			merged, err = s.repo.SetHistogramMetric(ctx, key, *jsonMetric.Histogram)
+			written.Histogram = &merged
+		}
+		return nil, []model.Metrics{written}, err
+	})
+	if err != nil {
+		release()
+		return err
+	}
+	s.recordSample(ctx, written)
+	return nil
+}
+
+// Observe - record single observation into histogram by name.
+// Bucket layout of stored histogram is used, model.DefaultBuckets for a new one
+func (s *Service) Observe(ctx context.Context, name string, value float64) error {
+	ctx, cancel := s.writeContext(ctx)
+	defer cancel()
+	buckets := model.DefaultBuckets
+	stored, err := s.repo.GetHistogramMetric(ctx, name)
+	if err == nil {
+		buckets = stored.Buckets
+	}
+	h := model.NewHistogram(buckets)
+	h.Observe(value)
+	m := model.Metrics{ID: name, Mtype: model.MetricTypeHistogram, Histogram: &h}
+	if err = s.validateMetric(m); err != nil {
+		return err
+	}
+	release, err := s.admit(ctx, m)
+	if err != nil {
+		return err
+	}
+	err = s.recordWrite([]string{name}, func() (_, set []model.Metrics, err error) {
+		merged, err := s.repo.SetHistogramMetric(ctx, name, h)
+		return nil, []model.Metrics{{ID: name, Mtype: model.MetricTypeHistogram, Histogram: &merged}}, err
+	})
+	if err != nil {
+		release()
+		return err
+	}
+	return nil
 }
 
 // Retrieve - get metrics by type and name from storage. Method sets value into passed variable
-func (s *Service) Retrieve(jsonMetric *model.Metrics) error {
+func (s *Service) Retrieve(ctx context.Context, jsonMetric *model.Metrics) error {
+	ctx, cancel := s.readContext(ctx)
+	defer cancel()
+	if err := s.retrieveValue(ctx, jsonMetric); err != nil {
+		return err
+	}
+	if meta, err := s.repo.GetMetadata(ctx, jsonMetric.ID); err == nil {
+		jsonMetric.Meta = &meta
+	}
+	return nil
+}
+
+// retrieveValue - fills value of metric by its type and series key
+func (s *Service) retrieveValue(ctx context.Context, jsonMetric *model.Metrics) error {
 	switch jsonMetric.Mtype {
 	case model.MetricTypeCounter:
-		value, err := s.repo.GetCounterMetric(jsonMetric.ID)
+		value, err := s.repo.GetCounterMetric(ctx, jsonMetric.Key())
 		if err != nil {
 			return err
 		}
 		jsonMetric.Delta = &value
 	case model.MetricTypeGauge:
-		value, err := s.repo.GetGaugeMetric(jsonMetric.ID)
+		value, err := s.repo.GetGaugeMetric(ctx, jsonMetric.Key())
 		if err != nil {
 			return err
 		}
 		jsonMetric.Value = &value
+	case model.MetricTypeHistogram:
+		value, err := s.repo.GetHistogramMetric(ctx, jsonMetric.Key())
+		if err != nil {
+			return err
+		}
+		jsonMetric.Histogram = &value
 	default:
 		return ErrInavlidMetricType
 	}
-
 	return nil
 }
 
 // GetAll - retrieve all metrics from storage
-func (s *Service) GetAll() []model.Metrics {
-	return s.repo.GetAllMetric()
+func (s *Service) GetAll(ctx context.Context) ([]model.Metrics, error) {
+	ctx, cancel := s.readContext(ctx)
+	defer cancel()
+	metrics, err := s.repo.GetAllMetric(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range metrics {
+		metrics[i].ID, metrics[i].Labels = model.ParseSeriesKey(metrics[i].ID)
+	}
+	s.attachMetadata(ctx, metrics)
+	return metrics, nil
+}
+
+// toStored - converts metric into form kept by storage, where labels are part of metric name
+func toStored(m model.Metrics) model.Metrics {
+	m.ID = m.Key()
+	m.Labels = nil
+	return m
+}
+
+// recordSample - appends value of counter or gauge returned by its write to its history, unless storage
+// is HistoryWriter. Failure is only logged, because the metric itself is already saved
+func (s *Service) recordSample(ctx context.Context, m model.Metrics) {
+	if h, ok := s.repo.(HistoryWriter); ok && h.WritesHistory() {
+		return
+	}
+	var value float64
+	switch {
+	case m.Mtype == model.MetricTypeCounter && m.Delta != nil:
+		value = float64(*m.Delta)
+	case m.Mtype == model.MetricTypeGauge && m.Value != nil:
+		value = *m.Value
+	default:
+		return
+	}
+
+	err := s.repo.AppendSample(ctx, m.Mtype, m.ID, model.Sample{Timestamp: s.now(), Value: value})
+	if err != nil && logger.Log() != nil {
+		logger.Log().Warn("failed to append sample", zap.String("name", m.ID), zap.Error(err))
+	}
+}
+
+// validateHistogram - checks that histogram value is present and consistent
+func validateHistogram(h *model.Histogram) error {
+	if h == nil {
+		return ErrInvalidMetricValue
+	}
+	if err := h.Validate(); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidMetricValue, err.Error())
+	}
+	return nil
 }
 
-func (s *Service) PingStorage() error {
-	return s.repo.PingStorage()
+func (s *Service) PingStorage(ctx context.Context) error {
+	ctx, cancel := s.readContext(ctx)
+	defer cancel()
+	return s.repo.PingStorage(ctx)
 }
@@ -1,8 +1,15 @@
 package service
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/SmoothWay/metrics/internal/model"
 	"github.com/SmoothWay/metrics/internal/repository/memstorage"
@@ -42,6 +49,71 @@ func TestService_Save(t *testing.T) {
 			},
 			wantErr: nil,
 		},
+		{
+			name: "save histogram",
+
+			args: args{
+				jsonMetric: model.Metrics{
+					ID:    "RequestDuration",
+					Mtype: model.MetricTypeHistogram,
+					Histogram: &model.Histogram{
+						Buckets: []float64{0.1, 1},
+						Counts:  []uint64{1, 2, 0},
+						Sum:     1.5,
+						Count:   3,
+					},
+				},
+			},
+			wantErr: nil,
+		},
+		{
+			name: "histogram with unsorted buckets",
+
+			args: args{
+				jsonMetric: model.Metrics{
+					ID:    "RequestDuration",
+					Mtype: model.MetricTypeHistogram,
+					Histogram: &model.Histogram{
+						Buckets: []float64{1, 0.1},
+						Counts:  []uint64{0, 0, 0},
+					},
+				},
+			},
+			wantErr: ErrInvalidMetricValue,
+		},
+		{
+			name: "histogram without value",
+
+			args: args{
+				jsonMetric: model.Metrics{
+					ID:    "RequestDuration",
+					Mtype: model.MetricTypeHistogram,
+				},
+			},
+			wantErr: ErrInvalidMetricValue,
+		},
+		{
+			name: "counter without delta",
+
+			args: args{
+				jsonMetric: model.Metrics{
+					ID:    "PollCount",
+					Mtype: model.MetricTypeCounter,
+				},
+			},
+			wantErr: ErrInvalidMetricValue,
+		},
+		{
+			name: "gauge without value",
+
+			args: args{
+				jsonMetric: model.Metrics{
+					ID:    "Alloc",
+					Mtype: model.MetricTypeGauge,
+				},
+			},
+			wantErr: ErrInvalidMetricValue,
+		},
 		{
 			name: "invalid metric type",
 
@@ -56,13 +128,11 @@ func TestService_Save(t *testing.T) {
 			wantErr: ErrInavlidMetricType,
 		},
 	}
-	s := &Service{
-		repo: memstorage.New(nil),
-	}
+	s := New(memstorage.New(nil))
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 
-			err := s.Save(tt.args.jsonMetric)
+			err := s.Save(context.Background(), tt.args.jsonMetric)
 			if !errors.Is(err, tt.wantErr) {
 				t.Errorf("Service.Save() error = %v, wantErr %v", err, tt.wantErr)
 			}
@@ -131,12 +201,10 @@ func TestService_Retrieve(t *testing.T) {
 		},
 	}
 
-	s := &Service{
-		repo: memstorage.New(nil),
-	}
+	s := New(memstorage.New(nil))
 
 	for _, smv := range saveMetric {
-		err := s.Save(smv)
+		err := s.Save(context.Background(), smv)
 		if err != nil {
 			t.Errorf("Service.Save() error = %v", err)
 		}
@@ -144,10 +212,624 @@ func TestService_Retrieve(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			err := s.Retrieve(tt.args.jsonMetric)
+			err := s.Retrieve(context.Background(), tt.args.jsonMetric)
 			if !errors.Is(err, tt.wantErr) {
 				t.Errorf("Service.Retrieve() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
 	}
 }
+
+func TestService_Observe(t *testing.T) {
+	s := New(memstorage.New(nil))
+
+	for _, v := range []float64{0.001, 0.3, 42} {
+		if err := s.Observe(context.Background(), "Latency", v); err != nil {
+			t.Fatalf("Service.Observe() error = %v", err)
+		}
+	}
+
+	m := &model.Metrics{ID: "Latency", Mtype: model.MetricTypeHistogram}
+	if err := s.Retrieve(context.Background(), m); err != nil {
+		t.Fatalf("Service.Retrieve() error = %v", err)
+	}
+	if m.Histogram.Count != 3 {
+		t.Errorf("histogram count = %d, want 3", m.Histogram.Count)
+	}
+	if m.Histogram.Counts[0] != 1 || m.Histogram.Counts[len(m.Histogram.Counts)-1] != 1 {
+		t.Errorf("unexpected bucket counts %v", m.Histogram.Counts)
+	}
+}
+
+func TestService_CounterRate(t *testing.T) {
+	repo := memstorage.New(nil)
+	s := New(repo)
+
+	start := time.Now().Add(-time.Minute)
+	// counter was reset between 20s and 30s
+	for i, v := range []float64{10, 20, 40, 5, 15} {
+		err := repo.AppendSample(context.Background(), model.MetricTypeCounter, "Requests", model.Sample{
+			Timestamp: start.Add(time.Duration(i*10) * time.Second),
+			Value:     v,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		fn      string
+		want    float64
+		wantErr error
+	}{
+		{name: "increase", fn: model.RateFuncIncrease, want: 45},
+		{name: "rate", fn: model.RateFuncRate, want: 45.0 / 40},
+		{name: "irate", fn: model.RateFuncIRate, want: 1},
+		{name: "unknown function", fn: "deriv", wantErr: ErrInvalidRateFunc},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.CounterRate(context.Background(), "Requests", tt.fn, 5*time.Minute)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Service.CounterRate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got.Value != tt.want {
+				t.Errorf("Service.CounterRate() = %v, want %v", got.Value, tt.want)
+			}
+		})
+	}
+
+	if _, err := s.CounterRate(context.Background(), "Unknown", model.RateFuncRate, time.Minute); !errors.Is(err, ErrNotEnoughSamples) {
+		t.Errorf("Service.CounterRate() error = %v, want %v", err, ErrNotEnoughSamples)
+	}
+}
+
+func TestService_Compact(t *testing.T) {
+	repo := memstorage.New(nil)
+	s := New(repo)
+	s.SetRetention(Retention{Raw: 10 * time.Minute, Minute: 3 * time.Hour, Hour: 24 * time.Hour})
+
+	end := time.Date(2024, 1, 1, 12, 0, 30, 0, time.UTC)
+	now := end.Add(-2 * time.Hour)
+	s.now = func() time.Time { return now }
+
+	// two samples per minute during last two hours, compaction runs every minute
+	for ; now.Before(end); now = now.Add(30 * time.Second) {
+		err := repo.AppendSample(context.Background(), model.MetricTypeGauge, "Alloc", model.Sample{Timestamp: now, Value: float64(now.Minute())})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if now.Second() == 0 {
+			if err = s.Compact(context.Background()); err != nil {
+				t.Fatalf("Service.Compact() error = %v", err)
+			}
+		}
+	}
+	if err := s.Compact(context.Background()); err != nil {
+		t.Fatalf("Service.Compact() error = %v", err)
+	}
+
+	raw, err := repo.GetSamples(context.Background(), model.MetricTypeGauge, "Alloc", now.Add(-24*time.Hour), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first := raw[0].Timestamp; first.Before(now.Add(-10 * time.Minute)) {
+		t.Errorf("raw sample %v is older than retention", first)
+	}
+
+	hours, err := repo.GetAggregates(context.Background(), model.MetricTypeGauge, "Alloc", model.ResolutionHour, now.Add(-24*time.Hour), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hours) != 2 {
+		t.Fatalf("got %d hour aggregates, want 2", len(hours))
+	}
+	want := model.Aggregate{Timestamp: now.Add(-time.Hour).Truncate(time.Hour), Min: 0, Max: 59, Sum: 2 * 59 * 60 / 2, Last: 59, Count: 120}
+	if hours[1] != want {
+		t.Errorf("hour aggregate = %+v, want %+v", hours[1], want)
+	}
+
+	tests := []struct {
+		name       string
+		from       time.Time
+		resolution string
+	}{
+		{name: "recent range uses raw samples", from: now.Add(-5 * time.Minute), resolution: "raw"},
+		{name: "older range uses minutes", from: now.Add(-time.Hour), resolution: "1m0s"},
+		{name: "oldest range uses hours", from: now.Add(-5 * time.Hour), resolution: "1h0m0s"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := s.History(context.Background(), model.MetricTypeGauge, "Alloc", tt.from, now)
+			if err != nil {
+				t.Fatalf("Service.History() error = %v", err)
+			}
+			if h.Resolution != tt.resolution {
+				t.Errorf("Service.History() resolution = %s, want %s", h.Resolution, tt.resolution)
+			}
+		})
+	}
+}
+
+func TestService_Limits(t *testing.T) {
+	s := New(memstorage.New(nil))
+	limits := DefaultLimits()
+	limits.MaxSeries = 4
+	limits.PrefixLimits = map[string]int{"http_": 2}
+	s.SetLimits(limits)
+
+	gauge := func(name string, labels map[string]string) model.Metrics {
+		v := 1.0
+		return model.Metrics{ID: name, Mtype: model.MetricTypeGauge, Value: &v, Labels: labels}
+	}
+
+	tests := []struct {
+		name    string
+		metrics []model.Metrics
+		wantErr error
+	}{
+		{name: "new series", metrics: []model.Metrics{gauge("http_requests", map[string]string{"code": "200"}), gauge("Alloc", nil)}},
+		{name: "known series are not counted", metrics: []model.Metrics{gauge("Alloc", nil), gauge("Alloc", nil)}},
+		{name: "prefix limit", metrics: []model.Metrics{gauge("http_requests", map[string]string{"code": "500"}), gauge("http_latency", nil)}, wantErr: ErrSeriesLimit},
+		{name: "prefix limit reached exactly", metrics: []model.Metrics{gauge("http_requests", map[string]string{"code": "500"})}},
+		{name: "invalid characters", metrics: []model.Metrics{gauge("heap alloc", nil)}, wantErr: ErrInvalidMetricName},
+		{name: "too long name", metrics: []model.Metrics{gauge(strings.Repeat("a", 201), nil)}, wantErr: ErrInvalidMetricName},
+		{name: "global limit", metrics: []model.Metrics{gauge("HeapSys", nil), gauge("Frees", nil)}, wantErr: ErrSeriesLimit},
+		{name: "rejected write does not use limit", metrics: []model.Metrics{{ID: "Alloc", Mtype: model.MetricTypeCounter, Delta: new(int64)}}, wantErr: ErrTypeConflict},
+		{name: "last series within global limit", metrics: []model.Metrics{gauge("HeapSys", nil)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := s.SaveAll(context.Background(), tt.metrics); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Service.SaveAll() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if err := s.Save(context.Background(), gauge("Frees", nil)); !errors.Is(err, ErrSeriesLimit) {
+		t.Errorf("Service.Save() error = %v, wantErr %v", err, ErrSeriesLimit)
+	}
+
+	want := []model.PrefixCount{{Prefix: "http", Series: 2}, {Prefix: "Alloc", Series: 1}}
+	got, err := s.TopPrefixes(context.Background(), 2)
+	if err != nil {
+		t.Fatalf("Service.TopPrefixes() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Service.TopPrefixes() = %v, want %v", got, want)
+	}
+}
+
+func TestService_Labels(t *testing.T) {
+	s := New(memstorage.New(nil))
+	v := 1.0
+	gauge := func(labels map[string]string) model.Metrics {
+		return model.Metrics{ID: "Alloc", Mtype: model.MetricTypeGauge, Value: &v, Labels: labels}
+	}
+
+	tests := []struct {
+		name    string
+		labels  map[string]string
+		wantErr error
+	}{
+		{name: "separators in value", labels: map[string]string{"path": `/a,b="{c}"`}},
+		{name: "equals sign in name", labels: map[string]string{"a=b": "1"}, wantErr: ErrInvalidLabel},
+		{name: "quote in name", labels: map[string]string{`a"`: "1"}, wantErr: ErrInvalidLabel},
+		{name: "brace in name", labels: map[string]string{"a{": "1"}, wantErr: ErrInvalidLabel},
+		{name: "name against pattern", labels: map[string]string{"1host": "1"}, wantErr: ErrInvalidLabel},
+		{name: "empty name", labels: map[string]string{"": "1"}, wantErr: ErrInvalidLabel},
+		{name: "invalid utf-8 value", labels: map[string]string{"host": "\xff"}, wantErr: ErrInvalidLabel},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := s.Save(context.Background(), gauge(tt.labels)); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Service.Save() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	all, err := s.GetAll(context.Background())
+	if err != nil {
+		t.Fatalf("Service.GetAll() error = %v", err)
+	}
+	if len(all) != 1 || !reflect.DeepEqual(all[0].Labels, tests[0].labels) {
+		t.Errorf("Service.GetAll() = %v, labels must round-trip through series key", all)
+	}
+}
+
+func TestService_SaveAllOnce(t *testing.T) {
+	s := New(memstorage.New(nil))
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	s.SetIdempotencyWindow(time.Minute)
+
+	delta := int64(5)
+	batch := []model.Metrics{{ID: "PollCount", Mtype: model.MetricTypeCounter, Delta: &delta}}
+
+	tests := []struct {
+		name        string
+		key         string
+		after       time.Duration
+		wantApplied bool
+		wantCounter int64
+	}{
+		{name: "new key", key: "a", wantApplied: true, wantCounter: 5},
+		{name: "duplicate key", key: "a", after: 30 * time.Second, wantApplied: false, wantCounter: 5},
+		{name: "other key", key: "b", wantApplied: true, wantCounter: 10},
+		{name: "empty key is always applied", key: "", wantApplied: true, wantCounter: 15},
+		{name: "key outside window", key: "a", after: 2 * time.Minute, wantApplied: true, wantCounter: 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now = now.Add(tt.after)
+			applied, err := s.SaveAllOnce(context.Background(), batch, tt.key)
+			if err != nil {
+				t.Fatalf("Service.SaveAllOnce() error = %v", err)
+			}
+			if applied != tt.wantApplied {
+				t.Errorf("Service.SaveAllOnce() = %v, want %v", applied, tt.wantApplied)
+			}
+			m := model.Metrics{ID: "PollCount", Mtype: model.MetricTypeCounter}
+			if err := s.Retrieve(context.Background(), &m); err != nil || *m.Delta != tt.wantCounter {
+				t.Errorf("counter = %v (err %v), want %d", m.Delta, err, tt.wantCounter)
+			}
+		})
+	}
+}
+
+func TestService_SaveAllAtomic(t *testing.T) {
+	repo := memstorage.New(nil)
+	s := New(repo)
+
+	delta := int64(1)
+	value := 2.0
+	stored := model.NewHistogram([]float64{1, 2})
+	if err := s.Save(context.Background(), model.Metrics{ID: "latency", Mtype: model.MetricTypeHistogram, Histogram: &stored}); err != nil {
+		t.Fatalf("Service.Save() error = %v", err)
+	}
+	mismatch := model.NewHistogram([]float64{5})
+
+	tests := []struct {
+		name      string
+		metrics   []model.Metrics
+		wantIndex []int
+		wantErr   error
+	}{
+		{
+			name: "invalid items are reported",
+			metrics: []model.Metrics{
+				{ID: "PollCount", Mtype: model.MetricTypeCounter, Delta: &delta},
+				{ID: "Alloc", Mtype: model.MetricTypeGauge},
+				{ID: "heap alloc", Mtype: model.MetricTypeGauge, Value: &value},
+				{ID: "Frees", Mtype: "summary", Value: &value},
+			},
+			wantIndex: []int{1, 2, 3},
+			wantErr:   ErrInvalidMetricName,
+		},
+		{
+			name: "storage rejects histogram with other buckets",
+			metrics: []model.Metrics{
+				{ID: "PollCount", Mtype: model.MetricTypeCounter, Delta: &delta},
+				{ID: "latency", Mtype: model.MetricTypeHistogram, Histogram: &mismatch},
+			},
+			wantIndex: []int{1},
+			wantErr:   model.ErrBucketMismatch,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := s.SaveAll(context.Background(), tt.metrics)
+			var batchErr *model.BatchError
+			if !errors.As(err, &batchErr) {
+				t.Fatalf("Service.SaveAll() error = %v, want *model.BatchError", err)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Service.SaveAll() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var got []int
+			for _, item := range batchErr.Items {
+				got = append(got, item.Index)
+			}
+			if !reflect.DeepEqual(got, tt.wantIndex) {
+				t.Errorf("rejected items = %v, want %v", got, tt.wantIndex)
+			}
+			if _, err := repo.GetCounterMetric(context.Background(), "PollCount"); err == nil {
+				t.Errorf("valid metric of rejected batch must not be saved")
+			}
+		})
+	}
+}
+
+// slowRepository storage which doesn't answer about counters until context is done
+type slowRepository struct {
+	*memstorage.MemStorage
+}
+
+func (r slowRepository) SetCounterMetric(ctx context.Context, key string, value int64) (int64, error) {
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+func (r slowRepository) GetCounterMetric(ctx context.Context, key string) (int64, error) {
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+// historyWriter storage which appends samples of written values itself
+type historyWriter struct {
+	*memstorage.MemStorage
+}
+
+func (r historyWriter) WritesHistory() bool {
+	return true
+}
+
+func TestService_HistoryWriter(t *testing.T) {
+	repo := memstorage.New(nil)
+	s := New(historyWriter{repo})
+	delta := int64(1)
+	if err := s.Save(context.Background(), model.Metrics{ID: "PollCount", Mtype: model.MetricTypeCounter, Delta: &delta}); err != nil {
+		t.Fatal(err)
+	}
+	samples, err := repo.GetSamples(context.Background(), model.MetricTypeCounter, "PollCount", time.Time{}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 0 {
+		t.Errorf("service appended %d samples to storage writing history itself", len(samples))
+	}
+}
+
+func TestService_Timeouts(t *testing.T) {
+	s := New(slowRepository{memstorage.New(nil)})
+	s.SetTimeouts(Timeouts{Read: 10 * time.Millisecond, Write: 10 * time.Millisecond})
+	delta := int64(1)
+
+	if err := s.Save(context.Background(), model.Metrics{ID: "PollCount", Mtype: model.MetricTypeCounter, Delta: &delta}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Service.Save() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if err := s.Retrieve(context.Background(), &model.Metrics{ID: "PollCount", Mtype: model.MetricTypeCounter}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Service.Retrieve() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.Save(ctx, model.Metrics{ID: "PollCount", Mtype: model.MetricTypeCounter, Delta: &delta}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Service.Save() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantReason string
+	}{
+		{name: "not found", err: memstorage.ErrNotFound, wantStatus: http.StatusNotFound, wantReason: ReasonNotFound},
+		{name: "type conflict", err: fmt.Errorf("save: %w", ErrTypeConflict), wantStatus: http.StatusConflict, wantReason: ReasonTypeConflict},
+		{name: "missing value", err: memstorage.ErrInvalidValue, wantStatus: http.StatusBadRequest, wantReason: ReasonInvalidValue},
+		{name: "invalid type", err: ErrInavlidMetricType, wantStatus: http.StatusBadRequest, wantReason: ReasonInvalidValue},
+		{name: "series limit", err: ErrSeriesLimit, wantStatus: http.StatusUnprocessableEntity, wantReason: ReasonSeriesLimit},
+		{name: "storage unavailable", err: fmt.Errorf("%w: connection refused", ErrStorageUnavailable), wantStatus: http.StatusServiceUnavailable, wantReason: ReasonStorageUnavailable},
+		{name: "deadline", err: context.DeadlineExceeded, wantStatus: http.StatusGatewayTimeout, wantReason: ReasonDeadlineExceeded},
+		{name: "canceled", err: context.Canceled, wantStatus: StatusClientClosedRequest, wantReason: ReasonCanceled},
+		{name: "unknown", err: errors.New("boom"), wantStatus: http.StatusInternalServerError, wantReason: ReasonInternal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, reason := ErrorCode(tt.err)
+			if status != tt.wantStatus || reason != tt.wantReason {
+				t.Errorf("ErrorCode() = %d, %s, want %d, %s", status, reason, tt.wantStatus, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestService_Retype(t *testing.T) {
+	s := New(memstorage.New(nil))
+	ctx := context.Background()
+	delta := int64(3)
+	value := 2.5
+
+	if err := s.Save(ctx, model.Metrics{ID: "PollCount", Mtype: model.MetricTypeCounter, Delta: &delta}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(ctx, model.Metrics{ID: "PollCount", Mtype: model.MetricTypeGauge, Value: &value}); !errors.Is(err, ErrTypeConflict) {
+		t.Fatalf("Service.Save() error = %v, want %v", err, ErrTypeConflict)
+	}
+
+	tests := []struct {
+		name    string
+		mtype   string
+		wantErr error
+	}{
+		{name: "invalid type", mtype: "summary", wantErr: ErrInavlidMetricType},
+		{name: "counter becomes gauge", mtype: model.MetricTypeGauge},
+		{name: "same type", mtype: model.MetricTypeGauge},
+		{name: "gauge becomes histogram", mtype: model.MetricTypeHistogram},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := s.Retype(ctx, "PollCount", tt.mtype); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Service.Retype() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	got := model.Metrics{ID: "PollCount", Mtype: model.MetricTypeGauge}
+	if err := s.Retrieve(ctx, &got); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Service.Retrieve() error = %v, want %v", err, ErrNotFound)
+	}
+	if err := s.Retype(ctx, "Unknown", model.MetricTypeGauge); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Service.Retype() error = %v, want %v", err, ErrNotFound)
+	}
+	if err := s.Observe(ctx, "PollCount", 0.3); err != nil {
+		t.Errorf("Service.Observe() error = %v, name must be free after retype", err)
+	}
+
+	// type owns name whatever labels of series are
+	host := func(h string) map[string]string { return map[string]string{"host": h} }
+	for _, h := range []string{"a", "b"} {
+		if err := s.Save(ctx, model.Metrics{ID: "requests", Mtype: model.MetricTypeCounter, Delta: &delta, Labels: host(h)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Save(ctx, model.Metrics{ID: "requests", Mtype: model.MetricTypeGauge, Value: &value, Labels: host("c")}); !errors.Is(err, ErrTypeConflict) {
+		t.Errorf("Service.Save() error = %v, want %v", err, ErrTypeConflict)
+	}
+	err := s.SaveAll(ctx, []model.Metrics{
+		{ID: "latency", Mtype: model.MetricTypeCounter, Delta: &delta, Labels: host("a")},
+		{ID: "latency", Mtype: model.MetricTypeGauge, Value: &value, Labels: host("b")},
+	})
+	if !errors.Is(err, ErrTypeConflict) {
+		t.Errorf("Service.SaveAll() error = %v, want %v", err, ErrTypeConflict)
+	}
+	if err = s.Retype(ctx, "requests", model.MetricTypeGauge); err != nil {
+		t.Fatalf("Service.Retype() error = %v", err)
+	}
+	for _, h := range []string{"a", "b"} {
+		got = model.Metrics{ID: "requests", Mtype: model.MetricTypeGauge, Labels: host(h)}
+		if err = s.Retrieve(ctx, &got); err != nil || *got.Value != float64(delta) {
+			t.Errorf("series of host %s after retype = %v, %v, want gauge %d", h, got.Value, err, delta)
+		}
+	}
+	if err = s.Save(ctx, model.Metrics{ID: "requests", Mtype: model.MetricTypeGauge, Value: &value, Labels: host("c")}); err != nil {
+		t.Errorf("Service.Save() error = %v, name must be owned by gauge after retype", err)
+	}
+}
+
+// changeList recorder keeping changes in memory
+type changeList []Change
+
+func (l *changeList) RecordChange(change Change) error {
+	*l = append(*l, change)
+	return nil
+}
+
+func TestService_ChangeRecorder(t *testing.T) {
+	repo := memstorage.New(nil)
+	s := New(repo)
+	s.SetTenants(func(id string) Repository { return repo.Tenant(id) }, repo.Tenants)
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	var changes changeList
+	s.SetChangeRecorder(&changes)
+	ctx := context.Background()
+	delta := int64(2)
+	value := 1.5
+
+	steps := []func() error{
+		func() error {
+			return s.Save(ctx, model.Metrics{ID: "PollCount", Mtype: model.MetricTypeCounter, Delta: &delta})
+		},
+		func() error {
+			return s.SaveAll(ctx, []model.Metrics{
+				{ID: "PollCount", Mtype: model.MetricTypeCounter, Delta: &delta},
+				{ID: "Alloc", Mtype: model.MetricTypeGauge, Value: &value, Labels: map[string]string{"host": "a"}},
+			})
+		},
+		func() error { return s.SetMetadata(ctx, model.Metadata{Name: "Alloc", Unit: "bytes"}) },
+		func() error { return s.Retype(ctx, "PollCount", model.MetricTypeGauge) },
+		func() error {
+			return s.ForTenant("acme").Save(ctx, model.Metrics{ID: "PollCount", Mtype: model.MetricTypeCounter, Delta: &delta})
+		},
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	counter := func(v int64) *int64 { return &v }
+	gauge := func(v float64) *float64 { return &v }
+	want := changeList{
+		{Op: ChangeSet, Metric: model.Metrics{ID: "PollCount", Mtype: model.MetricTypeCounter, Delta: counter(2)}},
+		{Op: ChangeSet, Metric: model.Metrics{ID: "PollCount", Mtype: model.MetricTypeCounter, Delta: counter(4)}},
+		{Op: ChangeSet, Metric: model.Metrics{ID: "Alloc", Mtype: model.MetricTypeGauge, Value: gauge(1.5), Labels: map[string]string{"host": "a"}}},
+		{Op: ChangeMetadata, Metric: model.Metrics{ID: "Alloc", Meta: &model.Metadata{Name: "Alloc", Unit: "bytes"}}},
+		{Op: ChangeDelete, Metric: model.Metrics{ID: "PollCount", Mtype: model.MetricTypeCounter}},
+		{Op: ChangeSet, Metric: model.Metrics{ID: "PollCount", Mtype: model.MetricTypeGauge, Value: gauge(4)}},
+		{Op: ChangeSet, Tenant: "acme", Metric: model.Metrics{ID: "PollCount", Mtype: model.MetricTypeCounter, Delta: counter(2)}},
+	}
+	for i := range want {
+		want[i].Time = now
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("recorded changes = %+v, want %+v", changes, want)
+	}
+
+	s.SetChangeRecorder(nil)
+	if err := steps[2](); err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != len(want) {
+		t.Errorf("changes are recorded after recorder is removed")
+	}
+}
+
+// blockingRecorder recorder which waits for release before recording first change
+type blockingRecorder struct {
+	changeList
+	started chan struct{}
+	release chan struct{}
+}
+
+func (r *blockingRecorder) RecordChange(change Change) error {
+	if len(r.changeList) == 0 {
+		close(r.started)
+		<-r.release
+	}
+	return r.changeList.RecordChange(change)
+}
+
+func TestService_ChangeRecorderConcurrent(t *testing.T) {
+	s := New(memstorage.New(nil))
+	var changes changeList
+	s.SetChangeRecorder(&changes)
+	ctx := context.Background()
+	delta := int64(1)
+
+	const writers, writes = 8, 100
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				if err := s.Save(ctx, model.Metrics{ID: "PollCount", Mtype: model.MetricTypeCounter, Delta: &delta}); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if len(changes) != writers*writes {
+		t.Fatalf("recorded %d changes, want %d", len(changes), writers*writes)
+	}
+	for i, change := range changes {
+		if *change.Metric.Delta != int64(i+1) {
+			t.Fatalf("change %d carries counter %d, changes of series must be recorded in order of writes", i, *change.Metric.Delta)
+		}
+	}
+
+	recorder := &blockingRecorder{started: make(chan struct{}), release: make(chan struct{})}
+	s.SetChangeRecorder(recorder)
+	done := make(chan error)
+	go func() {
+		done <- s.Save(ctx, model.Metrics{ID: "PollCount", Mtype: model.MetricTypeCounter, Delta: &delta})
+	}()
+	<-recorder.started
+	value := 1.5
+	if err := s.Save(ctx, model.Metrics{ID: "Alloc", Mtype: model.MetricTypeGauge, Value: &value}); err != nil {
+		t.Fatal(err)
+	}
+	close(recorder.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if len(recorder.changeList) != 2 {
+		t.Errorf("recorded %d changes, write waiting for recorder must not lose changes of other writes", len(recorder.changeList))
+	}
+}
@@ -0,0 +1,40 @@
+package service
+
+import (
+	"context"
+	"time"
+)
+
+// Timeouts how long single read or write operation of service may take, zero disables limit
+type Timeouts struct {
+	Read  time.Duration
+	Write time.Duration
+}
+
+// DefaultTimeouts timeouts used if none are set
+var DefaultTimeouts = Timeouts{
+	Read:  5 * time.Second,
+	Write: 10 * time.Second,
+}
+
+// SetTimeouts - sets timeouts of read and write operations
+func (s *Service) SetTimeouts(t Timeouts) {
+	s.timeouts = t
+}
+
+// readContext - limits ctx of read operation by read timeout
+func (s *Service) readContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(ctx, s.timeouts.Read)
+}
+
+// writeContext - limits ctx of write operation by write timeout
+func (s *Service) writeContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return withTimeout(ctx, s.timeouts.Write)
+}
+
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
@@ -0,0 +1,189 @@
+// Package tenant keeps API tokens of tenants and passes resolved tenant through request context
+package tenant
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Default tenant of requests when tenancy is disabled
+	Default = ""
+	// Header HTTP header and gRPC metadata key carrying API token
+	Header = "X-Api-Token"
+	// AdminHeader HTTP header carrying admin token
+	AdminHeader = "X-Admin-Token"
+)
+
+var (
+	ErrInvalidTenant = errors.New("tenant id must be 1-64 characters of letters, digits, '_' or '-'")
+	ErrTokenNotFound = errors.New("token not found")
+
+	validID = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+)
+
+type ctxKey struct{}
+
+// WithTenant - returns context carrying tenant id
+func WithTenant(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, ctxKey{}, id)
+}
+
+// FromContext - returns tenant id from context, Default if none
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(ctxKey{}).(string)
+	return id
+}
+
+// ValidID - checks that tenant id can be used as storage partition and file name suffix
+func ValidID(id string) bool {
+	return validID.MatchString(id)
+}
+
+// Token issued API token, only hash of token value is kept
+type Token struct {
+	ID        string    `json:"id"`
+	Tenant    string    `json:"tenant"`
+	Hash      string    `json:"hash"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type Registry struct {
+	path   string
+	tokens map[string]Token // by hash
+	mu     sync.RWMutex
+}
+
+// NewRegistry - creates registry of tokens persisted in file by path, tokens are loaded if file exists.
+// Registry with empty path keeps tokens in memory only
+func NewRegistry(path string) (*Registry, error) {
+	r := &Registry{path: path, tokens: make(map[string]Token)}
+	if path == "" {
+		return r, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var tokens []Token
+	if err = json.Unmarshal(data, &tokens); err != nil {
+		return nil, err
+	}
+	for _, t := range tokens {
+		r.tokens[t.Hash] = t
+	}
+	return r, nil
+}
+
+// Create - issues new token for tenant, returned token value is not stored and can't be retrieved later
+func (r *Registry) Create(tenantID string) (string, Token, error) {
+	if !ValidID(tenantID) {
+		return "", Token{}, ErrInvalidTenant
+	}
+	value, err := randomHex(32)
+	if err != nil {
+		return "", Token{}, err
+	}
+	id, err := randomHex(8)
+	if err != nil {
+		return "", Token{}, err
+	}
+	t := Token{ID: id, Tenant: tenantID, Hash: hash(value), CreatedAt: time.Now().UTC()}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tokens[t.Hash] = t
+	if err = r.save(); err != nil {
+		delete(r.tokens, t.Hash)
+		return "", Token{}, err
+	}
+	return value, t, nil
+}
+
+// Revoke - removes token by its id
+func (r *Registry) Revoke(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for h, t := range r.tokens {
+		if t.ID == id {
+			delete(r.tokens, h)
+			return r.save()
+		}
+	}
+	return ErrTokenNotFound
+}
+
+// Resolve - returns tenant of token value
+func (r *Registry) Resolve(value string) (string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	t, ok := r.tokens[hash(value)]
+	return t.Tenant, ok
+}
+
+// List - returns all issued tokens ordered by creation time
+func (r *Registry) List() []Token {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	tokens := make([]Token, 0, len(r.tokens))
+	for _, t := range r.tokens {
+		tokens = append(tokens, t)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.Before(tokens[j].CreatedAt)
+	})
+	return tokens
+}
+
+// Tenants - returns ids of tenants having at least one token
+func (r *Registry) Tenants() []string {
+	seen := make(map[string]bool)
+	var tenants []string
+	for _, t := range r.List() {
+		if !seen[t.Tenant] {
+			seen[t.Tenant] = true
+			tenants = append(tenants, t.Tenant)
+		}
+	}
+	return tenants
+}
+
+func (r *Registry) save() error {
+	if r.path == "" {
+		return nil
+	}
+	tokens := make([]Token, 0, len(r.tokens))
+	for _, t := range r.tokens {
+		tokens = append(tokens, t)
+	}
+	data, err := json.Marshal(tokens)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(r.path, data, 0600)
+}
+
+func hash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,39 @@
+package tenant
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	r, err := NewRegistry(path)
+	require.NoError(t, err)
+
+	_, _, err = r.Create("../etc")
+	assert.ErrorIs(t, err, ErrInvalidTenant)
+
+	value, token, err := r.Create("acme")
+	require.NoError(t, err)
+	assert.NotEqual(t, value, token.Hash, "token value must not be stored")
+
+	// tokens survive restart
+	r, err = NewRegistry(path)
+	require.NoError(t, err)
+
+	id, ok := r.Resolve(value)
+	assert.True(t, ok)
+	assert.Equal(t, "acme", id)
+	assert.Equal(t, []string{"acme"}, r.Tenants())
+
+	_, ok = r.Resolve("unknown")
+	assert.False(t, ok)
+
+	require.NoError(t, r.Revoke(token.ID))
+	_, ok = r.Resolve(value)
+	assert.False(t, ok)
+	assert.ErrorIs(t, r.Revoke(token.ID), ErrTokenNotFound)
+}